@@ -0,0 +1,110 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the api server as a library.
+//
+// The service is wired by cmd/main.go. The packages of the service are internal, so Run is the entry point for the
+// processes which embed the api server, for example the standalone command which runs all the services in one process.
+
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/dbutil"
+	"common/schema"
+	"common/secrets"
+	"common/storage"
+
+	"apiserver/internal/config"
+	"apiserver/internal/db"
+	"apiserver/internal/metrics"
+	services "apiserver/internal/services"
+	"apiserver/internal/web"
+)
+
+// Run creates the stats service of the storage backend of the configuration and serves the apis. The pending schema
+// migrations are applied before the apis can query the tables. It blocks while the server runs and only returns if
+// the stats service cannot be created.
+func Run(conf *viper.Viper, secretStore *secrets.Store, reloader *configutil.Reloader) error {
+	statsService, err := newStatsService(conf, secretStore)
+	if err != nil {
+		return fmt.Errorf("failed to create the stats service: %w", err)
+	}
+
+	// This will be a blocking call.
+	web.StartServer(conf, statsService, reloader)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadConfiguration loads the configuration file of the api server with the overrides of the environment variables.
+// The returned Reloader reloads the same file. Please refer to config.LoadFile.
+func LoadConfiguration(file string) (*viper.Viper, *configutil.Reloader, error) {
+	return config.LoadFile(file)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newStatsService is a helper function to create the stats service of the storage backend selected in the
+// configuration. The credentials are obtained from the secret store.
+func newStatsService(conf *viper.Viper, secretStore *secrets.Store) (services.StatsServicer, error) {
+	backend := conf.GetString(configutil.KStorageBackend)
+	glog.Infoln("Using storage backend", backend)
+
+	switch backend {
+	case storage.BackendPostgres, "":
+		database, err := dbutil.NewPostgres(conf, secretStore)
+		if err != nil {
+			return nil, err
+		}
+		metrics.DBPools.Add("primary", database)
+		// The migrations always run on the primary, the replicas receive them through replication.
+		if conf.GetBool(configutil.KMigrateOnStartup) {
+			if err := dbutil.Migrate(context.Background(), database.DB()); err != nil {
+				return nil, fmt.Errorf("failed to migrate the database: %w", err)
+			}
+		}
+
+		// Without read replicas the replica set routes all the queries to the primary.
+		replicas, err := db.NewReplicaSet(conf, database, secretStore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the read replicas: %w", err)
+		}
+		go replicas.MonitorReplicas(context.Background(), conf.GetDuration(config.KReplicaHealthCheckInterval))
+		return services.NewReplicatedStatsService(replicas, conf), nil
+	case storage.BackendClickHouse:
+		conn, err := dbutil.NewClickHouse(conf, secretStore)
+		if err != nil {
+			return nil, err
+		}
+		if conf.GetBool(configutil.KMigrateOnStartup) {
+			if err := schema.MigrateClickHouse(context.Background(), conn); err != nil {
+				return nil, err
+			}
+		}
+		return services.NewClickHouseStatsService(conn), nil
+	case storage.BackendSQLite:
+		sqlite, err := dbutil.NewSQLite(conf)
+		if err != nil {
+			return nil, err
+		}
+		if conf.GetBool(configutil.KMigrateOnStartup) {
+			if err := schema.MigrateSQLite(context.Background(), sqlite); err != nil {
+				return nil, err
+			}
+		}
+		return services.NewSQLiteStatsService(sqlite), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage backend: %s", backend)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -13,19 +13,22 @@
 package main
 
 import (
-	"flag"
+	"context"
 
 	"github.com/golang/glog"
 
+	"common/configutil"
+	"common/dbutil"
+	"common/logging"
+	commontracing "common/tracing"
+
+	"apiserver/app"
 	"apiserver/internal/config"
-	"apiserver/internal/db"
-	services "apiserver/internal/services"
-	"apiserver/internal/web"
+	"apiserver/internal/tracing"
 )
 
 func init() {
-	flag.Parse()
-	flag.Set("logtostderr", "true")
+	logging.Init()
 }
 
 func main() {
@@ -39,15 +42,33 @@ func main() {
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// Step (2): Load the configuration.
 	conf := config.LoadConfiguration()
+	glog.Infof("Loaded configuration: %v", config.RedactedSettings(conf))
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Step (3): Create the database object and stats services.
-	statsService := services.NewStatsService(db.NewDB(conf), conf)
+	// Resolve the credentials from their sources and pick up the rotated credentials without a restart. Please refer
+	// to secrets/secrets.go in the common module.
+	secretStore, err := configutil.NewSecretStore(context.Background(), conf, dbutil.SecretRefs(conf))
+	if err != nil {
+		glog.Fatalf("Failed to resolve the secrets: %v", err)
+	}
+	go secretStore.RefreshPeriodically(context.Background(), conf.GetDuration(configutil.KSecretsRefreshInterval))
+
+	// Install the tracer provider. The pending spans are flushed when the process exits.
+	shutdownTracing, err := commontracing.Init(conf, tracing.ServiceName)
+	if err != nil {
+		glog.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Apply the changes of the log levels and the timeouts of the apis without a restart.
+	reloader := config.NewReloader(conf)
+	go reloader.Run(context.Background())
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Step (4): Create the web server.
-	// This will be a blocking call.
-	web.StartServer(conf, statsService)
+	// Step (3): Create the database object and stats services of the storage backend and start the web server. Please
+	// refer to app/app.go.
+	if err := app.Run(conf, secretStore, reloader); err != nil {
+		glog.Fatalf("%v", err)
+	}
 }
 
 //----------------------------------------------------------------------------------------------------------------------
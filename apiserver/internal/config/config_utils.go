@@ -9,7 +9,8 @@
 // needing to recompile the code. We do not use helm in this excercise. But this pattern is extensible.
 //
 // The file contains a method called LoadConfiguration() which will load all the configuration represented in the
-// defaults.yaml and creates a golang object for that. This will be passed into all the other functions/classes in this
+// defaults.yaml, overridden by the environment variables and the command line flags, validates it against the Schema
+// and creates a golang object for that. This will be passed into all the other functions/classes in this
 // microservice and this object will be a single place where all the configuration is all maintained.
 //
 //
@@ -26,9 +27,13 @@
 package config
 
 import (
-	"fmt"
+	"flag"
 
 	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/dbutil"
+	"common/logging"
 )
 
 const (
@@ -44,58 +49,114 @@ const (
 	// KWebServerPort is a nested key under the group key KGroupKeyApiServer to obtain the port for webserver.
 	KWebServerPort = KGroupKeyApiServer + ".port"
 
+	// KTimeouts is a nested key under the group key KGroupKeyApiServer to obtain the timeouts of the apis. The timeout of
+	// an api is the key of the api under this key. The apis without a timeout use the default. For example
+	// defaults.yaml has something like this.
+	// apiserver:
+	//  timeouts:
+	//    default: 10s
+	//    attribute_counts: 30s
+	KTimeouts = KGroupKeyApiServer + ".timeouts"
+
+	// KDefaultTimeout is a nested key under the key KTimeouts to obtain the timeout of the apis without a timeout.
+	KDefaultTimeout = KTimeouts + ".default"
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Database related configuration
+	// The keys of the blocks shared by the services are declared in configutil/keys.go in the common module. The
+	// keys below are nested in those blocks but only used by the api server.
 
-	// KGroupDatabase is group key for db block in defaults.yaml. This is the parent key. All the nested
-	// children in this group can be referenced with this group key. For example defaults.yaml has something like this.
+	// KGroupReplicas is a nested group key under the group key KGroupDatabase for the read replicas of postgres. The
+	// queries of the apis are routed to the healthy replicas, so that they do not compete with the writes of the
+	// log-subscriber on the primary. For example defaults.yaml has something like this.
 	// db:
-	//   host: postgres
-	//   port: 5432
-	//   username: suresh
-	//   password: suresh
-	//   database: olap
-	KGroupDatabase = "db"
-
-	// KHost is a nested key under the group key KGroupDatabase to obtain the hostname for the postgres database.
-	KHost = KGroupDatabase + ".host"
-
-	// KPort is a nested key under the group key KGroupDatabase to obtain the portname for the postgres database.
-	KPort = KGroupDatabase + ".port"
-
-	// KUsername is a nested key under the group key KGroupDatabase to obtain the username to connect to the postgres
-	// database.
-	KUsername = KGroupDatabase + ".username"
-
-	// KPassword is a nested key under the group key KGroupDatabase to obtain the password to connect to the postgres
-	// database.
-	KPassword = KGroupDatabase + ".password"
-
-	// KDatabaseName is a nested key under the group key KGroupDatabase to obtain the database name to connect to the postgres
-	// database.
-	KDatabaseName = KGroupDatabase + ".database"
+	//   replicas:
+	//     addrs: ["postgres-replica-1:5432", "postgres-replica-2:5432"]
+	//     health_check_interval: 5s
+	KGroupReplicas = configutil.KGroupDatabase + ".replicas"
+
+	// KReplicaAddrs is a nested key under the group key KGroupReplicas to obtain the host:port of the replicas. The
+	// replicas use the credentials, the pool and the TLS configuration of the primary. Empty reads from the primary.
+	KReplicaAddrs = KGroupReplicas + ".addrs"
+
+	// KReplicaHealthCheckInterval is a nested key under the group key KGroupReplicas to obtain the interval of the
+	// health checks of the replicas.
+	KReplicaHealthCheckInterval = KGroupReplicas + ".health_check_interval"
+
+	// KReplicaMaxLag is a nested key under the group key KGroupReplicas to obtain the maximum replication lag of a
+	// healthy replica. A replica which lags behind more is skipped until it catches up. Zero does not check the lag.
+	KReplicaMaxLag = KGroupReplicas + ".max_lag"
 )
 
-// LoadConfiguration is a helper function to load the configuration present in defaults.yaml. This will be loaded
-// to a config object which then can be passed around(injected) to all the structs/classes to read the global
-// configuration.
+// envPrefix is the prefix of the environment variables which override the configuration, for example
+// APISERVER_DB_HOST.
+const envPrefix = "APISERVER"
+
+// Schema describes the keys of the configuration. The configuration is validated against it on startup and on every
+// reload. Only the Mutable keys are applied by a reload. Please refer to configutil/schema.go in the common module.
+var Schema = configutil.Merge(configutil.Schema{
+	configutil.Int(KWebServerPort).Required().Between(1, 65535),
+	configutil.Map(KTimeouts).Mutable(),
+	configutil.Duration(KDefaultTimeout).DurationAtLeast(0).Mutable(),
+	configutil.StringSlice(KReplicaAddrs),
+	configutil.Duration(KReplicaHealthCheckInterval).DurationAtLeast(0),
+	configutil.Duration(KReplicaMaxLag).DurationAtLeast(0),
+}, dbutil.DatabaseSchema, dbutil.StorageSchema, configutil.SecretsSchema, configutil.LoggingSchema,
+	configutil.TracingSchema)
+
+// flags are the command line flags of the configuration. Please refer to configutil/load.go in the common module.
+var flags = configutil.RegisterFlags(flag.CommandLine)
+
+// LoadConfiguration is a helper function to load the configuration present in defaults.yaml, with the overrides of the
+// environment variables and of the -set flags. This will be loaded to a config object which then can be passed
+// around(injected) to all the structs/classes to read the global configuration.
+//
+// The service exits with all the problems of the configuration if it does not match the Schema. With -print-config
+// the effective configuration is printed, with the secrets masked, and the service exits.
 func LoadConfiguration() *viper.Viper {
+	conf := configutil.MustLoad(Schema, envPrefix, flags)
+	logging.Apply(conf)
+
+	// At this point all the configuration present in defaults.yaml will be loaded into the config object.
+	return conf
+}
 
-	// Create a new Viper instance.
-	config := viper.New()
+//----------------------------------------------------------------------------------------------------------------------
 
-	// Initialize Viper config
-	config.SetConfigName("defaults")
-	config.SetConfigType("yaml")
-	config.AddConfigPath(".")
+// NewReloader returns the Reloader of the configuration loaded by LoadConfiguration. The log levels are applied on
+// every reload, the other mutable keys by the watchers registered by their owners. Please refer to
+// configutil/reload.go in the common module.
+func NewReloader(conf *viper.Viper) *configutil.Reloader {
+	return newReloader(conf, flags)
+}
 
-	// Read the configuration file.
-	if err := config.ReadInConfig(); err != nil {
-		panic(fmt.Sprintf("failed to read config file: %v", err))
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadFile loads the configuration file with the overrides of the environment variables, but not of the command line
+// flags. It is used when the api server runs in another process, for example the standalone command, which has
+// flags of its own. The returned Reloader reloads the same file.
+func LoadFile(file string) (*viper.Viper, *configutil.Reloader, error) {
+	fileFlags := &configutil.Flags{File: file}
+	conf, err := configutil.Load(Schema, envPrefix, fileFlags)
+	if err != nil {
+		return nil, nil, err
 	}
+	return conf, newReloader(conf, fileFlags), nil
+}
 
-	// At this point all the configuration present in defaults.yaml will be loaded into the config object.
-	return config
+//----------------------------------------------------------------------------------------------------------------------
+
+// newReloader is a helper function to create the Reloader of the configuration loaded with the flags.
+func newReloader(conf *viper.Viper, flags *configutil.Flags) *configutil.Reloader {
+	reloader := configutil.NewReloader(conf, Schema, envPrefix, flags)
+	reloader.OnReload(logging.Apply)
+	return reloader
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// RedactedSettings returns all the settings of the configuration with the secrets redacted, for logging.
+func RedactedSettings(conf *viper.Viper) map[string]interface{} {
+	return configutil.Redacted(conf, Schema)
 }
 
 //----------------------------------------------------------------------------------------------------------------------
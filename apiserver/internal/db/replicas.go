@@ -0,0 +1,197 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the routing of the read queries to the read replicas of postgres.
+//
+// The apis only read. Their heavy queries (for example the dashboards polling the attribute counts) should not compete
+// with the writes of the log-subscriber on the primary. So when read replicas are configured, every api call runs its
+// queries on one of the healthy replicas, round robin.
+//
+// The replicas are health checked in the background. A replica is healthy if it answers the health check and its
+// replication lag is below the configured maximum. An unhealthy replica gets no queries until it passes a health check
+// again. When there is no healthy replica, the queries fail over to the primary.
+//
+// The replicas start out unhealthy, so the queries run on the primary until the first health check passes.
+
+package db
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/dbutil"
+	"common/secrets"
+	"common/storage"
+
+	"apiserver/internal/config"
+	"apiserver/internal/metrics"
+)
+
+// replicaLagQuery returns the replication lag of a replica in seconds. A replica which replayed everything it
+// received is not lagging, even if the primary had no writes for a while. A server which is not in recovery is a
+// primary, which never lags.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+// ReplicaSet selects the postgres server for the read queries. It implements the services.DBReader interface.
+type ReplicaSet struct {
+	primary  *storage.RotatingDB
+	replicas []*replica
+
+	// maxLag is the maximum replication lag of a healthy replica. Zero does not check the lag.
+	maxLag time.Duration
+
+	// next is the round robin counter.
+	next uint32
+}
+
+// replica is a single read replica.
+type replica struct {
+	addr string
+	db   *storage.RotatingDB
+
+	// healthy is 1 if the replica passed the last health check. It is accessed atomically.
+	healthy int32
+}
+
+// NewReplicaSet connects to the read replicas in the configuration. The replicas share the options and the credentials
+// of the primary. Without replicas all the queries run on the primary.
+func NewReplicaSet(conf *viper.Viper, primary *storage.RotatingDB, secretStore *secrets.Store) (*ReplicaSet, error) {
+	set := &ReplicaSet{
+		primary: primary,
+		maxLag:  conf.GetDuration(config.KReplicaMaxLag),
+	}
+
+	for _, addr := range conf.GetStringSlice(config.KReplicaAddrs) {
+		options, err := dbutil.Options(conf, secretStore, addr)
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+
+		db := storage.NewRotatingDB(options, dbutil.NewQueryHook(conf, secretStore))
+		secretStore.Watch(configutil.KPassword, db.Rotate)
+		set.replicas = append(set.replicas, &replica{addr: addr, db: db})
+		metrics.ReplicaHealthy.WithLabelValues(addr).Set(0)
+		metrics.DBPools.Add(addr, db)
+	}
+
+	if len(set.replicas) > 0 {
+		glog.Infof("Routing the read queries to %d replicas", len(set.replicas))
+	}
+	return set, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Reader returns the next healthy replica, or the primary if there is none.
+func (set *ReplicaSet) Reader() *pg.DB {
+	n := len(set.replicas)
+	if n == 0 {
+		return set.primary.DB()
+	}
+
+	start := atomic.AddUint32(&set.next, 1)
+	for i := 0; i < n; i++ {
+		replica := set.replicas[(int(start)+i)%n]
+		if atomic.LoadInt32(&replica.healthy) == 1 {
+			return replica.db.DB()
+		}
+	}
+	return set.primary.DB()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Primary returns the primary. The readiness check pings it even when the read queries run on the replicas.
+func (set *ReplicaSet) Primary() *pg.DB {
+	return set.primary.DB()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MonitorReplicas is run as a go routine. It health checks the replicas right away and then at the interval until
+// the context is cancelled.
+func (set *ReplicaSet) MonitorReplicas(ctx context.Context, interval time.Duration) {
+	if len(set.replicas) == 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, replica := range set.replicas {
+			set.checkReplica(ctx, replica, interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close closes the connections to the replicas. The primary is owned by the caller.
+func (set *ReplicaSet) Close() error {
+	for _, replica := range set.replicas {
+		if err := replica.db.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkReplica is a helper function to health check a single replica and to record the result. A health check can
+// take at most the interval, so that a hanging replica does not delay the checks of the others.
+func (set *ReplicaSet) checkReplica(ctx context.Context, replica *replica, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lagSeconds float64
+	_, err := replica.db.DB().QueryOneContext(ctx, pg.Scan(&lagSeconds), replicaLagQuery)
+	lag := time.Duration(lagSeconds * float64(time.Second))
+
+	healthy := err == nil && (set.maxLag <= 0 || lag <= set.maxLag)
+
+	var value int32
+	if healthy {
+		value = 1
+	}
+	previous := atomic.SwapInt32(&replica.healthy, value)
+	metrics.ReplicaHealthy.WithLabelValues(replica.addr).Set(float64(value))
+
+	// Only the changes are logged, the health checks run every few seconds.
+	if previous == value {
+		return
+	}
+	switch {
+	case healthy:
+		glog.Infof("Replica %s is healthy, routing read queries to it", replica.addr)
+	case err != nil:
+		glog.Warningf("Replica %s failed the health check, failing over: %v", replica.addr, err)
+	default:
+		glog.Warningf("Replica %s lags %v behind the primary, failing over", replica.addr, lag)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
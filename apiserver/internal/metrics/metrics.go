@@ -0,0 +1,61 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the prometheus metrics exported by the api server.
+//
+// All the metrics are prefixed with the service name. The labels are consistent across the three services. The http
+// route is always labelled with the route template (for example "/templates/:id/lines") and not the actual path, so
+// that the number of time series stays bounded.
+//
+// The metrics are served on the /metrics endpoint of the web server.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	commonmetrics "common/metrics"
+)
+
+const (
+	// namespace is the prefix of all the metrics exported by the api server.
+	namespace = "apiserver"
+
+	// RouteUnmatched is the label value of the requests which did not match any route.
+	RouteUnmatched = "unmatched"
+)
+
+var (
+	// RequestsTotal is the number of http requests per route, method and status code.
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of http requests.",
+	}, []string{"route", "method", "code"})
+
+	// RequestDuration is the time taken to serve a http request per route and method.
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve a http request.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// ReplicaHealthy is 1 if the read replica passed its last health check and receives read queries, 0 otherwise.
+	ReplicaHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "db_replica_healthy",
+		Help:      "Whether the read replica passed its last health check.",
+	}, []string{"replica"})
+
+	// DBPools exports the statistics of the postgres connection pools of the primary and of the read replicas.
+	DBPools = commonmetrics.NewPoolCollector(namespace)
+)
+
+func init() {
+	prometheus.MustRegister(DBPools)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
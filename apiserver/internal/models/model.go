@@ -3,51 +3,310 @@
 // Author: Suresh Bysani
 //
 // The file contains the data model for all the apis needed for the assignment.
+//
+// Every stats api can be filtered by thread name using the "thread_name" field of the request. An empty thread name
+// matches all the threads.
 
 package models
 
 import "time"
 
-// LogLines encapsulates the data model for the schema in the database.
-type LogLines struct {
-	tableName        struct{}  `pg:"log_lines"`
+// The data model of the log_lines table is schema.LogLine in the common module. It is shared with the log subscriber.
+
+//----------------------------------------------------------------------------------------------------------------------
+// The data model for the rollup tables maintained by the stats worker in the log subscriber.
+
+// LogLinesPerSecond encapsulates the number of lines and bytes logged by a thread in a given second.
+type LogLinesPerSecond struct {
+	tableName     struct{} `pg:"log_lines_per_second"`
+	BucketSeconds int64    `pg:"bucket_seconds,notnull,pk"`
+	ProcessID     string   `pg:"process_id,notnull,pk"`
+	ThreadID      string   `pg:"thread_id,notnull,pk"`
+	ThreadName    string   `pg:"thread_name"`
+	LineCount     int64    `pg:"line_count,notnull"`
+	ByteCount     int64    `pg:"byte_count,notnull"`
+}
+
+// LogLinesPerMinute encapsulates the number of lines and bytes logged by a thread in a given minute. The bucket is the
+// start of the minute in seconds.
+type LogLinesPerMinute struct {
+	tableName     struct{} `pg:"log_lines_per_minute"`
+	BucketSeconds int64    `pg:"bucket_seconds,notnull,pk"`
+	ProcessID     string   `pg:"process_id,notnull,pk"`
+	ThreadID      string   `pg:"thread_id,notnull,pk"`
+	ThreadName    string   `pg:"thread_name"`
+	LineCount     int64    `pg:"line_count,notnull"`
+	ByteCount     int64    `pg:"byte_count,notnull"`
+}
+
+// ActiveThreadsPerSecond encapsulates the number of threads which logged at least one line in a given second.
+type ActiveThreadsPerSecond struct {
+	tableName     struct{} `pg:"active_threads_per_second"`
+	BucketSeconds int64    `pg:"bucket_seconds,notnull,pk"`
+	ActiveThreads int64    `pg:"active_threads,notnull"`
+}
+
+// ThreadLifetime encapsulates the first and last time a thread is seen.
+type ThreadLifetime struct {
+	tableName        struct{}  `pg:"thread_lifetimes"`
 	ProcessID        string    `pg:"process_id,notnull,pk"`
 	ThreadID         string    `pg:"thread_id,notnull,pk"`
-	Timestamp        time.Time `pg:"timestamp,notnull,pk"`
-	TimestampSeconds int64     `pg:"timestamp_seconds,notnull,pk"`
-	LogMessage       string    `pg:"log_message"`
+	ThreadName       string    `pg:"thread_name"`
+	FirstSeen        time.Time `pg:"first_seen,notnull"`
+	LastSeen         time.Time `pg:"last_seen,notnull"`
+	FirstSeenSeconds int64     `pg:"first_seen_seconds,notnull"`
+	LastSeenSeconds  int64     `pg:"last_seen_seconds,notnull"`
+	LineCount        int64     `pg:"line_count,notnull"`
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 // The data model for the basic log stats api. This contains request and response.
 
 type BasicLogStatsRequest struct {
-	StartTimeSeconds int64 `json:"start_time_seconds"`
-	EndTimeSeconds   int64 `json:"end_time_seconds"`
+	StartTimeSeconds int64  `json:"start_time_seconds" query:"start_time_seconds"`
+	EndTimeSeconds   int64  `json:"end_time_seconds" query:"end_time_seconds"`
+	ThreadName       string `json:"thread_name" query:"thread_name"`
 }
 
 type BasicLogStatsResponse struct {
-	ActiveThreadsCount int   `pg:"active_threads_count"`
-	ActiveThreadIDs    []int `pg:"active_thread_ids,array"`
-	ActiveProcessIDs   []int `pg:"active_process_ids,array"`
+	ActiveThreadsCount int      `pg:"active_threads_count"`
+	ActiveThreadIDs    []int    `pg:"active_thread_ids,array"`
+	ActiveProcessIDs   []int    `pg:"active_process_ids,array"`
+	ActiveThreadNames  []string `pg:"active_thread_names,array"`
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 // The data model for the bonus api 1.
 
-// MaxConcurrentThreadsResponse represents the response structure for the maximum concurrent threads API.
+// MaxConcurrentThreadsRequest represents the request structure for the maximum concurrent threads API.
+type MaxConcurrentThreadsRequest struct {
+	ThreadName string `json:"thread_name" query:"thread_name"`
+}
+
+// MaxConcurrentThreadsResponse represents the response structure for the maximum concurrent threads API. ThreadNames
+// contains the names of the threads which were active at the timestamp.
 type MaxConcurrentThreadsResponse struct {
-	ConcurrentThreads int64 `json:"concurrent_threads"`
-	TimestampSeconds  int64 `json:"timestamp_seconds"`
+	ConcurrentThreads int64    `json:"concurrent_threads"`
+	TimestampSeconds  int64    `json:"timestamp_seconds"`
+	ThreadNames       []string `json:"thread_names" pg:"thread_names,array"`
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 // The data model for the bonus api 2.
 
+// ThreadLifetimeStatsRequest represents the request structure for the thread lifetime statistics API.
+type ThreadLifetimeStatsRequest struct {
+	ThreadName string `json:"thread_name" query:"thread_name"`
+}
+
 // ThreadLifetimeStatsResponse represents the response structure for the thread lifetime statistics API.
 type ThreadLifetimeStatsResponse struct {
-	AverageLifetime float64 `json:"average_lifetime"`
-	StdevLifetime   float64 `json:"stdev_lifetime"`
+	AverageLifetime    float64              `json:"average_lifetime"`
+	StdevLifetime      float64              `json:"stdev_lifetime"`
+	LongestLivedThread *ThreadLifetimeEntry `json:"longest_lived_thread" pg:"-"`
+}
+
+// ThreadLifetimeEntry represents the lifetime of a single thread.
+type ThreadLifetimeEntry struct {
+	ProcessID       string `json:"process_id"`
+	ThreadID        string `json:"thread_id"`
+	ThreadName      string `json:"thread_name"`
+	LifetimeSeconds int64  `json:"lifetime_seconds"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+// The data model for the top api.
+
+const (
+	// TopByProcess ranks the processes.
+	TopByProcess = "process"
+
+	// TopByThread ranks the threads. A thread is identified as "process_id:thread_id".
+	TopByThread = "thread"
+
+	// TopByThreadName ranks the thread names. The threads with the same name across processes are added up.
+	TopByThreadName = "thread_name"
+
+	// TopMetricLines ranks by the number of log lines.
+	TopMetricLines = "lines"
+
+	// TopMetricBytes ranks by the number of bytes logged.
+	TopMetricBytes = "bytes"
+)
+
+// TopRequest represents the request structure for the top api. The parameters can be passed either as query
+// parameters or as json body.
+type TopRequest struct {
+	StartTimeSeconds int64  `json:"start_time_seconds" query:"start_time_seconds"`
+	EndTimeSeconds   int64  `json:"end_time_seconds" query:"end_time_seconds"`
+	N                int    `json:"n" query:"n"`
+	By               string `json:"by" query:"by"`
+	Metric           string `json:"metric" query:"metric"`
+	ThreadName       string `json:"thread_name" query:"thread_name"`
+}
+
+// TopEntry represents a single process or thread in the response of the top api. ChangePercent is null when the
+// entry did not log anything in the previous window.
+type TopEntry struct {
+	Key                  string   `json:"key"`
+	Value                int64    `json:"value"`
+	SharePercent         float64  `json:"share_percent"`
+	PreviousValue        int64    `json:"previous_value"`
+	PreviousSharePercent float64  `json:"previous_share_percent"`
+	ChangePercent        *float64 `json:"change_percent"`
+}
+
+// TopResponse represents the response structure for the top api.
+type TopResponse struct {
+	By                       string     `json:"by" pg:"-"`
+	Metric                   string     `json:"metric" pg:"-"`
+	StartTimeSeconds         int64      `json:"start_time_seconds" pg:"-"`
+	EndTimeSeconds           int64      `json:"end_time_seconds" pg:"-"`
+	PreviousStartTimeSeconds int64      `json:"previous_start_time_seconds" pg:"-"`
+	PreviousEndTimeSeconds   int64      `json:"previous_end_time_seconds" pg:"-"`
+	Total                    int64      `json:"total" pg:"total"`
+	PreviousTotal            int64      `json:"previous_total" pg:"previous_total"`
+	Entries                  []TopEntry `json:"entries" pg:"-"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+// The data model for the attribute counts api.
+
+// AttributeCountsRequest represents the request structure for the attribute counts API.
+//
+// GroupBy is the list of attribute names to group by. Only the lines which have all the grouped attributes are
+// counted. Filters are of the form "name=value" to match an attribute value or "name" to match the lines which have
+// the attribute. Interval is one of "second", "minute", "hour" or "day". When the interval is empty, the whole time
+// range is returned as a single bucket.
+type AttributeCountsRequest struct {
+	StartTimeSeconds int64    `json:"start_time_seconds" query:"start_time_seconds"`
+	EndTimeSeconds   int64    `json:"end_time_seconds" query:"end_time_seconds"`
+	GroupBy          []string `json:"group_by" query:"group_by"`
+	Filters          []string `json:"filters" query:"filter"`
+	Interval         string   `json:"interval" query:"interval"`
+	ThreadName       string   `json:"thread_name" query:"thread_name"`
+}
+
+// AttributeCount represents the number of lines with the given attribute values in a single time bucket.
+type AttributeCount struct {
+	BucketSeconds int64             `json:"bucket_seconds"`
+	Attributes    map[string]string `json:"attributes"`
+	Count         int64             `json:"count"`
+}
+
+// AttributeCountsResponse represents the response structure for the attribute counts API.
+type AttributeCountsResponse struct {
+	GroupBy  []string         `json:"group_by"`
+	Interval string           `json:"interval"`
+	Counts   []AttributeCount `json:"counts"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+// The data model for the templates api.
+
+const (
+	// TemplatesOrderByLineCount orders the templates by the number of lines, most frequent first.
+	TemplatesOrderByLineCount = "line_count"
+
+	// TemplatesOrderByFirstSeen orders the templates by the time they were first seen, newest first.
+	TemplatesOrderByFirstSeen = "first_seen"
+
+	// TemplatesOrderByLastSeen orders the templates by the time they were last seen, most recent first.
+	TemplatesOrderByLastSeen = "last_seen"
+)
+
+// LogTemplate encapsulates the data model of the log_templates table maintained by the stats worker.
+type LogTemplate struct {
+	tableName        struct{} `pg:"log_templates"`
+	TemplateID       int64    `json:"template_id" pg:"template_id,pk"`
+	Template         string   `json:"template" pg:"template"`
+	TokenCount       int      `json:"token_count" pg:"token_count"`
+	LineCount        int64    `json:"line_count" pg:"line_count"`
+	FirstSeenSeconds int64    `json:"first_seen_seconds" pg:"first_seen_seconds"`
+	LastSeenSeconds  int64    `json:"last_seen_seconds" pg:"last_seen_seconds"`
+}
+
+// TemplatesRequest represents the request structure for the templates API. NewSinceSeconds lists only the templates
+// which were first seen at or after the given time, which is how the new kinds of messages are found.
+type TemplatesRequest struct {
+	NewSinceSeconds int64  `json:"new_since_seconds" query:"new_since_seconds"`
+	OrderBy         string `json:"order_by" query:"order_by"`
+	Limit           int    `json:"limit" query:"limit"`
+}
+
+// TemplatesResponse represents the response structure for the templates API.
+type TemplatesResponse struct {
+	Templates []LogTemplate `json:"templates"`
+}
+
+// TemplateLinesRequest represents the request structure for the template lines API. An end time of zero means that
+// the time range has no upper bound.
+type TemplateLinesRequest struct {
+	TemplateID       int64  `param:"id"`
+	StartTimeSeconds int64  `json:"start_time_seconds" query:"start_time_seconds"`
+	EndTimeSeconds   int64  `json:"end_time_seconds" query:"end_time_seconds"`
+	ThreadName       string `json:"thread_name" query:"thread_name"`
+	Limit            int    `json:"limit" query:"limit"`
+}
+
+// TemplateLine represents a single log line of a template.
+type TemplateLine struct {
+	ProcessID        string            `json:"process_id"`
+	ThreadID         string            `json:"thread_id"`
+	ThreadName       string            `json:"thread_name"`
+	Timestamp        time.Time         `json:"timestamp"`
+	TimestampSeconds int64             `json:"timestamp_seconds"`
+	LogMessage       string            `json:"log_message"`
+	Attributes       map[string]string `json:"attributes"`
+}
+
+// TemplateLinesResponse represents the response structure for the template lines API. The lines are the most recent
+// lines of the template.
+type TemplateLinesResponse struct {
+	Template LogTemplate    `json:"template"`
+	Lines    []TemplateLine `json:"lines"`
+}
+
+// PartitionsRequest represents the request structure for the partitions admin API. By default the row counts are
+// the estimates of postgres. Exact counts every row, which scans all the partitions.
+type PartitionsRequest struct {
+	Exact bool `json:"exact" query:"exact"`
+}
+
+// Partition represents a single partition of the log_lines table. The range is [start_seconds, end_seconds) and is
+// empty for the default partition.
+type Partition struct {
+	Name         string `json:"name"`
+	StartSeconds int64  `json:"start_seconds,omitempty"`
+	EndSeconds   int64  `json:"end_seconds,omitempty"`
+	IsDefault    bool   `json:"is_default"`
+	RowCount     int64  `json:"row_count"`
+	TotalBytes   int64  `json:"total_bytes"`
+}
+
+// PartitionsResponse represents the response structure for the partitions admin API. Exact tells if the row counts
+// are exact or estimated.
+type PartitionsResponse struct {
+	Exact      bool        `json:"exact"`
+	Partitions []Partition `json:"partitions"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+// The data model for the health endpoints.
+
+const (
+	// HealthStatusOK is the status of a passing check and of the service when all the checks pass.
+	HealthStatusOK = "ok"
+
+	// HealthStatusUnavailable is the status of the service when at least one check fails.
+	HealthStatusUnavailable = "unavailable"
+)
+
+// HealthResponse represents the response structure for the /healthz and /readyz endpoints. Checks contains the result
+// of every check, which is either "ok" or the error.
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
 }
 
 //----------------------------------------------------------------------------------------------------------------------
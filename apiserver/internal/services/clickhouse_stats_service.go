@@ -0,0 +1,588 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the ClickHouse implementation of the stats services.
+//
+// The postgres implementation reads the rollup tables maintained by the stats worker. ClickHouse has no rollups, the
+// stats are aggregated from the raw log_lines table at query time. The table is ordered by time, so the time range
+// filters only read the granules of the range. Please refer to clickhouse.go in the schema package of the common
+// module for the tables.
+//
+// Every read uses FINAL, so that the lines redelivered by kafka and not yet merged away are not double counted.
+//
+// The responses are the same as the postgres implementation for the same log lines. This contract is checked by the
+// test program in test/contract.
+
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/golang/glog"
+
+	"common/schema"
+
+	"apiserver/internal/models"
+)
+
+// clickHouseTimeoutExceeded is the ClickHouse error code of a query which ran past its max_execution_time.
+const clickHouseTimeoutExceeded = 159
+
+// clickHouseTemplatesOrder maps the "order_by" parameter of the templates api to the order expression. The templates
+// without lines have zero timestamps, so they sort last.
+var clickHouseTemplatesOrder = map[string]string{
+	models.TemplatesOrderByLineCount: "line_count DESC",
+	models.TemplatesOrderByFirstSeen: "first_seen_seconds DESC",
+	models.TemplatesOrderByLastSeen:  "last_seen_seconds DESC",
+}
+
+// clickHouseTopDimensions maps the "by" parameter of the top api to the column expression in log_lines.
+var clickHouseTopDimensions = map[string]string{
+	models.TopByProcess:    "process_id",
+	models.TopByThread:     "concat(process_id, ':', thread_id)",
+	models.TopByThreadName: "thread_name",
+}
+
+// clickHouseTopMetrics maps the "metric" parameter of the top api to the aggregate in log_lines.
+var clickHouseTopMetrics = map[string]string{
+	models.TopMetricLines: "toInt64(count())",
+	models.TopMetricBytes: "toInt64(sum(byte_count))",
+}
+
+// clickHouseTemplatesQuery selects the templates with their stats. The condition and the order are appended.
+const clickHouseTemplatesQuery = `
+        SELECT template_id, t.template AS template, t.token_count AS token_count, s.line_count AS line_count,
+               s.first_seen_seconds AS first_seen_seconds, s.last_seen_seconds AS last_seen_seconds
+        FROM (
+            SELECT template_id, template, token_count FROM log_templates FINAL
+        ) AS t
+        LEFT JOIN (
+            SELECT template_id,
+                   toInt64(count()) AS line_count,
+                   min(timestamp_seconds) AS first_seen_seconds,
+                   max(timestamp_seconds) AS last_seen_seconds
+            FROM log_lines FINAL
+            GROUP BY template_id
+        ) AS s USING (template_id)
+`
+
+// ClickHouseStatsService provides the business logic for retrieving log statistics from ClickHouse.
+type ClickHouseStatsService struct {
+	// The ClickHouse connection pool.
+	conn driver.Conn
+}
+
+// NewClickHouseStatsService creates a new instance of ClickHouseStatsService.
+func NewClickHouseStatsService(conn driver.Conn) *ClickHouseStatsService {
+	return &ClickHouseStatsService{conn: conn}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping checks if ClickHouse is reachable.
+func (s *ClickHouseStatsService) Ping(ctx context.Context) error {
+	return s.conn.Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetBasicStats retrieves basic log statistics within the specified time range. A line without a thread name has an
+// empty name, which is listed like in the rollups of postgres.
+func (s *ClickHouseStatsService) GetBasicStats(ctx context.Context,
+	request *models.BasicLogStatsRequest) (*models.BasicLogStatsResponse, error) {
+	glog.Infoln("fetching basic stats from clickhouse")
+
+	var (
+		count      int64
+		threadIDs  []string
+		processIDs []string
+		names      []string
+	)
+	err := s.conn.QueryRow(ctx, `
+        SELECT toInt64(uniqExact(thread_id)),
+               arraySort(groupUniqArray(thread_id)),
+               arraySort(groupUniqArray(process_id)),
+               arraySort(groupUniqArray(thread_name))
+        FROM log_lines FINAL
+        WHERE timestamp_seconds >= ? AND timestamp_seconds <= ? AND (? = '' OR thread_name = ?)`,
+		request.StartTimeSeconds, request.EndTimeSeconds, request.ThreadName, request.ThreadName).
+		Scan(&count, &threadIDs, &processIDs, &names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+	}
+
+	result := models.BasicLogStatsResponse{ActiveThreadsCount: int(count)}
+	if result.ActiveThreadIDs, err = atoiAll(threadIDs); err != nil {
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+	}
+	if result.ActiveProcessIDs, err = atoiAll(processIDs); err != nil {
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+	}
+	if len(names) > 0 {
+		result.ActiveThreadNames = names
+	}
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetMaxConcurrentThreads retrieves the highest count of concurrent threads and the corresponding timestamp.
+func (s *ClickHouseStatsService) GetMaxConcurrentThreads(ctx context.Context,
+	request *models.MaxConcurrentThreadsRequest) (*models.MaxConcurrentThreadsResponse, error) {
+	glog.Infoln("Fetching max concurrent threads from clickhouse")
+
+	var result models.MaxConcurrentThreadsResponse
+
+	err := s.conn.QueryRow(ctx, `
+        SELECT timestamp_seconds, toInt64(uniqExact(process_id, thread_id)) AS active_threads
+        FROM log_lines FINAL
+        WHERE ? = '' OR thread_name = ?
+        GROUP BY timestamp_seconds
+        ORDER BY active_threads DESC, timestamp_seconds ASC
+        LIMIT 1`,
+		request.ThreadName, request.ThreadName).Scan(&result.TimestampSeconds, &result.ConcurrentThreads)
+
+	// There is no peak without log lines.
+	if err == sql.ErrNoRows {
+		return &result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve max concurrent threads: %w", err)
+	}
+
+	err = s.conn.QueryRow(ctx, `
+        SELECT arraySort(groupUniqArray(thread_name))
+        FROM log_lines FINAL
+        WHERE timestamp_seconds = ? AND (? = '' OR thread_name = ?)`,
+		result.TimestampSeconds, request.ThreadName, request.ThreadName).Scan(&result.ThreadNames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve max concurrent threads: %w", err)
+	}
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetThreadLifetimeStats retrieves the average and standard deviation of thread lifetimes along with the longest lived
+// thread. The name of a thread is the name of its latest line.
+func (s *ClickHouseStatsService) GetThreadLifetimeStats(ctx context.Context,
+	request *models.ThreadLifetimeStatsRequest) (*models.ThreadLifetimeStatsResponse, error) {
+	glog.Infoln("Fetching thread lifetime stats from clickhouse")
+
+	threads := `
+        WITH threads AS (
+            SELECT process_id, thread_id, argMax(thread_name, timestamp) AS thread_name,
+                   min(timestamp_seconds) AS first_seen_seconds, max(timestamp_seconds) AS last_seen_seconds
+            FROM log_lines FINAL
+            GROUP BY process_id, thread_id
+        )
+`
+
+	var result models.ThreadLifetimeStatsResponse
+	err := s.conn.QueryRow(ctx, threads+`
+        SELECT avg(lifetime), stddevSamp(lifetime)
+        FROM (
+            SELECT max(last_seen_seconds) - min(first_seen_seconds) AS lifetime
+            FROM threads
+            WHERE ? = '' OR thread_name = ?
+            GROUP BY thread_id
+        )`,
+		request.ThreadName, request.ThreadName).Scan(&result.AverageLifetime, &result.StdevLifetime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve thread lifetime stats: %w", err)
+	}
+
+	// ClickHouse returns nan where postgres returns null, which is zero in the response.
+	result.AverageLifetime = zeroIfNaN(result.AverageLifetime)
+	result.StdevLifetime = zeroIfNaN(result.StdevLifetime)
+
+	var longest models.ThreadLifetimeEntry
+	err = s.conn.QueryRow(ctx, threads+`
+        SELECT process_id, thread_id, thread_name, last_seen_seconds - first_seen_seconds AS lifetime_seconds
+        FROM threads
+        WHERE ? = '' OR thread_name = ?
+        ORDER BY lifetime_seconds DESC, process_id, thread_id
+        LIMIT 1`,
+		request.ThreadName, request.ThreadName).
+		Scan(&longest.ProcessID, &longest.ThreadID, &longest.ThreadName, &longest.LifetimeSeconds)
+	if err == nil {
+		result.LongestLivedThread = &longest
+	} else if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to retrieve longest lived thread: %w", err)
+	}
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTop retrieves the top N processes, threads or thread names with the most lines or bytes in the time window. Each
+// entry is compared against the previous window of equal length which ends right before the requested window starts.
+func (s *ClickHouseStatsService) GetTop(ctx context.Context, request *models.TopRequest) (*models.TopResponse, error) {
+	glog.Infoln("Fetching top", request.N, request.By, "by", request.Metric, "from clickhouse")
+
+	dimension, ok := clickHouseTopDimensions[request.By]
+	if !ok {
+		return nil, fmt.Errorf("unsupported top dimension: %s", request.By)
+	}
+	metric, ok := clickHouseTopMetrics[request.Metric]
+	if !ok {
+		return nil, fmt.Errorf("unsupported top metric: %s", request.Metric)
+	}
+
+	// The previous window has the same length as the requested window.
+	windowLength := request.EndTimeSeconds - request.StartTimeSeconds + 1
+	result := models.TopResponse{
+		By:                       request.By,
+		Metric:                   request.Metric,
+		StartTimeSeconds:         request.StartTimeSeconds,
+		EndTimeSeconds:           request.EndTimeSeconds,
+		PreviousStartTimeSeconds: request.StartTimeSeconds - windowLength,
+		PreviousEndTimeSeconds:   request.StartTimeSeconds - 1,
+		Entries:                  []models.TopEntry{},
+	}
+
+	// The windows are small enough after the grouping to be ranked here.
+	query := fmt.Sprintf(`
+        SELECT %s AS key, %s AS value
+        FROM log_lines FINAL
+        WHERE timestamp_seconds >= ? AND timestamp_seconds <= ? AND (? = '' OR thread_name = ?)
+        GROUP BY key`, dimension, metric)
+
+	current, err := s.queryKeyValues(ctx, query, result.StartTimeSeconds, result.EndTimeSeconds, request.ThreadName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve top %s: %w", request.By, err)
+	}
+	previous, err := s.queryKeyValues(ctx, query, result.PreviousStartTimeSeconds, result.PreviousEndTimeSeconds,
+		request.ThreadName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve top %s: %w", request.By, err)
+	}
+
+	rankTop(&result, current, previous, request.N)
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetAttributeCounts counts the lines grouped by the extracted attributes in the time window.
+func (s *ClickHouseStatsService) GetAttributeCounts(ctx context.Context,
+	request *models.AttributeCountsRequest) (*models.AttributeCountsResponse, error) {
+	glog.Infoln("Fetching attribute counts from clickhouse")
+
+	interval, ok := AttributeIntervals[request.Interval]
+	if !ok {
+		return nil, fmt.Errorf("unsupported interval: %s", request.Interval)
+	}
+
+	var params []interface{}
+
+	// The bucket is the start of the interval. Without an interval the whole time range is a single bucket.
+	bucket := "toInt64(?)"
+	if interval > 0 {
+		bucket = "timestamp_seconds - timestamp_seconds % ?"
+		params = append(params, interval)
+	} else {
+		params = append(params, request.StartTimeSeconds)
+	}
+
+	// The grouped attributes are returned as an array of values in the order of group_by.
+	values := make([]string, 0, len(request.GroupBy))
+	for _, name := range request.GroupBy {
+		values = append(values, "attributes[?]")
+		params = append(params, name)
+	}
+
+	conditions := []string{"timestamp_seconds >= ?", "timestamp_seconds <= ?", "(? = '' OR thread_name = ?)"}
+	params = append(params, request.StartTimeSeconds, request.EndTimeSeconds, request.ThreadName,
+		request.ThreadName)
+
+	// Only the lines with all the grouped attributes are counted.
+	for _, name := range request.GroupBy {
+		conditions = append(conditions, "mapContains(attributes, ?)")
+		params = append(params, name)
+	}
+
+	// The "name=value" filters match the value and the "name" filters only need the attribute to be present.
+	for _, filter := range request.Filters {
+		name, value, hasValue := cutAttributeFilter(filter)
+		if !hasValue {
+			conditions = append(conditions, "mapContains(attributes, ?)")
+			params = append(params, name)
+			continue
+		}
+		conditions = append(conditions, "mapContains(attributes, ?) AND attributes[?] = ?")
+		params = append(params, name, name, value)
+	}
+
+	query := fmt.Sprintf(`
+        SELECT %s AS bucket_seconds,
+               CAST([%s], 'Array(String)') AS attribute_values,
+               toInt64(count()) AS count
+        FROM log_lines FINAL
+        WHERE %s
+        GROUP BY bucket_seconds, attribute_values
+        ORDER BY bucket_seconds, count DESC
+        LIMIT ?
+    `, bucket, strings.Join(values, ", "), strings.Join(conditions, " AND "))
+	params = append(params, maxAttributeCounts)
+
+	rows, err := s.conn.Query(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve attribute counts: %w", err)
+	}
+	defer rows.Close()
+
+	result := models.AttributeCountsResponse{
+		GroupBy:  request.GroupBy,
+		Interval: request.Interval,
+		Counts:   []models.AttributeCount{},
+	}
+	for rows.Next() {
+		var (
+			count           models.AttributeCount
+			attributeValues []string
+		)
+		if err := rows.Scan(&count.BucketSeconds, &attributeValues, &count.Count); err != nil {
+			return nil, fmt.Errorf("failed to retrieve attribute counts: %w", err)
+		}
+
+		count.Attributes = make(map[string]string, len(request.GroupBy))
+		for i, name := range request.GroupBy {
+			count.Attributes[name] = attributeValues[i]
+		}
+		result.Counts = append(result.Counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve attribute counts: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Counts), "attribute counts")
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplates retrieves the log templates mined by the stats worker.
+func (s *ClickHouseStatsService) GetTemplates(ctx context.Context,
+	request *models.TemplatesRequest) (*models.TemplatesResponse, error) {
+	glog.Infoln("Fetching log templates from clickhouse")
+
+	order, ok := clickHouseTemplatesOrder[request.OrderBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported templates order: %s", request.OrderBy)
+	}
+
+	condition := "1"
+	var params []interface{}
+	if request.NewSinceSeconds > 0 {
+		condition = "first_seen_seconds >= ?"
+		params = append(params, request.NewSinceSeconds)
+	}
+	params = append(params, request.Limit)
+
+	query := clickHouseTemplatesQuery + fmt.Sprintf(`
+        WHERE %s
+        ORDER BY %s, template_id ASC
+        LIMIT ?`, condition, order)
+
+	templates, err := s.queryTemplates(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve log templates: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(templates), "log templates")
+	return &models.TemplatesResponse{Templates: templates}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplateLines retrieves the most recent log lines of a template.
+func (s *ClickHouseStatsService) GetTemplateLines(ctx context.Context,
+	request *models.TemplateLinesRequest) (*models.TemplateLinesResponse, error) {
+	glog.Infoln("Fetching log lines of template", request.TemplateID)
+
+	templates, err := s.queryTemplates(ctx, clickHouseTemplatesQuery+`
+        WHERE template_id = ?`, request.TemplateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve log template: %w", err)
+	}
+	if len(templates) == 0 {
+		return nil, ErrNotFound
+	}
+
+	endTimeSeconds := int64(math.MaxInt64)
+	if request.EndTimeSeconds > 0 {
+		endTimeSeconds = request.EndTimeSeconds
+	}
+
+	rows, err := s.conn.Query(ctx, `
+        SELECT process_id, thread_id, thread_name, timestamp, timestamp_seconds, log_message, attributes
+        FROM log_lines FINAL
+        WHERE template_id = ? AND timestamp_seconds >= ? AND timestamp_seconds <= ? AND (? = '' OR thread_name = ?)
+        ORDER BY timestamp_seconds DESC, timestamp DESC
+        LIMIT ?`,
+		request.TemplateID, request.StartTimeSeconds, endTimeSeconds, request.ThreadName, request.ThreadName,
+		request.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve log lines of template: %w", err)
+	}
+	defer rows.Close()
+
+	result := models.TemplateLinesResponse{Template: templates[0], Lines: []models.TemplateLine{}}
+	for rows.Next() {
+		var line models.TemplateLine
+		err := rows.Scan(&line.ProcessID, &line.ThreadID, &line.ThreadName, &line.Timestamp, &line.TimestampSeconds,
+			&line.LogMessage, &line.Attributes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve log lines of template: %w", err)
+		}
+		result.Lines = append(result.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve log lines of template: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Lines), "log lines of template", request.TemplateID)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetPartitions lists the daily partitions of the log_lines table with their row counts and sizes. The partitions
+// are named like the postgres partitions.
+func (s *ClickHouseStatsService) GetPartitions(ctx context.Context,
+	request *models.PartitionsRequest) (*models.PartitionsResponse, error) {
+	glog.Infoln("Fetching partitions of log_lines table from clickhouse")
+
+	rows, err := s.conn.Query(ctx, `
+        SELECT partition_id, toInt64(sum(rows)), toInt64(sum(bytes_on_disk))
+        FROM system.parts
+        WHERE database = currentDatabase() AND table = 'log_lines' AND active
+        GROUP BY partition_id
+        ORDER BY partition_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	defer rows.Close()
+
+	result := models.PartitionsResponse{Exact: request.Exact, Partitions: []models.Partition{}}
+	for rows.Next() {
+		var (
+			partitionID string
+			partition   models.Partition
+		)
+		if err := rows.Scan(&partitionID, &partition.RowCount, &partition.TotalBytes); err != nil {
+			return nil, fmt.Errorf("failed to list partitions: %w", err)
+		}
+
+		day, err := time.Parse("20060102", partitionID)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected partition id %s: %w", partitionID, err)
+		}
+		partition.Name = schema.PartitionName(day)
+		partition.StartSeconds = day.Unix()
+		partition.EndSeconds = day.AddDate(0, 0, 1).Unix()
+		result.Partitions = append(result.Partitions, partition)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	// The rows of the parts include the redelivered lines which are not merged away yet.
+	if request.Exact {
+		for i := range result.Partitions {
+			partition := &result.Partitions[i]
+			err := s.conn.QueryRow(ctx, `
+                SELECT toInt64(count())
+                FROM log_lines FINAL
+                WHERE timestamp_seconds >= ? AND timestamp_seconds < ?`,
+				partition.StartSeconds, partition.EndSeconds).Scan(&partition.RowCount)
+			if err != nil {
+				return nil, fmt.Errorf("failed to count the rows of partition %s: %w", partition.Name, err)
+			}
+		}
+	}
+
+	glog.Infoln("Fetched", len(result.Partitions), "partitions")
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// queryKeyValues is a helper function to run a query which returns key and value columns into a map.
+func (s *ClickHouseStatsService) queryKeyValues(ctx context.Context, query string, start int64, end int64,
+	threadName string) (map[string]int64, error) {
+	rows, err := s.conn.Query(ctx, query, start, end, threadName, threadName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]int64)
+	for rows.Next() {
+		var (
+			key   string
+			value int64
+		)
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// queryTemplates is a helper function to run a templates query and scan the templates.
+func (s *ClickHouseStatsService) queryTemplates(ctx context.Context, query string,
+	params ...interface{}) ([]models.LogTemplate, error) {
+	rows, err := s.conn.Query(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []models.LogTemplate{}
+	for rows.Next() {
+		var (
+			template   models.LogTemplate
+			tokenCount int32
+		)
+		err := rows.Scan(&template.TemplateID, &template.Template, &tokenCount, &template.LineCount,
+			&template.FirstSeenSeconds, &template.LastSeenSeconds)
+		if err != nil {
+			return nil, err
+		}
+		template.TokenCount = int(tokenCount)
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// zeroIfNaN is a helper function to replace nan with zero.
+func zeroIfNaN(value float64) float64 {
+	if math.IsNaN(value) {
+		return 0
+	}
+	return value
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,639 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the SQLite implementation of the stats services.
+//
+// The embedded SQLite backend is meant for a single node and for tests. Like the ClickHouse implementation, the stats
+// are aggregated from the raw log_lines table at query time. Please refer to sqlite.go in the schema package of the
+// common module for the tables.
+//
+// SQLite has neither arrays nor a standard deviation, so a few of the aggregations are finished here instead of in the
+// query. The responses are the same as the postgres implementation for the same log lines. This contract is checked
+// by the test program in test/contract.
+
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"common/schema"
+
+	"apiserver/internal/models"
+)
+
+// sqliteTemplatesOrder maps the "order_by" parameter of the templates api to the order expression. The templates
+// without lines have zero timestamps, so they sort last.
+var sqliteTemplatesOrder = map[string]string{
+	models.TemplatesOrderByLineCount: "line_count DESC",
+	models.TemplatesOrderByFirstSeen: "first_seen_seconds DESC",
+	models.TemplatesOrderByLastSeen:  "last_seen_seconds DESC",
+}
+
+// sqliteTopDimensions maps the "by" parameter of the top api to the column expression in log_lines.
+var sqliteTopDimensions = map[string]string{
+	models.TopByProcess:    "process_id",
+	models.TopByThread:     "process_id || ':' || thread_id",
+	models.TopByThreadName: "thread_name",
+}
+
+// sqliteTopMetrics maps the "metric" parameter of the top api to the aggregate in log_lines.
+var sqliteTopMetrics = map[string]string{
+	models.TopMetricLines: "COUNT(*)",
+	models.TopMetricBytes: "SUM(byte_count)",
+}
+
+// sqliteTemplatesQuery selects the templates with their stats. The condition and the order are appended.
+const sqliteTemplatesQuery = `
+        SELECT t.template_id, t.template, t.token_count,
+               COALESCE(s.line_count, 0) AS line_count,
+               COALESCE(s.first_seen_seconds, 0) AS first_seen_seconds,
+               COALESCE(s.last_seen_seconds, 0) AS last_seen_seconds
+        FROM log_templates AS t
+        LEFT JOIN (
+            SELECT template_id,
+                   COUNT(*) AS line_count,
+                   MIN(timestamp_seconds) AS first_seen_seconds,
+                   MAX(timestamp_seconds) AS last_seen_seconds
+            FROM log_lines
+            GROUP BY template_id
+        ) AS s ON s.template_id = t.template_id
+`
+
+// sqliteThreadsQuery selects every thread with its first and last seen timestamps. The name of a thread is the name
+// of its latest line. The query of the lifetimes is appended.
+const sqliteThreadsQuery = `
+        WITH threads AS (
+            SELECT t.process_id, t.thread_id,
+                   (SELECT l.thread_name FROM log_lines AS l
+                    WHERE l.process_id = t.process_id AND l.thread_id = t.thread_id
+                    ORDER BY l.timestamp DESC
+                    LIMIT 1) AS thread_name,
+                   t.first_seen_seconds, t.last_seen_seconds
+            FROM (
+                SELECT process_id, thread_id,
+                       MIN(timestamp_seconds) AS first_seen_seconds, MAX(timestamp_seconds) AS last_seen_seconds
+                FROM log_lines
+                GROUP BY process_id, thread_id
+            ) AS t
+        )
+`
+
+// SQLiteStatsService provides the business logic for retrieving log statistics from the embedded SQLite database.
+type SQLiteStatsService struct {
+	// The SQLite database.
+	db *sql.DB
+}
+
+// NewSQLiteStatsService creates a new instance of SQLiteStatsService.
+func NewSQLiteStatsService(db *sql.DB) *SQLiteStatsService {
+	return &SQLiteStatsService{db: db}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping checks if the database file can be opened.
+func (s *SQLiteStatsService) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetBasicStats retrieves basic log statistics within the specified time range. The distinct threads are selected and
+// the lists are built here. A line without a thread name has an empty name, which is listed like in the rollups of
+// postgres.
+func (s *SQLiteStatsService) GetBasicStats(ctx context.Context,
+	request *models.BasicLogStatsRequest) (*models.BasicLogStatsResponse, error) {
+	glog.Infoln("fetching basic stats from sqlite")
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT DISTINCT process_id, thread_id, thread_name
+        FROM log_lines
+        WHERE timestamp_seconds >= ? AND timestamp_seconds <= ? AND (? = '' OR thread_name = ?)`,
+		request.StartTimeSeconds, request.EndTimeSeconds, request.ThreadName, request.ThreadName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+	}
+	defer rows.Close()
+
+	threadIDs := make(map[string]bool)
+	processIDs := make(map[string]bool)
+	names := make(map[string]bool)
+	for rows.Next() {
+		var processID, threadID, threadName string
+		if err := rows.Scan(&processID, &threadID, &threadName); err != nil {
+			return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+		}
+		processIDs[processID] = true
+		threadIDs[threadID] = true
+		names[threadName] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+	}
+
+	result := models.BasicLogStatsResponse{ActiveThreadsCount: len(threadIDs)}
+	if result.ActiveThreadIDs, err = atoiAll(sortedKeys(threadIDs)); err != nil {
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+	}
+	if result.ActiveProcessIDs, err = atoiAll(sortedKeys(processIDs)); err != nil {
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
+	}
+	if len(names) > 0 {
+		result.ActiveThreadNames = sortedKeys(names)
+	}
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetMaxConcurrentThreads retrieves the highest count of concurrent threads and the corresponding timestamp.
+func (s *SQLiteStatsService) GetMaxConcurrentThreads(ctx context.Context,
+	request *models.MaxConcurrentThreadsRequest) (*models.MaxConcurrentThreadsResponse, error) {
+	glog.Infoln("Fetching max concurrent threads from sqlite")
+
+	var result models.MaxConcurrentThreadsResponse
+
+	err := s.db.QueryRowContext(ctx, `
+        SELECT timestamp_seconds, COUNT(DISTINCT process_id || ':' || thread_id) AS active_threads
+        FROM log_lines
+        WHERE ? = '' OR thread_name = ?
+        GROUP BY timestamp_seconds
+        ORDER BY active_threads DESC, timestamp_seconds ASC
+        LIMIT 1`,
+		request.ThreadName, request.ThreadName).Scan(&result.TimestampSeconds, &result.ConcurrentThreads)
+
+	// There is no peak without log lines.
+	if err == sql.ErrNoRows {
+		return &result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve max concurrent threads: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT DISTINCT thread_name
+        FROM log_lines
+        WHERE timestamp_seconds = ? AND (? = '' OR thread_name = ?)
+        ORDER BY thread_name`,
+		result.TimestampSeconds, request.ThreadName, request.ThreadName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve max concurrent threads: %w", err)
+	}
+	defer rows.Close()
+
+	result.ThreadNames = []string{}
+	for rows.Next() {
+		var threadName string
+		if err := rows.Scan(&threadName); err != nil {
+			return nil, fmt.Errorf("failed to retrieve max concurrent threads: %w", err)
+		}
+		result.ThreadNames = append(result.ThreadNames, threadName)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve max concurrent threads: %w", err)
+	}
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetThreadLifetimeStats retrieves the average and standard deviation of thread lifetimes along with the longest lived
+// thread. The lifetimes are selected per thread id and the average and the standard deviation are computed here.
+func (s *SQLiteStatsService) GetThreadLifetimeStats(ctx context.Context,
+	request *models.ThreadLifetimeStatsRequest) (*models.ThreadLifetimeStatsResponse, error) {
+	glog.Infoln("Fetching thread lifetime stats from sqlite")
+
+	rows, err := s.db.QueryContext(ctx, sqliteThreadsQuery+`
+        SELECT MAX(last_seen_seconds) - MIN(first_seen_seconds) AS lifetime
+        FROM threads
+        WHERE ? = '' OR thread_name = ?
+        GROUP BY thread_id`,
+		request.ThreadName, request.ThreadName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve thread lifetime stats: %w", err)
+	}
+	defer rows.Close()
+
+	var lifetimes []float64
+	for rows.Next() {
+		var lifetime float64
+		if err := rows.Scan(&lifetime); err != nil {
+			return nil, fmt.Errorf("failed to retrieve thread lifetime stats: %w", err)
+		}
+		lifetimes = append(lifetimes, lifetime)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve thread lifetime stats: %w", err)
+	}
+
+	var result models.ThreadLifetimeStatsResponse
+	result.AverageLifetime, result.StdevLifetime = meanAndStdev(lifetimes)
+
+	var longest models.ThreadLifetimeEntry
+	err = s.db.QueryRowContext(ctx, sqliteThreadsQuery+`
+        SELECT process_id, thread_id, thread_name, last_seen_seconds - first_seen_seconds AS lifetime_seconds
+        FROM threads
+        WHERE ? = '' OR thread_name = ?
+        ORDER BY lifetime_seconds DESC, process_id, thread_id
+        LIMIT 1`,
+		request.ThreadName, request.ThreadName).
+		Scan(&longest.ProcessID, &longest.ThreadID, &longest.ThreadName, &longest.LifetimeSeconds)
+	if err == nil {
+		result.LongestLivedThread = &longest
+	} else if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to retrieve longest lived thread: %w", err)
+	}
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTop retrieves the top N processes, threads or thread names with the most lines or bytes in the time window. Each
+// entry is compared against the previous window of equal length which ends right before the requested window starts.
+func (s *SQLiteStatsService) GetTop(ctx context.Context, request *models.TopRequest) (*models.TopResponse, error) {
+	glog.Infoln("Fetching top", request.N, request.By, "by", request.Metric, "from sqlite")
+
+	dimension, ok := sqliteTopDimensions[request.By]
+	if !ok {
+		return nil, fmt.Errorf("unsupported top dimension: %s", request.By)
+	}
+	metric, ok := sqliteTopMetrics[request.Metric]
+	if !ok {
+		return nil, fmt.Errorf("unsupported top metric: %s", request.Metric)
+	}
+
+	// The previous window has the same length as the requested window.
+	windowLength := request.EndTimeSeconds - request.StartTimeSeconds + 1
+	result := models.TopResponse{
+		By:                       request.By,
+		Metric:                   request.Metric,
+		StartTimeSeconds:         request.StartTimeSeconds,
+		EndTimeSeconds:           request.EndTimeSeconds,
+		PreviousStartTimeSeconds: request.StartTimeSeconds - windowLength,
+		PreviousEndTimeSeconds:   request.StartTimeSeconds - 1,
+		Entries:                  []models.TopEntry{},
+	}
+
+	// The windows are small enough after the grouping to be ranked here.
+	query := fmt.Sprintf(`
+        SELECT %s AS key, %s AS value
+        FROM log_lines
+        WHERE timestamp_seconds >= ? AND timestamp_seconds <= ? AND (? = '' OR thread_name = ?)
+        GROUP BY key`, dimension, metric)
+
+	current, err := s.queryKeyValues(ctx, query, result.StartTimeSeconds, result.EndTimeSeconds, request.ThreadName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve top %s: %w", request.By, err)
+	}
+	previous, err := s.queryKeyValues(ctx, query, result.PreviousStartTimeSeconds, result.PreviousEndTimeSeconds,
+		request.ThreadName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve top %s: %w", request.By, err)
+	}
+
+	rankTop(&result, current, previous, request.N)
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetAttributeCounts counts the lines grouped by the extracted attributes in the time window. The attributes are a
+// json object, which is read with json_each so that any attribute name is matched literally.
+func (s *SQLiteStatsService) GetAttributeCounts(ctx context.Context,
+	request *models.AttributeCountsRequest) (*models.AttributeCountsResponse, error) {
+	glog.Infoln("Fetching attribute counts from sqlite")
+
+	interval, ok := AttributeIntervals[request.Interval]
+	if !ok {
+		return nil, fmt.Errorf("unsupported interval: %s", request.Interval)
+	}
+
+	var params []interface{}
+
+	// The bucket is the start of the interval. Without an interval the whole time range is a single bucket.
+	bucket := "?"
+	if interval > 0 {
+		bucket = "timestamp_seconds - timestamp_seconds % ?"
+		params = append(params, interval)
+	} else {
+		params = append(params, request.StartTimeSeconds)
+	}
+
+	// The grouped attributes are returned as a json array of values in the order of group_by.
+	values := make([]string, 0, len(request.GroupBy))
+	for _, name := range request.GroupBy {
+		values = append(values, "(SELECT value FROM json_each(attributes) WHERE key = ?)")
+		params = append(params, name)
+	}
+
+	conditions := []string{"timestamp_seconds >= ?", "timestamp_seconds <= ?", "(? = '' OR thread_name = ?)"}
+	params = append(params, request.StartTimeSeconds, request.EndTimeSeconds, request.ThreadName,
+		request.ThreadName)
+
+	// Only the lines with all the grouped attributes are counted.
+	for _, name := range request.GroupBy {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(attributes) WHERE key = ?)")
+		params = append(params, name)
+	}
+
+	// The "name=value" filters match the value and the "name" filters only need the attribute to be present.
+	for _, filter := range request.Filters {
+		name, value, hasValue := cutAttributeFilter(filter)
+		if !hasValue {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(attributes) WHERE key = ?)")
+			params = append(params, name)
+			continue
+		}
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(attributes) WHERE key = ? AND value = ?)")
+		params = append(params, name, value)
+	}
+
+	query := fmt.Sprintf(`
+        SELECT %s AS bucket_seconds,
+               json_array(%s) AS attribute_values,
+               COUNT(*) AS count
+        FROM log_lines
+        WHERE %s
+        GROUP BY bucket_seconds, attribute_values
+        ORDER BY bucket_seconds, count DESC
+        LIMIT ?
+    `, bucket, strings.Join(values, ", "), strings.Join(conditions, " AND "))
+	params = append(params, maxAttributeCounts)
+
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve attribute counts: %w", err)
+	}
+	defer rows.Close()
+
+	result := models.AttributeCountsResponse{
+		GroupBy:  request.GroupBy,
+		Interval: request.Interval,
+		Counts:   []models.AttributeCount{},
+	}
+	for rows.Next() {
+		var (
+			count           models.AttributeCount
+			attributeValues string
+		)
+		if err := rows.Scan(&count.BucketSeconds, &attributeValues, &count.Count); err != nil {
+			return nil, fmt.Errorf("failed to retrieve attribute counts: %w", err)
+		}
+
+		var decoded []string
+		if err := json.Unmarshal([]byte(attributeValues), &decoded); err != nil {
+			return nil, fmt.Errorf("failed to decode attribute values: %w", err)
+		}
+		count.Attributes = make(map[string]string, len(request.GroupBy))
+		for i, name := range request.GroupBy {
+			count.Attributes[name] = decoded[i]
+		}
+		result.Counts = append(result.Counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve attribute counts: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Counts), "attribute counts")
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplates retrieves the log templates mined by the stats worker.
+func (s *SQLiteStatsService) GetTemplates(ctx context.Context,
+	request *models.TemplatesRequest) (*models.TemplatesResponse, error) {
+	glog.Infoln("Fetching log templates from sqlite")
+
+	order, ok := sqliteTemplatesOrder[request.OrderBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported templates order: %s", request.OrderBy)
+	}
+
+	condition := "1"
+	var params []interface{}
+	if request.NewSinceSeconds > 0 {
+		condition = "s.first_seen_seconds >= ?"
+		params = append(params, request.NewSinceSeconds)
+	}
+	params = append(params, request.Limit)
+
+	query := sqliteTemplatesQuery + fmt.Sprintf(`
+        WHERE %s
+        ORDER BY %s, t.template_id ASC
+        LIMIT ?`, condition, order)
+
+	templates, err := s.queryTemplates(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve log templates: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(templates), "log templates")
+	return &models.TemplatesResponse{Templates: templates}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplateLines retrieves the most recent log lines of a template.
+func (s *SQLiteStatsService) GetTemplateLines(ctx context.Context,
+	request *models.TemplateLinesRequest) (*models.TemplateLinesResponse, error) {
+	glog.Infoln("Fetching log lines of template", request.TemplateID)
+
+	templates, err := s.queryTemplates(ctx, sqliteTemplatesQuery+`
+        WHERE t.template_id = ?`, request.TemplateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve log template: %w", err)
+	}
+	if len(templates) == 0 {
+		return nil, ErrNotFound
+	}
+
+	endTimeSeconds := int64(math.MaxInt64)
+	if request.EndTimeSeconds > 0 {
+		endTimeSeconds = request.EndTimeSeconds
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT process_id, thread_id, thread_name, timestamp, timestamp_seconds, log_message, attributes
+        FROM log_lines
+        WHERE template_id = ? AND timestamp_seconds >= ? AND timestamp_seconds <= ? AND (? = '' OR thread_name = ?)
+        ORDER BY timestamp_seconds DESC, timestamp DESC
+        LIMIT ?`,
+		request.TemplateID, request.StartTimeSeconds, endTimeSeconds, request.ThreadName, request.ThreadName,
+		request.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve log lines of template: %w", err)
+	}
+	defer rows.Close()
+
+	result := models.TemplateLinesResponse{Template: templates[0], Lines: []models.TemplateLine{}}
+	for rows.Next() {
+		var (
+			line       models.TemplateLine
+			timestamp  int64
+			attributes string
+		)
+		err := rows.Scan(&line.ProcessID, &line.ThreadID, &line.ThreadName, &timestamp, &line.TimestampSeconds,
+			&line.LogMessage, &attributes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve log lines of template: %w", err)
+		}
+		if err := json.Unmarshal([]byte(attributes), &line.Attributes); err != nil {
+			return nil, fmt.Errorf("failed to decode attributes: %w", err)
+		}
+		line.Timestamp = time.UnixMilli(timestamp).UTC()
+		result.Lines = append(result.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve log lines of template: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Lines), "log lines of template", request.TemplateID)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetPartitions lists the log lines per day. SQLite has no partitions, so the days are listed under the names of the
+// daily partitions of the other backends. The row counts are always exact and the sizes are not known.
+func (s *SQLiteStatsService) GetPartitions(ctx context.Context,
+	request *models.PartitionsRequest) (*models.PartitionsResponse, error) {
+	glog.Infoln("Fetching log lines per day from sqlite")
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT timestamp_seconds - timestamp_seconds % 86400 AS day_seconds, COUNT(*)
+        FROM log_lines
+        GROUP BY day_seconds
+        ORDER BY day_seconds`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	defer rows.Close()
+
+	result := models.PartitionsResponse{Exact: true, Partitions: []models.Partition{}}
+	for rows.Next() {
+		var (
+			daySeconds int64
+			partition  models.Partition
+		)
+		if err := rows.Scan(&daySeconds, &partition.RowCount); err != nil {
+			return nil, fmt.Errorf("failed to list partitions: %w", err)
+		}
+		partition.Name = schema.PartitionName(time.Unix(daySeconds, 0))
+		partition.StartSeconds = daySeconds
+		partition.EndSeconds = daySeconds + 86400
+		result.Partitions = append(result.Partitions, partition)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Partitions), "partitions")
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// queryKeyValues is a helper function to run a query which returns key and value columns into a map.
+func (s *SQLiteStatsService) queryKeyValues(ctx context.Context, query string, start int64, end int64,
+	threadName string) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, query, start, end, threadName, threadName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]int64)
+	for rows.Next() {
+		var (
+			key   string
+			value int64
+		)
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// queryTemplates is a helper function to run a templates query and scan the templates.
+func (s *SQLiteStatsService) queryTemplates(ctx context.Context, query string,
+	params ...interface{}) ([]models.LogTemplate, error) {
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []models.LogTemplate{}
+	for rows.Next() {
+		var template models.LogTemplate
+		err := rows.Scan(&template.TemplateID, &template.Template, &template.TokenCount, &template.LineCount,
+			&template.FirstSeenSeconds, &template.LastSeenSeconds)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// sortedKeys is a helper function to return the keys of the set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// meanAndStdev is a helper function to compute the mean and the sample standard deviation like AVG and STDDEV of
+// postgres. Both are zero where postgres returns null.
+func meanAndStdev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	if len(values) < 2 {
+		return mean, 0
+	}
+
+	var squares float64
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)-1))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -7,31 +7,117 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
 
+	"common/schema"
+
 	"apiserver/internal/models"
 )
 
+// StatsServicer is the read contract of the apis. It is implemented on postgres by StatsService, on ClickHouse by
+// ClickHouseStatsService and on SQLite by SQLiteStatsService. All of them return the same responses for the same log
+// lines.
 type StatsServicer interface {
 	// GetBasicStats contains the business logic to get the basic stats.
-	GetBasicStats(request *models.BasicLogStatsRequest) (*models.BasicLogStatsResponse, error)
+	GetBasicStats(ctx context.Context, request *models.BasicLogStatsRequest) (*models.BasicLogStatsResponse, error)
 
 	// GetMaxConcurrentThreads retrieves the highest count of concurrent threads and the corresponding timestamp.
-	GetMaxConcurrentThreads() (*models.MaxConcurrentThreadsResponse, error)
+	GetMaxConcurrentThreads(ctx context.Context,
+		request *models.MaxConcurrentThreadsRequest) (*models.MaxConcurrentThreadsResponse, error)
 
 	// GetThreadLifetimeStats retrieves the average and standard deviation of thread lifetimes.
-	GetThreadLifetimeStats() (*models.ThreadLifetimeStatsResponse, error)
+	GetThreadLifetimeStats(ctx context.Context,
+		request *models.ThreadLifetimeStatsRequest) (*models.ThreadLifetimeStatsResponse, error)
+
+	// GetTop retrieves the top N processes, threads or thread names with the most lines or bytes in a time window.
+	GetTop(ctx context.Context, request *models.TopRequest) (*models.TopResponse, error)
+
+	// GetAttributeCounts counts the lines grouped by the extracted attributes in a time window.
+	GetAttributeCounts(ctx context.Context,
+		request *models.AttributeCountsRequest) (*models.AttributeCountsResponse, error)
+
+	// GetTemplates retrieves the log templates mined by the stats worker.
+	GetTemplates(ctx context.Context, request *models.TemplatesRequest) (*models.TemplatesResponse, error)
+
+	// GetTemplateLines retrieves the most recent log lines of a template. ErrNotFound is returned if the template
+	// does not exist.
+	GetTemplateLines(ctx context.Context, request *models.TemplateLinesRequest) (*models.TemplateLinesResponse, error)
+
+	// GetPartitions lists the partitions of the log_lines table with their row counts and sizes.
+	GetPartitions(ctx context.Context, request *models.PartitionsRequest) (*models.PartitionsResponse, error)
+
+	// Ping checks if the database is reachable. It is used by the readiness check.
+	Ping(ctx context.Context) error
+}
+
+// ErrNotFound is returned when the requested entity does not exist.
+var ErrNotFound = errors.New("not found")
+
+// queryCanceled is the postgres error code of a query cancelled because of the statement_timeout or a cancel request.
+const queryCanceled = "57014"
+
+// TemplatesOrder maps the "order_by" parameter of the templates api to the order expression.
+var TemplatesOrder = map[string]string{
+	models.TemplatesOrderByLineCount: "line_count DESC",
+	models.TemplatesOrderByFirstSeen: "first_seen_seconds DESC NULLS LAST",
+	models.TemplatesOrderByLastSeen:  "last_seen_seconds DESC NULLS LAST",
+}
+
+// AttributeIntervals maps the "interval" parameter of the attribute counts api to the bucket width in seconds.
+var AttributeIntervals = map[string]int64{
+	"":       0,
+	"second": 1,
+	"minute": 60,
+	"hour":   3600,
+	"day":    86400,
+}
+
+// maxAttributeCounts is the maximum number of rows returned by the attribute counts api.
+const maxAttributeCounts = 10000
+
+// topDimensions maps the "by" parameter of the top api to the column expression in the rollup tables.
+var topDimensions = map[string]string{
+	models.TopByProcess:    "process_id",
+	models.TopByThread:     "process_id || ':' || thread_id",
+	models.TopByThreadName: "COALESCE(thread_name, '')",
+}
+
+// topMetrics maps the "metric" parameter of the top api to the column in the rollup tables.
+var topMetrics = map[string]string{
+	models.TopMetricLines: "line_count",
+	models.TopMetricBytes: "byte_count",
+}
+
+// DBReader selects the postgres server on which the read queries run.
+type DBReader interface {
+	// Reader returns the go-pg object of the selected server.
+	Reader() *pg.DB
+
+	// Primary returns the go-pg object of the primary.
+	Primary() *pg.DB
 }
 
 // StatsService provides the business logic for retrieving log statistics
 type StatsService struct {
-	// The go-pg object.
+	// The go-pg object of the primary. It is only used when reader is nil.
 	DB *pg.DB
 
+	// reader selects the server of the read queries, a read replica or the primary. It is nil when all the queries
+	// run on the primary.
+	reader DBReader
+
 	// The viper configuration object.
 	conf *viper.Viper
 }
@@ -44,25 +130,64 @@ func NewStatsService(db *pg.DB, conf *viper.Viper) *StatsService {
 	}
 }
 
+// NewReplicatedStatsService creates a new instance of StatsService whose queries run on the server selected by the
+// reader. The server is selected once per api call, so all the queries of an api call see the same data.
+func NewReplicatedStatsService(reader DBReader, conf *viper.Viper) *StatsService {
+	return &StatsService{
+		reader: reader,
+		conf:   conf,
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping checks if the database is reachable. That is the primary, and the replica on which the read queries run if it
+// is not the primary.
+func (s *StatsService) Ping(ctx context.Context) error {
+	primary := s.DB
+	if s.reader != nil {
+		primary = s.reader.Primary()
+	}
+	if err := primary.Ping(ctx); err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+
+	if reader := s.readDB(); reader != primary {
+		if err := reader.Ping(ctx); err != nil {
+			return fmt.Errorf("replica: %w", err)
+		}
+	}
+	return nil
+}
+
 //----------------------------------------------------------------------------------------------------------------------
 
 // GetBasicStats retrieves basic log statistics within the specified time range.
-func (s *StatsService) GetBasicStats(request *models.BasicLogStatsRequest) (*models.BasicLogStatsResponse, error) {
+//
+// The stats are read from the rollup tables. The minutes which are fully covered by the time range are read from the
+// per minute rollup and the remaining seconds at the edges of the time range are read from the per second rollup.
+func (s *StatsService) GetBasicStats(ctx context.Context,
+	request *models.BasicLogStatsRequest) (*models.BasicLogStatsResponse, error) {
+
+	glog.Infoln("fetching basic stats from rollup tables")
 
-	glog.Infoln("fetching basic stats from log_lines table")
+	db := s.readDB()
 
 	var result models.BasicLogStatsResponse
 
-	query := s.DB.Model((*models.LogLines)(nil)).
-		ColumnExpr("COUNT(DISTINCT thread_id) AS active_threads_count").
-		ColumnExpr("ARRAY_AGG(DISTINCT thread_id) AS active_thread_ids").
-		ColumnExpr("ARRAY_AGG(DISTINCT process_id) AS active_process_ids").
-		Where("timestamp_seconds >= ?", request.StartTimeSeconds).
-		Where("timestamp_seconds <= ?", request.EndTimeSeconds)
+	query := `
+        SELECT COUNT(DISTINCT thread_id) AS active_threads_count,
+               ARRAY_AGG(DISTINCT thread_id) AS active_thread_ids,
+               ARRAY_AGG(DISTINCT process_id) AS active_process_ids,
+               ARRAY_AGG(DISTINCT thread_name) FILTER (WHERE thread_name IS NOT NULL) AS active_thread_names
+        FROM (?) AS active
+    `
 
-	err := query.Select(&result)
+	_, err := db.QueryOneContext(ctx, &result, query,
+		rollupRange("process_id, thread_id, thread_name", request.StartTimeSeconds, request.EndTimeSeconds,
+			request.ThreadName))
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve basic stats: %v", err)
+		return nil, fmt.Errorf("failed to retrieve basic stats: %w", err)
 	}
 
 	glog.Infoln(result)
@@ -72,21 +197,48 @@ func (s *StatsService) GetBasicStats(request *models.BasicLogStatsRequest) (*mod
 //----------------------------------------------------------------------------------------------------------------------
 
 // GetMaxConcurrentThreads retrieves the highest count of concurrent threads and the corresponding timestamp.
-func (s *StatsService) GetMaxConcurrentThreads() (*models.MaxConcurrentThreadsResponse, error) {
-	glog.Infoln("Fetching max concurrent threads from log_lines table")
+//
+// Without a thread name filter the precomputed active_threads_per_second rollup is used. With a thread name filter the
+// active threads are counted from the per second rollup.
+func (s *StatsService) GetMaxConcurrentThreads(ctx context.Context,
+	request *models.MaxConcurrentThreadsRequest) (*models.MaxConcurrentThreadsResponse, error) {
+	glog.Infoln("Fetching max concurrent threads from rollup tables")
+
+	db := s.readDB()
 
 	var result models.MaxConcurrentThreadsResponse
 
-	err := s.DB.Model((*models.LogLines)(nil)).
-		ColumnExpr("COUNT(DISTINCT thread_id) AS concurrent_threads").
-		Column("timestamp_seconds").
-		Group("timestamp_seconds").
-		Order("concurrent_threads DESC").
-		Limit(1).
-		Select(&result)
+	peak := pg.SafeQuery(`
+            SELECT bucket_seconds, active_threads
+            FROM active_threads_per_second`)
+	if request.ThreadName != "" {
+		peak = pg.SafeQuery(`
+            SELECT bucket_seconds, COUNT(*) AS active_threads
+            FROM log_lines_per_second
+            WHERE ?
+            GROUP BY bucket_seconds`, threadNameCondition(request.ThreadName))
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve max concurrent threads: %v", err)
+	query := `
+        WITH peak AS (
+            SELECT bucket_seconds, active_threads FROM (?) AS p
+            ORDER BY active_threads DESC, bucket_seconds ASC
+            LIMIT 1
+        )
+        SELECT peak.active_threads AS concurrent_threads,
+               peak.bucket_seconds AS timestamp_seconds,
+               ARRAY(
+                   SELECT DISTINCT thread_name
+                   FROM log_lines_per_second AS r
+                   WHERE r.bucket_seconds = peak.bucket_seconds AND r.thread_name IS NOT NULL AND ?
+                   ORDER BY thread_name
+               ) AS thread_names
+        FROM peak
+    `
+
+	_, err := db.QueryOneContext(ctx, &result, query, peak, threadNameCondition(request.ThreadName))
+	if err != nil && err != pg.ErrNoRows {
+		return nil, fmt.Errorf("failed to retrieve max concurrent threads: %w", err)
 	}
 
 	glog.Infoln(result)
@@ -95,25 +247,118 @@ func (s *StatsService) GetMaxConcurrentThreads() (*models.MaxConcurrentThreadsRe
 
 //----------------------------------------------------------------------------------------------------------------------
 
-// GetThreadLifetimeStats retrieves the average and standard deviation of thread lifetimes.
-func (s *StatsService) GetThreadLifetimeStats() (*models.ThreadLifetimeStatsResponse, error) {
-	glog.Infoln("Fetching thread lifetime stats from log_lines table")
+// GetThreadLifetimeStats retrieves the average and standard deviation of thread lifetimes along with the longest lived
+// thread.
+func (s *StatsService) GetThreadLifetimeStats(ctx context.Context,
+	request *models.ThreadLifetimeStatsRequest) (*models.ThreadLifetimeStatsResponse, error) {
+	glog.Infoln("Fetching thread lifetime stats from thread_lifetimes table")
+
+	db := s.readDB()
 
 	var result models.ThreadLifetimeStatsResponse
 
-	query := fmt.Sprintf(`
-        WITH thread_lifetimes AS (
-            SELECT MAX(timestamp_seconds) - MIN(timestamp_seconds) AS lifetime
-            FROM log_lines
+	query := `
+        WITH lifetimes AS (
+            SELECT MAX(last_seen_seconds) - MIN(first_seen_seconds) AS lifetime
+            FROM thread_lifetimes
+            WHERE ?
             GROUP BY thread_id
         )
         SELECT AVG(lifetime) AS average_lifetime, STDDEV(lifetime) AS stdev_lifetime
+        FROM lifetimes
+    `
+
+	_, err := db.QueryOneContext(ctx, &result, query, threadNameCondition(request.ThreadName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve thread lifetime stats: %w", err)
+	}
+
+	var longest models.ThreadLifetimeEntry
+	longestQuery := `
+        SELECT process_id, thread_id, COALESCE(thread_name, '') AS thread_name,
+               last_seen_seconds - first_seen_seconds AS lifetime_seconds
         FROM thread_lifetimes
-    `)
+        WHERE ?
+        ORDER BY lifetime_seconds DESC, process_id, thread_id
+        LIMIT 1
+    `
+	_, err = db.QueryOneContext(ctx, &longest, longestQuery, threadNameCondition(request.ThreadName))
+	if err == nil {
+		result.LongestLivedThread = &longest
+	} else if err != pg.ErrNoRows {
+		return nil, fmt.Errorf("failed to retrieve longest lived thread: %w", err)
+	}
+
+	glog.Infoln(result)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTop retrieves the top N processes, threads or thread names with the most lines or bytes in the time window. Each entry is
+// compared against the previous window of equal length which ends right before the requested window starts.
+func (s *StatsService) GetTop(ctx context.Context, request *models.TopRequest) (*models.TopResponse, error) {
+	glog.Infoln("Fetching top", request.N, request.By, "by", request.Metric, "from rollup tables")
+
+	db := s.readDB()
+
+	dimension, ok := topDimensions[request.By]
+	if !ok {
+		return nil, fmt.Errorf("unsupported top dimension: %s", request.By)
+	}
+	metric, ok := topMetrics[request.Metric]
+	if !ok {
+		return nil, fmt.Errorf("unsupported top metric: %s", request.Metric)
+	}
+
+	// The previous window has the same length as the requested window.
+	windowLength := request.EndTimeSeconds - request.StartTimeSeconds + 1
+	result := models.TopResponse{
+		By:                       request.By,
+		Metric:                   request.Metric,
+		StartTimeSeconds:         request.StartTimeSeconds,
+		EndTimeSeconds:           request.EndTimeSeconds,
+		PreviousStartTimeSeconds: request.StartTimeSeconds - windowLength,
+		PreviousEndTimeSeconds:   request.StartTimeSeconds - 1,
+		Entries:                  []models.TopEntry{},
+	}
+
+	columns := pg.Safe(fmt.Sprintf("%s AS key, %s AS value", dimension, metric))
+	current := rollupRange(string(columns), result.StartTimeSeconds, result.EndTimeSeconds, request.ThreadName)
+	previous := rollupRange(string(columns), result.PreviousStartTimeSeconds, result.PreviousEndTimeSeconds,
+		request.ThreadName)
+
+	// Totals for both the windows. These are needed for the share of total percentages.
+	totalsQuery := `
+        SELECT (SELECT COALESCE(SUM(value), 0) FROM (?) AS c) AS total,
+               (SELECT COALESCE(SUM(value), 0) FROM (?) AS p) AS previous_total
+    `
+	_, err := db.QueryOneContext(ctx, &result, totalsQuery, current, previous)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve top totals: %w", err)
+	}
 
-	_, err := s.DB.QueryOne(&result, query)
+	query := `
+        WITH current_window AS (
+            SELECT key, SUM(value) AS value FROM (?) AS c GROUP BY key
+        ), previous_window AS (
+            SELECT key, SUM(value) AS value FROM (?) AS p GROUP BY key
+        )
+        SELECT c.key,
+               c.value,
+               100.0 * c.value / NULLIF(?, 0) AS share_percent,
+               COALESCE(p.value, 0) AS previous_value,
+               COALESCE(100.0 * p.value / NULLIF(?, 0), 0) AS previous_share_percent,
+               100.0 * (c.value - p.value) / NULLIF(p.value, 0) AS change_percent
+        FROM current_window c
+        LEFT JOIN previous_window p ON p.key = c.key
+        ORDER BY c.value DESC, c.key
+        LIMIT ?
+    `
+	_, err = db.QueryContext(ctx, &result.Entries, query, current, previous, result.Total, result.PreviousTotal,
+		request.N)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve thread lifetime stats: %v", err)
+		return nil, fmt.Errorf("failed to retrieve top %s: %w", request.By, err)
 	}
 
 	glog.Infoln(result)
@@ -121,3 +366,345 @@ func (s *StatsService) GetThreadLifetimeStats() (*models.ThreadLifetimeStatsResp
 }
 
 //----------------------------------------------------------------------------------------------------------------------
+
+// GetAttributeCounts counts the lines grouped by the extracted attributes in the time window. The attributes are not
+// part of the rollups, so this reads the raw log_lines table. The containment filters are served by the GIN index on
+// the attributes column.
+func (s *StatsService) GetAttributeCounts(ctx context.Context,
+	request *models.AttributeCountsRequest) (*models.AttributeCountsResponse, error) {
+	glog.Infoln("Fetching attribute counts from log_lines table")
+
+	db := s.readDB()
+
+	interval, ok := AttributeIntervals[request.Interval]
+	if !ok {
+		return nil, fmt.Errorf("unsupported interval: %s", request.Interval)
+	}
+
+	var params []interface{}
+
+	// The bucket is the start of the interval. Without an interval the whole time range is a single bucket.
+	if interval > 0 {
+		params = append(params, pg.SafeQuery("timestamp_seconds - timestamp_seconds % ?", interval))
+	} else {
+		params = append(params, pg.SafeQuery("?::BIGINT", request.StartTimeSeconds))
+	}
+
+	// The grouped attributes are returned as a json object.
+	var pairs []string
+	for _, name := range request.GroupBy {
+		pairs = append(pairs, "?, attributes->>?")
+		params = append(params, name, name)
+	}
+
+	conditions := []string{"timestamp_seconds >= ?", "timestamp_seconds <= ?", "?"}
+	params = append(params, request.StartTimeSeconds, request.EndTimeSeconds,
+		threadNameCondition(request.ThreadName))
+
+	// Only the lines with all the grouped attributes are counted.
+	for _, name := range request.GroupBy {
+		conditions = append(conditions, "attributes->>? IS NOT NULL")
+		params = append(params, name)
+	}
+
+	// The "name=value" filters are combined into a single containment filter. The "name" filters only need the
+	// attribute to be present.
+	values := make(map[string]string)
+	for _, filter := range request.Filters {
+		name, value, hasValue := cutAttributeFilter(filter)
+		if !hasValue {
+			conditions = append(conditions, "attributes->>? IS NOT NULL")
+			params = append(params, name)
+			continue
+		}
+		values[name] = value
+	}
+	if len(values) > 0 {
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode attribute filters: %v", err)
+		}
+		conditions = append(conditions, "attributes @> ?::JSONB")
+		params = append(params, string(encoded))
+	}
+
+	query := fmt.Sprintf(`
+        SELECT ? AS bucket_seconds,
+               jsonb_build_object(%s) AS attributes,
+               COUNT(*) AS count
+        FROM log_lines
+        WHERE %s
+        GROUP BY 1, 2
+        ORDER BY 1, 3 DESC
+        LIMIT ?
+    `, strings.Join(pairs, ", "), strings.Join(conditions, " AND "))
+	params = append(params, maxAttributeCounts)
+
+	result := models.AttributeCountsResponse{
+		GroupBy:  request.GroupBy,
+		Interval: request.Interval,
+		Counts:   []models.AttributeCount{},
+	}
+	_, err := db.QueryContext(ctx, &result.Counts, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve attribute counts: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Counts), "attribute counts")
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplates retrieves the log templates mined by the stats worker.
+func (s *StatsService) GetTemplates(ctx context.Context,
+	request *models.TemplatesRequest) (*models.TemplatesResponse, error) {
+	glog.Infoln("Fetching log templates from log_templates table")
+
+	db := s.readDB()
+
+	order, ok := TemplatesOrder[request.OrderBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported templates order: %s", request.OrderBy)
+	}
+
+	result := models.TemplatesResponse{Templates: []models.LogTemplate{}}
+	query := db.ModelContext(ctx, &result.Templates).
+		Order(order, "template_id ASC").
+		Limit(request.Limit)
+	if request.NewSinceSeconds > 0 {
+		query = query.Where("first_seen_seconds >= ?", request.NewSinceSeconds)
+	}
+
+	if err := query.Select(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve log templates: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Templates), "log templates")
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplateLines retrieves the most recent log lines of a template.
+func (s *StatsService) GetTemplateLines(ctx context.Context,
+	request *models.TemplateLinesRequest) (*models.TemplateLinesResponse, error) {
+	glog.Infoln("Fetching log lines of template", request.TemplateID)
+
+	db := s.readDB()
+
+	result := models.TemplateLinesResponse{Lines: []models.TemplateLine{}}
+
+	err := db.ModelContext(ctx, &result.Template).Where("template_id = ?", request.TemplateID).Select()
+	if err == pg.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve log template: %w", err)
+	}
+
+	query := db.ModelContext(ctx, (*schema.LogLine)(nil)).
+		Column("process_id", "thread_id", "timestamp", "timestamp_seconds", "log_message", "attributes").
+		ColumnExpr("COALESCE(thread_name, '') AS thread_name").
+		Where("template_id = ?", request.TemplateID).
+		Where("timestamp_seconds >= ?", request.StartTimeSeconds).
+		Where("?", threadNameCondition(request.ThreadName)).
+		Order("timestamp_seconds DESC", "timestamp DESC").
+		Limit(request.Limit)
+	if request.EndTimeSeconds > 0 {
+		query = query.Where("timestamp_seconds <= ?", request.EndTimeSeconds)
+	}
+
+	if err := query.Select(&result.Lines); err != nil {
+		return nil, fmt.Errorf("failed to retrieve log lines of template: %w", err)
+	}
+
+	glog.Infoln("Fetched", len(result.Lines), "log lines of template", request.TemplateID)
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetPartitions lists the partitions of the log_lines table with their row counts and sizes.
+func (s *StatsService) GetPartitions(ctx context.Context,
+	request *models.PartitionsRequest) (*models.PartitionsResponse, error) {
+	glog.Infoln("Fetching partitions of log_lines table")
+
+	db := s.readDB()
+
+	partitions, err := schema.ListPartitions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	result := models.PartitionsResponse{Exact: request.Exact, Partitions: []models.Partition{}}
+	for _, partition := range partitions {
+		rowCount := partition.EstimatedRows
+		if request.Exact {
+			rowCount, err = schema.CountPartitionRows(ctx, db, partition.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result.Partitions = append(result.Partitions, models.Partition{
+			Name:         partition.Name,
+			StartSeconds: partition.StartSeconds,
+			EndSeconds:   partition.EndSeconds,
+			IsDefault:    partition.IsDefault,
+			RowCount:     rowCount,
+			TotalBytes:   partition.TotalBytes,
+		})
+	}
+
+	glog.Infoln("Fetched", len(result.Partitions), "partitions")
+	return &result, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// readDB is a helper function to return the go-pg object on which the read queries of an api call run.
+func (s *StatsService) readDB() *pg.DB {
+	if s.reader == nil {
+		return s.DB
+	}
+	return s.reader.Reader()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// IsTimeout checks if the error is caused by a query which ran out of time. That is either the deadline of the context,
+// the statement_timeout of postgres or the max_execution_time of ClickHouse.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var chErr *clickhouse.Exception
+	if errors.As(err, &chErr) {
+		return chErr.Code == clickHouseTimeoutExceeded
+	}
+
+	var pgErr pg.Error
+	return errors.As(err, &pgErr) && pgErr.Field('C') == queryCanceled
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// cutAttributeFilter is a helper function to split an attribute filter of the form "name=value" into the name and
+// the value. The last return value is false if the filter is just a "name".
+func cutAttributeFilter(filter string) (string, string, bool) {
+	index := strings.Index(filter, "=")
+	if index < 0 {
+		return filter, "", false
+	}
+	return filter[:index], filter[index+1:], true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// rollupRange is a helper function to build a sub query which selects the given columns from the rollup tables for the
+// time range [start, end]. The minutes which are fully covered by the time range are read from the per minute rollup
+// and the remaining seconds at the edges of the time range are read from the per second rollup. The rows are
+// optionally filtered by thread name.
+func rollupRange(columns string, start int64, end int64, threadName string) *orm.SafeQueryAppender {
+	minuteStart, minuteEnd := splitMinuteRange(start, end)
+	return pg.SafeQuery(`
+            SELECT ?0 FROM log_lines_per_minute
+            WHERE bucket_seconds >= ?1 AND bucket_seconds < ?2 AND ?5
+            UNION ALL
+            SELECT ?0 FROM log_lines_per_second
+            WHERE ((bucket_seconds >= ?3 AND bucket_seconds < ?1) OR (bucket_seconds >= ?2 AND bucket_seconds <= ?4))
+              AND ?5`,
+		pg.Safe(columns), minuteStart, minuteEnd, start, end, threadNameCondition(threadName))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// threadNameCondition is a helper function to build the condition for the thread name filter. An empty thread name
+// matches all the rows.
+func threadNameCondition(threadName string) *orm.SafeQueryAppender {
+	if threadName == "" {
+		return pg.SafeQuery("TRUE")
+	}
+	return pg.SafeQuery("thread_name = ?", threadName)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// splitMinuteRange is a helper function to split the time range [start, end] into the minutes which are fully covered
+// by the range. The returned minute range is [minuteStart, minuteEnd). The seconds in [start, minuteStart) and
+// [minuteEnd, end] are not covered by a full minute. If there is no full minute in the time range, both minuteStart
+// and minuteEnd point to end + 1.
+func splitMinuteRange(start int64, end int64) (int64, int64) {
+	minuteStart := start
+	if rem := start % 60; rem != 0 {
+		minuteStart = start - rem + 60
+	}
+	minuteEnd := (end + 1) - (end+1)%60
+
+	if minuteStart >= minuteEnd {
+		return end + 1, end + 1
+	}
+
+	return minuteStart, minuteEnd
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// rankTop is a helper function to fill the entries of the top response from the values of the current and the
+// previous window. It is used by the backends which aggregate the windows separately.
+func rankTop(result *models.TopResponse, current map[string]int64, previous map[string]int64, n int) {
+	for _, value := range current {
+		result.Total += value
+	}
+	for _, value := range previous {
+		result.PreviousTotal += value
+	}
+
+	for key, value := range current {
+		entry := models.TopEntry{Key: key, Value: value, PreviousValue: previous[key]}
+		if result.Total > 0 {
+			entry.SharePercent = 100.0 * float64(value) / float64(result.Total)
+		}
+		if result.PreviousTotal > 0 {
+			entry.PreviousSharePercent = 100.0 * float64(entry.PreviousValue) / float64(result.PreviousTotal)
+		}
+		if entry.PreviousValue != 0 {
+			change := 100.0 * float64(value-entry.PreviousValue) / float64(entry.PreviousValue)
+			entry.ChangePercent = &change
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+
+	sort.Slice(result.Entries, func(i, j int) bool {
+		if result.Entries[i].Value != result.Entries[j].Value {
+			return result.Entries[i].Value > result.Entries[j].Value
+		}
+		return result.Entries[i].Key < result.Entries[j].Key
+	})
+	if len(result.Entries) > n {
+		result.Entries = result.Entries[:n]
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// atoiAll is a helper function to convert the ids to integers. An empty list is nil like in the postgres response.
+func atoiAll(values []string) ([]int, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	ints := make([]int, 0, len(values))
+	for _, value := range values {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,59 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the health endpoints of the api server.
+//
+// 1. /healthz (liveness): The process is alive and serving http.
+// 2. /readyz (readiness): The dependencies are reachable. That is the storage backend. The orchestrator should hold the traffic
+//    until the api server is ready.
+//
+// Both the endpoints respond with 200 if all the checks pass and 503 otherwise.
+
+package web
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/labstack/echo/v4"
+
+	"apiserver/internal/models"
+)
+
+// checkTimeout is the maximum time a single readiness check can take.
+const checkTimeout = 2 * time.Second
+
+// HealthzHandler handles the liveness endpoint.
+func (server *Server) HealthzHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, &models.HealthResponse{
+		Status: models.HealthStatusOK,
+		Checks: map[string]string{},
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ReadyzHandler handles the readiness endpoint.
+func (server *Server) ReadyzHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), checkTimeout)
+	defer cancel()
+
+	resp := &models.HealthResponse{
+		Status: models.HealthStatusOK,
+		Checks: map[string]string{"storage": models.HealthStatusOK},
+	}
+
+	if err := server.statsService.Ping(ctx); err != nil {
+		glog.Warningf("readiness check failed: %v", err)
+		resp.Status = models.HealthStatusUnavailable
+		resp.Checks["storage"] = err.Error()
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,43 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the echo middleware which records the request metrics.
+
+package web
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"apiserver/internal/metrics"
+)
+
+// metricsMiddleware records the number of requests and the latency per route.
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		// Let echo write the error response so that the status code is final.
+		if err != nil {
+			c.Error(err)
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = metrics.RouteUnmatched
+		}
+		method := c.Request().Method
+		code := strconv.Itoa(c.Response().Status)
+
+		metrics.RequestsTotal.WithLabelValues(route, method, code).Inc()
+		metrics.RequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+
+		return nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
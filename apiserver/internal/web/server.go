@@ -9,15 +9,38 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+
+	"common/configutil"
 
 	"apiserver/internal/config"
 	"apiserver/internal/models"
 	services "apiserver/internal/services"
+	"apiserver/internal/tracing"
+)
+
+const (
+	// defaultTopN is the number of entries returned by the top api when n is not specified.
+	defaultTopN = 10
+
+	// maxTopN is the maximum number of entries that can be requested from the top api.
+	maxTopN = 1000
+
+	// maxAttributeGroupBy is the maximum number of attributes the attribute counts api can group by.
+	maxAttributeGroupBy = 5
+
+	// defaultLimit is the number of entries returned by the list apis when the limit is not specified.
+	defaultLimit = 100
+
+	// maxLimit is the maximum number of entries that can be requested from the list apis.
+	maxLimit = 10000
 )
 
 // Server defines the struct that encapsulates all the necessary injections to start the web server.
@@ -30,6 +53,9 @@ type Server struct {
 
 	// The configuration object.
 	conf *viper.Viper
+
+	// live holds the *viper.Viper of the last reload, the timeouts of the apis are read from it.
+	live atomic.Value
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -40,24 +66,43 @@ func NewWebServer(ec *echo.Echo, statsService services.StatsServicer, conf *vipe
 	ws.ec = ec
 	ws.statsService = statsService
 	ws.conf = conf
+	ws.live.Store(conf)
 	return ws
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
+// Reload applies the reloaded timeouts of the apis to the next requests. It is registered with the configuration
+// reloader.
+func (server *Server) Reload(conf *viper.Viper) {
+	server.live.Store(conf)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
 // StartServer starts the Echo server.
-func StartServer(conf *viper.Viper, statsService services.StatsServicer) {
+func StartServer(conf *viper.Viper, statsService services.StatsServicer, reloader *configutil.Reloader) {
 	// Initialize Echo instance
 	ec := echo.New()
 
 	// Create the web server object.
 	webServer := NewWebServer(ec, statsService, conf)
+	reloader.OnReload(webServer.Reload)
 
 	// Middleware
 	webServer.ec.Use(middleware.Logger())
 	webServer.ec.Use(middleware.Recover())
+	webServer.ec.Use(metricsMiddleware)
+	webServer.ec.Use(otelecho.Middleware(tracing.ServiceName, otelecho.WithSkipper(skipTracing)))
 
 	// Routes
+	// Prometheus metrics.
+	webServer.ec.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	// Liveness and readiness checks.
+	webServer.ec.GET("/healthz", webServer.HealthzHandler)
+	webServer.ec.GET("/readyz", webServer.ReadyzHandler)
+
 	// Basic api requested in assignment.
 	webServer.ec.GET("/basicStats", webServer.BasicStatsAPIHandler)
 
@@ -65,6 +110,20 @@ func StartServer(conf *viper.Viper, statsService services.StatsServicer) {
 	webServer.ec.GET("/maxConcurrentThreads", webServer.GetMaxConcurrentThreadsHandler)
 	webServer.ec.GET("/threadLifetimeStats", webServer.GetThreadLifetimeStatsHandler)
 
+	// Top N noisy processes and threads.
+	webServer.ec.GET("/top", webServer.GetTopHandler)
+
+	// Counts grouped by the attributes extracted from the log messages.
+	webServer.ec.GET("/attributeCounts", webServer.GetAttributeCountsHandler)
+
+	// Log templates mined by the stats worker and their lines.
+	webServer.ec.GET("/templates", webServer.GetTemplatesHandler)
+	webServer.ec.GET("/templates/:id/lines", webServer.GetTemplateLinesHandler)
+
+	// Administration of the log_lines table.
+	admin := webServer.ec.Group("/admin")
+	admin.GET("/partitions", webServer.GetPartitionsHandler)
+
 	// Start web server.
 	addr := fmt.Sprintf(":%d", conf.GetInt(config.KWebServerPort))
 	glog.Infoln("Starting web server on port :", addr)
@@ -73,6 +132,18 @@ func StartServer(conf *viper.Viper, statsService services.StatsServicer) {
 
 //----------------------------------------------------------------------------------------------------------------------
 
+// skipTracing is a helper function to skip the tracing of the operational endpoints. These are scraped every few
+// seconds and would drown the traces of the apis.
+func skipTracing(c echo.Context) bool {
+	switch c.Path() {
+	case "/metrics", "/healthz", "/readyz":
+		return true
+	}
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
 // BasicStatsAPIHandler is a handler.
 func (server *Server) BasicStatsAPIHandler(c echo.Context) error {
 
@@ -84,11 +155,14 @@ func (server *Server) BasicStatsAPIHandler(c echo.Context) error {
 
 	glog.Infoln("Received request for basic stats handler ", req)
 
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiBasicStats)
+	defer cancel()
+
 	// Call the GetBasicStats method on the statsService
-	resp, err := server.statsService.GetBasicStats(req)
+	resp, err := server.statsService.GetBasicStats(ctx, req)
 	if err != nil {
-		glog.Errorln(err.Error())
-		return c.JSON(http.StatusInternalServerError, "Failed to retrieve stats")
+		return server.errorResponse(c, ctx, apiBasicStats, err, "Failed to retrieve stats")
 	}
 
 	return c.JSON(http.StatusOK, resp)
@@ -98,11 +172,21 @@ func (server *Server) BasicStatsAPIHandler(c echo.Context) error {
 
 // GetMaxConcurrentThreadsHandler handles the maxConcurrentThreads API.
 func (server *Server) GetMaxConcurrentThreadsHandler(c echo.Context) error {
+	// Parse the optional filters into the MaxConcurrentThreadsRequest struct.
+	req := new(models.MaxConcurrentThreadsRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid request")
+	}
+
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiMaxConcurrentThreads)
+	defer cancel()
+
 	// Call the GetMaxConcurrentThreads method on the statsService
-	resp, err := server.statsService.GetMaxConcurrentThreads()
+	resp, err := server.statsService.GetMaxConcurrentThreads(ctx, req)
 	if err != nil {
-		glog.Errorln(err.Error())
-		return c.JSON(http.StatusInternalServerError, "Failed to retrieve max concurrent threads")
+		return server.errorResponse(c, ctx, apiMaxConcurrentThreads, err,
+			"Failed to retrieve max concurrent threads")
 	}
 
 	return c.JSON(http.StatusOK, resp)
@@ -112,15 +196,215 @@ func (server *Server) GetMaxConcurrentThreadsHandler(c echo.Context) error {
 
 // GetThreadLifetimeStatsHandler handles the threadLifetimeStats API.
 func (server *Server) GetThreadLifetimeStatsHandler(c echo.Context) error {
+	// Parse the optional filters into the ThreadLifetimeStatsRequest struct.
+	req := new(models.ThreadLifetimeStatsRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid request")
+	}
+
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiThreadLifetimeStats)
+	defer cancel()
+
 	// Call the GetThreadLifetimeStats method on the statsService
-	resp, err := server.statsService.GetThreadLifetimeStats()
+	resp, err := server.statsService.GetThreadLifetimeStats(ctx, req)
+	if err != nil {
+		return server.errorResponse(c, ctx, apiThreadLifetimeStats, err,
+			"Failed to retrieve thread lifetime stats")
+	}
+
+	return c.JSON(http.StatusOK, resp)
+
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTopHandler handles the top api.
+func (server *Server) GetTopHandler(c echo.Context) error {
+
+	// Parse the request into the TopRequest struct. The defaults are overridden by the request.
+	req := &models.TopRequest{
+		N:      defaultTopN,
+		By:     models.TopByProcess,
+		Metric: models.TopMetricLines,
+	}
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid request")
+	}
+
+	glog.Infoln("Received request for top handler ", req)
+
+	if req.N <= 0 || req.N > maxTopN {
+		return c.JSON(http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", maxTopN))
+	}
+	if req.By != models.TopByProcess && req.By != models.TopByThread && req.By != models.TopByThreadName {
+		return c.JSON(http.StatusBadRequest, "by must be one of process, thread, thread_name")
+	}
+	if req.Metric != models.TopMetricLines && req.Metric != models.TopMetricBytes {
+		return c.JSON(http.StatusBadRequest, "metric must be one of lines, bytes")
+	}
+	if req.EndTimeSeconds < req.StartTimeSeconds {
+		return c.JSON(http.StatusBadRequest, "end_time_seconds must not be before start_time_seconds")
+	}
+
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiTop)
+	defer cancel()
+
+	// Call the GetTop method on the statsService
+	resp, err := server.statsService.GetTop(ctx, req)
+	if err != nil {
+		return server.errorResponse(c, ctx, apiTop, err, "Failed to retrieve top")
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetAttributeCountsHandler handles the attributeCounts API.
+func (server *Server) GetAttributeCountsHandler(c echo.Context) error {
+
+	// Parse the request into the AttributeCountsRequest struct.
+	req := new(models.AttributeCountsRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid request")
+	}
+
+	glog.Infoln("Received request for attribute counts handler ", req)
+
+	if req.EndTimeSeconds < req.StartTimeSeconds {
+		return c.JSON(http.StatusBadRequest, "end_time_seconds must not be before start_time_seconds")
+	}
+	if _, ok := services.AttributeIntervals[req.Interval]; !ok {
+		return c.JSON(http.StatusBadRequest, "interval must be one of second, minute, hour, day")
+	}
+	if len(req.GroupBy) > maxAttributeGroupBy {
+		return c.JSON(http.StatusBadRequest, fmt.Sprintf("at most %d group_by attributes are allowed",
+			maxAttributeGroupBy))
+	}
+	for _, name := range req.GroupBy {
+		if name == "" {
+			return c.JSON(http.StatusBadRequest, "group_by must not contain empty attribute names")
+		}
+	}
+	for _, filter := range req.Filters {
+		if filter == "" || filter[0] == '=' {
+			return c.JSON(http.StatusBadRequest, "filter must be of the form name=value or name")
+		}
+	}
+
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiAttributeCounts)
+	defer cancel()
+
+	// Call the GetAttributeCounts method on the statsService
+	resp, err := server.statsService.GetAttributeCounts(ctx, req)
 	if err != nil {
-		glog.Errorln(err.Error())
-		return c.JSON(http.StatusInternalServerError, "Failed to retrieve thread lifetime stats")
+		return server.errorResponse(c, ctx, apiAttributeCounts, err, "Failed to retrieve attribute counts")
 	}
 
 	return c.JSON(http.StatusOK, resp)
+}
 
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplatesHandler handles the templates API.
+func (server *Server) GetTemplatesHandler(c echo.Context) error {
+
+	// Parse the request into the TemplatesRequest struct. The defaults are overridden by the request.
+	req := &models.TemplatesRequest{
+		OrderBy: models.TemplatesOrderByLineCount,
+		Limit:   defaultLimit,
+	}
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid request")
+	}
+
+	glog.Infoln("Received request for templates handler ", req)
+
+	if _, ok := services.TemplatesOrder[req.OrderBy]; !ok {
+		return c.JSON(http.StatusBadRequest, "order_by must be one of line_count, first_seen, last_seen")
+	}
+	if req.Limit <= 0 || req.Limit > maxLimit {
+		return c.JSON(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+	}
+
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiTemplates)
+	defer cancel()
+
+	// Call the GetTemplates method on the statsService
+	resp, err := server.statsService.GetTemplates(ctx, req)
+	if err != nil {
+		return server.errorResponse(c, ctx, apiTemplates, err, "Failed to retrieve templates")
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetTemplateLinesHandler handles the template lines API.
+func (server *Server) GetTemplateLinesHandler(c echo.Context) error {
+
+	// Parse the request into the TemplateLinesRequest struct. The defaults are overridden by the request.
+	req := &models.TemplateLinesRequest{
+		Limit: defaultLimit,
+	}
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid request")
+	}
+
+	glog.Infoln("Received request for template lines handler ", req)
+
+	if req.Limit <= 0 || req.Limit > maxLimit {
+		return c.JSON(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+	}
+	if req.EndTimeSeconds != 0 && req.EndTimeSeconds < req.StartTimeSeconds {
+		return c.JSON(http.StatusBadRequest, "end_time_seconds must not be before start_time_seconds")
+	}
+
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiTemplateLines)
+	defer cancel()
+
+	// Call the GetTemplateLines method on the statsService
+	resp, err := server.statsService.GetTemplateLines(ctx, req)
+	if err == services.ErrNotFound {
+		return c.JSON(http.StatusNotFound, "Template not found")
+	}
+	if err != nil {
+		return server.errorResponse(c, ctx, apiTemplateLines, err, "Failed to retrieve template lines")
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// GetPartitionsHandler handles the partitions admin API.
+func (server *Server) GetPartitionsHandler(c echo.Context) error {
+
+	// Parse the optional exact flag into the PartitionsRequest struct.
+	req := new(models.PartitionsRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, "Invalid request")
+	}
+
+	glog.Infoln("Received request for partitions handler ", req)
+
+	// The context is cancelled when the api times out or the client disconnects.
+	ctx, cancel := server.requestContext(c, apiPartitions)
+	defer cancel()
+
+	// Call the GetPartitions method on the statsService
+	resp, err := server.statsService.GetPartitions(ctx, req)
+	if err != nil {
+		return server.errorResponse(c, ctx, apiPartitions, err, "Failed to retrieve partitions")
+	}
+
+	return c.JSON(http.StatusOK, resp)
 }
 
 //----------------------------------------------------------------------------------------------------------------------
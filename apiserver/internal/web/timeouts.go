@@ -0,0 +1,97 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the timeouts of the apis.
+//
+// Every api runs its queries with a context which is derived from the context of the http request. So the queries are
+// cancelled in the following cases.
+//
+// 1. The client disconnects. There is nobody to read the response, so the query is cancelled right away.
+// 2. The api runs out of time. The timeout of every api is configured under apiserver.timeouts in defaults.yaml. The
+//    client gets a 504 with a clear error. The timeouts can be changed without a restart, they are reloaded with the
+//    configuration.
+//
+// go-pg sends a cancel request to postgres when the context is done, so the query does not keep running on the
+// server. In addition the statement_timeout of the postgres session bounds every query.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"apiserver/internal/config"
+	services "apiserver/internal/services"
+)
+
+// The names of the apis under apiserver.timeouts in defaults.yaml.
+const (
+	apiBasicStats           = "basic_stats"
+	apiMaxConcurrentThreads = "max_concurrent_threads"
+	apiThreadLifetimeStats  = "thread_lifetime_stats"
+	apiTop                  = "top"
+	apiAttributeCounts      = "attribute_counts"
+	apiTemplates            = "templates"
+	apiTemplateLines        = "template_lines"
+	apiPartitions           = "partitions"
+)
+
+// statusClientClosedRequest is the status code recorded when the client disconnects before the response is ready.
+// This is not a standard status code, but it is widely used for this purpose.
+const statusClientClosedRequest = 499
+
+// requestContext returns the context for the queries of the api. The context is cancelled when the client
+// disconnects or the timeout of the api expires. The caller must call the cancel function.
+func (server *Server) requestContext(c echo.Context, api string) (context.Context, context.CancelFunc) {
+	timeout := server.timeout(api)
+	if timeout <= 0 {
+		return context.WithCancel(c.Request().Context())
+	}
+	return context.WithTimeout(c.Request().Context(), timeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// errorResponse writes the response for an error returned by the stats service. The timeouts are reported as 504 and
+// all the other errors as 500 with the given message.
+func (server *Server) errorResponse(c echo.Context, ctx context.Context, api string, err error, message string) error {
+	glog.Errorln(err.Error())
+
+	// The client is gone, nobody reads the response.
+	if errors.Is(c.Request().Context().Err(), context.Canceled) {
+		return c.NoContent(statusClientClosedRequest)
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return c.JSON(http.StatusGatewayTimeout, fmt.Sprintf("%s: query timed out after %s", message,
+			server.timeout(api)))
+	}
+	if services.IsTimeout(err) {
+		return c.JSON(http.StatusGatewayTimeout, fmt.Sprintf("%s: query exceeded the statement timeout", message))
+	}
+
+	return c.JSON(http.StatusInternalServerError, message)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// timeout is a helper function to get the timeout of the api. The apis without a timeout use the default timeout.
+// A timeout of zero means no timeout. The timeouts are read from the last reloaded configuration.
+func (server *Server) timeout(api string) time.Duration {
+	conf := server.live.Load().(*viper.Viper)
+	key := config.KTimeouts + "." + api
+	if conf.IsSet(key) {
+		return conf.GetDuration(key)
+	}
+	return conf.GetDuration(config.KDefaultTimeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
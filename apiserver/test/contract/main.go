@@ -0,0 +1,748 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file for the api contract test of the storage backends.
+//
+// The apis read from postgres or ClickHouse depending on the configuration. Both the backends must return the same
+// responses for the same log lines. This test checks that contract.
+//
+// It performs the following steps:
+// 1. Start postgres and ClickHouse in local docker containers. SQLite is embedded and needs no container.
+// 2. Write a small fixture of log lines through the storage.Writer of each backend, the same way the stats worker
+//    does. The fixture contains a redelivered line which must not be counted twice.
+// 3. Call every api of the stats service of each backend and compare the response against the expected response.
+// 4. Remove the containers.
+//
+// The template ids are assigned by the backend, so the templates are compared by their text. For example,
+//
+//     cd apiserver
+//     go run ./test/contract
+//
+// The containers can be skipped with -docker=false to run against postgres and ClickHouse started by hand. The backends
+// are selected with -backends. SQLite alone needs neither docker nor a database server,
+//
+//     go run ./test/contract -backends sqlite
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/go-pg/pg/v10"
+	"github.com/spf13/viper"
+
+	"common/schema"
+	"common/storage"
+
+	"apiserver/internal/models"
+	services "apiserver/internal/services"
+)
+
+const (
+	// s0 is the start of the fixture. It is an hour into the day of the sample logs and is aligned to a minute.
+	s0 = 1596934800
+
+	// The credentials of the databases in the containers.
+	username = "suresh"
+	password = "suresh"
+	database = "olap"
+
+	// startupTimeout is the maximum time to wait for a container to accept connections.
+	startupTimeout = 2 * time.Minute
+)
+
+// The templates of the fixture.
+const (
+	templateConnected = "Connected to host <*>"
+	templateRequest   = "Request took <*> ms"
+	templateShutdown  = "Shutting down"
+)
+
+// fixtureLine is a single log line of the fixture.
+type fixtureLine struct {
+	processID  string
+	threadID   string
+	threadName string
+	offset     time.Duration
+	message    string
+	attributes map[string]string
+	template   string
+	tokenCount int
+}
+
+// fixture is the log lines written to both the backends in the order of delivery. The last line is a redelivery.
+var fixture = []fixtureLine{
+	{"100", "1", "main", 100 * time.Millisecond, "Connected to host db1", map[string]string{"host": "db1"},
+		templateConnected, 4},
+	{"100", "2", "worker", 200 * time.Millisecond, "Connected to host db2", map[string]string{"host": "db2"},
+		templateConnected, 4},
+	{"200", "1", "main", time.Second, "Request took 15 ms", map[string]string{"latency_ms": "15"},
+		templateRequest, 4},
+	{"100", "1", "main", 61500 * time.Millisecond, "Request took 20 ms", map[string]string{"latency_ms": "20"},
+		templateRequest, 4},
+	{"100", "2", "worker", 2 * time.Second, "Connected to host db1", map[string]string{"host": "db1"},
+		templateConnected, 4},
+	{"200", "3", "", 120 * time.Second, "Shutting down", map[string]string{}, templateShutdown, 2},
+	{"200", "1", "main", time.Second, "Request took 15 ms", map[string]string{"latency_ms": "15"},
+		templateRequest, 4},
+}
+
+// container is the docker container of a backend.
+type container struct {
+	name  string
+	image string
+	port  string
+	args  []string
+}
+
+// containers are the docker containers of the backends which run as a server. SQLite is embedded.
+var containers = map[string]container{
+	storage.BackendPostgres: {
+		name: "contract-postgres", image: "postgres:13", port: "5432",
+		args: []string{"-e", "POSTGRES_USER=" + username, "-e", "POSTGRES_PASSWORD=" + password,
+			"-e", "POSTGRES_DB=" + database},
+	},
+	storage.BackendClickHouse: {
+		name: "contract-clickhouse", image: "clickhouse/clickhouse-server:23.8", port: "9000",
+		args: []string{"--ulimit", "nofile=262144:262144", "-e", "CLICKHOUSE_USER=" + username,
+			"-e", "CLICKHOUSE_PASSWORD=" + password, "-e", "CLICKHOUSE_DB=" + database},
+	},
+}
+
+// backend is a storage backend under test.
+type backend struct {
+	name    string
+	writer  storage.Writer
+	service services.StatsServicer
+
+	// templateIDs maps the text of a template to the id assigned by the backend.
+	templateIDs map[string]int64
+}
+
+// contractCase is a single api call and its expected response.
+type contractCase struct {
+	name string
+	run  func(ctx context.Context, backend *backend) (interface{}, error)
+
+	// Either the response or the error is expected.
+	expected    interface{}
+	expectedErr error
+}
+
+// contractCases are all the api calls checked by the test.
+var contractCases = []contractCase{
+	{
+		name: "basic stats",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetBasicStats(ctx, &models.BasicLogStatsRequest{
+				StartTimeSeconds: s0, EndTimeSeconds: s0 + 130})
+		},
+		expected: &models.BasicLogStatsResponse{
+			ActiveThreadsCount: 3,
+			ActiveThreadIDs:    []int{1, 2, 3},
+			ActiveProcessIDs:   []int{100, 200},
+			ActiveThreadNames:  []string{"", "main", "worker"},
+		},
+	},
+	{
+		name: "basic stats by thread name",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetBasicStats(ctx, &models.BasicLogStatsRequest{
+				StartTimeSeconds: s0, EndTimeSeconds: s0 + 130, ThreadName: "main"})
+		},
+		expected: &models.BasicLogStatsResponse{
+			ActiveThreadsCount: 1,
+			ActiveThreadIDs:    []int{1},
+			ActiveProcessIDs:   []int{100, 200},
+			ActiveThreadNames:  []string{"main"},
+		},
+	},
+	{
+		name: "basic stats without lines",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetBasicStats(ctx, &models.BasicLogStatsRequest{
+				StartTimeSeconds: s0 + 1000, EndTimeSeconds: s0 + 2000})
+		},
+		expected: &models.BasicLogStatsResponse{},
+	},
+	{
+		name: "max concurrent threads",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetMaxConcurrentThreads(ctx, &models.MaxConcurrentThreadsRequest{})
+		},
+		expected: &models.MaxConcurrentThreadsResponse{
+			ConcurrentThreads: 2,
+			TimestampSeconds:  s0,
+			ThreadNames:       []string{"main", "worker"},
+		},
+	},
+	{
+		name: "max concurrent threads by thread name",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetMaxConcurrentThreads(ctx, &models.MaxConcurrentThreadsRequest{
+				ThreadName: "worker"})
+		},
+		expected: &models.MaxConcurrentThreadsResponse{
+			ConcurrentThreads: 1,
+			TimestampSeconds:  s0,
+			ThreadNames:       []string{"worker"},
+		},
+	},
+	{
+		name: "thread lifetime stats",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetThreadLifetimeStats(ctx, &models.ThreadLifetimeStatsRequest{})
+		},
+		// The lifetimes per thread id are 61, 2 and 0 seconds.
+		expected: &models.ThreadLifetimeStatsResponse{
+			AverageLifetime: 21,
+			StdevLifetime:   math.Sqrt(1201),
+			LongestLivedThread: &models.ThreadLifetimeEntry{
+				ProcessID: "100", ThreadID: "1", ThreadName: "main", LifetimeSeconds: 61},
+		},
+	},
+	{
+		name: "thread lifetime stats by thread name",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetThreadLifetimeStats(ctx, &models.ThreadLifetimeStatsRequest{ThreadName: "main"})
+		},
+		expected: &models.ThreadLifetimeStatsResponse{
+			AverageLifetime: 61,
+			LongestLivedThread: &models.ThreadLifetimeEntry{
+				ProcessID: "100", ThreadID: "1", ThreadName: "main", LifetimeSeconds: 61},
+		},
+	},
+	{
+		name: "top processes by lines",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetTop(ctx, &models.TopRequest{
+				StartTimeSeconds: s0, EndTimeSeconds: s0 + 119, N: 10, By: models.TopByProcess,
+				Metric: models.TopMetricLines})
+		},
+		expected: &models.TopResponse{
+			By: models.TopByProcess, Metric: models.TopMetricLines,
+			StartTimeSeconds: s0, EndTimeSeconds: s0 + 119,
+			PreviousStartTimeSeconds: s0 - 120, PreviousEndTimeSeconds: s0 - 1,
+			Total: 5,
+			Entries: []models.TopEntry{
+				{Key: "100", Value: 4, SharePercent: 80},
+				{Key: "200", Value: 1, SharePercent: 20},
+			},
+		},
+	},
+	{
+		name: "top threads by bytes",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetTop(ctx, &models.TopRequest{
+				StartTimeSeconds: s0 + 60, EndTimeSeconds: s0 + 179, N: 10, By: models.TopByThread,
+				Metric: models.TopMetricBytes})
+		},
+		expected: &models.TopResponse{
+			By: models.TopByThread, Metric: models.TopMetricBytes,
+			StartTimeSeconds: s0 + 60, EndTimeSeconds: s0 + 179,
+			PreviousStartTimeSeconds: s0 - 60, PreviousEndTimeSeconds: s0 + 59,
+			Total: 31, PreviousTotal: 81,
+			Entries: []models.TopEntry{
+				{Key: "100:1", Value: 18, SharePercent: 100.0 * 18 / 31, PreviousValue: 21,
+					PreviousSharePercent: 100.0 * 21 / 81, ChangePercent: percent(100.0 * -3 / 21)},
+				{Key: "200:3", Value: 13, SharePercent: 100.0 * 13 / 31},
+			},
+		},
+	},
+	{
+		name: "top thread names by lines",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetTop(ctx, &models.TopRequest{
+				StartTimeSeconds: s0, EndTimeSeconds: s0 + 179, N: 2, By: models.TopByThreadName,
+				Metric: models.TopMetricLines})
+		},
+		expected: &models.TopResponse{
+			By: models.TopByThreadName, Metric: models.TopMetricLines,
+			StartTimeSeconds: s0, EndTimeSeconds: s0 + 179,
+			PreviousStartTimeSeconds: s0 - 180, PreviousEndTimeSeconds: s0 - 1,
+			Total: 6,
+			Entries: []models.TopEntry{
+				{Key: "main", Value: 3, SharePercent: 50},
+				{Key: "worker", Value: 2, SharePercent: 100.0 * 2 / 6},
+			},
+		},
+	},
+	{
+		name: "attribute counts per minute",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return sortCounts(backend.service.GetAttributeCounts(ctx, &models.AttributeCountsRequest{
+				StartTimeSeconds: s0, EndTimeSeconds: s0 + 179, GroupBy: []string{"host"}, Interval: "minute"}))
+		},
+		expected: &models.AttributeCountsResponse{
+			GroupBy:  []string{"host"},
+			Interval: "minute",
+			Counts: []models.AttributeCount{
+				{BucketSeconds: s0, Attributes: map[string]string{"host": "db1"}, Count: 2},
+				{BucketSeconds: s0, Attributes: map[string]string{"host": "db2"}, Count: 1},
+			},
+		},
+	},
+	{
+		name: "attribute counts with filters",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return sortCounts(backend.service.GetAttributeCounts(ctx, &models.AttributeCountsRequest{
+				StartTimeSeconds: s0, EndTimeSeconds: s0 + 179, GroupBy: []string{"latency_ms"},
+				Filters: []string{"latency_ms"}, ThreadName: "main"}))
+		},
+		expected: &models.AttributeCountsResponse{
+			GroupBy: []string{"latency_ms"},
+			Counts: []models.AttributeCount{
+				{BucketSeconds: s0, Attributes: map[string]string{"latency_ms": "15"}, Count: 1},
+				{BucketSeconds: s0, Attributes: map[string]string{"latency_ms": "20"}, Count: 1},
+			},
+		},
+	},
+	{
+		name: "attribute counts with value filter",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return sortCounts(backend.service.GetAttributeCounts(ctx, &models.AttributeCountsRequest{
+				StartTimeSeconds: s0, EndTimeSeconds: s0 + 179, Filters: []string{"latency_ms=20"}}))
+		},
+		expected: &models.AttributeCountsResponse{
+			Counts: []models.AttributeCount{
+				{BucketSeconds: s0, Attributes: map[string]string{}, Count: 1},
+			},
+		},
+	},
+	{
+		name: "templates by line count",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return clearTemplateIDs(backend.service.GetTemplates(ctx, &models.TemplatesRequest{
+				OrderBy: models.TemplatesOrderByLineCount, Limit: 10}))
+		},
+		expected: &models.TemplatesResponse{
+			Templates: []models.LogTemplate{
+				{Template: templateConnected, TokenCount: 4, LineCount: 3, FirstSeenSeconds: s0,
+					LastSeenSeconds: s0 + 2},
+				{Template: templateRequest, TokenCount: 4, LineCount: 2, FirstSeenSeconds: s0 + 1,
+					LastSeenSeconds: s0 + 61},
+				{Template: templateShutdown, TokenCount: 2, LineCount: 1, FirstSeenSeconds: s0 + 120,
+					LastSeenSeconds: s0 + 120},
+			},
+		},
+	},
+	{
+		name: "new templates",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return clearTemplateIDs(backend.service.GetTemplates(ctx, &models.TemplatesRequest{
+				NewSinceSeconds: s0 + 100, OrderBy: models.TemplatesOrderByFirstSeen, Limit: 10}))
+		},
+		expected: &models.TemplatesResponse{
+			Templates: []models.LogTemplate{
+				{Template: templateShutdown, TokenCount: 2, LineCount: 1, FirstSeenSeconds: s0 + 120,
+					LastSeenSeconds: s0 + 120},
+			},
+		},
+	},
+	{
+		name: "template lines",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			resp, err := backend.service.GetTemplateLines(ctx, &models.TemplateLinesRequest{
+				TemplateID: backend.templateIDs[templateConnected], StartTimeSeconds: s0, Limit: 2})
+			if err != nil {
+				return nil, err
+			}
+			resp.Template.TemplateID = 0
+			for i := range resp.Lines {
+				resp.Lines[i].Timestamp = resp.Lines[i].Timestamp.UTC()
+			}
+			return resp, nil
+		},
+		expected: &models.TemplateLinesResponse{
+			Template: models.LogTemplate{Template: templateConnected, TokenCount: 4, LineCount: 3,
+				FirstSeenSeconds: s0, LastSeenSeconds: s0 + 2},
+			Lines: []models.TemplateLine{
+				{ProcessID: "100", ThreadID: "2", ThreadName: "worker", Timestamp: at(2 * time.Second),
+					TimestampSeconds: s0 + 2, LogMessage: "Connected to host db1",
+					Attributes: map[string]string{"host": "db1"}},
+				{ProcessID: "100", ThreadID: "2", ThreadName: "worker", Timestamp: at(200 * time.Millisecond),
+					TimestampSeconds: s0, LogMessage: "Connected to host db2",
+					Attributes: map[string]string{"host": "db2"}},
+			},
+		},
+	},
+	{
+		name: "template lines of unknown template",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			return backend.service.GetTemplateLines(ctx, &models.TemplateLinesRequest{TemplateID: -1, Limit: 10})
+		},
+		expectedErr: services.ErrNotFound,
+	},
+	{
+		name: "partition of the fixture",
+		run: func(ctx context.Context, backend *backend) (interface{}, error) {
+			resp, err := backend.service.GetPartitions(ctx, &models.PartitionsRequest{Exact: true})
+			if err != nil {
+				return nil, err
+			}
+
+			// The backends lay out the partitions differently. Only the partition of the fixture day is compared.
+			name := schema.PartitionName(time.Unix(s0, 0))
+			for _, partition := range resp.Partitions {
+				if partition.Name == name {
+					partition.TotalBytes = 0
+					return &partition, nil
+				}
+			}
+			return nil, fmt.Errorf("partition %s not found", name)
+		},
+		expected: &models.Partition{
+			Name:         schema.PartitionName(time.Unix(s0, 0)),
+			StartSeconds: s0 - 3600,
+			EndSeconds:   s0 - 3600 + 86400,
+			RowCount:     6,
+		},
+	},
+}
+
+func main() {
+	backendNames := flag.String("backends", "postgres,clickhouse,sqlite", "comma separated backends to check")
+	useDocker := flag.Bool("docker", true, "start postgres and clickhouse in local docker containers")
+	postgresAddr := flag.String("postgres-addr", "localhost:15432", "host:port of the postgres database")
+	clickHouseAddr := flag.String("clickhouse-addr", "localhost:19000", "host:port of the clickhouse native protocol")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	// The sqlite database is a file in a scratch directory.
+	scratchDir, err := os.MkdirTemp("", "contract")
+	if err != nil {
+		log.Fatal("Failed to create the scratch directory:", err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	var backends []*backend
+	for _, name := range strings.Split(*backendNames, ",") {
+		// Step 1: Start the container of the backend.
+		if *useDocker {
+			if container, ok := containers[name]; ok {
+				startContainer(container, name, *postgresAddr, *clickHouseAddr)
+				defer removeContainer(container.name)
+			}
+		}
+
+		backend, err := connectBackend(ctx, name, *postgresAddr, *clickHouseAddr, scratchDir)
+		if err != nil {
+			cleanup(*useDocker, scratchDir)
+			log.Fatal(err)
+		}
+		backends = append(backends, backend)
+	}
+
+	// Step 2 and 3: Write the fixture and check every api against each backend.
+	failed := 0
+	for _, backend := range backends {
+		if err := writeFixture(ctx, backend); err != nil {
+			cleanup(*useDocker, scratchDir)
+			log.Fatalf("Failed to write the fixture to %s: %v", backend.name, err)
+		}
+
+		for _, contractCase := range contractCases {
+			if !checkCase(ctx, backend, contractCase) {
+				failed++
+			}
+		}
+		backend.writer.Close()
+	}
+
+	if failed > 0 {
+		cleanup(*useDocker, scratchDir)
+		log.Fatalf("%d of %d api calls broke the contract", failed, len(backends)*len(contractCases))
+	}
+	fmt.Println("All the backends fulfil the api contract.")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// startContainer starts the docker container of a backend and publishes the port of the service on the port of its
+// address.
+func startContainer(container container, name string, postgresAddr string, clickHouseAddr string) {
+	removeContainer(container.name)
+
+	addr := postgresAddr
+	if name == storage.BackendClickHouse {
+		addr = clickHouseAddr
+	}
+
+	args := []string{"run", "-d", "--rm", "--name", container.name, "-p", portOf(addr) + ":" + container.port}
+	args = append(args, container.args...)
+	args = append(args, container.image)
+	if output, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		log.Fatalf("Failed to start the %s container: %v\n%s", container.name, err, output)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// removeContainer removes a docker container if it exists.
+func removeContainer(name string) {
+	exec.Command("docker", "rm", "-f", name).Run()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// cleanup removes the containers and the scratch directory before the test exits with log.Fatal, which skips the
+// deferred calls.
+func cleanup(useDocker bool, scratchDir string) {
+	if useDocker {
+		for _, container := range containers {
+			removeContainer(container.name)
+		}
+	}
+	os.RemoveAll(scratchDir)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// portOf is a helper function to return the port of a host:port address.
+func portOf(addr string) string {
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			return addr[i+1:]
+		}
+	}
+	return addr
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// connectBackend connects to a backend and waits until it accepts connections.
+func connectBackend(ctx context.Context, name string, postgresAddr string, clickHouseAddr string,
+	scratchDir string) (*backend, error) {
+	var result *backend
+
+	switch name {
+	case storage.BackendPostgres:
+		db := pg.Connect(&pg.Options{Addr: postgresAddr, User: username, Password: password, Database: database})
+		result = &backend{
+			name:    name,
+			writer:  storage.NewPostgresWriter(db),
+			service: services.NewStatsService(db, viper.New()),
+		}
+	case storage.BackendClickHouse:
+		conn, err := clickhouse.Open(&clickhouse.Options{
+			Addr: []string{clickHouseAddr},
+			Auth: clickhouse.Auth{Database: database, Username: username, Password: password},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to clickhouse: %w", err)
+		}
+
+		// The lines are inserted synchronously, so that they can be read right away.
+		result = &backend{
+			name:    name,
+			writer:  storage.NewClickHouseWriter(conn, false),
+			service: services.NewClickHouseStatsService(conn),
+		}
+	case storage.BackendSQLite:
+		db, err := schema.OpenSQLite(filepath.Join(scratchDir, "contract.sqlite"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sqlite: %w", err)
+		}
+		result = &backend{
+			name:    name,
+			writer:  storage.NewSQLiteWriter(db),
+			service: services.NewSQLiteStatsService(db),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported backend: %s", name)
+	}
+
+	deadline := time.Now().Add(startupTimeout)
+	for {
+		err := result.writer.Ping(ctx)
+		if err == nil {
+			return result, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is not reachable: %w", name, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// writeFixture creates the schema of the backend and writes the fixture the same way the stats worker does. The id
+// of a template is known after its first line, so the following lines are written with the id.
+func writeFixture(ctx context.Context, backend *backend) error {
+	if err := backend.writer.Migrate(ctx); err != nil {
+		return err
+	}
+	if err := backend.writer.Maintain(ctx, time.Unix(s0, 0), storage.RetentionPolicy{}); err != nil {
+		return err
+	}
+
+	backend.templateIDs = make(map[string]int64)
+	for _, line := range fixture {
+		logLine := &schema.LogLine{
+			ProcessID:        line.processID,
+			ThreadID:         line.threadID,
+			ThreadName:       line.threadName,
+			Timestamp:        at(line.offset),
+			TimestampSeconds: at(line.offset).Unix(),
+			LogMessage:       line.message,
+			Attributes:       line.attributes,
+		}
+		template := storage.Template{
+			ID:         backend.templateIDs[line.template],
+			Text:       line.template,
+			TokenCount: line.tokenCount,
+		}
+
+		templateID, err := backend.writer.WriteLogLine(ctx, logLine, template, len(line.message))
+		if err != nil {
+			return err
+		}
+		backend.templateIDs[line.template] = templateID
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkCase runs a single api call against the backend and prints the difference to the expected response.
+func checkCase(ctx context.Context, backend *backend, contractCase contractCase) bool {
+	got, err := contractCase.run(ctx, backend)
+
+	if contractCase.expectedErr != nil {
+		if !errors.Is(err, contractCase.expectedErr) {
+			fmt.Printf("FAIL %s %s: expected error %v, got %v\n", backend.name, contractCase.name,
+				contractCase.expectedErr, err)
+			return false
+		}
+		fmt.Printf("PASS %s %s\n", backend.name, contractCase.name)
+		return true
+	}
+	if err != nil {
+		fmt.Printf("FAIL %s %s: %v\n", backend.name, contractCase.name, err)
+		return false
+	}
+
+	gotJSON, gotValue := normalize(got)
+	expectedJSON, expectedValue := normalize(contractCase.expected)
+	if !reflect.DeepEqual(gotValue, expectedValue) {
+		fmt.Printf("FAIL %s %s:\n  expected %s\n  got      %s\n", backend.name, contractCase.name, expectedJSON,
+			gotJSON)
+		return false
+	}
+
+	fmt.Printf("PASS %s %s\n", backend.name, contractCase.name)
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// normalize is a helper function to convert a response to its json form for the comparison. The floats are rounded,
+// and the empty lists and objects are the same as null, which the backends do not agree on.
+func normalize(response interface{}) (string, interface{}) {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		log.Fatal("Failed to encode the response:", err)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(encoded, &value); err != nil {
+		log.Fatal("Failed to decode the response:", err)
+	}
+	return string(encoded), normalizeValue(value)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// normalizeValue is a helper function to normalize a decoded json value recursively.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		return math.Round(v*1e6) / 1e6
+	case []interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		for i := range v {
+			v[i] = normalizeValue(v[i])
+		}
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		for key := range v {
+			v[key] = normalizeValue(v[key])
+		}
+	}
+	return value
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// sortCounts is a helper function to sort the attribute counts by bucket, count and then attributes. The backends
+// order the counts with the same bucket and count differently.
+func sortCounts(resp *models.AttributeCountsResponse, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(resp.Counts, func(i, j int) bool {
+		a, b := resp.Counts[i], resp.Counts[j]
+		if a.BucketSeconds != b.BucketSeconds {
+			return a.BucketSeconds < b.BucketSeconds
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		aJSON, _ := json.Marshal(a.Attributes)
+		bJSON, _ := json.Marshal(b.Attributes)
+		return string(aJSON) < string(bJSON)
+	})
+	return resp, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// clearTemplateIDs is a helper function to clear the ids of the templates, which are assigned by the backend.
+func clearTemplateIDs(resp *models.TemplatesResponse, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resp.Templates {
+		resp.Templates[i].TemplateID = 0
+	}
+	return resp, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// at is a helper function to return the time at the offset from the start of the fixture.
+func at(offset time.Duration) time.Time {
+	return time.Unix(s0, 0).Add(offset).UTC()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// percent is a helper function to return a pointer to the percentage.
+func percent(value float64) *float64 {
+	return &value
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,394 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file for the query plan regression test.
+//
+// A missing index does not show up on the small sample logs. The query silently falls back to a sequential scan and
+// only becomes slow once the tables have millions of rows. This test catches that before it reaches production.
+//
+// It performs the following steps:
+// 1. Create a scratch database in a local postgres and apply all the migrations.
+// 2. Load a synthetic dataset into log_lines and derive the rollup tables from it, the same way the stats worker
+//    maintains them. Then analyze the tables so that the planner has realistic statistics.
+// 3. Run the apis of the stats service with narrow filters and capture their queries with a query hook.
+// 4. EXPLAIN every captured query and fail if one of the large tables is read with a sequential scan.
+// 5. Drop the scratch database.
+//
+// The test needs a postgres which the test user can create databases in. For example with the postgres of the
+// docker-compose file,
+//
+//     docker-compose up -d postgres
+//     cd apiserver
+//     PGPASSWORD=suresh go run ./test/queryplans -addr localhost:5432
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/spf13/viper"
+
+	"common/schema"
+
+	"apiserver/internal/models"
+	services "apiserver/internal/services"
+)
+
+const (
+	// datasetStart is the start of the synthetic dataset. It is the day of the sample logs.
+	datasetStart = 1596931200
+
+	// datasetDays is the number of days covered by the synthetic dataset.
+	datasetDays = 2
+
+	// numLines is the number of synthetic log lines.
+	numLines = 400000
+
+	// numProcesses is the number of synthetic processes.
+	numProcesses = 100
+
+	// threadsPerProcess is the number of threads per synthetic process. The thread name is derived from the thread id,
+	// so every thread name is shared by numProcesses threads.
+	threadsPerProcess = 200
+
+	// numTemplates is the number of synthetic log templates.
+	numTemplates = 20
+
+	// windowStart and windowEnd are the narrow time window used by the apis. It is in the middle of the first day.
+	windowStart = datasetStart + 43200
+	windowEnd   = windowStart + 300
+
+	// threadName is the thread name used by the thread name filters.
+	threadName = "Thread-5"
+)
+
+// guardedTables are the prefixes of the tables which grow with the logs. They must never be read with a sequential
+// scan. This covers the partitions of log_lines and the per second and per minute rollups.
+var guardedTables = []string{"log_lines", "thread_lifetimes"}
+
+// planCase is a single api call whose queries are checked.
+type planCase struct {
+	name string
+	run  func(ctx context.Context, service *services.StatsService) error
+}
+
+// planCases are all the api calls checked by the test.
+var planCases = []planCase{
+	{"basic stats", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetBasicStats(ctx, &models.BasicLogStatsRequest{
+			StartTimeSeconds: windowStart, EndTimeSeconds: windowEnd})
+		return err
+	}},
+	{"basic stats by thread name", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetBasicStats(ctx, &models.BasicLogStatsRequest{
+			StartTimeSeconds: windowStart, EndTimeSeconds: windowEnd, ThreadName: threadName})
+		return err
+	}},
+	{"max concurrent threads by thread name", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetMaxConcurrentThreads(ctx, &models.MaxConcurrentThreadsRequest{ThreadName: threadName})
+		return err
+	}},
+	{"thread lifetime stats by thread name", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetThreadLifetimeStats(ctx, &models.ThreadLifetimeStatsRequest{ThreadName: threadName})
+		return err
+	}},
+	{"top threads", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetTop(ctx, &models.TopRequest{
+			StartTimeSeconds: windowStart, EndTimeSeconds: windowEnd, N: 10, By: models.TopByThread,
+			Metric: models.TopMetricLines})
+		return err
+	}},
+	{"attribute counts", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetAttributeCounts(ctx, &models.AttributeCountsRequest{
+			StartTimeSeconds: windowStart, EndTimeSeconds: windowEnd, GroupBy: []string{"host"},
+			Interval: "minute"})
+		return err
+	}},
+	{"attribute counts by thread name", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetAttributeCounts(ctx, &models.AttributeCountsRequest{
+			StartTimeSeconds: windowStart, EndTimeSeconds: windowEnd + 86400, GroupBy: []string{"host"},
+			ThreadName: threadName})
+		return err
+	}},
+	{"template lines", func(ctx context.Context, service *services.StatsService) error {
+		_, err := service.GetTemplateLines(ctx, &models.TemplateLinesRequest{TemplateID: 1, Limit: 10})
+		return err
+	}},
+}
+
+// queryRecorder is a go-pg query hook which records the queries of the stats service.
+type queryRecorder struct {
+	enabled bool
+	queries []string
+}
+
+// planNode is a node of the json output of EXPLAIN.
+type planNode struct {
+	NodeType     string     `json:"Node Type"`
+	RelationName string     `json:"Relation Name"`
+	IndexName    string     `json:"Index Name"`
+	Plans        []planNode `json:"Plans"`
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:5432", "host:port of the postgres database")
+	user := flag.String("user", "suresh", "user to connect to the postgres database")
+	database := flag.String("database", "query_plans", "name of the scratch database created by the test")
+	flag.Parse()
+
+	ctx := context.Background()
+	options := &pg.Options{Addr: *addr, User: *user, Password: os.Getenv("PGPASSWORD")}
+
+	// Step 1: Create the scratch database and apply the migrations.
+	admin := pg.Connect(withDatabase(options, "postgres"))
+	defer admin.Close()
+	recreateDatabase(ctx, admin, *database)
+	defer dropDatabase(ctx, admin, *database)
+
+	db := pg.Connect(withDatabase(options, *database))
+	migrate(ctx, db)
+
+	// Step 2: Load the synthetic dataset.
+	loadDataset(ctx, db)
+
+	// Step 3 and 4: Run every api and check the plans of its queries.
+	recorder := &queryRecorder{}
+	db.AddQueryHook(recorder)
+	service := services.NewStatsService(db, viper.New())
+
+	failed := 0
+	for _, planCase := range planCases {
+		if !checkPlans(ctx, db, service, recorder, planCase) {
+			failed++
+		}
+	}
+
+	// The database must be closed before it is dropped.
+	db.Close()
+
+	if failed > 0 {
+		dropDatabase(ctx, admin, *database)
+		log.Fatalf("%d of %d api calls read a large table with a sequential scan", failed, len(planCases))
+	}
+	fmt.Println("All the query plans use indexes.")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// BeforeQuery implements the pg.QueryHook interface.
+func (recorder *queryRecorder) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// AfterQuery implements the pg.QueryHook interface. The query is recorded with all its parameters substituted.
+func (recorder *queryRecorder) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	if !recorder.enabled {
+		return nil
+	}
+
+	query, err := event.FormattedQuery()
+	if err != nil {
+		return err
+	}
+	recorder.queries = append(recorder.queries, string(query))
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// withDatabase is a helper function to copy the connection options with a different database.
+func withDatabase(options *pg.Options, database string) *pg.Options {
+	copied := *options
+	copied.Database = database
+	return &copied
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// recreateDatabase drops the scratch database left over by a previous run and creates it again.
+func recreateDatabase(ctx context.Context, admin *pg.DB, database string) {
+	dropDatabase(ctx, admin, database)
+	if _, err := admin.ExecContext(ctx, "CREATE DATABASE ?", pg.Ident(database)); err != nil {
+		log.Fatal("Failed to create the scratch database:", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// dropDatabase drops the scratch database if it exists.
+func dropDatabase(ctx context.Context, admin *pg.DB, database string) {
+	if _, err := admin.ExecContext(ctx, "DROP DATABASE IF EXISTS ?", pg.Ident(database)); err != nil {
+		log.Fatal("Failed to drop the scratch database:", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// migrate applies all the migrations and creates the partitions of the days of the synthetic dataset.
+func migrate(ctx context.Context, db *pg.DB) {
+	migrator, err := schema.NewMigrator(db)
+	if err != nil {
+		log.Fatal("Failed to load the migrations:", err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		log.Fatal("Failed to apply the migrations:", err)
+	}
+
+	if _, err := schema.EnsurePartitions(ctx, db, time.Unix(datasetStart, 0), datasetDays); err != nil {
+		log.Fatal("Failed to create the partitions:", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// loadDataset loads the synthetic log lines in time order and derives the rollup tables from them.
+func loadDataset(ctx context.Context, db *pg.DB) {
+	start := time.Now()
+
+	statements := []struct {
+		description string
+		query       string
+		params      []interface{}
+	}{
+		{"log templates", `
+			INSERT INTO log_templates (template, token_count, line_count)
+			SELECT 'Starting new HTTPS connection <*> <*> ' || n, 6, 0
+			FROM generate_series(1, ?) AS n`,
+			[]interface{}{numTemplates}},
+		{"log lines", `
+			INSERT INTO log_lines (process_id, thread_id, thread_name, timestamp, timestamp_seconds, log_message,
+				attributes, template_id)
+			SELECT process_id, thread_id, 'Thread-' || thread_id, to_timestamp(timestamp_seconds), timestamp_seconds,
+				'Starting new HTTPS connection (1): host' || i % 50 || '.example.com',
+				jsonb_build_object('scheme', 'HTTPS', 'host', 'host' || i % 50 || '.example.com'),
+				1 + i % ?
+			FROM (
+				SELECT i,
+					(i % ?)::TEXT AS process_id,
+					(i / ? % ?)::TEXT AS thread_id,
+					? + i * ? / ? AS timestamp_seconds
+				FROM generate_series(0::BIGINT, ? - 1) AS i
+			) AS g`,
+			[]interface{}{numTemplates, numProcesses, numProcesses, threadsPerProcess, datasetStart,
+				datasetDays * 86400, numLines, numLines}},
+		{"per second rollup", `
+			INSERT INTO log_lines_per_second (bucket_seconds, process_id, thread_id, thread_name, line_count,
+				byte_count)
+			SELECT timestamp_seconds, process_id, thread_id, thread_name, COUNT(*), SUM(LENGTH(log_message))
+			FROM log_lines
+			GROUP BY 1, 2, 3, 4`, nil},
+		{"per minute rollup", `
+			INSERT INTO log_lines_per_minute (bucket_seconds, process_id, thread_id, thread_name, line_count,
+				byte_count)
+			SELECT timestamp_seconds - timestamp_seconds % 60, process_id, thread_id, thread_name, COUNT(*),
+				SUM(LENGTH(log_message))
+			FROM log_lines
+			GROUP BY 1, 2, 3, 4`, nil},
+		{"active threads per second", `
+			INSERT INTO active_threads_per_second (bucket_seconds, active_threads)
+			SELECT bucket_seconds, COUNT(*) FROM log_lines_per_second GROUP BY 1`, nil},
+		{"active threads per minute", `
+			INSERT INTO active_threads_per_minute (bucket_seconds, active_threads)
+			SELECT bucket_seconds, COUNT(*) FROM log_lines_per_minute GROUP BY 1`, nil},
+		{"thread lifetimes", `
+			INSERT INTO thread_lifetimes (process_id, thread_id, thread_name, first_seen, last_seen,
+				first_seen_seconds, last_seen_seconds, line_count)
+			SELECT process_id, thread_id, thread_name, MIN(timestamp), MAX(timestamp), MIN(timestamp_seconds),
+				MAX(timestamp_seconds), COUNT(*)
+			FROM log_lines
+			GROUP BY 1, 2, 3`, nil},
+		{"statistics", "ANALYZE", nil},
+	}
+
+	for _, statement := range statements {
+		if _, err := db.ExecContext(ctx, statement.query, statement.params...); err != nil {
+			log.Fatalf("Failed to load the %s: %v", statement.description, err)
+		}
+	}
+
+	fmt.Printf("Loaded %d synthetic log lines in %v.\n", numLines, time.Since(start).Round(time.Millisecond))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkPlans runs the api call, explains every query it made and reports the sequential scans of the guarded tables.
+// It returns false if the check failed.
+func checkPlans(ctx context.Context, db *pg.DB, service *services.StatsService, recorder *queryRecorder,
+	planCase planCase) bool {
+	recorder.queries = nil
+	recorder.enabled = true
+	err := planCase.run(ctx, service)
+	recorder.enabled = false
+	if err != nil {
+		log.Fatalf("Failed to run %s: %v", planCase.name, err)
+	}
+
+	ok := true
+	for _, query := range recorder.queries {
+		var output string
+		_, err := db.QueryOneContext(ctx, pg.Scan(&output), "EXPLAIN (FORMAT JSON) ?", pg.Safe(query))
+		if err != nil {
+			log.Fatalf("Failed to explain the query of %s: %v", planCase.name, err)
+		}
+
+		var plans []struct {
+			Plan planNode `json:"Plan"`
+		}
+		if err := json.Unmarshal([]byte(output), &plans); err != nil || len(plans) == 0 {
+			log.Fatalf("Failed to parse the plan of %s: %v", planCase.name, err)
+		}
+
+		scans := sequentialScans(plans[0].Plan)
+		if len(scans) == 0 {
+			continue
+		}
+
+		// If we reach here, the query regressed. Print the plan to make the cause obvious.
+		ok = false
+		var text []string
+		if _, err := db.QueryContext(ctx, &text, "EXPLAIN ?", pg.Safe(query)); err != nil {
+			log.Fatalf("Failed to explain the query of %s: %v", planCase.name, err)
+		}
+		fmt.Printf("FAIL %s: sequential scan of %s\n%s\n\n%s\n\n", planCase.name, strings.Join(scans, ", "),
+			strings.TrimSpace(query), strings.Join(text, "\n"))
+	}
+
+	if ok {
+		fmt.Printf("PASS %s (%d queries)\n", planCase.name, len(recorder.queries))
+	}
+	return ok
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// sequentialScans is a helper function to find the guarded tables which are read with a sequential scan anywhere in
+// the plan. The default partition of log_lines is empty, so it is allowed.
+func sequentialScans(node planNode) []string {
+	var scans []string
+	if node.NodeType == "Seq Scan" && node.RelationName != schema.DefaultPartition {
+		for _, prefix := range guardedTables {
+			if strings.HasPrefix(node.RelationName, prefix) {
+				scans = append(scans, node.RelationName)
+				break
+			}
+		}
+	}
+
+	for _, child := range node.Plans {
+		scans = append(scans, sequentialScans(child)...)
+	}
+	return scans
+}
+
+//----------------------------------------------------------------------------------------------------------------------
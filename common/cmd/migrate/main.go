@@ -0,0 +1,90 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file of the migrate command.
+//
+// The api server and the log-subscriber apply the pending migrations on startup. This command is for the operators to
+// inspect and change the schema version by hand. For example,
+//
+//     go run ./cmd/migrate -addr localhost:5432 status
+//     go run ./cmd/migrate -addr localhost:5432 up
+//     go run ./cmd/migrate -addr localhost:5432 -steps 2 down
+//
+// The password is read from the PGPASSWORD environment variable.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/golang/glog"
+
+	"common/schema"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:5432", "host:port of the postgres database")
+	user := flag.String("user", "suresh", "user to connect to the postgres database")
+	database := flag.String("database", "olap", "name of the postgres database")
+	steps := flag.Int("steps", 1, "number of migrations reverted by down")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] up|down|status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	flag.Set("logtostderr", "true")
+	defer glog.Flush()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db := pg.Connect(&pg.Options{
+		Addr:     *addr,
+		User:     *user,
+		Password: os.Getenv("PGPASSWORD"),
+		Database: *database,
+	})
+	defer db.Close()
+
+	migrator, err := schema.NewMigrator(db)
+	if err != nil {
+		glog.Fatalf("Failed to load the migrations: %v", err)
+	}
+
+	ctx := context.Background()
+	switch flag.Arg(0) {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			glog.Fatalf("Failed to migrate up: %v", err)
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		reverted, err := migrator.Down(ctx, *steps)
+		if err != nil {
+			glog.Fatalf("Failed to migrate down: %v", err)
+		}
+		fmt.Printf("Reverted %d migrations\n", reverted)
+	case "status":
+		current, pending, err := migrator.Status(ctx)
+		if err != nil {
+			glog.Fatalf("Failed to get the migration status: %v", err)
+		}
+		fmt.Printf("Current version: %d\n", current)
+		for _, migration := range pending {
+			fmt.Printf("Pending: %d_%s\n", migration.Version, migration.Name)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,495 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the keys of the configuration blocks which are shared by the services.
+//
+// The kafka, db, storage, secrets, logging and tracing blocks used to be declared in the config_utils.go of every
+// service, and their declarations and validations drifted apart. They are declared once here, together with their
+// part of the schema, and the services merge the parts they use into their own schema.
+//
+// var Schema = configutil.Merge(configutil.Schema{
+//   configutil.String(KLogsDirectory).Required(),
+// }, configutil.KafkaSchema, configutil.LoggingSchema)
+//
+// The schema of the db, storage, clickhouse and sqlite blocks is in dbutil/schema.go, so that the services which do not
+// store anything do not depend on the storage backends. The keys which only one service has, like the read replicas of
+// the api server, stay in the config_utils.go of that service. Likewise the schema of the message_queue, nats and redis
+// blocks is in messageq/config.go.
+
+package configutil
+
+import "math"
+
+const (
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Message queue related configuration.
+
+	// KGroupMessageQueue is group key for message_queue block in defaults.yaml. It selects the transport between the
+	// log-processor and the log-subscriber. For example defaults.yaml has something like this.
+	// message_queue:
+	//  transport: kafka
+	KGroupMessageQueue = "message_queue"
+
+	// KTransport is a nested key under the group key KGroupMessageQueue to obtain the transport. It is kafka, nats or
+	// redis. Every transport is configured in the block of its name. The topic is kafka.topic for all of them.
+	KTransport = KGroupMessageQueue + ".transport"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Kafka related configuration.
+
+	// KGroupKafka is group key for kafka block in defaults.yaml. For example defaults.yaml has something like this.
+	// kafka:
+	//  bootstrap_servers: "kafka:9092"
+	//  topic: "processor-messages"
+	KGroupKafka = "kafka"
+
+	// KBootstrapServers is a nested key under the group key KGroupKafka to obtain the kafka bootstrap servers.
+	KBootstrapServers = KGroupKafka + ".bootstrap_servers"
+
+	// KTopic is a nested key under the group key KGroupKafka to obtain the kafka topic name. The nats and redis
+	// transports name their streams after it.
+	KTopic = KGroupKafka + ".topic"
+
+	// KKafkaSecurityProtocol is a nested key under the group key KGroupKafka to obtain the protocol of the connections
+	// to the brokers. It is plaintext, ssl, sasl_plaintext or sasl_ssl. Empty connects in plain text.
+	KKafkaSecurityProtocol = KGroupKafka + ".security_protocol"
+
+	// KGroupKafkaTLS is a nested group key under the group key KGroupKafka for the TLS connections to the brokers. It
+	// is used when the security protocol is ssl or sasl_ssl. For example defaults.yaml has something like this.
+	// kafka:
+	//   security_protocol: sasl_ssl
+	//   tls:
+	//     ca_file: /etc/kafka/ca.pem
+	KGroupKafkaTLS = KGroupKafka + ".tls"
+
+	// KKafkaTLSCAFile is a nested key under the group key KGroupKafkaTLS to obtain the pem file of the certificate
+	// authorities which signed the certificates of the brokers. Empty uses the certificate authorities of the system.
+	KKafkaTLSCAFile = KGroupKafkaTLS + ".ca_file"
+
+	// KKafkaTLSCertFile is a nested key under the group key KGroupKafkaTLS to obtain the pem file of the client
+	// certificate. It is only needed when the brokers authenticate the clients by certificate.
+	KKafkaTLSCertFile = KGroupKafkaTLS + ".cert_file"
+
+	// KKafkaTLSKeyFile is a nested key under the group key KGroupKafkaTLS to obtain the pem file of the key of the
+	// client certificate.
+	KKafkaTLSKeyFile = KGroupKafkaTLS + ".key_file"
+
+	// KKafkaTLSKeyPassword is a nested key under the group key KGroupKafkaTLS to obtain the reference of the password
+	// of an encrypted key file. It is a secret, the password itself is obtained from the secret store.
+	KKafkaTLSKeyPassword = KGroupKafkaTLS + ".key_password"
+
+	// KKafkaTLSInsecureSkipVerify is a nested key under the group key KGroupKafkaTLS to skip the verification of the
+	// certificates of the brokers. The connection is encrypted but not authenticated, so this is only meant for testing.
+	KKafkaTLSInsecureSkipVerify = KGroupKafkaTLS + ".insecure_skip_verify"
+
+	// KGroupKafkaSASL is a nested group key under the group key KGroupKafka for the SASL authentication of the clients.
+	// It is used when the security protocol is sasl_plaintext or sasl_ssl. For example defaults.yaml has something like
+	// this.
+	// kafka:
+	//   sasl:
+	//     mechanism: SCRAM-SHA-512
+	//     username: olap
+	//     password: "file:/run/secrets/kafka_password"
+	KGroupKafkaSASL = KGroupKafka + ".sasl"
+
+	// KKafkaSASLMechanism is a nested key under the group key KGroupKafkaSASL to obtain the SASL mechanism. It is PLAIN,
+	// SCRAM-SHA-256 or SCRAM-SHA-512.
+	KKafkaSASLMechanism = KGroupKafkaSASL + ".mechanism"
+
+	// KKafkaSASLUsername is a nested key under the group key KGroupKafkaSASL to obtain the username.
+	KKafkaSASLUsername = KGroupKafkaSASL + ".username"
+
+	// KKafkaSASLPassword is a nested key under the group key KGroupKafkaSASL to obtain the reference of the password.
+	// It is a secret, the password itself is obtained from the secret store.
+	KKafkaSASLPassword = KGroupKafkaSASL + ".password"
+
+	// KGroupKafkaProducer is a nested group key under the group key KGroupKafka for the tuning of the producer. The
+	// keys which are not set keep the defaults of librdkafka. For example defaults.yaml has something like this.
+	// kafka:
+	//   producer:
+	//     linger_ms: 20
+	//     batch_size: 1048576
+	//     compression: lz4
+	//     enable_idempotence: true
+	KGroupKafkaProducer = KGroupKafka + ".producer"
+
+	// KProducerLingerMs is a nested key under the group key KGroupKafkaProducer to obtain the time the producer waits
+	// for more messages before it sends a batch. A longer linger makes larger batches at the cost of latency.
+	KProducerLingerMs = KGroupKafkaProducer + ".linger_ms"
+
+	// KProducerBatchSize is a nested key under the group key KGroupKafkaProducer to obtain the maximum size of a batch
+	// of messages to a partition in bytes.
+	KProducerBatchSize = KGroupKafkaProducer + ".batch_size"
+
+	// KProducerCompression is a nested key under the group key KGroupKafkaProducer to obtain the compression codec of
+	// the batches. It is none, gzip, snappy, lz4 or zstd.
+	KProducerCompression = KGroupKafkaProducer + ".compression"
+
+	// KProducerIdempotence is a nested key under the group key KGroupKafkaProducer to enable the idempotent producer.
+	// The broker discards the duplicates of the retried batches and keeps the order of the messages of a partition.
+	KProducerIdempotence = KGroupKafkaProducer + ".enable_idempotence"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// NATS related configuration.
+
+	// KGroupNATS is group key for nats block in defaults.yaml. It is used when the transport is nats. The server must
+	// run with JetStream enabled. For example defaults.yaml has something like this.
+	// nats:
+	//  url: "nats://nats:4222"
+	//  token: ""
+	//  partitions: 4
+	//  max_age: 168h
+	KGroupNATS = "nats"
+
+	// KNATSURL is a nested key under the group key KGroupNATS to obtain the comma separated urls of the servers.
+	KNATSURL = KGroupNATS + ".url"
+
+	// KNATSToken is a nested key under the group key KGroupNATS to obtain the reference of the authentication token.
+	// It is a secret, the token itself is obtained from the secret store. Empty connects without authentication.
+	KNATSToken = KGroupNATS + ".token"
+
+	// KNATSPartitions is a nested key under the group key KGroupNATS to obtain the number of partitions of the stream.
+	// The log-processor and the log-subscriber must use the same number.
+	KNATSPartitions = KGroupNATS + ".partitions"
+
+	// KNATSMaxAge is a nested key under the group key KGroupNATS to obtain the retention of the messages in the
+	// stream. Zero keeps them until the stream is purged.
+	KNATSMaxAge = KGroupNATS + ".max_age"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Redis related configuration.
+
+	// KGroupRedis is group key for redis block in defaults.yaml. It is used when the transport is redis. The lag of
+	// the subscribers is only known by redis 7 and later. For example defaults.yaml has something like this.
+	// redis:
+	//  addr: "redis:6379"
+	//  password: ""
+	//  db: 0
+	//  partitions: 4
+	//  max_len: 1000000
+	KGroupRedis = "redis"
+
+	// KRedisAddr is a nested key under the group key KGroupRedis to obtain the host:port of the server.
+	KRedisAddr = KGroupRedis + ".addr"
+
+	// KRedisPassword is a nested key under the group key KGroupRedis to obtain the reference of the password. It is a
+	// secret, the password itself is obtained from the secret store.
+	KRedisPassword = KGroupRedis + ".password"
+
+	// KRedisDB is a nested key under the group key KGroupRedis to obtain the number of the database.
+	KRedisDB = KGroupRedis + ".db"
+
+	// KRedisPartitions is a nested key under the group key KGroupRedis to obtain the number of partitions, every
+	// partition is a stream of its own. The log-processor and the log-subscriber must use the same number.
+	KRedisPartitions = KGroupRedis + ".partitions"
+
+	// KRedisMaxLen is a nested key under the group key KGroupRedis to obtain the approximate number of messages which
+	// every partition retains. The oldest messages are dropped even if a consumer group did not consume them yet.
+	KRedisMaxLen = KGroupRedis + ".max_len"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Http server related configuration.
+
+	// KGroupHttpServer is group key for http_server block in defaults.yaml. The http server of the log-processor and
+	// the log-subscriber exposes the operational endpoints like /metrics, /healthz and /readyz. For example
+	// defaults.yaml has something like this.
+	// http_server:
+	//  port: 9090
+	KGroupHttpServer = "http_server"
+
+	// KHttpServerPort is a nested key under the group key KGroupHttpServer to obtain the port for the http server.
+	KHttpServerPort = KGroupHttpServer + ".port"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Database related configuration.
+
+	// KGroupDatabase is group key for db block in defaults.yaml. For example defaults.yaml has something like this.
+	// db:
+	//   host: postgres
+	//   port: 5432
+	//   username: suresh
+	//   password: "file:/run/secrets/postgres_password"
+	//   database: olap
+	KGroupDatabase = "db"
+
+	// KHost is a nested key under the group key KGroupDatabase to obtain the hostname for the postgres database.
+	KHost = KGroupDatabase + ".host"
+
+	// KPort is a nested key under the group key KGroupDatabase to obtain the port for the postgres database.
+	KPort = KGroupDatabase + ".port"
+
+	// KUsername is a nested key under the group key KGroupDatabase to obtain the username to connect to the postgres
+	// database.
+	KUsername = KGroupDatabase + ".username"
+
+	// KPassword is a nested key under the group key KGroupDatabase to obtain the reference of the password to connect
+	// to the postgres database. It is a secret, the password itself is obtained from the secret store.
+	KPassword = KGroupDatabase + ".password"
+
+	// KDatabaseName is a nested key under the group key KGroupDatabase to obtain the database name to connect to the
+	// postgres database.
+	KDatabaseName = KGroupDatabase + ".database"
+
+	// KMigrateOnStartup is a nested key under the group key KGroupDatabase to apply the pending schema migrations when
+	// the service starts.
+	KMigrateOnStartup = KGroupDatabase + ".migrate_on_startup"
+
+	// KLogQueries is a nested key under the group key KGroupDatabase to log every query, with the secrets redacted.
+	KLogQueries = KGroupDatabase + ".log_queries"
+
+	// KStatementTimeout is a nested key under the group key KGroupDatabase to obtain the statement_timeout of the
+	// postgres sessions, and the max_execution_time of the ClickHouse queries. Zero does not bound the queries.
+	KStatementTimeout = KGroupDatabase + ".statement_timeout"
+
+	// KPoolSize is a nested key under the group key KGroupDatabase to obtain the maximum number of connections per
+	// postgres server. Zero uses the default of go-pg, which is 10 per CPU.
+	KPoolSize = KGroupDatabase + ".pool_size"
+
+	// KMinIdleConns is a nested key under the group key KGroupDatabase to obtain the number of idle connections kept
+	// open per postgres server.
+	KMinIdleConns = KGroupDatabase + ".min_idle_conns"
+
+	// KMaxConnAge is a nested key under the group key KGroupDatabase to obtain the age after which a connection is
+	// closed. Zero keeps the connections forever.
+	KMaxConnAge = KGroupDatabase + ".max_conn_age"
+
+	// KIdleTimeout is a nested key under the group key KGroupDatabase to obtain the time after which an idle
+	// connection is closed.
+	KIdleTimeout = KGroupDatabase + ".idle_timeout"
+
+	// KPoolTimeout is a nested key under the group key KGroupDatabase to obtain the time a query waits for a free
+	// connection when all the connections of the pool are busy.
+	KPoolTimeout = KGroupDatabase + ".pool_timeout"
+
+	// KMaxRetries is a nested key under the group key KGroupDatabase to obtain the number of times a query is retried
+	// after a network error. Only the services whose queries are safe to retry should set it.
+	KMaxRetries = KGroupDatabase + ".max_retries"
+
+	// KMinRetryBackoff is a nested key under the group key KGroupDatabase to obtain the backoff before the first
+	// retry. The backoff doubles with every retry up to KMaxRetryBackoff.
+	KMinRetryBackoff = KGroupDatabase + ".min_retry_backoff"
+
+	// KMaxRetryBackoff is a nested key under the group key KGroupDatabase to obtain the maximum backoff between the
+	// retries.
+	KMaxRetryBackoff = KGroupDatabase + ".max_retry_backoff"
+
+	// KGroupDatabaseTLS is a nested group key under the group key KGroupDatabase for the TLS connections to postgres.
+	// For example defaults.yaml has something like this.
+	// db:
+	//   tls:
+	//     enabled: true
+	//     ca_file: /etc/apiserver/postgres-ca.pem
+	//     server_name: postgres
+	KGroupDatabaseTLS = KGroupDatabase + ".tls"
+
+	// KTLSEnabled is a nested key under the group key KGroupDatabaseTLS to connect to postgres over TLS.
+	KTLSEnabled = KGroupDatabaseTLS + ".enabled"
+
+	// KTLSCAFile is a nested key under the group key KGroupDatabaseTLS to obtain the pem file of the certificate
+	// authorities which signed the certificate of postgres. Empty uses the certificate authorities of the system.
+	KTLSCAFile = KGroupDatabaseTLS + ".ca_file"
+
+	// KTLSCertFile is a nested key under the group key KGroupDatabaseTLS to obtain the pem file of the client
+	// certificate. It is only needed when postgres authenticates the clients by certificate.
+	KTLSCertFile = KGroupDatabaseTLS + ".cert_file"
+
+	// KTLSKeyFile is a nested key under the group key KGroupDatabaseTLS to obtain the pem file of the key of the client
+	// certificate.
+	KTLSKeyFile = KGroupDatabaseTLS + ".key_file"
+
+	// KTLSServerName is a nested key under the group key KGroupDatabaseTLS to obtain the name verified against the
+	// certificate of postgres. Empty uses the host of each server.
+	KTLSServerName = KGroupDatabaseTLS + ".server_name"
+
+	// KTLSInsecureSkipVerify is a nested key under the group key KGroupDatabaseTLS to skip the verification of the
+	// certificate of postgres. The connection is encrypted but not authenticated, so this is only meant for testing.
+	KTLSInsecureSkipVerify = KGroupDatabaseTLS + ".insecure_skip_verify"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Storage related configuration.
+
+	// KGroupStorage is group key for storage block in defaults.yaml. It selects the backend in which the stats worker
+	// persists the log lines and from which the apis read them. For example defaults.yaml has something like this.
+	// storage:
+	//  backend: postgres
+	KGroupStorage = "storage"
+
+	// KStorageBackend is a nested key under the group key KGroupStorage to obtain the backend. It is postgres,
+	// clickhouse or sqlite. The postgres backend is configured in the db block.
+	KStorageBackend = KGroupStorage + ".backend"
+
+	// KGroupClickHouse is group key for clickhouse block in defaults.yaml. It is used when the storage backend is
+	// clickhouse. For example defaults.yaml has something like this.
+	// clickhouse:
+	//  addr: "clickhouse:9000"
+	//  database: default
+	//  username: default
+	//  password: ""
+	KGroupClickHouse = "clickhouse"
+
+	// KClickHouseAddr is a nested key under the group key KGroupClickHouse to obtain the host:port of the native
+	// protocol of ClickHouse.
+	KClickHouseAddr = KGroupClickHouse + ".addr"
+
+	// KClickHouseDatabase is a nested key under the group key KGroupClickHouse to obtain the database name.
+	KClickHouseDatabase = KGroupClickHouse + ".database"
+
+	// KClickHouseUsername is a nested key under the group key KGroupClickHouse to obtain the username.
+	KClickHouseUsername = KGroupClickHouse + ".username"
+
+	// KClickHousePassword is a nested key under the group key KGroupClickHouse to obtain the reference of the password.
+	// It is a secret, the password itself is obtained from the secret store.
+	KClickHousePassword = KGroupClickHouse + ".password"
+
+	// KGroupSQLite is group key for sqlite block in defaults.yaml. It is used when the storage backend is sqlite. For
+	// example defaults.yaml has something like this.
+	// sqlite:
+	//  path: "/app/data/olap.sqlite"
+	KGroupSQLite = "sqlite"
+
+	// KSQLitePath is a nested key under the group key KGroupSQLite to obtain the path of the database file. The
+	// log-subscriber and the api server must use the same file.
+	KSQLitePath = KGroupSQLite + ".path"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Secrets related configuration.
+
+	// KGroupSecrets is group key for secrets block in defaults.yaml. The secrets in the configuration are references to
+	// their sources. Please refer to secrets/secrets.go. For example defaults.yaml has something like this.
+	// secrets:
+	//  refresh_interval: 1m
+	//  vault:
+	//    addr: "http://vault:8200"
+	//    token: "env:VAULT_TOKEN"
+	//    mount: secret
+	KGroupSecrets = "secrets"
+
+	// KSecretsRefreshInterval is a nested key under the group key KGroupSecrets to obtain the interval at which the
+	// secrets are resolved again to pick up rotated credentials. Zero disables the rotation.
+	KSecretsRefreshInterval = KGroupSecrets + ".refresh_interval"
+
+	// KGroupVault is a nested group key under the group key KGroupSecrets for the vault block. Vault is not used when
+	// the address is empty.
+	KGroupVault = KGroupSecrets + ".vault"
+
+	// KVaultAddr is a nested key under the group key KGroupVault to obtain the url of the vault server.
+	KVaultAddr = KGroupVault + ".addr"
+
+	// KVaultToken is a nested key under the group key KGroupVault to obtain the reference of the vault token. It is an
+	// env: or a file: reference.
+	KVaultToken = KGroupVault + ".token"
+
+	// KVaultMount is a nested key under the group key KGroupVault to obtain the mount path of the KV version 2 engine.
+	KVaultMount = KGroupVault + ".mount"
+
+	// KVaultTimeout is a nested key under the group key KGroupVault to obtain the timeout of a read of a secret.
+	KVaultTimeout = KGroupVault + ".timeout"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Logging related configuration.
+
+	// KGroupLogging is group key for logging block in defaults.yaml. The log levels can be changed while the service
+	// runs, the configuration is reloaded when defaults.yaml changes or on SIGHUP. For example defaults.yaml has
+	// something like this.
+	// logging:
+	//  verbosity: 0
+	//  vmodule: ""
+	KGroupLogging = "logging"
+
+	// KLogVerbosity is a nested key under the group key KGroupLogging to obtain the verbosity of the glog V logs. It
+	// replaces the -v flag.
+	KLogVerbosity = KGroupLogging + ".verbosity"
+
+	// KLogVModule is a nested key under the group key KGroupLogging to obtain the verbosity per file, for example
+	// "stats_worker=2". It replaces the -vmodule flag.
+	KLogVModule = KGroupLogging + ".vmodule"
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Tracing related configuration.
+
+	// KGroupTracing is group key for tracing block in defaults.yaml. The spans are exported with OTLP over grpc to an
+	// OpenTelemetry collector. For example defaults.yaml has something like this.
+	// tracing:
+	//  enabled: true
+	//  otlp_endpoint: "otel-collector:4317"
+	//  sample_ratio: 1.0
+	KGroupTracing = "tracing"
+
+	// KTracingEnabled is a nested key under the group key KGroupTracing to enable the export of the spans.
+	KTracingEnabled = KGroupTracing + ".enabled"
+
+	// KTracingEndpoint is a nested key under the group key KGroupTracing to obtain the host:port of the OTLP grpc
+	// receiver of the collector.
+	KTracingEndpoint = KGroupTracing + ".otlp_endpoint"
+
+	// KTracingSampleRatio is a nested key under the group key KGroupTracing to obtain the fraction of the traces that
+	// are sampled. The services which continue a trace follow the sampling decision of the parent.
+	KTracingSampleRatio = KGroupTracing + ".sample_ratio"
+)
+
+// KafkaSchema is the schema of the kafka block. The bootstrap servers are only required when kafka is the transport,
+// the topic is used by every transport. The combinations of the security protocol and the TLS and SASL keys are
+// checked when the clients are created, please refer to kafkautil/kafka.go.
+var KafkaSchema = Schema{
+	String(KBootstrapServers).RequiredWhen(KTransport, "kafka"),
+	String(KTopic).Required(),
+	String(KKafkaSecurityProtocol).OneOf("plaintext", "ssl", "sasl_plaintext", "sasl_ssl"),
+	String(KKafkaTLSCAFile),
+	String(KKafkaTLSCertFile),
+	String(KKafkaTLSKeyFile),
+	String(KKafkaTLSKeyPassword).Secret(),
+	Bool(KKafkaTLSInsecureSkipVerify),
+	String(KKafkaSASLMechanism).OneOf("PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"),
+	String(KKafkaSASLUsername),
+	String(KKafkaSASLPassword).Secret(),
+}
+
+// KafkaProducerSchema is the schema of the producer block of the kafka block. It is only used by the services which
+// produce messages.
+var KafkaProducerSchema = Schema{
+	Int(KProducerLingerMs).Between(0, 900000),
+	Int(KProducerBatchSize).Between(1, math.MaxInt32),
+	String(KProducerCompression).OneOf("none", "gzip", "snappy", "lz4", "zstd"),
+	Bool(KProducerIdempotence),
+}
+
+// HttpServerSchema is the schema of the http_server block.
+var HttpServerSchema = Schema{
+	Int(KHttpServerPort).Required().Between(1, 65535),
+}
+
+// SecretsSchema is the schema of the secrets block.
+var SecretsSchema = Schema{
+	Duration(KSecretsRefreshInterval).DurationAtLeast(0),
+	String(KVaultAddr),
+	String(KVaultToken).Secret(),
+	String(KVaultMount),
+	Duration(KVaultTimeout).DurationAtLeast(0),
+}
+
+// LoggingSchema is the schema of the logging block. The log levels are applied on every reload.
+var LoggingSchema = Schema{
+	Int(KLogVerbosity).AtLeast(0).Mutable(),
+	String(KLogVModule).Mutable(),
+}
+
+// TracingSchema is the schema of the tracing block.
+var TracingSchema = Schema{
+	Bool(KTracingEnabled),
+	String(KTracingEndpoint).RequiredWhen(KTracingEnabled, "true"),
+	Float(KTracingSampleRatio).Between(0, 1),
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Merge returns a schema with the keys of all the schemas, in order.
+func Merge(schemas ...Schema) Schema {
+	var merged Schema
+	for _, schema := range schemas {
+		merged = append(merged, schema...)
+	}
+	return merged
+}
+
+//----------------------------------------------------------------------------------------------------------------------
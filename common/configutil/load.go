@@ -0,0 +1,209 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the loading of the configuration of a service.
+//
+// The configuration is layered. Every layer overrides the ones before it.
+//
+// 1. The configuration file, defaults.yaml in the working directory unless -config is passed.
+// 2. The environment variables. The name of the variable of a key is the prefix of the service followed by the key in
+//    upper case, with the dots replaced by underscores. For example APISERVER_DB_HOST overrides db.host of the api
+//    server. A list of strings is separated by spaces.
+// 3. The -set key=value flags. The flag can be repeated, for example -set db.host=localhost -set db.port=5433.
+//
+// The layered configuration is validated against the schema of the service. With -print-config the service prints
+// the effective configuration, with the secrets masked, and exits instead of starting.
+
+package configutil
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+
+	"common/secrets"
+)
+
+// defaultFile is the configuration file when -config is not passed.
+const defaultFile = "defaults.yaml"
+
+// Flags are the command line flags of the configuration.
+type Flags struct {
+	// File is the path of the configuration file.
+	File string
+
+	// Overrides are the key=value pairs of the -set flags, in order.
+	Overrides overrides
+
+	// PrintConfig prints the effective configuration instead of starting the service.
+	PrintConfig bool
+}
+
+// overrides implements flag.Value for the repeated -set flag.
+type overrides []string
+
+var (
+	// Guards registered.
+	registeredMutex sync.Mutex
+
+	// registered are the Flags registered per flag set.
+	registered = make(map[*flag.FlagSet]*Flags)
+)
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// RegisterFlags registers the flags of the configuration. It must be called before the flags are parsed, typically
+// from a package level variable. The flags are registered once per flag set, the later calls return the same Flags,
+// so that the configuration packages of several services can be linked into one binary.
+func RegisterFlags(flags *flag.FlagSet) *Flags {
+	registeredMutex.Lock()
+	defer registeredMutex.Unlock()
+
+	if f, ok := registered[flags]; ok {
+		return f
+	}
+	f := &Flags{}
+	registered[flags] = f
+	flags.StringVar(&f.File, "config", defaultFile, "path of the configuration file")
+	flags.Var(&f.Overrides, "set", "override a configuration key, as key=value. Can be repeated.")
+	flags.BoolVar(&f.PrintConfig, "print-config", false,
+		"print the effective configuration with the secrets masked and exit")
+	return f
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Load reads the configuration file of the flags, layers the environment variables with the prefix and the overrides
+// of the flags on top of it and validates the result against the schema. The configuration is returned even if it is
+// invalid, together with the *ValidationError, so that it can still be printed. It is nil if the file cannot be read.
+func Load(schema Schema, envPrefix string, flags *Flags) (*viper.Viper, error) {
+	conf := viper.New()
+
+	conf.SetConfigFile(flags.File)
+	conf.SetConfigType("yaml")
+	if err := conf.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// The keys of the schema are bound explicitly, so that a key which is only set in the environment still shows up
+	// in the dump of the configuration.
+	conf.SetEnvPrefix(envPrefix)
+	conf.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	conf.AutomaticEnv()
+	for _, key := range schema {
+		if err := conf.BindEnv(key.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, override := range flags.Overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid override %q, expected key=value", override)
+		}
+		key, ok := schema.lookup(parts[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid override %q, %s is not a configuration key", override, parts[0])
+		}
+		conf.Set(parts[0], parseOverride(key, parts[1]))
+	}
+
+	return conf, schema.Validate(conf)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MustLoad loads the configuration like Load for the startup of a service. The service exits with all the problems of
+// the configuration if it does not match the schema. With -print-config the effective configuration is printed, with
+// the secrets masked, and the service exits.
+func MustLoad(schema Schema, envPrefix string, flags *Flags) *viper.Viper {
+	conf, err := Load(schema, envPrefix, flags)
+	if flags.PrintConfig && conf != nil {
+		if err := Print(os.Stdout, conf, schema); err != nil {
+			glog.Exitf("Failed to print the configuration: %v", err)
+		}
+	}
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+	if flags.PrintConfig {
+		os.Exit(0)
+	}
+	return conf
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Print writes the effective configuration as yaml, with the secrets of the schema masked.
+func Print(w io.Writer, conf *viper.Viper, schema Schema) error {
+	out, err := yaml.Marshal(Redacted(conf, schema))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Redacted returns all the settings of the configuration with the secrets of the schema masked, for logging.
+func Redacted(conf *viper.Viper, schema Schema) map[string]interface{} {
+	return secrets.RedactSettings(conf.AllSettings(), schema.SecretKeys())
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// String returns the key=value pairs of the -set flags.
+func (o *overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Set adds a key=value pair of a -set flag.
+func (o *overrides) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// lookup is a helper function to return the key of the schema which can be overridden by the name. That is the key
+// itself or a map of the schema in which the key is nested, like the timeout of a single api.
+func (schema Schema) lookup(name string) (Key, bool) {
+	name = strings.ToLower(name)
+	for _, key := range schema {
+		keyName := strings.ToLower(key.Name)
+		if keyName == name || (key.Type == TypeMap && strings.HasPrefix(name, keyName+".")) {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// parseOverride is a helper function to parse the value of an override as yaml, so that "-set db.port=5433" is a
+// number and "-set db.replicas.addrs=[a:5432, b:5432]" a list, like in the configuration file. The value of a string
+// key is taken as is, otherwise a password like "yes" would become a boolean.
+func parseOverride(key Key, value string) interface{} {
+	if key.Type == TypeString {
+		return value
+	}
+
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(value), &parsed); err != nil || parsed == nil {
+		return value
+	}
+	return parsed
+}
+
+//----------------------------------------------------------------------------------------------------------------------
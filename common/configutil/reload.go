@@ -0,0 +1,193 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the hot reload of the configuration.
+//
+// Changing a batch size or the log verbosity used to mean restarting the container. The Reloader watches the
+// configuration file, and reloads it on SIGHUP as well, and applies the changes of the keys which are safe to change
+// while the service runs. Those keys are tagged Mutable in the schema of the service.
+//
+// A reload goes through the same layers and the same validation as the startup. An invalid configuration is rejected
+// as a whole and the service keeps running with the current one. A changed key which is not mutable, like the kafka
+// topic, is ignored with a logged explanation, and the other changes are applied.
+//
+// The configuration object of the startup is never changed, viper is not safe for concurrent writes. Every reload
+// creates a new object which is handed to the watchers. A watcher reads the mutable keys it cares about from it.
+
+package configutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/secrets"
+)
+
+// reloadDelay is the time the reload waits after a change of the file. Editors and kubernetes write the file in
+// several steps, the reload waits until the writes settle.
+const reloadDelay = 500 * time.Millisecond
+
+// kubernetesDataDir is the symlink which kubernetes swaps when a mounted config map changes. The file itself is not
+// written, so the change is only seen on the symlink.
+const kubernetesDataDir = "..data"
+
+// Reloader reloads the configuration and hands the changes of the mutable keys to the watchers.
+type Reloader struct {
+	schema    Schema
+	envPrefix string
+	flags     *Flags
+
+	mu       sync.Mutex
+	current  *viper.Viper
+	watchers []func(conf *viper.Viper)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Mutable tags the key as safe to change while the service runs. Its changes are applied by the Reloader.
+func (key Key) Mutable() Key {
+	key.mutable = true
+	return key
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewReloader returns a new instance of Reloader for the configuration loaded with the same schema, prefix and flags.
+func NewReloader(conf *viper.Viper, schema Schema, envPrefix string, flags *Flags) *Reloader {
+	return &Reloader{
+		schema:    schema,
+		envPrefix: envPrefix,
+		flags:     flags,
+		current:   conf,
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// OnReload registers a function which is called with the new configuration whenever a mutable key changed. The
+// function is called from the go routine of Run.
+func (reloader *Reloader) OnReload(watcher func(conf *viper.Viper)) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.watchers = append(reloader.watchers, watcher)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Run is run as a go routine. It reloads the configuration when the file changes or the process receives SIGHUP,
+// until the context is cancelled.
+func (reloader *Reloader) Run(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	// The directory is watched instead of the file, because an editor replaces the file with a new one.
+	file, err := filepath.Abs(reloader.flags.File)
+	if err != nil {
+		file = reloader.flags.File
+	}
+	var events chan fsnotify.Event
+	var errors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(file))
+	}
+	if err != nil {
+		glog.Errorf("Failed to watch %s, the configuration is only reloaded on SIGHUP: %v", file, err)
+	} else {
+		defer watcher.Close()
+		events, errors = watcher.Events, watcher.Errors
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			glog.Infoln("Received SIGHUP, reloading the configuration")
+			reloader.Reload()
+		case event := <-events:
+			name := filepath.Base(event.Name)
+			if filepath.Clean(event.Name) == file || name == kubernetesDataDir {
+				settled = time.After(reloadDelay)
+			}
+		case err := <-errors:
+			glog.Errorf("Failed to watch %s: %v", file, err)
+		case <-settled:
+			settled = nil
+			glog.Infof("%s changed, reloading the configuration", file)
+			reloader.Reload()
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Reload loads the configuration again and applies the changes of the mutable keys. The changes of the other keys
+// are ignored. An invalid configuration is rejected and the current one is kept.
+func (reloader *Reloader) Reload() error {
+	next, err := Load(reloader.schema, reloader.envPrefix, reloader.flags)
+	if err != nil {
+		glog.Errorf("Rejected the reloaded configuration, keeping the current one: %v", err)
+		return err
+	}
+
+	reloader.mu.Lock()
+	current := reloader.current
+
+	// The immutable keys keep their current values, so that the new configuration is the effective one.
+	var changed []string
+	for _, key := range reloader.schema {
+		before, after := current.Get(key.Name), next.Get(key.Name)
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		if !key.mutable {
+			glog.Warningf("Ignoring the change of %s from %s to %s, it is only applied on a restart",
+				key.Name, key.display(before), key.display(after))
+			next.Set(key.Name, before)
+			continue
+		}
+		glog.Infof("Applying the change of %s from %s to %s", key.Name, key.display(before), key.display(after))
+		changed = append(changed, key.Name)
+	}
+
+	if len(changed) == 0 {
+		reloader.mu.Unlock()
+		glog.Infoln("No mutable configuration changed")
+		return nil
+	}
+	reloader.current = next
+	watchers := reloader.watchers
+	reloader.mu.Unlock()
+
+	for _, watcher := range watchers {
+		watcher(next)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// display is a helper function to format the value of the key in the logs. The values of the secrets are redacted.
+func (key Key) display(value interface{}) string {
+	if key.secret {
+		return secrets.Redacted
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
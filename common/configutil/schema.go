@@ -0,0 +1,304 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the schema against which the configuration of a service is validated on startup.
+//
+// viper returns the zero value for a key which is missing or misspelled in defaults.yaml, so a typo used to surface
+// as a port of 0 or an empty topic somewhere deep in the service. Every service now describes its keys in a schema,
+// with their types, whether they are required and their allowed ranges, and refuses to start when the configuration
+// does not match. All the problems are reported at once, not one per restart.
+//
+// A schema is a list of keys, built like this.
+//
+// var Schema = configutil.Schema{
+//   configutil.Int(KWebServerPort).Required().Between(1, 65535),
+//   configutil.String(KStorageBackend).OneOf("postgres", "clickhouse", "sqlite"),
+//   configutil.String(KClickHouseAddr).RequiredWhen(KStorageBackend, "clickhouse"),
+//   configutil.String(KPassword).Secret(),
+//   configutil.Int(KLogVerbosity).AtLeast(0).Mutable(),
+// }
+
+package configutil
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Type is the type of the value of a key.
+type Type int
+
+const (
+	TypeString Type = iota
+	TypeInt
+	TypeFloat
+	TypeBool
+	TypeDuration
+	TypeStringSlice
+
+	// TypeMap is a nested block whose keys are not known up front, for example the timeouts of the apis.
+	TypeMap
+
+	// TypeList is a list of nested blocks, for example the extraction rules.
+	TypeList
+)
+
+// typeNames are the names of the types in the validation errors.
+var typeNames = map[Type]string{
+	TypeString:      "a string",
+	TypeInt:         "an integer",
+	TypeFloat:       "a number",
+	TypeBool:        "a boolean",
+	TypeDuration:    "a duration",
+	TypeStringSlice: "a list of strings",
+	TypeMap:         "a map",
+	TypeList:        "a list",
+}
+
+// Key describes a key of the configuration.
+type Key struct {
+	// Name is the dotted path of the key, for example "db.port".
+	Name string
+
+	// Type is the type of the value.
+	Type Type
+
+	required bool
+
+	// requiredWhen makes the key required when the key requiredKey has the value requiredValue.
+	requiredKey   string
+	requiredValue string
+
+	// min and max bound the numbers, and the durations in nanoseconds, when bounded is set.
+	bounded  bool
+	min, max float64
+
+	oneOf   []string
+	secret  bool
+	mutable bool
+}
+
+// Schema is the list of the keys of the configuration of a service.
+type Schema []Key
+
+// ValidationError lists all the problems of a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// String returns a key whose value is a string.
+func String(name string) Key { return Key{Name: name, Type: TypeString} }
+
+// Int returns a key whose value is an integer.
+func Int(name string) Key { return Key{Name: name, Type: TypeInt} }
+
+// Float returns a key whose value is a number.
+func Float(name string) Key { return Key{Name: name, Type: TypeFloat} }
+
+// Bool returns a key whose value is a boolean.
+func Bool(name string) Key { return Key{Name: name, Type: TypeBool} }
+
+// Duration returns a key whose value is a duration like "30s".
+func Duration(name string) Key { return Key{Name: name, Type: TypeDuration} }
+
+// StringSlice returns a key whose value is a list of strings.
+func StringSlice(name string) Key { return Key{Name: name, Type: TypeStringSlice} }
+
+// Map returns a key whose value is a nested block.
+func Map(name string) Key { return Key{Name: name, Type: TypeMap} }
+
+// List returns a key whose value is a list of nested blocks.
+func List(name string) Key { return Key{Name: name, Type: TypeList} }
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Required makes the key required. A required string must not be empty.
+func (key Key) Required() Key {
+	key.required = true
+	return key
+}
+
+// RequiredWhen makes the key required when the other key has the value, for example the address of ClickHouse when
+// it is the storage backend.
+func (key Key) RequiredWhen(other string, value string) Key {
+	key.requiredKey = other
+	key.requiredValue = value
+	return key
+}
+
+// Between bounds the value of a number key, inclusive.
+func (key Key) Between(min, max float64) Key {
+	key.bounded = true
+	key.min, key.max = min, max
+	return key
+}
+
+// AtLeast bounds the value of a number key from below, inclusive.
+func (key Key) AtLeast(min float64) Key {
+	return key.Between(min, math.Inf(1))
+}
+
+// DurationBetween bounds the value of a duration key, inclusive.
+func (key Key) DurationBetween(min, max time.Duration) Key {
+	return key.Between(float64(min), float64(max))
+}
+
+// DurationAtLeast bounds the value of a duration key from below, inclusive.
+func (key Key) DurationAtLeast(min time.Duration) Key {
+	return key.Between(float64(min), math.Inf(1))
+}
+
+// OneOf restricts the value of a string key to the values. An empty value is allowed unless the key is required.
+func (key Key) OneOf(values ...string) Key {
+	key.oneOf = values
+	return key
+}
+
+// Secret tags the key as a secret. Its value is redacted in the logs and in the dumps of the configuration.
+func (key Key) Secret() Key {
+	key.secret = true
+	return key
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// SecretKeys returns the names of the keys tagged as secrets.
+func (schema Schema) SecretKeys() []string {
+	var keys []string
+	for _, key := range schema {
+		if key.secret {
+			keys = append(keys, key.Name)
+		}
+	}
+	return keys
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Validate checks the configuration against the schema. It returns a *ValidationError with all the problems, or nil.
+func (schema Schema) Validate(conf *viper.Viper) error {
+	var problems []string
+	for _, key := range schema {
+		if problem := key.validate(conf); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", key.Name, problem))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return &ValidationError{Problems: problems}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Error returns all the problems, one per line.
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration, %d problems:\n  - %s", len(err.Problems),
+		strings.Join(err.Problems, "\n  - "))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// validate is a helper function to check the value of a single key. It returns the problem, or an empty string.
+func (key Key) validate(conf *viper.Viper) string {
+	required := key.required ||
+		(key.requiredKey != "" && conf.GetString(key.requiredKey) == key.requiredValue)
+
+	if !conf.IsSet(key.Name) || conf.Get(key.Name) == nil {
+		if required {
+			return "is required but not set"
+		}
+		return ""
+	}
+	value := conf.Get(key.Name)
+
+	var number float64
+	var err error
+	switch key.Type {
+	case TypeString:
+		var text string
+		if text, err = cast.ToStringE(value); err != nil {
+			break
+		}
+		if text == "" {
+			if required {
+				return "is required but empty"
+			}
+			return ""
+		}
+		if len(key.oneOf) > 0 && !contains(key.oneOf, text) {
+			return fmt.Sprintf("is %q, must be one of %s", text, strings.Join(key.oneOf, ", "))
+		}
+	case TypeInt:
+		var integer int64
+		integer, err = cast.ToInt64E(value)
+		number = float64(integer)
+	case TypeFloat:
+		number, err = cast.ToFloat64E(value)
+	case TypeBool:
+		_, err = cast.ToBoolE(value)
+	case TypeDuration:
+		var duration time.Duration
+		duration, err = cast.ToDurationE(value)
+		number = float64(duration)
+	case TypeStringSlice:
+		_, err = cast.ToStringSliceE(value)
+	case TypeMap:
+		_, err = cast.ToStringMapE(value)
+	case TypeList:
+		if kind := reflect.ValueOf(value).Kind(); kind != reflect.Slice && kind != reflect.Array {
+			err = fmt.Errorf("unable to cast %#v of type %T to a list", value, value)
+		}
+	}
+	if err != nil {
+		return fmt.Sprintf("must be %s, got %v", typeNames[key.Type], value)
+	}
+
+	if key.bounded && (number < key.min || number > key.max) {
+		return fmt.Sprintf("is %v, must be %s", value, key.describeRange())
+	}
+	return ""
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// describeRange is a helper function to describe the range of the key in a validation error.
+func (key Key) describeRange() string {
+	format := func(bound float64) string {
+		if key.Type == TypeDuration {
+			return time.Duration(bound).String()
+		}
+		return cast.ToString(bound)
+	}
+
+	if math.IsInf(key.max, 1) {
+		return "at least " + format(key.min)
+	}
+	return fmt.Sprintf("between %s and %s", format(key.min), format(key.max))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// contains is a helper function to check if the value is one of the values.
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------
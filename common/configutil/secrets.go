@@ -0,0 +1,40 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the construction of the secret store from the secrets block of the configuration.
+//
+// The secrets of a service come from the blocks it uses, for example the postgres password of the db block and the
+// SASL password of the kafka block. Every block lists its secrets (please refer to dbutil.SecretRefs and
+// kafkautil.SecretRefs) and the service resolves them all in one store.
+
+package configutil
+
+import (
+	"context"
+
+	"github.com/spf13/viper"
+
+	"common/secrets"
+)
+
+// NewSecretStore resolves the secrets of the configuration. refs maps the keys of the secrets to their references.
+// The store must be refreshed periodically to pick up the rotated credentials. Please refer to secrets/secrets.go.
+func NewSecretStore(ctx context.Context, conf *viper.Viper, refs ...map[string]string) (*secrets.Store, error) {
+	// The vault token is resolved by the store before vault can be used.
+	merged := map[string]string{}
+	for _, blockRefs := range refs {
+		for key, ref := range blockRefs {
+			merged[key] = ref
+		}
+	}
+
+	return secrets.NewStore(ctx, merged, secrets.VaultConfig{
+		Addr:    conf.GetString(KVaultAddr),
+		Token:   conf.GetString(KVaultToken),
+		Mount:   conf.GetString(KVaultMount),
+		Timeout: conf.GetDuration(KVaultTimeout),
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
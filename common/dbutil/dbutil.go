@@ -0,0 +1,266 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the connection setup of the storage backends shared by the services.
+//
+// GO-PG is an ORM tool to interact with postgres SQL. It can be thought of as hibernate equivalent.
+//
+// The log-subscriber and the api server used to connect to postgres each in their own way. Only the api server had
+// the pool and TLS settings and the query logging. Both now connect through this package, with the db block of their
+// defaults.yaml. Please refer to configutil/keys.go for the keys.
+
+package dbutil
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-pg/pg/v10"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"common/configutil"
+	"common/schema"
+	"common/secrets"
+	"common/storage"
+)
+
+// tracer traces the queries. It picks up the tracer provider installed by the service, so the spans carry the name of
+// the service.
+var tracer = otel.Tracer("common/dbutil")
+
+// QueryHook is a go-pg query hook which traces every query as a child span of the context of the query, so the
+// queries show up under the span of the http request or of the kafka message. It also logs every query when
+// db.log_queries is set. The secrets are redacted from the logged queries.
+type QueryHook struct {
+	secrets    *secrets.Store
+	logQueries bool
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewQueryHook returns a new instance of QueryHook.
+func NewQueryHook(conf *viper.Viper, secretStore *secrets.Store) QueryHook {
+	return QueryHook{secrets: secretStore, logQueries: conf.GetBool(configutil.KLogQueries)}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// BeforeQuery starts the span of the query.
+func (hook QueryHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	ctx, _ = tracer.Start(ctx, "postgres query", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	return ctx, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// AfterQuery logs the query and ends its span. The statement is recorded in the span without the parameters.
+func (hook QueryHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	if hook.logQueries {
+		query, err := event.FormattedQuery()
+		if err != nil {
+			glog.Errorln(err.Error())
+		}
+		glog.Infof("%s (%s)", hook.secrets.Redact(string(query)), time.Since(event.StartTime))
+	}
+
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return nil
+	}
+	defer span.End()
+
+	if query, err := event.UnformattedQuery(); err == nil {
+		span.SetAttributes(semconv.DBStatementKey.String(string(query)))
+	}
+	if event.Err != nil && event.Err != pg.ErrNoRows {
+		span.RecordError(event.Err)
+		span.SetStatus(codes.Error, "query failed")
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewPostgres returns a new instance of go pg DB object. Using this object the postgres queries can be made.
+// Please note that this will also connect to the postgres db. The object reconnects with the new password when the
+// password is rotated in the secret store.
+func NewPostgres(conf *viper.Viper, secretStore *secrets.Store) (*storage.RotatingDB, error) {
+	host := conf.GetString(configutil.KHost)
+	port := conf.GetInt(configutil.KPort)
+
+	// Printing this information to make sure the config is correctly loaded into the config object. The password is
+	// a secret and never logged.
+	glog.Infof("the postgres server %s:%d, user %s, database %s", host, port, conf.GetString(configutil.KUsername),
+		conf.GetString(configutil.KDatabaseName))
+
+	options, err := Options(conf, secretStore, fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	db := storage.NewRotatingDB(options, NewQueryHook(conf, secretStore))
+	secretStore.Watch(configutil.KPassword, db.Rotate)
+	return db, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Options builds the connection options of the postgres server at addr from the db block of the configuration. The
+// primary and the read replicas of the api server share the same options except for the address.
+func Options(conf *viper.Viper, secretStore *secrets.Store, addr string) (*pg.Options, error) {
+	tlsConfig, err := newTLSConfig(conf, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The statement_timeout bounds every query on the server side, even if the client never cancels it.
+	statementTimeout := conf.GetDuration(configutil.KStatementTimeout)
+
+	options := &pg.Options{
+		User:            conf.GetString(configutil.KUsername),
+		Password:        secretStore.Get(configutil.KPassword),
+		Addr:            addr,
+		Database:        conf.GetString(configutil.KDatabaseName),
+		TLSConfig:       tlsConfig,
+		PoolSize:        conf.GetInt(configutil.KPoolSize),
+		MinIdleConns:    conf.GetInt(configutil.KMinIdleConns),
+		MaxConnAge:      conf.GetDuration(configutil.KMaxConnAge),
+		IdleTimeout:     conf.GetDuration(configutil.KIdleTimeout),
+		PoolTimeout:     conf.GetDuration(configutil.KPoolTimeout),
+		MaxRetries:      conf.GetInt(configutil.KMaxRetries),
+		MinRetryBackoff: conf.GetDuration(configutil.KMinRetryBackoff),
+		MaxRetryBackoff: conf.GetDuration(configutil.KMaxRetryBackoff),
+		OnConnect: func(ctx context.Context, cn *pg.Conn) error {
+			if statementTimeout <= 0 {
+				return nil
+			}
+			_, err := cn.ExecContext(ctx, "SET statement_timeout = ?", statementTimeout.Milliseconds())
+			return err
+		},
+	}
+
+	glog.Infof("postgres %s: pool_size=%d min_idle_conns=%d max_conn_age=%v idle_timeout=%v max_retries=%d tls=%t",
+		addr, options.PoolSize, options.MinIdleConns, options.MaxConnAge, options.IdleTimeout, options.MaxRetries,
+		tlsConfig != nil)
+	return options, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Migrate applies the pending schema migrations. It is safe to call from several replicas at once, the migrations are
+// applied by exactly one of them.
+func Migrate(ctx context.Context, db *pg.DB) error {
+	migrator, err := schema.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Applied %d schema migrations", applied)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewClickHouse returns a new connection pool to ClickHouse. The connections are established lazily. The
+// statement_timeout of the db block is the max_execution_time of every query, so both backends have the same upper
+// bound. The pool reconnects with the new password when the password is rotated in the secret store.
+func NewClickHouse(conf *viper.Viper, secretStore *secrets.Store) (driver.Conn, error) {
+	settings := clickhouse.Settings{}
+	if statementTimeout := conf.GetDuration(configutil.KStatementTimeout); statementTimeout > 0 {
+		settings["max_execution_time"] = int(statementTimeout.Seconds())
+	}
+
+	conn, err := storage.NewRotatingClickHouse(&clickhouse.Options{
+		Addr: []string{conf.GetString(configutil.KClickHouseAddr)},
+		Auth: clickhouse.Auth{
+			Database: conf.GetString(configutil.KClickHouseDatabase),
+			Username: conf.GetString(configutil.KClickHouseUsername),
+			Password: secretStore.Get(configutil.KClickHousePassword),
+		},
+		Settings: settings,
+	})
+	if err != nil {
+		return nil, err
+	}
+	secretStore.Watch(configutil.KClickHousePassword, conn.Rotate)
+	return conn, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewSQLite returns the embedded SQLite database at the path in the configuration.
+func NewSQLite(conf *viper.Viper) (*sql.DB, error) {
+	path := conf.GetString(configutil.KSQLitePath)
+	glog.Infoln("the sqlite path", path)
+	return schema.OpenSQLite(path)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newTLSConfig is a helper function to build the TLS configuration of the connections to the postgres server at addr.
+// nil is returned when TLS is disabled, which connects in plain text.
+func newTLSConfig(conf *viper.Viper, addr string) (*tls.Config, error) {
+	if !conf.GetBool(configutil.KTLSEnabled) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         conf.GetString(configutil.KTLSServerName),
+		InsecureSkipVerify: conf.GetBool(configutil.KTLSInsecureSkipVerify),
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	// The certificate is verified against the host of the server unless the name is configured.
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid postgres address %s: %w", addr, err)
+		}
+		tlsConfig.ServerName = host
+	}
+
+	if caFile := conf.GetString(configutil.KTLSCAFile); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the postgres ca file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the postgres ca file %s", caFile)
+		}
+	}
+
+	certFile := conf.GetString(configutil.KTLSCertFile)
+	keyFile := conf.GetString(configutil.KTLSKeyFile)
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the postgres client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,70 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the schema and the secrets of the configuration of the storage backends.
+
+package dbutil
+
+import (
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/storage"
+)
+
+// DatabaseSchema is the schema of the db block. The connection keys are required when postgres is the storage
+// backend, the keys of the pool and TLS fall back to the defaults of go-pg.
+var DatabaseSchema = configutil.Schema{
+	configutil.String(configutil.KHost).RequiredWhen(configutil.KStorageBackend, storage.BackendPostgres),
+	configutil.Int(configutil.KPort).RequiredWhen(configutil.KStorageBackend, storage.BackendPostgres).
+		Between(1, 65535),
+	configutil.String(configutil.KUsername).RequiredWhen(configutil.KStorageBackend, storage.BackendPostgres),
+	configutil.String(configutil.KPassword).Secret(),
+	configutil.String(configutil.KDatabaseName).RequiredWhen(configutil.KStorageBackend, storage.BackendPostgres),
+	configutil.Bool(configutil.KMigrateOnStartup),
+	configutil.Bool(configutil.KLogQueries),
+	configutil.Duration(configutil.KStatementTimeout).DurationAtLeast(0),
+	configutil.Int(configutil.KPoolSize).AtLeast(0),
+	configutil.Int(configutil.KMinIdleConns).AtLeast(0),
+	configutil.Duration(configutil.KMaxConnAge).DurationAtLeast(0),
+	configutil.Duration(configutil.KIdleTimeout).DurationAtLeast(0),
+	configutil.Duration(configutil.KPoolTimeout).DurationAtLeast(0),
+	configutil.Int(configutil.KMaxRetries).AtLeast(0),
+	configutil.Duration(configutil.KMinRetryBackoff).DurationAtLeast(0),
+	configutil.Duration(configutil.KMaxRetryBackoff).DurationAtLeast(0),
+	configutil.Bool(configutil.KTLSEnabled),
+	configutil.String(configutil.KTLSCAFile),
+	configutil.String(configutil.KTLSCertFile),
+	configutil.String(configutil.KTLSKeyFile),
+	configutil.String(configutil.KTLSServerName),
+	configutil.Bool(configutil.KTLSInsecureSkipVerify),
+}
+
+// StorageSchema is the schema of the storage, clickhouse and sqlite blocks.
+var StorageSchema = configutil.Schema{
+	configutil.String(configutil.KStorageBackend).Required().
+		OneOf(storage.BackendPostgres, storage.BackendClickHouse, storage.BackendSQLite),
+	configutil.String(configutil.KClickHouseAddr).RequiredWhen(configutil.KStorageBackend, storage.BackendClickHouse),
+	configutil.String(configutil.KClickHouseDatabase),
+	configutil.String(configutil.KClickHouseUsername),
+	configutil.String(configutil.KClickHousePassword).Secret(),
+	configutil.String(configutil.KSQLitePath).RequiredWhen(configutil.KStorageBackend, storage.BackendSQLite),
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// SecretRefs returns the references of the secrets of the storage backends, to be resolved by
+// configutil.NewSecretStore. Only the password of the selected storage backend must be resolvable.
+func SecretRefs(conf *viper.Viper) map[string]string {
+	refs := map[string]string{}
+	switch conf.GetString(configutil.KStorageBackend) {
+	case storage.BackendPostgres:
+		refs[configutil.KPassword] = conf.GetString(configutil.KPassword)
+	case storage.BackendClickHouse:
+		refs[configutil.KClickHousePassword] = conf.GetString(configutil.KClickHousePassword)
+	}
+	return refs
+}
+
+//----------------------------------------------------------------------------------------------------------------------
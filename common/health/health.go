@@ -0,0 +1,249 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the health checks of the log-processor and the log-subscriber.
+//
+// The http server exposes two endpoints for the orchestrators.
+//
+// 1. /healthz (liveness): The process and its workers are alive. Every worker of the log-subscriber beats its
+//    heartbeat at least once per poll of kafka. A worker which did not beat for a while is stuck and the orchestrator
+//    should restart the container.
+// 2. /readyz (readiness): The liveness checks and all the dependencies are reachable. For example kafka, postgres and
+//    the sanitized logs directory is writable. The orchestrator should hold the traffic until the service is ready.
+//
+// Both the endpoints respond with 200 if all the checks pass and 503 otherwise. The body has the result of every
+// check. For example,
+//
+//     {"status": "unavailable", "checks": {"kafka": "ok", "postgres": "dial tcp: connection refused"}}
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// StatusOK is the status of a passing check and of the service when all the checks pass.
+	StatusOK = "ok"
+
+	// StatusUnavailable is the status of the service when at least one check fails.
+	StatusUnavailable = "unavailable"
+
+	// checkTimeout is the maximum time a single check can take.
+	checkTimeout = 2 * time.Second
+)
+
+// Check is a single health check. It returns nil if the check passes.
+type Check func(ctx context.Context) error
+
+// Response is the body of the health endpoints.
+type Response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Checker holds the liveness and the readiness checks of the service.
+type Checker struct {
+	// Guards all the fields below.
+	mutex sync.Mutex
+
+	// liveness checks by name.
+	liveness map[string]Check
+
+	// readiness checks by name.
+	readiness map[string]Check
+}
+
+// NewChecker returns a new instance of Checker with no checks.
+func NewChecker() *Checker {
+	return &Checker{
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// AddLivenessCheck adds a check to the liveness endpoint. The liveness checks are also part of the readiness endpoint.
+func (checker *Checker) AddLivenessCheck(name string, check Check) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.liveness[name] = check
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// AddReadinessCheck adds a check to the readiness endpoint.
+func (checker *Checker) AddReadinessCheck(name string, check Check) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.readiness[name] = check
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LivenessHandler returns the http handler of the /healthz endpoint.
+func (checker *Checker) LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checker.mutex.Lock()
+		checks := copyChecks(checker.liveness)
+		checker.mutex.Unlock()
+
+		writeResponse(w, runChecks(r.Context(), checks))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ReadinessHandler returns the http handler of the /readyz endpoint.
+func (checker *Checker) ReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checker.mutex.Lock()
+		checks := copyChecks(checker.liveness, checker.readiness)
+		checker.mutex.Unlock()
+
+		writeResponse(w, runChecks(r.Context(), checks))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Heartbeat records the last time a worker made progress. The zero value is not alive until the first beat.
+type Heartbeat struct {
+	// lastBeat is the unix nano timestamp of the last beat.
+	lastBeat int64
+}
+
+// Beat records that the worker is alive now.
+func (heartbeat *Heartbeat) Beat() {
+	atomic.StoreInt64(&heartbeat.lastBeat, time.Now().UnixNano())
+}
+
+// Check returns a check which fails if the worker did not beat in the last maxAge.
+func (heartbeat *Heartbeat) Check(maxAge time.Duration) Check {
+	return func(ctx context.Context) error {
+		lastBeat := atomic.LoadInt64(&heartbeat.lastBeat)
+		if lastBeat == 0 {
+			return fmt.Errorf("not started")
+		}
+
+		age := time.Since(time.Unix(0, lastBeat))
+		if age > maxAge {
+			return fmt.Errorf("no heartbeat for %s", age.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// WritableDirCheck returns a check which fails if a file cannot be created in the directory.
+func WritableDirCheck(dir string) Check {
+	return func(ctx context.Context) error {
+		file, err := os.CreateTemp(dir, ".healthz-*")
+		if err != nil {
+			return err
+		}
+
+		// Clean up the probe file.
+		name := file.Name()
+		if err := file.Close(); err != nil {
+			return err
+		}
+		return os.Remove(name)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// runChecks is a helper function to run all the checks in parallel. Every check is bounded by the check timeout.
+func runChecks(ctx context.Context, checks map[string]Check) *Response {
+	response := &Response{
+		Status: StatusOK,
+		Checks: make(map[string]string, len(checks)),
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			err := check(checkCtx)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				response.Status = StatusUnavailable
+				response.Checks[name] = err.Error()
+				return
+			}
+			response.Checks[name] = StatusOK
+		}(name, check)
+	}
+	wg.Wait()
+
+	return response
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// writeResponse is a helper function to write the response of the health endpoints.
+func writeResponse(w http.ResponseWriter, response *Response) {
+	code := http.StatusOK
+	if response.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+		glog.Warningf("health check failed: %v", response.Checks)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		glog.Errorf("failed to write the health response: %v", err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// copyChecks is a helper function to merge the check maps into a new map. Must be called with the mutex held.
+func copyChecks(checkMaps ...map[string]Check) map[string]Check {
+	checks := make(map[string]Check)
+	for _, checkMap := range checkMaps {
+		for name, check := range checkMap {
+			checks[name] = check
+		}
+	}
+	return checks
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// TimeoutMs converts the deadline of the context of a check to the timeout in milliseconds expected by the clients
+// which do not take a context, like the kafka client.
+func TimeoutMs(ctx context.Context) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return int(checkTimeout.Milliseconds())
+	}
+
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining < 1 {
+		remaining = 1
+	}
+	return int(remaining)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
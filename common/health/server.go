@@ -0,0 +1,38 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the http server of the log-processor and the log-subscriber.
+//
+// These services do not serve any api. The http server only exposes the operational endpoints.
+//
+// 1. /metrics: The prometheus metrics.
+// 2. /healthz: The liveness checks.
+// 3. /readyz: The readiness checks.
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+)
+
+// StartServer starts the http server on the port of the http_server block. This is a blocking call.
+func StartServer(conf *viper.Viper, checker *Checker) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", checker.LivenessHandler())
+	mux.Handle("/readyz", checker.ReadinessHandler())
+
+	addr := fmt.Sprintf(":%d", conf.GetInt(configutil.KHttpServerPort))
+	glog.Infoln("Starting http server on port :", addr)
+	glog.Fatal(http.ListenAndServe(addr, mux))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
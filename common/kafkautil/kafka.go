@@ -0,0 +1,345 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the construction of the kafka clients shared by the services.
+//
+// Every kafka client, the admin client, the producer of the log-processor and the consumers of the log-subscriber, is
+// created from the kafka block of the configuration through ClientConfig. So a setting which applies to all the
+// clients is added in one place.
+//
+// The production cluster rejects plain text connections. The clients connect with the security protocol of the
+// configuration, over TLS with an optional client certificate, and authenticate with SASL/PLAIN or SASL/SCRAM.
+//
+// kafka:
+//   security_protocol: sasl_ssl
+//   tls:
+//     ca_file: /etc/kafka/ca.pem
+//   sasl:
+//     mechanism: SCRAM-SHA-512
+//     username: olap
+//     password: "file:/run/secrets/kafka_password"
+//
+// The SASL password and the password of the key file are secrets. They are read from the secret store when a client is
+// created, so a rotated password is only picked up on a restart.
+
+package kafkautil
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/health"
+	"common/secrets"
+)
+
+// metadataTimeoutMs is the timeout to query the metadata of a topic from the broker.
+const metadataTimeoutMs = 5000
+
+// The security protocols of the connections to the brokers.
+const (
+	ProtocolPlaintext     = "plaintext"
+	ProtocolSSL           = "ssl"
+	ProtocolSASLPlaintext = "sasl_plaintext"
+	ProtocolSASLSSL       = "sasl_ssl"
+)
+
+// MetadataClient is the subset of the kafka clients used to query the metadata of a topic. It is implemented by the
+// admin client, the producer and the consumer.
+type MetadataClient interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// SecretRefs returns the references of the secrets of the kafka block, to be resolved by configutil.NewSecretStore.
+func SecretRefs(conf *viper.Viper) map[string]string {
+	refs := map[string]string{}
+	protocol := conf.GetString(configutil.KKafkaSecurityProtocol)
+	if isSASL(protocol) {
+		refs[configutil.KKafkaSASLPassword] = conf.GetString(configutil.KKafkaSASLPassword)
+	}
+	if isTLS(protocol) && conf.GetString(configutil.KKafkaTLSKeyPassword) != "" {
+		refs[configutil.KKafkaTLSKeyPassword] = conf.GetString(configutil.KKafkaTLSKeyPassword)
+	}
+	return refs
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ClientConfig returns the configuration shared by all the kafka clients. The passwords are obtained from the secret
+// store. An error is returned if the security settings do not fit together.
+func ClientConfig(conf *viper.Viper, secretStore *secrets.Store) (*kafka.ConfigMap, error) {
+	clientConfig := &kafka.ConfigMap{"bootstrap.servers": conf.GetString(configutil.KBootstrapServers)}
+
+	protocol := conf.GetString(configutil.KKafkaSecurityProtocol)
+	if protocol == "" {
+		protocol = ProtocolPlaintext
+	}
+	if err := clientConfig.SetKey("security.protocol", protocol); err != nil {
+		return nil, err
+	}
+
+	if isTLS(protocol) {
+		if err := setTLS(conf, secretStore, clientConfig); err != nil {
+			return nil, err
+		}
+	} else if conf.GetString(configutil.KKafkaTLSCAFile) != "" || conf.GetString(configutil.KKafkaTLSCertFile) != "" {
+		glog.Warningf("%s is ignored with the security protocol %s", configutil.KGroupKafkaTLS, protocol)
+	}
+
+	if isSASL(protocol) {
+		if err := setSASL(conf, secretStore, clientConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return clientConfig, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewAdminClient creates and returns a new kafka admin client. The caller must close it.
+func NewAdminClient(conf *viper.Viper, secretStore *secrets.Store) (*kafka.AdminClient, error) {
+	clientConfig, err := ClientConfig(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+	return kafka.NewAdminClient(clientConfig)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewProducer creates and returns a new kafka producer instance, tuned with the producer block of the configuration.
+func NewProducer(conf *viper.Viper, secretStore *secrets.Store) (*kafka.Producer, error) {
+	clientConfig, err := ClientConfig(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+
+	// The settings which are not configured keep the defaults of librdkafka.
+	settings := kafka.ConfigMap{}
+	if conf.IsSet(configutil.KProducerLingerMs) {
+		settings["linger.ms"] = conf.GetInt(configutil.KProducerLingerMs)
+	}
+	if conf.IsSet(configutil.KProducerBatchSize) {
+		settings["batch.size"] = conf.GetInt(configutil.KProducerBatchSize)
+	}
+	if conf.IsSet(configutil.KProducerCompression) {
+		settings["compression.type"] = conf.GetString(configutil.KProducerCompression)
+	}
+	if conf.IsSet(configutil.KProducerIdempotence) {
+		settings["enable.idempotence"] = conf.GetBool(configutil.KProducerIdempotence)
+	}
+	for key, value := range settings {
+		if err := clientConfig.SetKey(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	glog.Infof("kafka producer: linger_ms=%v batch_size=%v compression=%v enable_idempotence=%v",
+		conf.Get(configutil.KProducerLingerMs), conf.Get(configutil.KProducerBatchSize),
+		conf.Get(configutil.KProducerCompression), conf.Get(configutil.KProducerIdempotence))
+	return kafka.NewProducer(clientConfig)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewConsumer creates and returns a new kafka consumer in the consumer group. A new consumer group starts from the
+// earliest message of the topic.
+func NewConsumer(conf *viper.Viper, secretStore *secrets.Store, consumerGroupId string) (*kafka.Consumer, error) {
+	consumerConfig, err := ClientConfig(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+	if err := consumerConfig.SetKey("group.id", consumerGroupId); err != nil {
+		return nil, err
+	}
+	if err := consumerConfig.SetKey("auto.offset.reset", "earliest"); err != nil {
+		return nil, err
+	}
+	// The offsets are stored for the next commit once the messages are processed. Please refer to messageq/kafka.go.
+	if err := consumerConfig.SetKey("enable.auto.offset.store", false); err != nil {
+		return nil, err
+	}
+	return kafka.NewConsumer(consumerConfig)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MaybeCreateTopic creates the topic of the configuration in the kafka cluster. The topic will be created only if the
+// topic does not exist.
+func MaybeCreateTopic(conf *viper.Viper, secretStore *secrets.Store) error {
+	topic := conf.GetString(configutil.KTopic)
+
+	adminClient, err := NewAdminClient(conf, secretStore)
+	if err != nil {
+		return err
+	}
+	defer adminClient.Close()
+
+	// Check if the topic already exists.
+	exists, err := topicExists(topic, adminClient)
+	if err != nil {
+		return err
+	}
+	if exists {
+		glog.Infoln("Kafka topic", topic, "already exists")
+		return nil
+	}
+
+	// If we reach here, the topic does not exist. Create one.
+	if err := createTopic(topic, adminClient); err != nil {
+		return err
+	}
+	glog.Infoln("Kafka topic", topic, "created successfully")
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// HealthCheck returns a check which fails if the kafka brokers are not reachable or the topic does not exist.
+func HealthCheck(client MetadataClient, topic string) health.Check {
+	return func(ctx context.Context) error {
+		metadata, err := client.GetMetadata(&topic, false, health.TimeoutMs(ctx))
+		if err != nil {
+			return err
+		}
+
+		topicMetadata, ok := metadata.Topics[topic]
+		if !ok {
+			return fmt.Errorf("topic %s does not exist", topic)
+		}
+		if topicMetadata.Error.Code() != kafka.ErrNoError {
+			return topicMetadata.Error
+		}
+		return nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// topicExists is a helper function to check if the topic exists in the given kafka broker.
+func topicExists(topic string, client MetadataClient) (bool, error) {
+	topics, err := client.GetMetadata(&topic, false, metadataTimeoutMs)
+	if err != nil {
+		return false, err
+	}
+
+	// Iterate over all the topics that are present and check if the topic exists.
+	for _, t := range topics.Topics {
+		if t.Topic == topic && t.Error.Code() != kafka.ErrUnknownTopicOrPart {
+			return true, nil
+		}
+	}
+
+	// If we reach here the topic does not exist.
+	return false, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// createTopic is a helper function to create the kafka topic.
+func createTopic(topic string, adminClient *kafka.AdminClient) error {
+	topics := []kafka.TopicSpecification{{
+		Topic:             topic,
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+	}}
+
+	results, err := adminClient.CreateTopics(context.Background(), topics)
+	if err != nil {
+		return err
+	}
+
+	// The errors of the single topics are reported in the results.
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError && result.Error.Code() != kafka.ErrTopicAlreadyExists {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setTLS is a helper function to set the TLS settings of the configuration on the client configuration.
+func setTLS(conf *viper.Viper, secretStore *secrets.Store, clientConfig *kafka.ConfigMap) error {
+	certFile := conf.GetString(configutil.KKafkaTLSCertFile)
+	keyFile := conf.GetString(configutil.KKafkaTLSKeyFile)
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("%s and %s must be set together", configutil.KKafkaTLSCertFile, configutil.KKafkaTLSKeyFile)
+	}
+
+	settings := kafka.ConfigMap{}
+	if caFile := conf.GetString(configutil.KKafkaTLSCAFile); caFile != "" {
+		settings["ssl.ca.location"] = caFile
+	}
+	if certFile != "" {
+		settings["ssl.certificate.location"] = certFile
+		settings["ssl.key.location"] = keyFile
+		if conf.GetString(configutil.KKafkaTLSKeyPassword) != "" {
+			settings["ssl.key.password"] = secretStore.Get(configutil.KKafkaTLSKeyPassword)
+		}
+	}
+
+	// The host name of the broker is verified against its certificate unless the verification is skipped.
+	if conf.GetBool(configutil.KKafkaTLSInsecureSkipVerify) {
+		settings["enable.ssl.certificate.verification"] = false
+		settings["ssl.endpoint.identification.algorithm"] = "none"
+	} else {
+		settings["ssl.endpoint.identification.algorithm"] = "https"
+	}
+
+	for key, value := range settings {
+		if err := clientConfig.SetKey(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setSASL is a helper function to set the SASL settings of the configuration on the client configuration.
+func setSASL(conf *viper.Viper, secretStore *secrets.Store, clientConfig *kafka.ConfigMap) error {
+	mechanism := conf.GetString(configutil.KKafkaSASLMechanism)
+	username := conf.GetString(configutil.KKafkaSASLUsername)
+	if mechanism == "" || username == "" {
+		return fmt.Errorf("%s and %s are required with the security protocol %s", configutil.KKafkaSASLMechanism,
+			configutil.KKafkaSASLUsername, conf.GetString(configutil.KKafkaSecurityProtocol))
+	}
+
+	settings := kafka.ConfigMap{
+		"sasl.mechanisms": mechanism,
+		"sasl.username":   username,
+		"sasl.password":   secretStore.Get(configutil.KKafkaSASLPassword),
+	}
+	for key, value := range settings {
+		if err := clientConfig.SetKey(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// isTLS is a helper function to check if the security protocol connects over TLS.
+func isTLS(protocol string) bool {
+	return protocol == ProtocolSSL || protocol == ProtocolSASLSSL
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// isSASL is a helper function to check if the security protocol authenticates with SASL.
+func isSASL(protocol string) bool {
+	return protocol == ProtocolSASLPlaintext || protocol == ProtocolSASLSSL
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,72 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the logging setup shared by the services.
+//
+// All the services log with glog to stderr, so that the logs are collected by the container runtime. The verbosity of
+// the V logs is configured in the logging block of defaults.yaml, so that it can be changed while the service runs.
+// The -v and -vmodule flags still win over the configuration when they are passed on the command line.
+
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+)
+
+// commandLine holds the names of the flags passed on the command line. It is filled by Init.
+var commandLine = map[string]bool{}
+
+// Init parses the command line flags and logs to stderr. It is called from the init function of every main package,
+// before anything is logged.
+func Init() {
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	flag.Set("logtostderr", "true")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Apply applies the log levels of the configuration. It is called on startup and registered with the configuration
+// reloader. A level which is not in the configuration, or whose flag is passed on the command line, is left as is.
+func Apply(conf *viper.Viper) {
+	if conf.IsSet(configutil.KLogVerbosity) {
+		if err := setLevel("v", strconv.Itoa(conf.GetInt(configutil.KLogVerbosity))); err != nil {
+			glog.Errorln(err.Error())
+		}
+	}
+	if conf.IsSet(configutil.KLogVModule) {
+		if err := setLevel("vmodule", conf.GetString(configutil.KLogVModule)); err != nil {
+			glog.Errorln(err.Error())
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setLevel is a helper function to set the glog flag, "v" for the verbosity of the V logs or "vmodule" for the per
+// file verbosities, for example "stats_worker=2". The flag is only set if it is not passed on the command line and
+// its value changes. It is safe to call while the service logs.
+func setLevel(name string, value string) error {
+	if commandLine[name] {
+		return nil
+	}
+	if current := flag.Lookup(name); current != nil && current.Value.String() == value {
+		return nil
+	}
+	if err := flag.Set(name, value); err != nil {
+		return fmt.Errorf("failed to set the log %s: %w", name, err)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,122 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the schema, the secrets and the clients of the transport selected in the configuration.
+//
+// The services create their clients with NewPublisher and NewSubscriber, so they run on kafka, nats or redis without
+// knowing which one. The in-memory transport is not selectable, its clients must share a MemoryBroker in the process.
+
+package messageq
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/kafkautil"
+	"common/secrets"
+)
+
+const (
+	// TransportKafka is the name of the kafka transport in the configuration.
+	TransportKafka = "kafka"
+
+	// TransportNATS is the name of the NATS JetStream transport in the configuration.
+	TransportNATS = "nats"
+
+	// TransportRedis is the name of the redis streams transport in the configuration.
+	TransportRedis = "redis"
+
+	// maxPartitions bounds the number of partitions of the nats and redis transports.
+	maxPartitions = 1024
+)
+
+// Schema is the schema of the message_queue, nats and redis blocks. The kafka block is validated by
+// configutil.KafkaSchema, which every service merges as well since the topic is shared by all the transports.
+var Schema = configutil.Schema{
+	configutil.String(configutil.KTransport).Required().OneOf(TransportKafka, TransportNATS, TransportRedis),
+	configutil.String(configutil.KNATSURL).RequiredWhen(configutil.KTransport, TransportNATS),
+	configutil.String(configutil.KNATSToken).Secret(),
+	configutil.Int(configutil.KNATSPartitions).RequiredWhen(configutil.KTransport, TransportNATS).
+		Between(1, maxPartitions),
+	configutil.Duration(configutil.KNATSMaxAge).DurationAtLeast(0),
+	configutil.String(configutil.KRedisAddr).RequiredWhen(configutil.KTransport, TransportRedis),
+	configutil.String(configutil.KRedisPassword).Secret(),
+	configutil.Int(configutil.KRedisDB).AtLeast(0),
+	configutil.Int(configutil.KRedisPartitions).RequiredWhen(configutil.KTransport, TransportRedis).
+		Between(1, maxPartitions),
+	configutil.Int(configutil.KRedisMaxLen).AtLeast(0),
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// SecretRefs returns the references of the secrets of the transport, to be resolved by configutil.NewSecretStore. Only
+// the secrets of the selected transport must be resolvable.
+func SecretRefs(conf *viper.Viper) map[string]string {
+	refs := map[string]string{}
+	switch conf.GetString(configutil.KTransport) {
+	case TransportKafka:
+		refs = kafkautil.SecretRefs(conf)
+	case TransportNATS:
+		if conf.GetString(configutil.KNATSToken) != "" {
+			refs[configutil.KNATSToken] = conf.GetString(configutil.KNATSToken)
+		}
+	case TransportRedis:
+		if conf.GetString(configutil.KRedisPassword) != "" {
+			refs[configutil.KRedisPassword] = conf.GetString(configutil.KRedisPassword)
+		}
+	}
+	return refs
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewPublisher returns a publisher on the transport of the configuration.
+func NewPublisher(conf *viper.Viper, secretStore *secrets.Store) (Publisher, error) {
+	var publisher Publisher
+	var err error
+	switch transport := conf.GetString(configutil.KTransport); transport {
+	case TransportKafka:
+		publisher, err = NewKafkaPublisher(conf, secretStore)
+	case TransportNATS:
+		publisher, err = NewNATSPublisher(conf, secretStore)
+	case TransportRedis:
+		publisher, err = NewRedisPublisher(conf, secretStore)
+	default:
+		err = fmt.Errorf("unknown message queue transport %q", transport)
+	}
+
+	// Do not return a typed nil in the interface.
+	if err != nil {
+		return nil, err
+	}
+	return publisher, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewSubscriber returns a subscriber in the consumer group on the transport of the configuration.
+func NewSubscriber(conf *viper.Viper, secretStore *secrets.Store, group string) (Subscriber, error) {
+	var subscriber Subscriber
+	var err error
+	switch transport := conf.GetString(configutil.KTransport); transport {
+	case TransportKafka:
+		subscriber, err = NewKafkaSubscriber(conf, secretStore, group)
+	case TransportNATS:
+		subscriber, err = NewNATSSubscriber(conf, secretStore, group)
+	case TransportRedis:
+		subscriber, err = NewRedisSubscriber(conf, secretStore, group)
+	default:
+		err = fmt.Errorf("unknown message queue transport %q", transport)
+	}
+
+	// Do not return a typed nil in the interface.
+	if err != nil {
+		return nil, err
+	}
+	return subscriber, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,364 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the kafka transport of the message queue.
+//
+// The kafka clients are created with kafkautil, so they pick up the security settings and the tuning of the producer
+// from the kafka block of the configuration. The producer partitions the messages by the hash of their key, so the
+// messages with the same key end up in the same partition and are consumed in order.
+//
+// The consumer commits in the background, but only the offsets stored by the subscriber once the worker received the
+// next message. A message received before a crash is consumed again.
+
+package messageq
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/kafkautil"
+	"common/secrets"
+)
+
+const (
+	// flushInterval is the interval at which Flush checks if the queued messages are delivered.
+	flushInterval = 10 * time.Millisecond
+
+	// watermarkTimeoutMs is the timeout to query the watermark offsets from the broker.
+	watermarkTimeoutMs = 5000
+
+	// seekTimeoutMs is the timeout to rewind a partition to a message received while paused.
+	seekTimeoutMs = 5000
+)
+
+// KafkaPublisher implements the Publisher interface with a kafka producer.
+type KafkaPublisher struct {
+	producer *kafka.Producer
+
+	// topic is the topic of the configuration, checked by Ping.
+	topic string
+
+	deliveries chan Delivery
+
+	// pending is the number of published messages whose delivery is not received from the deliveries channel yet. It
+	// is accessed atomically.
+	pending int64
+}
+
+// NewKafkaPublisher creates a kafka producer from the configuration and returns a new instance of KafkaPublisher.
+func NewKafkaPublisher(conf *viper.Viper, secretStore *secrets.Store) (*KafkaPublisher, error) {
+	producer, err := kafkautil.NewProducer(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+
+	publisher := &KafkaPublisher{
+		producer:   producer,
+		topic:      conf.GetString(configutil.KTopic),
+		deliveries: make(chan Delivery),
+	}
+	go publisher.handleEvents()
+	return publisher, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Publish implements Publisher.
+func (publisher *KafkaPublisher) Publish(message *Message) error {
+	kafkaMessage := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &message.Topic, Partition: kafka.PartitionAny},
+		Key:            message.Key,
+		Value:          message.Value,
+		Opaque:         message,
+	}
+	for key, value := range message.Headers {
+		kafkaMessage.Headers = append(kafkaMessage.Headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+
+	atomic.AddInt64(&publisher.pending, 1)
+	if err := publisher.producer.Produce(kafkaMessage, nil); err != nil {
+		atomic.AddInt64(&publisher.pending, -1)
+		if kafkaErr, ok := err.(kafka.Error); ok && kafkaErr.Code() == kafka.ErrQueueFull {
+			return ErrQueueFull
+		}
+		return err
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Deliveries implements Publisher.
+func (publisher *KafkaPublisher) Deliveries() <-chan Delivery {
+	return publisher.deliveries
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Flush implements Publisher.
+func (publisher *KafkaPublisher) Flush(timeout time.Duration) int {
+	return flush(publisher, timeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Len implements Publisher.
+func (publisher *KafkaPublisher) Len() int {
+	return int(atomic.LoadInt64(&publisher.pending))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Publisher. It fails if the brokers are not reachable or the topic does not exist.
+func (publisher *KafkaPublisher) Ping(ctx context.Context) error {
+	return kafkautil.HealthCheck(publisher.producer, publisher.topic)(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Publisher.
+func (publisher *KafkaPublisher) Close() {
+	publisher.producer.Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// handleEvents is a helper function which is run as a go routine for the lifetime of the producer. The kafka producer
+// reports the outcome of every produce call on its events channel, which is translated to the deliveries channel.
+func (publisher *KafkaPublisher) handleEvents() {
+	defer close(publisher.deliveries)
+
+	for event := range publisher.producer.Events() {
+		switch ev := event.(type) {
+		case *kafka.Message:
+			message, ok := ev.Opaque.(*Message)
+			if !ok {
+				continue
+			}
+			message.Partition = ev.TopicPartition.Partition
+			message.Offset = int64(ev.TopicPartition.Offset)
+			publisher.deliveries <- Delivery{Message: message, Err: ev.TopicPartition.Error}
+			atomic.AddInt64(&publisher.pending, -1)
+		case kafka.Error:
+			// An idempotent producer which lost track of its sequence numbers cannot continue without breaking the
+			// order of the messages. The process is restarted instead.
+			if ev.IsFatal() {
+				glog.Fatalf("Fatal kafka producer error: %v", ev)
+			}
+			glog.Errorf("Kafka producer error: %v", ev)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// KafkaSubscriber implements the Subscriber interface with a kafka consumer.
+type KafkaSubscriber struct {
+	consumer *kafka.Consumer
+
+	// topic is the topic of the configuration, checked by Ping.
+	topic string
+
+	// paused is set between Pause and Resume. It is accessed atomically, also by the rebalance callback.
+	paused int32
+
+	// previous is the position of the last received message. Its offset is stored for the next commit by the next
+	// Receive which is not paused, so that a message held by a paused worker is consumed again after a restart.
+	previous *kafka.TopicPartition
+}
+
+// NewKafkaSubscriber creates a kafka consumer in the consumer group from the configuration and returns a new instance
+// of KafkaSubscriber. A new consumer group starts from the earliest message of the topic.
+func NewKafkaSubscriber(conf *viper.Viper, secretStore *secrets.Store, group string) (*KafkaSubscriber, error) {
+	consumer, err := kafkautil.NewConsumer(conf, secretStore, group)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaSubscriber{consumer: consumer, topic: conf.GetString(configutil.KTopic)}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Subscribe implements Subscriber.
+func (subscriber *KafkaSubscriber) Subscribe(topic string) error {
+	return subscriber.consumer.SubscribeTopics([]string{topic}, subscriber.rebalance)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// rebalance is a helper function which is called by the consumer on a rebalance of the consumer group. The partitions
+// assigned while the subscriber is paused are paused right away. The consumer applies the other rebalances itself.
+func (subscriber *KafkaSubscriber) rebalance(consumer *kafka.Consumer, event kafka.Event) error {
+	assigned, ok := event.(kafka.AssignedPartitions)
+	if !ok || atomic.LoadInt32(&subscriber.paused) == 0 {
+		return nil
+	}
+
+	var err error
+	if consumer.GetRebalanceProtocol() == "COOPERATIVE" {
+		err = consumer.IncrementalAssign(assigned.Partitions)
+	} else {
+		err = consumer.Assign(assigned.Partitions)
+	}
+	if err != nil {
+		return err
+	}
+	return consumer.Pause(assigned.Partitions)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Receive implements Subscriber.
+func (subscriber *KafkaSubscriber) Receive(timeout time.Duration) (*Message, error) {
+	if atomic.LoadInt32(&subscriber.paused) == 0 {
+		subscriber.storePrevious()
+	}
+
+	kafkaMessage, err := subscriber.consumer.ReadMessage(timeout)
+	if err != nil {
+		if kafkaErr, ok := err.(kafka.Error); ok && kafkaErr.Code() == kafka.ErrTimedOut {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+
+	// A message fetched before the partitions were paused is not handed out while paused, the previous message is
+	// still held by the worker. The partition is rewound to the message, so it is received again after Resume.
+	if atomic.LoadInt32(&subscriber.paused) == 1 {
+		if err := subscriber.consumer.Seek(kafkaMessage.TopicPartition, seekTimeoutMs); err != nil {
+			return nil, err
+		}
+		return nil, ErrTimeout
+	}
+
+	subscriber.previous = &kafkaMessage.TopicPartition
+	message := &Message{
+		Partition: kafkaMessage.TopicPartition.Partition,
+		Offset:    int64(kafkaMessage.TopicPartition.Offset),
+		Key:       kafkaMessage.Key,
+		Value:     kafkaMessage.Value,
+		Headers:   make(map[string]string, len(kafkaMessage.Headers)),
+	}
+	if kafkaMessage.TopicPartition.Topic != nil {
+		message.Topic = *kafkaMessage.TopicPartition.Topic
+	}
+	for _, header := range kafkaMessage.Headers {
+		message.Headers[header.Key] = string(header.Value)
+	}
+	return message, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Lag implements Subscriber. The lag is the difference between the high watermark of the partition and the position
+// of the consumer.
+func (subscriber *KafkaSubscriber) Lag() ([]PartitionLag, error) {
+	assignment, err := subscriber.consumer.Assignment()
+	if err != nil || len(assignment) == 0 {
+		return nil, err
+	}
+
+	positions, err := subscriber.consumer.Position(assignment)
+	if err != nil {
+		return nil, err
+	}
+
+	var lags []PartitionLag
+	for _, position := range positions {
+		if position.Topic == nil {
+			continue
+		}
+
+		_, high, err := subscriber.consumer.QueryWatermarkOffsets(*position.Topic, position.Partition,
+			watermarkTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+
+		// The position is invalid until the consumer consumed the first message. The whole partition is the lag.
+		lag := high
+		if position.Offset >= 0 {
+			lag = high - int64(position.Offset)
+		}
+		lags = append(lags, PartitionLag{Topic: *position.Topic, Partition: position.Partition, Lag: lag})
+	}
+	return lags, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Pause implements Subscriber. The assigned partitions are paused, the messages which are fetched already are fetched
+// again on Resume.
+func (subscriber *KafkaSubscriber) Pause() error {
+	atomic.StoreInt32(&subscriber.paused, 1)
+	assignment, err := subscriber.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	return subscriber.consumer.Pause(assignment)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Resume implements Subscriber.
+func (subscriber *KafkaSubscriber) Resume() error {
+	atomic.StoreInt32(&subscriber.paused, 0)
+	assignment, err := subscriber.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	return subscriber.consumer.Resume(assignment)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Subscriber. It fails if the brokers are not reachable or the topic does not exist.
+func (subscriber *KafkaSubscriber) Ping(ctx context.Context) error {
+	return kafkautil.HealthCheck(subscriber.consumer, subscriber.topic)(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Subscriber. The offset of the last received message is committed, unless the subscriber is paused.
+func (subscriber *KafkaSubscriber) Close() error {
+	if atomic.LoadInt32(&subscriber.paused) == 0 {
+		subscriber.storePrevious()
+	}
+	return subscriber.consumer.Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// storePrevious is a helper function to store the offset after the last received message, which the consumer commits
+// in the background. A partition which was revoked in the meantime is consumed again by its new owner.
+func (subscriber *KafkaSubscriber) storePrevious() {
+	if subscriber.previous == nil {
+		return
+	}
+	next := *subscriber.previous
+	next.Offset++
+	subscriber.previous = nil
+	if _, err := subscriber.consumer.StoreOffsets([]kafka.TopicPartition{next}); err != nil {
+		glog.Warningf("Failed to store the offset %v of partition %d: %v", next.Offset, next.Partition, err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// flush is a helper function to wait until the publisher has no queued messages or the timeout expires.
+func flush(publisher Publisher, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for publisher.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(flushInterval)
+	}
+	return publisher.Len()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,459 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the in-memory transport of the message queue.
+//
+// The MemoryBroker keeps the topics in the memory of the process, so the log-processor, the log-subscriber and the
+// api server can run in one process without brokers, for local development and tests. It follows the model of kafka
+// closely enough that the services cannot tell the difference.
+//
+// 1. A topic has a fixed number of partitions. A message goes to the partition of the hash of its key.
+// 2. Every consumer group has its own offset per partition. A new group starts from the earliest retained message.
+// 3. The partitions are spread over the subscribers of a group, partition p belongs to subscriber p % subscribers. The
+//    assignment changes when a subscriber joins or leaves the group.
+// 4. The messages which every group consumed are dropped, the topics do not grow without bound.
+//
+// The messages are lost when the process exits.
+
+package messageq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// memoryQueueSize is the number of deliveries a MemoryPublisher keeps before Publish returns ErrQueueFull, like the
+// local queue of the kafka producer.
+const memoryQueueSize = 100000
+
+// errClosed is returned when a closed client of the MemoryBroker is used.
+var errClosed = errors.New("the client is closed")
+
+// MemoryBroker is a message broker in the memory of the process.
+type MemoryBroker struct {
+	// partitions is the number of partitions of every topic.
+	partitions int
+
+	// Guards the topics and everything below them.
+	mutex  sync.Mutex
+	topics map[string]*memoryTopic
+}
+
+// memoryTopic is a topic of the MemoryBroker.
+type memoryTopic struct {
+	partitions []*memoryPartition
+	groups     map[string]*memoryGroup
+
+	// changed is closed and replaced when a message is appended, to wake up the waiting subscribers.
+	changed chan struct{}
+}
+
+// memoryPartition is a partition of a memoryTopic.
+type memoryPartition struct {
+	// base is the offset of the first retained message.
+	base     int64
+	messages []*Message
+}
+
+// memoryGroup is a consumer group of a memoryTopic.
+type memoryGroup struct {
+	// offsets are the offsets of the next message of every partition.
+	offsets []int64
+	members []*MemorySubscriber
+}
+
+// NewMemoryBroker returns a new instance of MemoryBroker whose topics have the number of partitions.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBroker{
+		partitions: partitions,
+		topics:     make(map[string]*memoryTopic),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewPublisher returns a new publisher to the topics of the broker.
+func (broker *MemoryBroker) NewPublisher() *MemoryPublisher {
+	return &MemoryPublisher{
+		broker:     broker,
+		deliveries: make(chan Delivery, memoryQueueSize),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewSubscriber returns a new subscriber in the consumer group. It joins the group on Subscribe.
+func (broker *MemoryBroker) NewSubscriber(group string) *MemorySubscriber {
+	return &MemorySubscriber{
+		broker: broker,
+		group:  group,
+		closed: make(chan struct{}),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// topic is a helper function to return the topic, which is created on first use. The caller must hold the mutex.
+func (broker *MemoryBroker) topic(name string) *memoryTopic {
+	topic, ok := broker.topics[name]
+	if !ok {
+		topic = &memoryTopic{
+			partitions: make([]*memoryPartition, broker.partitions),
+			groups:     make(map[string]*memoryGroup),
+			changed:    make(chan struct{}),
+		}
+		for i := range topic.partitions {
+			topic.partitions[i] = &memoryPartition{}
+		}
+		broker.topics[name] = topic
+	}
+	return topic
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// end returns the offset of the next message of the partition.
+func (partition *memoryPartition) end() int64 {
+	return partition.base + int64(len(partition.messages))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// trim is a helper function to drop the messages of the partition which every consumer group consumed.
+func (topic *memoryTopic) trim(partition int32) {
+	p := topic.partitions[partition]
+	consumed := p.end()
+	for _, group := range topic.groups {
+		if group.offsets[partition] < consumed {
+			consumed = group.offsets[partition]
+		}
+	}
+
+	drop := int(consumed - p.base)
+	for i := 0; i < drop; i++ {
+		// Release the messages, the backing array is only reallocated by a later append.
+		p.messages[i] = nil
+	}
+	p.messages = p.messages[drop:]
+	p.base = consumed
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MemoryPublisher implements the Publisher interface with a MemoryBroker. The messages are appended to the topic by
+// Publish, so their delivery is reported right away.
+type MemoryPublisher struct {
+	broker     *MemoryBroker
+	deliveries chan Delivery
+
+	// closed is guarded by the mutex of the broker.
+	closed bool
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Publish implements Publisher.
+func (publisher *MemoryPublisher) Publish(message *Message) error {
+	broker := publisher.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	if publisher.closed {
+		return errClosed
+	}
+	// Only Publish sends to the deliveries channel, so the send below cannot block.
+	if len(publisher.deliveries) == cap(publisher.deliveries) {
+		return ErrQueueFull
+	}
+
+	topic := broker.topic(message.Topic)
+	message.Partition = partitionOf(message.Key, broker.partitions)
+	partition := topic.partitions[message.Partition]
+	message.Offset = partition.end()
+
+	// The subscribers get a copy of the message, without the opaque value of the publisher.
+	stored := &Message{
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Key:       message.Key,
+		Value:     message.Value,
+		Headers:   make(map[string]string, len(message.Headers)),
+	}
+	for key, value := range message.Headers {
+		stored.Headers[key] = value
+	}
+	partition.messages = append(partition.messages, stored)
+
+	// Wake up the waiting subscribers.
+	close(topic.changed)
+	topic.changed = make(chan struct{})
+
+	publisher.deliveries <- Delivery{Message: message}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Deliveries implements Publisher.
+func (publisher *MemoryPublisher) Deliveries() <-chan Delivery {
+	return publisher.deliveries
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Flush implements Publisher.
+func (publisher *MemoryPublisher) Flush(timeout time.Duration) int {
+	return flush(publisher, timeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Len implements Publisher.
+func (publisher *MemoryPublisher) Len() int {
+	return len(publisher.deliveries)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Publisher. The broker is always reachable.
+func (publisher *MemoryPublisher) Ping(ctx context.Context) error {
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Publisher.
+func (publisher *MemoryPublisher) Close() {
+	publisher.broker.mutex.Lock()
+	defer publisher.broker.mutex.Unlock()
+
+	if !publisher.closed {
+		publisher.closed = true
+		close(publisher.deliveries)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MemorySubscriber implements the Subscriber interface with a MemoryBroker.
+type MemorySubscriber struct {
+	broker *MemoryBroker
+	group  string
+
+	// topic is the subscribed topic, guarded by the mutex of the broker.
+	topic string
+
+	// next is the partition which is checked first by the next Receive, so that no partition is starved. It is
+	// guarded by the mutex of the broker.
+	next int
+
+	// paused is set between Pause and Resume, guarded by the mutex of the broker.
+	paused bool
+
+	// closed is closed by Close to wake up a waiting Receive.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Subscribe implements Subscriber.
+func (subscriber *MemorySubscriber) Subscribe(topic string) error {
+	broker := subscriber.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	if subscriber.topic != "" {
+		return errors.New("the subscriber is already subscribed to " + subscriber.topic)
+	}
+
+	t := broker.topic(topic)
+	group, ok := t.groups[subscriber.group]
+	if !ok {
+		group = &memoryGroup{offsets: make([]int64, len(t.partitions))}
+		for i, partition := range t.partitions {
+			group.offsets[i] = partition.base
+		}
+		t.groups[subscriber.group] = group
+	}
+	group.members = append(group.members, subscriber)
+	subscriber.topic = topic
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Receive implements Subscriber.
+func (subscriber *MemorySubscriber) Receive(timeout time.Duration) (*Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		message, changed, err := subscriber.poll()
+		if message != nil || err != nil {
+			return message, err
+		}
+
+		select {
+		case <-changed:
+		case <-subscriber.closed:
+			return nil, errClosed
+		case <-timer.C:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// poll is a helper function to take the next message of the partitions assigned to the subscriber. Without a message,
+// it returns the channel which is closed when the next message is published.
+func (subscriber *MemorySubscriber) poll() (*Message, <-chan struct{}, error) {
+	broker := subscriber.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	if subscriber.topic == "" {
+		return nil, nil, errors.New("the subscriber is not subscribed to a topic")
+	}
+
+	topic := broker.topics[subscriber.topic]
+	if subscriber.paused {
+		return nil, topic.changed, nil
+	}
+	group := topic.groups[subscriber.group]
+	for _, p := range subscriber.assignment(group) {
+		partition := topic.partitions[p]
+		offset := group.offsets[p]
+		if offset >= partition.end() {
+			continue
+		}
+
+		message := partition.messages[offset-partition.base]
+		group.offsets[p]++
+		topic.trim(p)
+		subscriber.next = int(p) + 1
+		return message, nil, nil
+	}
+	return nil, topic.changed, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// assignment is a helper function to return the partitions assigned to the subscriber in its group, starting from the
+// partition which is checked first. The caller must hold the mutex of the broker.
+func (subscriber *MemorySubscriber) assignment(group *memoryGroup) []int32 {
+	member := -1
+	for i, m := range group.members {
+		if m == subscriber {
+			member = i
+		}
+	}
+	if member < 0 {
+		return nil
+	}
+
+	partitions := len(group.offsets)
+	var assigned []int32
+	for i := 0; i < partitions; i++ {
+		p := (subscriber.next + i) % partitions
+		if p%len(group.members) == member {
+			assigned = append(assigned, int32(p))
+		}
+	}
+	return assigned
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Lag implements Subscriber.
+func (subscriber *MemorySubscriber) Lag() ([]PartitionLag, error) {
+	broker := subscriber.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	topic, ok := broker.topics[subscriber.topic]
+	if !ok {
+		return nil, nil
+	}
+
+	group := topic.groups[subscriber.group]
+	var lags []PartitionLag
+	for _, p := range subscriber.assignment(group) {
+		lags = append(lags, PartitionLag{
+			Topic:     subscriber.topic,
+			Partition: p,
+			Lag:       topic.partitions[p].end() - group.offsets[p],
+		})
+	}
+	return lags, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Pause implements Subscriber.
+func (subscriber *MemorySubscriber) Pause() error {
+	subscriber.setPaused(true)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Resume implements Subscriber.
+func (subscriber *MemorySubscriber) Resume() error {
+	subscriber.setPaused(false)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setPaused is a helper function to pause or resume the subscriber.
+func (subscriber *MemorySubscriber) setPaused(paused bool) {
+	broker := subscriber.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	subscriber.paused = paused
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Subscriber. The broker is always reachable.
+func (subscriber *MemorySubscriber) Ping(ctx context.Context) error {
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Subscriber. The partitions of the subscriber are assigned to the other subscribers of the group,
+// which continue from the offsets of the group.
+func (subscriber *MemorySubscriber) Close() error {
+	subscriber.closeOnce.Do(func() {
+		close(subscriber.closed)
+
+		broker := subscriber.broker
+		broker.mutex.Lock()
+		defer broker.mutex.Unlock()
+
+		topic, ok := broker.topics[subscriber.topic]
+		if !ok {
+			return
+		}
+		group := topic.groups[subscriber.group]
+		for i, member := range group.members {
+			if member == subscriber {
+				group.members = append(group.members[:i], group.members[i+1:]...)
+				break
+			}
+		}
+	})
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,170 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the message queue interfaces shared by the services.
+//
+// The log-processor publishes the log lines with a Publisher and the workers of the log-subscriber consume them with
+// a Subscriber. The services only depend on these interfaces, the transport is chosen when the clients are created.
+//
+// 1. Kafka: the default transport of the deployed services. Please refer to kafka.go.
+// 2. NATS JetStream: for the environments without kafka. Please refer to nats.go.
+// 3. Redis streams: for the environments without kafka. Please refer to redis.go.
+// 4. Memory: a broker inside the process, for local development and tests without brokers. Please refer to memory.go.
+//
+// The deployed services select kafka, nats or redis in the configuration, please refer to config.go. All the
+// transports give the same guarantees to the services.
+//
+// 1. The messages with the same key are delivered in the order in which they were published. The log-processor keys
+//    the messages by the thread of the line, pid:tid without the timestamp, so the lines of a thread stay in order.
+// 2. Every consumer group receives all the messages of the topic. The messages are spread over the subscribers of
+//    the same group, every key is consumed by a single subscriber of the group.
+// 3. Publishing is asynchronous. The outcome of every message is reported on the Deliveries channel, which must be
+//    drained.
+
+package messageq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTimeout is returned by Receive when no message arrived within the timeout. It only means that no message is
+	// available yet.
+	ErrTimeout = errors.New("no message within the timeout")
+
+	// ErrQueueFull is returned by Publish when the local queue of the publisher is full. The caller retries once the
+	// queued messages are delivered.
+	ErrQueueFull = errors.New("the local queue of the publisher is full")
+
+	// subscriberCount numbers the subscribers of the process, to give them unique names.
+	subscriberCount int64
+)
+
+// Message is a single message of a topic.
+type Message struct {
+	// Topic is the topic of the message.
+	Topic string
+
+	// Partition and Offset are the position of the message in the topic. They are set on the delivered and on the
+	// received messages.
+	Partition int32
+	Offset    int64
+
+	// Key decides the order of the messages. The messages with the same key are delivered in order.
+	Key   []byte
+	Value []byte
+
+	// Headers carry the metadata of the message, for example the trace context.
+	Headers map[string]string
+
+	// Opaque is not sent to the subscribers. It is handed back with the delivery of the message, for example to end
+	// the span of the publish call.
+	Opaque interface{}
+}
+
+// Delivery is the outcome of a published message.
+type Delivery struct {
+	// Message is the published message, with its position in the topic on success.
+	Message *Message
+
+	// Err is the reason why the message was not delivered, nil on success.
+	Err error
+}
+
+// PartitionLag is the number of messages of a partition which are not consumed yet.
+type PartitionLag struct {
+	Topic     string
+	Partition int32
+	Lag       int64
+}
+
+// Publisher publishes messages to the topics.
+type Publisher interface {
+	// Publish queues the message for delivery. It returns ErrQueueFull when the local queue of the publisher is full.
+	Publish(message *Message) error
+
+	// Deliveries returns the channel of the outcome of the published messages. It is closed by Close.
+	Deliveries() <-chan Delivery
+
+	// Flush waits until all the queued messages are delivered or the timeout expires. It returns the number of
+	// messages which are still queued.
+	Flush(timeout time.Duration) int
+
+	// Len returns the number of published messages whose delivery is not received from Deliveries yet.
+	Len() int
+
+	// Ping checks if the topic of the configuration can be published to. It is used by the readiness check.
+	Ping(ctx context.Context) error
+
+	// Close releases the publisher. The messages which are still queued are lost, call Flush first.
+	Close()
+}
+
+// Subscriber consumes the messages of a topic as a member of a consumer group.
+type Subscriber interface {
+	// Subscribe joins the consumer group on the topic.
+	Subscribe(topic string) error
+
+	// Receive blocks until the next message is available or the timeout expires, in which case it returns
+	// ErrTimeout. A received message is acknowledged by the next Receive or by Close, after which it is not received
+	// again by the consumer group.
+	Receive(timeout time.Duration) (*Message, error)
+
+	// Lag returns the lag of the partitions assigned to the subscriber.
+	Lag() ([]PartitionLag, error)
+
+	// Pause stops the delivery of the messages of the partitions assigned to the subscriber, for example while the
+	// storage of the worker is down. Receive must still be called while paused, to stay in the consumer group. It
+	// never returns a message while paused, it returns ErrTimeout and does not acknowledge the last received message.
+	// A message fetched before the pause is received again after Resume.
+	Pause() error
+
+	// Resume continues the delivery of the messages after Pause.
+	Resume() error
+
+	// Ping checks if the topic of the configuration can be consumed from. It is used by the readiness check.
+	Ping(ctx context.Context) error
+
+	// Close leaves the consumer group and releases the subscriber.
+	Close() error
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LogLineKey returns the key of a log line published by the log-processor, the thread of the line as pid:tid. The
+// header of the line also carries the timestamp, which would spread the lines of a thread over the partitions.
+func LogLineKey(logLine string) string {
+	thread := strings.SplitN(logLine, " ", 2)[0]
+	return strings.SplitN(thread, "::", 2)[0]
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// consumerName is a helper function to return a unique name for a subscriber of the nats and redis transports, which
+// must tell apart the subscribers of a group themselves. The dots of the hostname are replaced since nats uses them
+// as separators of the keys.
+func consumerName() string {
+	hostname, _ := os.Hostname()
+	hostname = strings.ReplaceAll(hostname, ".", "_")
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), atomic.AddInt64(&subscriberCount, 1))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// partitionOf is a helper function to return the partition of the key, for the transports which partition the
+// messages themselves. The messages with the same key always map to the same partition, which keeps their order.
+func partitionOf(key []byte, partitions int) int32 {
+	hash := fnv.New32a()
+	hash.Write(key)
+	return int32(hash.Sum32() % uint32(partitions))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
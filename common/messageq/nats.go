@@ -0,0 +1,801 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the NATS JetStream transport of the message queue.
+//
+// JetStream has no partitions, so they are built from subjects, like the partitions of kafka.
+//
+// 1. A topic is a stream of the same name with one subject per partition, <topic>.<partition>. The publisher sends a
+//    message to the subject of the hash of its key, so the messages with the same key are stored in order.
+// 2. A consumer group has one durable pull consumer per partition, <group>-<partition>. A new consumer starts from the
+//    first message of the stream.
+// 3. A partition is fetched by one subscriber of the group at a time, the one holding its lease. The leases are keys
+//    of the key-value bucket <topic>-leases, which the subscribers take, renew and release on Receive like the redis
+//    transport. Every subscriber takes its fair share of the partitions, from the number of subscribers registered
+//    in the bucket, so the messages of a key are processed in order by a single subscriber.
+// 4. A consumer hands out one message at a time, and the next one is only delivered once the previous one is
+//    acknowledged, which Receive does when it is called again. A lease or a registration expires after natsLeaseTTL
+//    without renewal, and a message which is not acknowledged within natsAckWait is delivered again, so the partitions
+//    of a subscriber which died are taken over. The delivery is at least once, like the auto commit of the kafka
+//    consumers.
+//
+// The server must run with JetStream enabled. The messages are retained for the max_age of the nats block, the stream
+// is created with it when it does not exist.
+
+package messageq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/secrets"
+)
+
+const (
+	// natsQueueSize is the number of messages a NATSPublisher keeps waiting for their acknowledgement before Publish
+	// returns ErrQueueFull, like the local queue of the kafka producer.
+	natsQueueSize = 100000
+
+	// natsAckTimeout is the time after which a published message without an acknowledgement of the server is reported
+	// as not delivered.
+	natsAckTimeout = 30 * time.Second
+
+	// natsAckWait is the time after which a received message without an acknowledgement is delivered again.
+	natsAckWait = 30 * time.Second
+
+	// natsFetchWait is the time a fetch waits on the server for the next message of a partition.
+	natsFetchWait = time.Second
+
+	// natsLeaseTTL is the time for which a subscriber owns a partition without renewing its lease. The registration of
+	// the subscriber in the members of the group expires after the same time.
+	natsLeaseTTL = 30 * time.Second
+
+	// natsRebalanceInterval is the interval at which a subscriber renews its leases and takes its fair share of the
+	// partitions.
+	natsRebalanceInterval = time.Second
+
+	// natsKeyHeader is the header which carries the key of the message.
+	natsKeyHeader = "Messageq-Key"
+)
+
+// NATSPublisher implements the Publisher interface with a JetStream context.
+type NATSPublisher struct {
+	conn       *nats.Conn
+	js         nats.JetStreamContext
+	partitions int
+
+	// topic is the topic of the configuration, checked by Ping.
+	topic string
+
+	// futures are the published messages waiting for their acknowledgement, in the order of publishing.
+	futures    chan natsFuture
+	deliveries chan Delivery
+
+	// pending is the number of published messages whose delivery is not received from the deliveries channel yet. It
+	// is accessed atomically.
+	pending int64
+
+	// done is closed by Close.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// natsFuture is a published message waiting for its acknowledgement.
+type natsFuture struct {
+	message  *Message
+	future   nats.PubAckFuture
+	deadline time.Time
+}
+
+// NewNATSPublisher connects to the servers of the configuration and returns a new instance of NATSPublisher. The
+// stream of the topic of the configuration is created if it does not exist.
+func NewNATSPublisher(conf *viper.Viper, secretStore *secrets.Store) (*NATSPublisher, error) {
+	conn, js, err := connectNATS(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+
+	publisher := &NATSPublisher{
+		conn:       conn,
+		js:         js,
+		partitions: conf.GetInt(configutil.KNATSPartitions),
+		topic:      conf.GetString(configutil.KTopic),
+		futures:    make(chan natsFuture, natsQueueSize),
+		deliveries: make(chan Delivery),
+		done:       make(chan struct{}),
+	}
+	go publisher.handleAcks()
+	return publisher, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Publish implements Publisher.
+func (publisher *NATSPublisher) Publish(message *Message) error {
+	select {
+	case <-publisher.done:
+		return errClosed
+	default:
+	}
+	if atomic.LoadInt64(&publisher.pending) >= natsQueueSize {
+		return ErrQueueFull
+	}
+
+	partition := partitionOf(message.Key, publisher.partitions)
+	natsMessage := nats.NewMsg(natsSubject(message.Topic, partition))
+	natsMessage.Data = message.Value
+	for key, value := range message.Headers {
+		natsMessage.Header.Set(key, value)
+	}
+	natsMessage.Header.Set(natsKeyHeader, string(message.Key))
+
+	future, err := publisher.js.PublishMsgAsync(natsMessage)
+	if err != nil {
+		return err
+	}
+
+	message.Partition = partition
+	atomic.AddInt64(&publisher.pending, 1)
+	publisher.futures <- natsFuture{message: message, future: future, deadline: time.Now().Add(natsAckTimeout)}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Deliveries implements Publisher.
+func (publisher *NATSPublisher) Deliveries() <-chan Delivery {
+	return publisher.deliveries
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Flush implements Publisher.
+func (publisher *NATSPublisher) Flush(timeout time.Duration) int {
+	return flush(publisher, timeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Len implements Publisher.
+func (publisher *NATSPublisher) Len() int {
+	return int(atomic.LoadInt64(&publisher.pending))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Publisher. It fails if the servers are not reachable or the stream does not exist.
+func (publisher *NATSPublisher) Ping(ctx context.Context) error {
+	_, err := publisher.js.StreamInfo(publisher.topic, nats.Context(ctx))
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Publisher.
+func (publisher *NATSPublisher) Close() {
+	publisher.closeOnce.Do(func() {
+		close(publisher.done)
+		publisher.conn.Close()
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// handleAcks is a helper function which is run as a go routine for the lifetime of the publisher. It waits for the
+// acknowledgement of the published messages in order and reports their outcome on the deliveries channel. The offset
+// of a delivered message is its sequence number in the stream, which is shared by the partitions.
+func (publisher *NATSPublisher) handleAcks() {
+	defer close(publisher.deliveries)
+
+	for {
+		var pending natsFuture
+		select {
+		case pending = <-publisher.futures:
+		case <-publisher.done:
+			return
+		}
+
+		delivery := Delivery{Message: pending.message}
+		timer := time.NewTimer(time.Until(pending.deadline))
+		select {
+		case ack := <-pending.future.Ok():
+			pending.message.Offset = int64(ack.Sequence)
+		case err := <-pending.future.Err():
+			delivery.Err = err
+		case <-timer.C:
+			delivery.Err = fmt.Errorf("no acknowledgement of the message within %v", natsAckTimeout)
+		case <-publisher.done:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+
+		select {
+		case publisher.deliveries <- delivery:
+			atomic.AddInt64(&publisher.pending, -1)
+		case <-publisher.done:
+			return
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NATSSubscriber implements the Subscriber interface with the pull consumers of a consumer group.
+type NATSSubscriber struct {
+	conn       *nats.Conn
+	js         nats.JetStreamContext
+	group      string
+	partitions int
+	maxAge     time.Duration
+
+	// consumer is the name of the subscriber in the leases.
+	consumer string
+
+	// topic is the topic of the configuration, checked by Ping.
+	topic string
+
+	// Guards the state below.
+	mutex      sync.Mutex
+	subscribed string
+	leases     nats.KeyValue
+
+	// owned are the partitions whose lease the subscriber holds.
+	owned map[int32]*natsPartition
+
+	// previous is the last received message, which is acknowledged by the next Receive.
+	previous *nats.Msg
+
+	// paused is set between Pause and Resume. Receive only renews the leases while paused.
+	paused bool
+
+	rebalanced time.Time
+
+	// messages are the fetched messages of the owned partitions.
+	messages chan *nats.Msg
+
+	// done is closed by Close to wake up a waiting Receive.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// natsPartition is a partition owned by a NATSSubscriber.
+type natsPartition struct {
+	subscription *nats.Subscription
+
+	// revision is the revision of the lease of the partition.
+	revision uint64
+
+	// cancel stops the fetches of the partition, which closes stopped.
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewNATSSubscriber connects to the servers of the configuration and returns a new instance of NATSSubscriber in the
+// consumer group. It joins the group on Subscribe.
+func NewNATSSubscriber(conf *viper.Viper, secretStore *secrets.Store, group string) (*NATSSubscriber, error) {
+	conn, js, err := connectNATS(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSSubscriber{
+		conn:       conn,
+		js:         js,
+		group:      group,
+		partitions: conf.GetInt(configutil.KNATSPartitions),
+		maxAge:     conf.GetDuration(configutil.KNATSMaxAge),
+		consumer:   consumerName(),
+		topic:      conf.GetString(configutil.KTopic),
+		owned:      make(map[int32]*natsPartition),
+		messages:   make(chan *nats.Msg),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Subscribe implements Subscriber. The consumers of the group and the bucket of the leases are created if they do not
+// exist.
+func (subscriber *NATSSubscriber) Subscribe(topic string) error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.subscribed != "" {
+		return errors.New("the subscriber is already subscribed to " + subscriber.subscribed)
+	}
+	if err := ensureStream(subscriber.js, topic, subscriber.maxAge); err != nil {
+		return err
+	}
+
+	for partition := int32(0); int(partition) < subscriber.partitions; partition++ {
+		consumer := natsConsumer(subscriber.group, partition)
+		_, err := subscriber.js.AddConsumer(topic, &nats.ConsumerConfig{
+			Durable:       consumer,
+			FilterSubject: natsSubject(topic, partition),
+			DeliverPolicy: nats.DeliverAllPolicy,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       natsAckWait,
+			MaxAckPending: 1,
+		})
+		if err != nil {
+			// The older servers fail to create a consumer which exists already, even with the same configuration.
+			if _, infoErr := subscriber.js.ConsumerInfo(topic, consumer); infoErr != nil {
+				return fmt.Errorf("failed to create the consumer %s: %w", consumer, err)
+			}
+		}
+	}
+
+	bucket := topic + "-leases"
+	leases, err := subscriber.js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		leases, err = subscriber.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			TTL:     natsLeaseTTL,
+			Storage: nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the bucket of the leases %s: %w", bucket, err)
+	}
+
+	subscriber.subscribed = topic
+	subscriber.leases = leases
+	return subscriber.rebalance()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Receive implements Subscriber. It acknowledges the message of the previous call first.
+func (subscriber *NATSSubscriber) Receive(timeout time.Duration) (*Message, error) {
+	deadline := time.Now().Add(timeout)
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.subscribed == "" {
+		return nil, errors.New("the subscriber is not subscribed to a topic")
+	}
+	if !subscriber.paused {
+		if err := subscriber.ackPrevious(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		if time.Since(subscriber.rebalanced) >= natsRebalanceInterval {
+			if err := subscriber.rebalance(); err != nil {
+				return nil, err
+			}
+
+			// The last received message of a paused subscriber is not delivered again while it waits.
+			if subscriber.paused && subscriber.previous != nil {
+				subscriber.previous.InProgress()
+			}
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, ErrTimeout
+		}
+		if untilRebalance := natsRebalanceInterval - time.Since(subscriber.rebalanced); wait > untilRebalance {
+			wait = untilRebalance
+		}
+
+		// The fetches of the owned partitions run while the mutex is released.
+		paused := subscriber.paused
+		subscriber.mutex.Unlock()
+		natsMessage, err := subscriber.wait(wait, paused)
+		subscriber.mutex.Lock()
+		if err != nil {
+			return nil, err
+		}
+		if natsMessage != nil {
+			subscriber.previous = natsMessage
+			return natsToMessage(natsMessage), nil
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// wait is a helper function to wait at most for the time for the next fetched message. It returns nil when no message
+// arrived. A paused subscriber takes no message. The caller must not hold the mutex.
+func (subscriber *NATSSubscriber) wait(wait time.Duration, paused bool) (*nats.Msg, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	messages := subscriber.messages
+	if paused {
+		messages = nil
+	}
+
+	select {
+	case natsMessage := <-messages:
+		return natsMessage, nil
+	case <-subscriber.done:
+		return nil, errClosed
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ackPrevious is a helper function to acknowledge the last received message, which releases the next message of its
+// partition. The caller must hold the mutex.
+func (subscriber *NATSSubscriber) ackPrevious() error {
+	if subscriber.previous == nil {
+		return nil
+	}
+	err := subscriber.previous.Ack()
+	subscriber.previous = nil
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// rebalance is a helper function to renew the leases of the owned partitions and to release or take partitions until
+// the subscriber owns its fair share of them. The caller must hold the mutex and has acknowledged the last received
+// message.
+func (subscriber *NATSSubscriber) rebalance() error {
+	// Register the subscriber, the registrations of the subscribers which died expire with the leases.
+	if _, err := subscriber.leases.Put(natsMemberKey(subscriber.group, subscriber.consumer), nil); err != nil {
+		return err
+	}
+	alive, err := subscriber.members()
+	if err != nil {
+		return err
+	}
+	share := (subscriber.partitions + alive - 1) / alive
+
+	for partition, owned := range subscriber.owned {
+		lease := natsLeaseKey(subscriber.group, partition)
+		revision, err := subscriber.leases.Update(lease, []byte(subscriber.consumer), owned.revision)
+		if errors.Is(err, nats.ErrKeyExists) {
+			glog.Warningf("Lost the partition %d of %s in the consumer group %s", partition, subscriber.subscribed,
+				subscriber.group)
+			subscriber.stop(owned)
+			delete(subscriber.owned, partition)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		owned.revision = revision
+
+		// Release the partitions above the fair share.
+		if len(subscriber.owned) > share {
+			subscriber.stop(owned)
+			delete(subscriber.owned, partition)
+			if err := subscriber.leases.Delete(lease, nats.LastRevision(revision)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for partition := int32(0); int(partition) < subscriber.partitions && len(subscriber.owned) < share; partition++ {
+		if _, ok := subscriber.owned[partition]; ok {
+			continue
+		}
+
+		lease := natsLeaseKey(subscriber.group, partition)
+		revision, err := subscriber.leases.Create(lease, []byte(subscriber.consumer))
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		owned, err := subscriber.start(partition)
+		if err != nil {
+			subscriber.leases.Delete(lease, nats.LastRevision(revision))
+			return err
+		}
+		owned.revision = revision
+		subscriber.owned[partition] = owned
+	}
+
+	subscriber.rebalanced = time.Now()
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// members is a helper function to return the number of subscribers registered in the consumer group.
+func (subscriber *NATSSubscriber) members() (int, error) {
+	watcher, err := subscriber.leases.Watch(natsMemberKey(subscriber.group, "*"), nats.IgnoreDeletes(),
+		nats.MetaOnly())
+	if err != nil {
+		return 0, err
+	}
+	defer watcher.Stop()
+
+	members := 0
+	timer := time.NewTimer(natsFetchWait)
+	defer timer.Stop()
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// The watcher sends nil once all the registrations are sent.
+			if entry == nil {
+				if members == 0 {
+					members = 1
+				}
+				return members, nil
+			}
+			members++
+		case <-timer.C:
+			return 0, errors.New("timeout while listing the members of the consumer group " + subscriber.group)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// start is a helper function to bind the consumer of the partition and to start fetching its messages.
+func (subscriber *NATSSubscriber) start(partition int32) (*natsPartition, error) {
+	topic := subscriber.subscribed
+	consumer := natsConsumer(subscriber.group, partition)
+
+	// The consumer is bound rather than created by the subscription, so that unsubscribing does not delete it together
+	// with the position of the group.
+	subscription, err := subscriber.js.PullSubscribe(natsSubject(topic, partition), consumer, nats.Bind(topic, consumer))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	owned := &natsPartition{subscription: subscription, cancel: cancel, stopped: make(chan struct{})}
+	go subscriber.fetch(ctx, owned)
+	return owned, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// stop is a helper function to stop fetching the messages of the partition. A fetched message which is not received
+// yet is handed to the next owner right away.
+func (subscriber *NATSSubscriber) stop(owned *natsPartition) {
+	owned.cancel()
+	<-owned.stopped
+	owned.subscription.Unsubscribe()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// fetch is a helper function which is run as a go routine per owned partition until the partition is stopped. It
+// fetches the messages of the partition one at a time and hands them to Receive.
+func (subscriber *NATSSubscriber) fetch(ctx context.Context, owned *natsPartition) {
+	defer close(owned.stopped)
+
+	for ctx.Err() == nil {
+		fetchCtx, cancel := context.WithTimeout(ctx, natsFetchWait)
+		messages, err := owned.subscription.Fetch(1, nats.Context(fetchCtx))
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+				continue
+			}
+			glog.Errorf("Failed to fetch the messages of %s: %v", owned.subscription.Subject, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(natsFetchWait):
+			}
+			continue
+		}
+
+		for _, message := range messages {
+			select {
+			case subscriber.messages <- message:
+			case <-ctx.Done():
+				message.Nak()
+			}
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Pause implements Subscriber. The fetched messages wait for Resume.
+func (subscriber *NATSSubscriber) Pause() error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	subscriber.paused = true
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Resume implements Subscriber.
+func (subscriber *NATSSubscriber) Resume() error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	subscriber.paused = false
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Lag implements Subscriber. The lag of a partition is the number of messages which its consumer did not deliver yet.
+func (subscriber *NATSSubscriber) Lag() ([]PartitionLag, error) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	var lags []PartitionLag
+	for partition, owned := range subscriber.owned {
+		info, err := owned.subscription.ConsumerInfo()
+		if err != nil {
+			return nil, err
+		}
+		lags = append(lags, PartitionLag{Topic: subscriber.subscribed, Partition: partition,
+			Lag: int64(info.NumPending)})
+	}
+	return lags, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Subscriber. It fails if the servers are not reachable or the stream does not exist.
+func (subscriber *NATSSubscriber) Ping(ctx context.Context) error {
+	_, err := subscriber.js.StreamInfo(subscriber.topic, nats.Context(ctx))
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Subscriber. The last received message is acknowledged and the partitions are released, so that
+// the other subscribers of the group take them over right away. The consumers of the group are kept.
+func (subscriber *NATSSubscriber) Close() error {
+	var err error
+	subscriber.closeOnce.Do(func() {
+		close(subscriber.done)
+
+		subscriber.mutex.Lock()
+		defer subscriber.mutex.Unlock()
+
+		// The last received message of a paused subscriber is not processed, it is delivered again right away.
+		if subscriber.paused && subscriber.previous != nil {
+			err = subscriber.previous.Nak()
+			subscriber.previous = nil
+		} else {
+			err = subscriber.ackPrevious()
+		}
+		for partition, owned := range subscriber.owned {
+			subscriber.stop(owned)
+			subscriber.leases.Delete(natsLeaseKey(subscriber.group, partition), nats.LastRevision(owned.revision))
+		}
+		if subscriber.leases != nil {
+			subscriber.leases.Delete(natsMemberKey(subscriber.group, subscriber.consumer))
+		}
+
+		// Make sure the server got the acknowledgements before the connection is closed.
+		if flushErr := subscriber.conn.FlushTimeout(natsFetchWait); err == nil {
+			err = flushErr
+		}
+		subscriber.conn.Close()
+	})
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// connectNATS is a helper function to connect to the servers of the configuration and to create the stream of the
+// topic of the configuration if it does not exist. The token is obtained from the secret store on every connect, so
+// a rotated token is picked up when the connection is established again.
+func connectNATS(conf *viper.Viper, secretStore *secrets.Store) (*nats.Conn, nats.JetStreamContext, error) {
+	options := []nats.Option{nats.MaxReconnects(-1)}
+	if conf.GetString(configutil.KNATSToken) != "" {
+		options = append(options, nats.TokenHandler(func() string {
+			return secretStore.Get(configutil.KNATSToken)
+		}))
+	}
+
+	conn, err := nats.Connect(conf.GetString(configutil.KNATSURL), options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	js, err := conn.JetStream(nats.PublishAsyncMaxPending(natsQueueSize))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := ensureStream(js, conf.GetString(configutil.KTopic), conf.GetDuration(configutil.KNATSMaxAge)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, js, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ensureStream is a helper function to create the stream of the topic if it does not exist.
+func ensureStream(js nats.JetStreamContext, topic string, maxAge time.Duration) error {
+	_, err := js.StreamInfo(topic)
+	if err == nil || !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     topic,
+		Subjects: []string{topic + ".*"},
+		Storage:  nats.FileStorage,
+		MaxAge:   maxAge,
+	})
+	// Another client created the stream in the meantime.
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return nil
+	}
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// natsConsumer is a helper function to return the durable consumer of the partition in the consumer group.
+func natsConsumer(group string, partition int32) string {
+	return group + "-" + strconv.Itoa(int(partition))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// natsLeaseKey is a helper function to return the key of the lease of the partition in the consumer group.
+func natsLeaseKey(group string, partition int32) string {
+	return "lease." + group + "." + strconv.Itoa(int(partition))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// natsMemberKey is a helper function to return the key of the registration of a subscriber in the consumer group.
+func natsMemberKey(group string, consumer string) string {
+	return "member." + group + "." + consumer
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// natsSubject is a helper function to return the subject of the partition of the topic.
+func natsSubject(topic string, partition int32) string {
+	return topic + "." + strconv.Itoa(int(partition))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// natsToMessage is a helper function to convert a received message. The topic and the partition are taken from the
+// subject.
+func natsToMessage(natsMessage *nats.Msg) *Message {
+	message := &Message{
+		Key:     []byte(natsMessage.Header.Get(natsKeyHeader)),
+		Value:   natsMessage.Data,
+		Headers: make(map[string]string, len(natsMessage.Header)),
+	}
+
+	if dot := strings.LastIndex(natsMessage.Subject, "."); dot >= 0 {
+		message.Topic = natsMessage.Subject[:dot]
+		partition, _ := strconv.Atoi(natsMessage.Subject[dot+1:])
+		message.Partition = int32(partition)
+	}
+	if metadata, err := natsMessage.Metadata(); err == nil {
+		message.Offset = int64(metadata.Sequence.Stream)
+	}
+	for key := range natsMessage.Header {
+		if key != natsKeyHeader {
+			message.Headers[key] = natsMessage.Header.Get(key)
+		}
+	}
+	return message
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,773 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the redis streams transport of the message queue.
+//
+// A redis stream has consumer groups but no partitions, and the entries of a stream are spread over all the consumers
+// of a group, which breaks the order of the keys. So the partitions are built from streams and every partition is
+// consumed by a single subscriber of the group at a time, like the partitions of kafka.
+//
+// 1. A topic has one stream per partition, {<topic>}:<partition>. The publisher adds a message to the stream of the
+//    hash of its key, so the messages with the same key are stored in order. The braces keep all the keys of a topic
+//    in the same slot of a redis cluster.
+// 2. A consumer group is a group of the same name on every stream. A new group starts from the first entry.
+// 3. A subscriber owns a partition while it holds its lease, {<topic>}:<group>:lease:<partition>. The subscribers of
+//    a group register in {<topic>}:<group>:members and every subscriber takes its fair share of the partitions. The
+//    leases are renewed, released and taken by Receive, at most once every redisRebalanceInterval.
+// 4. A received message is acknowledged when Receive is called again, and a partition is only released when its
+//    messages are acknowledged. The new owner of a partition whose subscriber died claims the entries which were not
+//    acknowledged and processes them first. The delivery is at least once, like the auto commit of the kafka consumers.
+//
+// A subscriber which does not call Receive within redisLeaseTTL loses its partitions, like a kafka consumer which
+// exceeds the maximum poll interval. The streams are trimmed to about max_len entries of the redis block.
+
+package messageq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/secrets"
+)
+
+const (
+	// redisQueueSize is the number of messages a RedisPublisher keeps waiting to be added before Publish returns
+	// ErrQueueFull, like the local queue of the kafka producer.
+	redisQueueSize = 100000
+
+	// redisBatchSize is the maximum number of messages which are added to the streams in one round trip.
+	redisBatchSize = 1000
+
+	// redisLeaseTTL is the time for which a subscriber owns a partition without renewing its lease. The registration
+	// of the subscriber in the members of the group expires after the same time.
+	redisLeaseTTL = 30 * time.Second
+
+	// redisRebalanceInterval is the interval at which a subscriber renews its leases and takes its fair share of the
+	// partitions.
+	redisRebalanceInterval = time.Second
+
+	// redisClaimCount is the maximum number of entries which are claimed from a dead subscriber per partition. A
+	// subscriber has at most a few entries of a partition which are not acknowledged.
+	redisClaimCount = 100
+)
+
+var (
+	// renewLease extends the lease of KEYS[1] by ARGV[2] milliseconds if it is held by the subscriber ARGV[1].
+	renewLease = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	// releaseLease deletes the lease of KEYS[1] if it is held by the subscriber ARGV[1].
+	releaseLease = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+)
+
+// RedisPublisher implements the Publisher interface with redis streams.
+type RedisPublisher struct {
+	client     *redis.Client
+	partitions int
+	maxLen     int64
+
+	// topic is the topic of the configuration, checked by Ping.
+	topic string
+
+	// queue are the published messages waiting to be added to the streams, in the order of publishing.
+	queue      chan *Message
+	deliveries chan Delivery
+
+	// pending is the number of published messages whose delivery is not received from the deliveries channel yet. It
+	// is accessed atomically.
+	pending int64
+
+	// done is closed by Close.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRedisPublisher creates a redis client from the configuration and returns a new instance of RedisPublisher.
+func NewRedisPublisher(conf *viper.Viper, secretStore *secrets.Store) (*RedisPublisher, error) {
+	client, err := newRedisClient(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+
+	publisher := &RedisPublisher{
+		client:     client,
+		partitions: conf.GetInt(configutil.KRedisPartitions),
+		maxLen:     conf.GetInt64(configutil.KRedisMaxLen),
+		topic:      conf.GetString(configutil.KTopic),
+		queue:      make(chan *Message, redisQueueSize),
+		deliveries: make(chan Delivery),
+		done:       make(chan struct{}),
+	}
+	go publisher.addMessages()
+	return publisher, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Publish implements Publisher.
+func (publisher *RedisPublisher) Publish(message *Message) error {
+	select {
+	case <-publisher.done:
+		return errClosed
+	default:
+	}
+
+	message.Partition = partitionOf(message.Key, publisher.partitions)
+	atomic.AddInt64(&publisher.pending, 1)
+	select {
+	case publisher.queue <- message:
+		return nil
+	default:
+		atomic.AddInt64(&publisher.pending, -1)
+		return ErrQueueFull
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Deliveries implements Publisher.
+func (publisher *RedisPublisher) Deliveries() <-chan Delivery {
+	return publisher.deliveries
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Flush implements Publisher.
+func (publisher *RedisPublisher) Flush(timeout time.Duration) int {
+	return flush(publisher, timeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Len implements Publisher.
+func (publisher *RedisPublisher) Len() int {
+	return int(atomic.LoadInt64(&publisher.pending))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Publisher. It fails if the server is not reachable. The streams are created by the first message.
+func (publisher *RedisPublisher) Ping(ctx context.Context) error {
+	return publisher.client.Ping(ctx).Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Publisher.
+func (publisher *RedisPublisher) Close() {
+	publisher.closeOnce.Do(func() {
+		close(publisher.done)
+		publisher.client.Close()
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// addMessages is a helper function which is run as a go routine for the lifetime of the publisher. It adds the queued
+// messages to their streams in batches and reports their outcome on the deliveries channel. Redis does not number the
+// entries of a stream, so the offset of the delivered messages is not set.
+func (publisher *RedisPublisher) addMessages() {
+	defer close(publisher.deliveries)
+
+	for {
+		var batch []*Message
+		select {
+		case message := <-publisher.queue:
+			batch = append(batch, message)
+		case <-publisher.done:
+			return
+		}
+
+		// Add the messages which are queued in the meantime in the same round trip.
+	collect:
+		for len(batch) < redisBatchSize {
+			select {
+			case message := <-publisher.queue:
+				batch = append(batch, message)
+			default:
+				break collect
+			}
+		}
+
+		for i, err := range publisher.add(batch) {
+			select {
+			case publisher.deliveries <- Delivery{Message: batch[i], Err: err}:
+				atomic.AddInt64(&publisher.pending, -1)
+			case <-publisher.done:
+				return
+			}
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// add is a helper function to add the messages to their streams in a pipeline. It returns the error of every message.
+func (publisher *RedisPublisher) add(batch []*Message) []error {
+	ctx := context.Background()
+	pipeline := publisher.client.Pipeline()
+
+	errs := make([]error, len(batch))
+	cmds := make([]*redis.StringCmd, len(batch))
+	for i, message := range batch {
+		headers, err := json.Marshal(message.Headers)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		cmds[i] = pipeline.XAdd(ctx, &redis.XAddArgs{
+			Stream: redisStream(message.Topic, message.Partition),
+			MaxLen: publisher.maxLen,
+			Approx: true,
+			Values: []interface{}{"key", message.Key, "value", message.Value, "headers", headers},
+		})
+	}
+
+	// The errors are reported per command.
+	pipeline.Exec(ctx)
+	for i, cmd := range cmds {
+		if cmd != nil {
+			errs[i] = cmd.Err()
+		}
+	}
+	return errs
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// RedisSubscriber implements the Subscriber interface with a consumer group of redis streams.
+type RedisSubscriber struct {
+	client     *redis.Client
+	group      string
+	partitions int
+
+	// consumer is the name of the subscriber in the consumer group and in the leases.
+	consumer string
+
+	// topic is the topic of the configuration, checked by Ping.
+	topic string
+
+	// Guards the state below.
+	mutex      sync.Mutex
+	subscribed string
+	closed     bool
+
+	// owned are the partitions whose lease the subscriber holds, with the fetched entries which are not received yet.
+	owned map[int32][]redis.XMessage
+
+	// next is the partition which is checked first by the next Receive, so that no partition is starved.
+	next int32
+
+	// previous is the last received entry, which is acknowledged by the next Receive.
+	previous *redisEntry
+
+	// paused is set between Pause and Resume. Receive only renews the leases while paused.
+	paused bool
+
+	rebalanced time.Time
+}
+
+// redisEntry is an entry of a partition.
+type redisEntry struct {
+	partition int32
+	id        string
+}
+
+// NewRedisSubscriber creates a redis client from the configuration and returns a new instance of RedisSubscriber in
+// the consumer group. It joins the group on Subscribe.
+func NewRedisSubscriber(conf *viper.Viper, secretStore *secrets.Store, group string) (*RedisSubscriber, error) {
+	client, err := newRedisClient(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisSubscriber{
+		client:     client,
+		group:      group,
+		partitions: conf.GetInt(configutil.KRedisPartitions),
+		consumer:   consumerName(),
+		topic:      conf.GetString(configutil.KTopic),
+		owned:      make(map[int32][]redis.XMessage),
+	}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Subscribe implements Subscriber. The consumer group is created on the streams of the topic if it does not exist.
+func (subscriber *RedisSubscriber) Subscribe(topic string) error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.subscribed != "" {
+		return errors.New("the subscriber is already subscribed to " + subscriber.subscribed)
+	}
+
+	ctx := context.Background()
+	for partition := 0; partition < subscriber.partitions; partition++ {
+		stream := redisStream(topic, int32(partition))
+		err := subscriber.client.XGroupCreateMkStream(ctx, stream, subscriber.group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create the consumer group on %s: %w", stream, err)
+		}
+	}
+	subscriber.subscribed = topic
+	return subscriber.rebalance(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Receive implements Subscriber. It acknowledges the message of the previous call first.
+func (subscriber *RedisSubscriber) Receive(timeout time.Duration) (*Message, error) {
+	ctx := context.Background()
+	deadline := time.Now().Add(timeout)
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.subscribed == "" {
+		return nil, errors.New("the subscriber is not subscribed to a topic")
+	}
+	if !subscriber.paused {
+		if err := subscriber.ackPrevious(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		if subscriber.closed {
+			return nil, errClosed
+		}
+		if time.Since(subscriber.rebalanced) >= redisRebalanceInterval {
+			if err := subscriber.rebalance(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		if !subscriber.paused {
+			if message := subscriber.take(); message != nil {
+				return message, nil
+			}
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, ErrTimeout
+		}
+		if wait > redisRebalanceInterval {
+			wait = redisRebalanceInterval
+		}
+
+		// A paused subscriber only waits for the next rebalance, which renews its leases.
+		if subscriber.paused {
+			subscriber.mutex.Unlock()
+			time.Sleep(wait)
+			subscriber.mutex.Lock()
+			continue
+		}
+		if err := subscriber.read(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Pause implements Subscriber. The fetched entries are kept for Resume.
+func (subscriber *RedisSubscriber) Pause() error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	subscriber.paused = true
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Resume implements Subscriber.
+func (subscriber *RedisSubscriber) Resume() error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	subscriber.paused = false
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// take is a helper function to take the next fetched entry of the owned partitions. It returns nil when no entry is
+// fetched. The caller must hold the mutex.
+func (subscriber *RedisSubscriber) take() *Message {
+	for i := 0; i < subscriber.partitions; i++ {
+		partition := (subscriber.next + int32(i)) % int32(subscriber.partitions)
+		entries := subscriber.owned[partition]
+		if len(entries) == 0 {
+			continue
+		}
+
+		entry := entries[0]
+		subscriber.owned[partition] = entries[1:]
+		subscriber.next = partition + 1
+		subscriber.previous = &redisEntry{partition: partition, id: entry.ID}
+		return redisToMessage(subscriber.subscribed, partition, entry)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// read is a helper function to fetch the next entries of the owned partitions, waiting at most for the time. The
+// mutex is released while waiting, the caller must hold it.
+func (subscriber *RedisSubscriber) read(ctx context.Context, wait time.Duration) error {
+	var streams, ids []string
+	for partition := range subscriber.owned {
+		streams = append(streams, redisStream(subscriber.subscribed, partition))
+		ids = append(ids, ">")
+	}
+
+	subscriber.mutex.Unlock()
+	results, err := subscriber.wait(ctx, streams, ids, wait)
+	subscriber.mutex.Lock()
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		partition := redisPartition(result.Stream)
+		// The entries of a partition which was lost meanwhile are claimed by its new owner.
+		if entries, ok := subscriber.owned[partition]; ok {
+			subscriber.owned[partition] = append(entries, result.Messages...)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// wait is a helper function to wait at most for the time for the next entries of the streams. The caller must not
+// hold the mutex.
+func (subscriber *RedisSubscriber) wait(ctx context.Context, streams, ids []string,
+	wait time.Duration) ([]redis.XStream, error) {
+	if len(streams) == 0 {
+		// The other subscribers of the group own all the partitions.
+		time.Sleep(wait)
+		return nil, nil
+	}
+
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	results, err := subscriber.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    subscriber.group,
+		Consumer: subscriber.consumer,
+		Streams:  append(streams, ids...),
+		Count:    1,
+		Block:    wait,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return results, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ackPrevious is a helper function to acknowledge the last received entry. The caller must hold the mutex.
+func (subscriber *RedisSubscriber) ackPrevious(ctx context.Context) error {
+	if subscriber.previous == nil {
+		return nil
+	}
+
+	stream := redisStream(subscriber.subscribed, subscriber.previous.partition)
+	err := subscriber.client.XAck(ctx, stream, subscriber.group, subscriber.previous.id).Err()
+	subscriber.previous = nil
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// rebalance is a helper function to renew the leases of the owned partitions and to release or take partitions until
+// the subscriber owns its fair share of them. The caller must hold the mutex and has acknowledged the last received
+// entry.
+func (subscriber *RedisSubscriber) rebalance(ctx context.Context) error {
+	topic := subscriber.subscribed
+	members := redisMembers(topic, subscriber.group)
+	now := time.Now()
+
+	// Register the subscriber and forget the subscribers which did not register within the lease.
+	pipeline := subscriber.client.TxPipeline()
+	pipeline.ZAdd(ctx, members, &redis.Z{
+		Score:  float64(now.Add(redisLeaseTTL).UnixMilli()),
+		Member: subscriber.consumer,
+	})
+	pipeline.ZRemRangeByScore(ctx, members, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	alive := pipeline.ZCard(ctx, members)
+	if _, err := pipeline.Exec(ctx); err != nil {
+		return err
+	}
+	share := (subscriber.partitions + int(alive.Val()) - 1) / int(alive.Val())
+
+	leaseTTL := redisLeaseTTL.Milliseconds()
+	for partition, entries := range subscriber.owned {
+		lease := redisLease(topic, subscriber.group, partition)
+		renewed, err := renewLease.Run(ctx, subscriber.client, []string{lease}, subscriber.consumer, leaseTTL).Int()
+		if err != nil {
+			return err
+		}
+		if renewed == 0 {
+			glog.Warningf("Lost the partition %d of %s in the consumer group %s", partition, topic, subscriber.group)
+			delete(subscriber.owned, partition)
+			continue
+		}
+
+		// Release the partitions above the fair share once their fetched entries are received.
+		if len(subscriber.owned) > share && len(entries) == 0 {
+			if err := releaseLease.Run(ctx, subscriber.client, []string{lease}, subscriber.consumer).Err(); err != nil {
+				return err
+			}
+			delete(subscriber.owned, partition)
+		}
+	}
+
+	for partition := int32(0); int(partition) < subscriber.partitions && len(subscriber.owned) < share; partition++ {
+		if _, ok := subscriber.owned[partition]; ok {
+			continue
+		}
+
+		lease := redisLease(topic, subscriber.group, partition)
+		taken, err := subscriber.client.SetNX(ctx, lease, subscriber.consumer, redisLeaseTTL).Result()
+		if err != nil {
+			return err
+		}
+		if !taken {
+			continue
+		}
+
+		entries, err := subscriber.claim(ctx, partition)
+		if err != nil {
+			subscriber.client.Del(ctx, lease)
+			return err
+		}
+		subscriber.owned[partition] = entries
+	}
+
+	subscriber.rebalanced = now
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// claim is a helper function to claim the entries of the partition which the previous owners did not acknowledge. They
+// precede the entries which are not delivered yet, so they are received first.
+func (subscriber *RedisSubscriber) claim(ctx context.Context, partition int32) ([]redis.XMessage, error) {
+	stream := redisStream(subscriber.subscribed, partition)
+	pending, err := subscriber.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  subscriber.group,
+		Start:  "-",
+		End:    "+",
+		Count:  redisClaimCount,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	ids := make([]string, len(pending))
+	for i, entry := range pending {
+		ids[i] = entry.ID
+	}
+	entries, err := subscriber.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    subscriber.group,
+		Consumer: subscriber.consumer,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries which were trimmed from the stream meanwhile cannot be processed anymore.
+	var claimed []redis.XMessage
+	for _, entry := range entries {
+		if entry.Values != nil {
+			claimed = append(claimed, entry)
+		}
+	}
+	return claimed, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Lag implements Subscriber. The lag of a partition is the number of entries which are not delivered to the group yet.
+// It is only known by redis 7 and later.
+func (subscriber *RedisSubscriber) Lag() ([]PartitionLag, error) {
+	subscriber.mutex.Lock()
+	topic := subscriber.subscribed
+	var partitions []int32
+	for partition := range subscriber.owned {
+		partitions = append(partitions, partition)
+	}
+	subscriber.mutex.Unlock()
+
+	ctx := context.Background()
+	var lags []PartitionLag
+	for _, partition := range partitions {
+		groups, err := subscriber.client.Do(ctx, "XINFO", "GROUPS", redisStream(topic, partition)).Slice()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range groups {
+			fields, ok := group.([]interface{})
+			if !ok {
+				continue
+			}
+			info := make(map[string]interface{}, len(fields)/2)
+			for i := 0; i+1 < len(fields); i += 2 {
+				info[fmt.Sprint(fields[i])] = fields[i+1]
+			}
+			if info["name"] != subscriber.group {
+				continue
+			}
+			if lag, ok := info["lag"].(int64); ok {
+				lags = append(lags, PartitionLag{Topic: topic, Partition: partition, Lag: lag})
+			}
+		}
+	}
+	return lags, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Subscriber. It fails if the server is not reachable.
+func (subscriber *RedisSubscriber) Ping(ctx context.Context) error {
+	return subscriber.client.Ping(ctx).Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Subscriber. The last received message is acknowledged and the partitions are released, so that
+// the other subscribers of the group take them over right away.
+func (subscriber *RedisSubscriber) Close() error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.closed {
+		return nil
+	}
+	subscriber.closed = true
+
+	// The last received entry of a paused subscriber is not processed, it is claimed by the next owner.
+	ctx := context.Background()
+	var err error
+	if !subscriber.paused {
+		err = subscriber.ackPrevious(ctx)
+	}
+	if subscriber.subscribed != "" {
+		// The fetched entries which are not received are claimed by the next owner.
+		for partition := range subscriber.owned {
+			lease := redisLease(subscriber.subscribed, subscriber.group, partition)
+			releaseLease.Run(ctx, subscriber.client, []string{lease}, subscriber.consumer)
+		}
+		subscriber.client.ZRem(ctx, redisMembers(subscriber.subscribed, subscriber.group), subscriber.consumer)
+	}
+
+	if closeErr := subscriber.client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newRedisClient is a helper function to create a redis client from the configuration. The password is obtained from
+// the secret store on every new connection, so a rotated password is picked up by the connections opened afterwards.
+func newRedisClient(conf *viper.Viper, secretStore *secrets.Store) (*redis.Client, error) {
+	options := &redis.Options{
+		Addr: conf.GetString(configutil.KRedisAddr),
+		DB:   conf.GetInt(configutil.KRedisDB),
+	}
+	if conf.GetString(configutil.KRedisPassword) != "" {
+		options.OnConnect = func(ctx context.Context, conn *redis.Conn) error {
+			return conn.Auth(ctx, secretStore.Get(configutil.KRedisPassword)).Err()
+		}
+	}
+
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// redisStream is a helper function to return the stream of the partition of the topic.
+func redisStream(topic string, partition int32) string {
+	return "{" + topic + "}:" + strconv.Itoa(int(partition))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// redisPartition is a helper function to return the partition of a stream.
+func redisPartition(stream string) int32 {
+	partition, _ := strconv.Atoi(stream[strings.LastIndex(stream, ":")+1:])
+	return int32(partition)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// redisMembers is a helper function to return the members of the consumer group on the topic.
+func redisMembers(topic string, group string) string {
+	return "{" + topic + "}:" + group + ":members"
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// redisLease is a helper function to return the lease of the partition of the topic in the consumer group.
+func redisLease(topic string, group string, partition int32) string {
+	return "{" + topic + "}:" + group + ":lease:" + strconv.Itoa(int(partition))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// redisToMessage is a helper function to convert an entry of a partition.
+func redisToMessage(topic string, partition int32, entry redis.XMessage) *Message {
+	message := &Message{
+		Topic:     topic,
+		Partition: partition,
+		Headers:   map[string]string{},
+	}
+	if key, ok := entry.Values["key"].(string); ok {
+		message.Key = []byte(key)
+	}
+	if value, ok := entry.Values["value"].(string); ok {
+		message.Value = []byte(value)
+	}
+	if headers, ok := entry.Values["headers"].(string); ok {
+		if err := json.Unmarshal([]byte(headers), &message.Headers); err != nil {
+			glog.Warningf("Invalid headers of the entry %s of %s: %v", entry.ID, topic, err)
+		}
+	}
+	return message
+}
+
+//----------------------------------------------------------------------------------------------------------------------
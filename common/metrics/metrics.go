@@ -0,0 +1,134 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the prometheus metrics shared by the services.
+//
+// Every service declares its own metrics, prefixed with the service name, in its metrics package. The collectors of
+// this package export the metrics which more than one service needs, under the namespace of the service which uses
+// them. The labels follow the conventions of the services, for example the topic is always labelled as "topic".
+
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"common/messageq"
+	"common/storage"
+)
+
+// lagInterval is the interval at which the consumer lag is refreshed.
+const lagInterval = 15 * time.Second
+
+// PoolCollector exports the statistics of the postgres connection pools of a service. The pools are labelled with
+// their name, for example "primary" or the address of a read replica.
+type PoolCollector struct {
+	// Guards the pools.
+	mutex sync.Mutex
+	pools map[string]*storage.RotatingDB
+
+	connections *prometheus.Desc
+	requests    *prometheus.Desc
+	timeouts    *prometheus.Desc
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewPoolCollector returns a new instance of PoolCollector whose metrics are prefixed with the namespace. It must be
+// registered with prometheus by the caller.
+func NewPoolCollector(namespace string) *PoolCollector {
+	return &PoolCollector{
+		pools: make(map[string]*storage.RotatingDB),
+		connections: prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "connections"),
+			"Number of connections in the postgres connection pool.", []string{"pool", "state"}, nil),
+		requests: prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "requests_total"),
+			"Number of requests for a connection, by whether a free connection was found in the pool.",
+			[]string{"pool", "result"}, nil),
+		timeouts: prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "timeouts_total"),
+			"Number of requests for a connection which timed out waiting for a free connection.",
+			[]string{"pool"}, nil),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Add adds a connection pool under the name.
+func (collector *PoolCollector) Add(name string, db *storage.RotatingDB) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.pools[name] = db
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Describe implements prometheus.Collector.
+func (collector *PoolCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- collector.connections
+	descs <- collector.requests
+	descs <- collector.timeouts
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Collect implements prometheus.Collector. The counters start from zero again when the pool is replaced after a
+// rotation of the credentials, which prometheus handles like a restart.
+func (collector *PoolCollector) Collect(metrics chan<- prometheus.Metric) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	for name, db := range collector.pools {
+		stats := db.DB().PoolStats()
+		metrics <- prometheus.MustNewConstMetric(collector.connections, prometheus.GaugeValue,
+			float64(stats.TotalConns-stats.IdleConns), name, "in_use")
+		metrics <- prometheus.MustNewConstMetric(collector.connections, prometheus.GaugeValue,
+			float64(stats.IdleConns), name, "idle")
+		metrics <- prometheus.MustNewConstMetric(collector.requests, prometheus.CounterValue,
+			float64(stats.Hits), name, "hit")
+		metrics <- prometheus.MustNewConstMetric(collector.requests, prometheus.CounterValue,
+			float64(stats.Misses), name, "miss")
+		metrics <- prometheus.MustNewConstMetric(collector.timeouts, prometheus.CounterValue,
+			float64(stats.Timeouts), name)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MonitorConsumerLag is a helper function which is run as a go routine per subscriber. It periodically refreshes the
+// lag of all the partitions assigned to the subscriber in the gauge, labelled with the worker, the topic and the
+// partition, until the context is cancelled.
+func MonitorConsumerLag(ctx context.Context, lag *prometheus.GaugeVec, worker string, subscriber messageq.Subscriber) {
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			updateConsumerLag(lag, worker, subscriber)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// updateConsumerLag is a helper function to set the lag of every partition assigned to the subscriber.
+func updateConsumerLag(lag *prometheus.GaugeVec, worker string, subscriber messageq.Subscriber) {
+	lags, err := subscriber.Lag()
+	if err != nil {
+		glog.Errorf("failed to get the lag of the %s consumer: %v", worker, err)
+		return
+	}
+
+	for _, partition := range lags {
+		lag.WithLabelValues(worker, partition.Topic, strconv.Itoa(int(partition.Partition))).Set(float64(partition.Lag))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,65 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the schema of the ClickHouse backend.
+//
+// ClickHouse is a column store built for the analytical queries of the apis. It scans and aggregates the raw log lines
+// fast enough that it needs neither the rollup tables nor the template counters of the postgres backend.
+//
+// 1. log_lines: The raw log lines ordered by time and thread. The table is partitioned by day, so the retention drops
+//    whole partitions. It is a ReplacingMergeTree keyed by (timestamp_seconds, thread_id, process_id, timestamp),
+//    which is the primary key of the postgres table. A line redelivered by kafka is collapsed with the original, and
+//    the reads use FINAL so that the lines are never double counted before the parts are merged.
+// 2. log_templates: The templates mined by the stats worker. A changed template is inserted again with a newer
+//    updated_at, and the ReplacingMergeTree keeps the latest version.
+//
+// The tables are created with "IF NOT EXISTS". There are no versioned migrations for ClickHouse yet.
+
+package schema
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// clickHouseTables are the statements which create the tables of the ClickHouse backend.
+var clickHouseTables = []string{
+	`CREATE TABLE IF NOT EXISTS log_lines (
+		process_id String,
+		thread_id String,
+		thread_name String,
+		timestamp DateTime64(3, 'UTC'),
+		timestamp_seconds Int64,
+		log_message String,
+		attributes Map(String, String),
+		template_id Int64,
+		byte_count UInt32
+	) ENGINE = ReplacingMergeTree
+	PARTITION BY toYYYYMMDD(timestamp)
+	ORDER BY (timestamp_seconds, thread_id, process_id, timestamp)`,
+
+	`CREATE TABLE IF NOT EXISTS log_templates (
+		template_id Int64,
+		template String,
+		token_count Int32,
+		updated_at DateTime64(3, 'UTC')
+	) ENGINE = ReplacingMergeTree(updated_at)
+	ORDER BY template_id`,
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MigrateClickHouse creates the tables of the ClickHouse backend if they do not exist.
+func MigrateClickHouse(ctx context.Context, conn driver.Conn) error {
+	for _, statement := range clickHouseTables {
+		if err := conn.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create the clickhouse tables: %w", err)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
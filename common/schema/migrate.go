@@ -0,0 +1,309 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the versioned schema migrations of the postgres database.
+//
+// The schema used to live in a one-shot init.sql which only ran on an empty data directory. Instead the schema is now
+// a sequence of migrations embedded in the binaries. Every migration is a pair of files in the migrations directory.
+//
+//     0001_create_log_lines.up.sql
+//     0001_create_log_lines.down.sql
+//
+// The number is the version of the migration and the rest of the file name is a short description. The up file
+// applies the migration and the down file reverts it.
+//
+// At a high-level the migrator does the following.
+//
+// 1. Take a postgres advisory lock. The api server and the log-subscriber both migrate on startup, and there can be
+//    several replicas of each. The lock makes sure exactly one of them applies the pending migrations while the
+//    others wait and then find nothing to do.
+// 2. Create the schema_migrations table if it does not exist. It holds a row per applied version.
+// 3. Apply every pending migration in its own transaction together with the row in schema_migrations. A failed
+//    migration leaves no trace and the next attempt starts from the same version.
+//
+// The up migrations use "IF NOT EXISTS" so that a database created by the old init.sql is adopted as is.
+
+package schema
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/golang/glog"
+)
+
+// migrationsLockID is the key of the postgres advisory lock held while migrating. It is an arbitrary constant which
+// must be the same in all the services.
+const migrationsLockID = 7264917305
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a single version of the schema.
+type Migration struct {
+	// Version is the number in the file name.
+	Version int64
+
+	// Name is the description in the file name.
+	Name string
+
+	// Up is the sql which applies the migration.
+	Up string
+
+	// Down is the sql which reverts the migration.
+	Down string
+}
+
+// appliedMigration encapsulates the structure of the schema_migrations table.
+type appliedMigration struct {
+	tableName struct{}  `pg:"schema_migrations"`
+	Version   int64     `pg:"version,pk"`
+	Name      string    `pg:"name,notnull"`
+	AppliedAt time.Time `pg:"applied_at,notnull"`
+}
+
+// Migrator applies and reverts the migrations.
+type Migrator struct {
+	db         *pg.DB
+	migrations []Migration
+}
+
+// NewMigrator returns a new instance of Migrator with all the embedded migrations.
+func NewMigrator(db *pg.DB) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Up applies all the pending migrations. It returns the number of migrations applied.
+func (migrator *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := migrator.withLock(ctx, func(conn *pg.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrator.migrations {
+			if migration.Version <= current {
+				continue
+			}
+
+			glog.Infof("Applying migration %d_%s", migration.Version, migration.Name)
+			err := conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+					return err
+				}
+				_, err := tx.ModelContext(ctx, &appliedMigration{
+					Version:   migration.Version,
+					Name:      migration.Name,
+					AppliedAt: time.Now(),
+				}).Insert()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Down reverts the latest applied migrations. It returns the number of migrations reverted.
+func (migrator *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	reverted := 0
+	err := migrator.withLock(ctx, func(conn *pg.Conn) error {
+		current, err := currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrator.migrations) - 1; i >= 0 && reverted < steps; i-- {
+			migration := migrator.migrations[i]
+			if migration.Version > current {
+				continue
+			}
+
+			glog.Infof("Reverting migration %d_%s", migration.Version, migration.Name)
+			err := conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+					return err
+				}
+				_, err := tx.ModelContext(ctx, (*appliedMigration)(nil)).
+					Where("version = ?", migration.Version).
+					Delete()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to revert migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted++
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Status returns the current version of the database and the migrations which are not applied yet.
+func (migrator *Migrator) Status(ctx context.Context) (int64, []Migration, error) {
+	var current int64
+	var pending []Migration
+	err := migrator.withLock(ctx, func(conn *pg.Conn) error {
+		var err error
+		current, err = currentVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrator.migrations {
+			if migration.Version > current {
+				pending = append(pending, migration)
+			}
+		}
+		return nil
+	})
+
+	return current, pending, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// withLock is a helper function to run the function with the migrations lock held. The advisory lock belongs to the
+// session, so the lock and everything which runs under the lock use a single connection from the pool.
+func (migrator *Migrator) withLock(ctx context.Context, fn func(conn *pg.Conn) error) error {
+	conn := migrator.db.Conn()
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(?)", migrationsLockID); err != nil {
+		return fmt.Errorf("failed to take the migrations lock: %w", err)
+	}
+	defer func() {
+		// The lock is released anyway when the connection is closed, this is just being polite.
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(?)",
+			migrationsLockID); err != nil {
+			glog.Errorf("failed to release the migrations lock: %v", err)
+		}
+	}()
+
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create the schema_migrations table: %w", err)
+	}
+
+	return fn(conn)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// currentVersion is a helper function to get the latest applied version. Zero means no migration is applied.
+func currentVersion(ctx context.Context, conn *pg.Conn) (int64, error) {
+	var version int64
+	_, err := conn.QueryOneContext(ctx, pg.Scan(&version), "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the current schema version: %w", err)
+	}
+	return version, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// loadMigrations is a helper function to read all the embedded migrations ordered by version. Every version must have
+// both the up and the down file.
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		// The file name is <version>_<name>.<up|down>.sql.
+		base := strings.TrimSuffix(fileName, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+		versionText, name, ok := cut(base, "_")
+		if !ok || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("invalid migration file name: %s", fileName)
+		}
+		version, err := strconv.ParseInt(versionText, 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version: %s", fileName)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		if migration.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, name)
+		}
+
+		if direction == ".up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", migration.Version,
+				migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// cut is a helper function to split the string around the first separator. This is strings.Cut, which is not
+// available in go 1.17.
+func cut(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -1,6 +1,4 @@
--- Connect to the olap database
-\c olap
-
+-- The raw log lines written by the stats worker in the log subscriber.
 CREATE TABLE IF NOT EXISTS log_lines (
     process_id VARCHAR(255),
     thread_id VARCHAR(255),
@@ -8,4 +6,4 @@ CREATE TABLE IF NOT EXISTS log_lines (
     timestamp_seconds BIGINT,
     log_message TEXT,
     PRIMARY KEY (process_id, thread_id, timestamp, timestamp_seconds)
-)
\ No newline at end of file
+);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS thread_lifetimes;
+DROP TABLE IF EXISTS active_threads_per_minute;
+DROP TABLE IF EXISTS active_threads_per_second;
+DROP TABLE IF EXISTS log_lines_per_minute;
+DROP TABLE IF EXISTS log_lines_per_second;
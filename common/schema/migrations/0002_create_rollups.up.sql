@@ -0,0 +1,75 @@
+-- Rollup tables maintained incrementally by the stats worker in the log subscriber. The api server reads from these
+-- tables instead of scanning log_lines.
+CREATE TABLE IF NOT EXISTS log_lines_per_second (
+    bucket_seconds BIGINT,
+    process_id VARCHAR(255),
+    thread_id VARCHAR(255),
+    line_count BIGINT NOT NULL,
+    byte_count BIGINT NOT NULL,
+    PRIMARY KEY (bucket_seconds, process_id, thread_id)
+);
+
+CREATE TABLE IF NOT EXISTS log_lines_per_minute (
+    bucket_seconds BIGINT,
+    process_id VARCHAR(255),
+    thread_id VARCHAR(255),
+    line_count BIGINT NOT NULL,
+    byte_count BIGINT NOT NULL,
+    PRIMARY KEY (bucket_seconds, process_id, thread_id)
+);
+
+CREATE TABLE IF NOT EXISTS active_threads_per_second (
+    bucket_seconds BIGINT PRIMARY KEY,
+    active_threads BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS active_threads_per_minute (
+    bucket_seconds BIGINT PRIMARY KEY,
+    active_threads BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS thread_lifetimes (
+    process_id VARCHAR(255),
+    thread_id VARCHAR(255),
+    first_seen TIMESTAMPTZ NOT NULL,
+    last_seen TIMESTAMPTZ NOT NULL,
+    first_seen_seconds BIGINT NOT NULL,
+    last_seen_seconds BIGINT NOT NULL,
+    line_count BIGINT NOT NULL,
+    PRIMARY KEY (process_id, thread_id)
+);
+
+-- Backfill the rollups from the existing log_lines, so that an upgraded database answers the same from the rollups as
+-- from the raw table. A rollup which is not empty was already maintained by the stats worker and is kept as is. The
+-- raw lines are not stored, so their bytes are counted from the log messages.
+INSERT INTO log_lines_per_second (bucket_seconds, process_id, thread_id, line_count, byte_count)
+SELECT timestamp_seconds, process_id, thread_id, COUNT(*), COALESCE(SUM(octet_length(log_message)), 0)
+FROM log_lines
+WHERE NOT EXISTS (SELECT 1 FROM log_lines_per_second)
+GROUP BY timestamp_seconds, process_id, thread_id;
+
+INSERT INTO log_lines_per_minute (bucket_seconds, process_id, thread_id, line_count, byte_count)
+SELECT timestamp_seconds - timestamp_seconds % 60, process_id, thread_id, COUNT(*),
+       COALESCE(SUM(octet_length(log_message)), 0)
+FROM log_lines
+WHERE NOT EXISTS (SELECT 1 FROM log_lines_per_minute)
+GROUP BY timestamp_seconds - timestamp_seconds % 60, process_id, thread_id;
+
+INSERT INTO active_threads_per_second (bucket_seconds, active_threads)
+SELECT bucket_seconds, COUNT(*)
+FROM log_lines_per_second
+WHERE NOT EXISTS (SELECT 1 FROM active_threads_per_second)
+GROUP BY bucket_seconds;
+
+INSERT INTO active_threads_per_minute (bucket_seconds, active_threads)
+SELECT bucket_seconds, COUNT(*)
+FROM log_lines_per_minute
+WHERE NOT EXISTS (SELECT 1 FROM active_threads_per_minute)
+GROUP BY bucket_seconds;
+
+INSERT INTO thread_lifetimes
+    (process_id, thread_id, first_seen, last_seen, first_seen_seconds, last_seen_seconds, line_count)
+SELECT process_id, thread_id, MIN(timestamp), MAX(timestamp), MIN(timestamp_seconds), MAX(timestamp_seconds), COUNT(*)
+FROM log_lines
+WHERE NOT EXISTS (SELECT 1 FROM thread_lifetimes)
+GROUP BY process_id, thread_id;
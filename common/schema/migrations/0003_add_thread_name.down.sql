@@ -0,0 +1,4 @@
+ALTER TABLE thread_lifetimes DROP COLUMN IF EXISTS thread_name;
+ALTER TABLE log_lines_per_minute DROP COLUMN IF EXISTS thread_name;
+ALTER TABLE log_lines_per_second DROP COLUMN IF EXISTS thread_name;
+ALTER TABLE log_lines DROP COLUMN IF EXISTS thread_name;
@@ -0,0 +1,12 @@
+-- Adds the thread_name column to log_lines and the rollup tables.
+
+ALTER TABLE log_lines ADD COLUMN IF NOT EXISTS thread_name VARCHAR(255);
+ALTER TABLE log_lines_per_second ADD COLUMN IF NOT EXISTS thread_name VARCHAR(255);
+ALTER TABLE log_lines_per_minute ADD COLUMN IF NOT EXISTS thread_name VARCHAR(255);
+ALTER TABLE thread_lifetimes ADD COLUMN IF NOT EXISTS thread_name VARCHAR(255);
+
+-- The thread name was never stored for the existing rows, and it cannot be recovered from them since log_lines only
+-- keeps the message of a line. The thread name of a (process_id, thread_id) does not change during the lifetime of the
+-- thread, so the stats worker fills in the name of the existing rows of a thread in log_lines, log_lines_per_second and
+-- log_lines_per_minute when it records the name of the thread in thread_lifetimes for the first time. Please refer to
+-- backfillThreadName in storage/postgres.go. The rows of the threads which never log again keep a NULL thread_name.
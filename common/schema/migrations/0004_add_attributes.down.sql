@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS log_lines_attributes_idx;
+ALTER TABLE log_lines DROP COLUMN IF EXISTS attributes;
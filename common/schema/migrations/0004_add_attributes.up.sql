@@ -0,0 +1,6 @@
+-- Adds the attributes extracted by the configured extraction rules to log_lines. The GIN index serves the containment
+-- filters.
+
+ALTER TABLE log_lines ADD COLUMN IF NOT EXISTS attributes JSONB;
+
+CREATE INDEX IF NOT EXISTS log_lines_attributes_idx ON log_lines USING GIN (attributes jsonb_path_ops);
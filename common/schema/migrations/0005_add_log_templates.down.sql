@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS log_lines_template_id_idx;
+ALTER TABLE log_lines DROP COLUMN IF EXISTS template_id;
+DROP TABLE IF EXISTS log_templates;
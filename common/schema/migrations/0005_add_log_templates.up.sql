@@ -0,0 +1,17 @@
+-- The log templates mined by the stats worker. Every log line refers to its template with the template_id column. The
+-- existing lines are not assigned a template. The lines of a template are listed by the templates api.
+
+CREATE TABLE IF NOT EXISTS log_templates (
+    template_id BIGSERIAL PRIMARY KEY,
+    template TEXT NOT NULL,
+    token_count INT NOT NULL,
+    line_count BIGINT NOT NULL DEFAULT 0,
+    first_seen TIMESTAMPTZ,
+    last_seen TIMESTAMPTZ,
+    first_seen_seconds BIGINT,
+    last_seen_seconds BIGINT
+);
+
+ALTER TABLE log_lines ADD COLUMN IF NOT EXISTS template_id BIGINT;
+
+CREATE INDEX IF NOT EXISTS log_lines_template_id_idx ON log_lines (template_id, timestamp_seconds);
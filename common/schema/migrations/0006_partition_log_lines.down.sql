@@ -0,0 +1,28 @@
+-- Converts log_lines back to a plain table. The lines of all the partitions are kept.
+ALTER TABLE log_lines RENAME TO log_lines_partitioned;
+ALTER INDEX log_lines_pkey RENAME TO log_lines_partitioned_pkey;
+ALTER INDEX log_lines_attributes_idx RENAME TO log_lines_partitioned_attributes_idx;
+ALTER INDEX log_lines_template_id_idx RENAME TO log_lines_partitioned_template_id_idx;
+
+CREATE TABLE log_lines (
+    process_id VARCHAR(255),
+    thread_id VARCHAR(255),
+    timestamp TIMESTAMPTZ,
+    timestamp_seconds BIGINT,
+    log_message TEXT,
+    thread_name VARCHAR(255),
+    attributes JSONB,
+    template_id BIGINT,
+    PRIMARY KEY (process_id, thread_id, timestamp, timestamp_seconds)
+);
+
+CREATE INDEX log_lines_attributes_idx ON log_lines USING GIN (attributes jsonb_path_ops);
+CREATE INDEX log_lines_template_id_idx ON log_lines (template_id, timestamp_seconds);
+
+INSERT INTO log_lines (process_id, thread_id, timestamp, timestamp_seconds, log_message, thread_name, attributes,
+                       template_id)
+SELECT process_id, thread_id, timestamp, timestamp_seconds, log_message, thread_name, attributes, template_id
+FROM log_lines_partitioned;
+
+-- Dropping the partitioned table drops all its partitions.
+DROP TABLE log_lines_partitioned;
@@ -0,0 +1,33 @@
+-- Converts log_lines to a table partitioned by day on timestamp_seconds. The daily partitions are named
+-- log_lines_pYYYYMMDD and are created and dropped by the partition maintenance of the log subscriber. The default
+-- partition catches the lines of the days which have no partition yet, so that an insert never fails. The maintenance
+-- moves those lines to their daily partition.
+ALTER TABLE log_lines RENAME TO log_lines_unpartitioned;
+ALTER INDEX log_lines_pkey RENAME TO log_lines_unpartitioned_pkey;
+ALTER INDEX IF EXISTS log_lines_attributes_idx RENAME TO log_lines_unpartitioned_attributes_idx;
+ALTER INDEX IF EXISTS log_lines_template_id_idx RENAME TO log_lines_unpartitioned_template_id_idx;
+
+CREATE TABLE log_lines (
+    process_id VARCHAR(255),
+    thread_id VARCHAR(255),
+    timestamp TIMESTAMPTZ,
+    timestamp_seconds BIGINT,
+    log_message TEXT,
+    thread_name VARCHAR(255),
+    attributes JSONB,
+    template_id BIGINT,
+    PRIMARY KEY (process_id, thread_id, timestamp, timestamp_seconds)
+) PARTITION BY RANGE (timestamp_seconds);
+
+CREATE INDEX log_lines_attributes_idx ON log_lines USING GIN (attributes jsonb_path_ops);
+CREATE INDEX log_lines_template_id_idx ON log_lines (template_id, timestamp_seconds);
+
+CREATE TABLE log_lines_default PARTITION OF log_lines DEFAULT;
+
+-- The existing lines land in the default partition. The next partition maintenance moves them to daily partitions.
+INSERT INTO log_lines (process_id, thread_id, timestamp, timestamp_seconds, log_message, thread_name, attributes,
+                       template_id)
+SELECT process_id, thread_id, timestamp, timestamp_seconds, log_message, thread_name, attributes, template_id
+FROM log_lines_unpartitioned;
+
+DROP TABLE log_lines_unpartitioned;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS thread_lifetimes_thread_name_idx;
+DROP INDEX IF EXISTS thread_lifetimes_thread_id_idx;
+DROP INDEX IF EXISTS log_lines_per_minute_thread_name_idx;
+DROP INDEX IF EXISTS log_lines_per_second_thread_name_idx;
+DROP INDEX IF EXISTS log_lines_thread_name_idx;
+DROP INDEX IF EXISTS log_lines_timestamp_seconds_brin;
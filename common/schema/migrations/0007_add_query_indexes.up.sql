@@ -0,0 +1,14 @@
+-- Indexes for the filters of the stats queries which are not served by a primary key.
+--
+-- log_lines is appended in time order, so a BRIN index on timestamp_seconds serves the time range filters at a tiny
+-- fraction of the size of a btree. The primary keys of log_lines and thread_lifetimes start with process_id, so the
+-- filters and groupings on the thread keys get their own btree indexes. The query plans are checked by the test
+-- program in apiserver/test/queryplans.
+CREATE INDEX IF NOT EXISTS log_lines_timestamp_seconds_brin ON log_lines USING BRIN (timestamp_seconds);
+CREATE INDEX IF NOT EXISTS log_lines_thread_name_idx ON log_lines (thread_name, timestamp_seconds);
+
+CREATE INDEX IF NOT EXISTS log_lines_per_second_thread_name_idx ON log_lines_per_second (thread_name, bucket_seconds);
+CREATE INDEX IF NOT EXISTS log_lines_per_minute_thread_name_idx ON log_lines_per_minute (thread_name, bucket_seconds);
+
+CREATE INDEX IF NOT EXISTS thread_lifetimes_thread_id_idx ON thread_lifetimes (thread_id);
+CREATE INDEX IF NOT EXISTS thread_lifetimes_thread_name_idx ON thread_lifetimes (thread_name);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS log_templates_template_md5_idx;
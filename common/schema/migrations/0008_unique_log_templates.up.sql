@@ -0,0 +1,37 @@
+-- Makes the text of a template unique. Every replica of the log-subscriber mines the templates on its own, so the same
+-- template used to be inserted once per replica. The stats worker now looks up a template by its text instead.
+--
+-- The duplicated templates are merged into the one with the lowest id first. The lines of the duplicates are moved to
+-- it and their counters are added up.
+UPDATE log_lines AS l
+SET template_id = d.keep_id
+FROM (
+    SELECT template_id, MIN(template_id) OVER (PARTITION BY template) AS keep_id
+    FROM log_templates
+) AS d
+WHERE l.template_id = d.template_id
+  AND d.template_id <> d.keep_id;
+
+UPDATE log_templates AS t
+SET line_count = m.line_count,
+    first_seen = m.first_seen,
+    last_seen = m.last_seen,
+    first_seen_seconds = m.first_seen_seconds,
+    last_seen_seconds = m.last_seen_seconds
+FROM (
+    SELECT MIN(template_id) AS keep_id, SUM(line_count) AS line_count, MIN(first_seen) AS first_seen,
+           MAX(last_seen) AS last_seen, MIN(first_seen_seconds) AS first_seen_seconds,
+           MAX(last_seen_seconds) AS last_seen_seconds
+    FROM log_templates
+    GROUP BY template
+    HAVING COUNT(*) > 1
+) AS m
+WHERE t.template_id = m.keep_id;
+
+DELETE FROM log_templates AS t
+USING log_templates AS k
+WHERE t.template = k.template
+  AND t.template_id > k.template_id;
+
+-- The text can be longer than a btree entry, so the index is on its hash.
+CREATE UNIQUE INDEX IF NOT EXISTS log_templates_template_md5_idx ON log_templates (md5(template));
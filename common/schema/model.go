@@ -0,0 +1,37 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the data model of the log_lines table shared by the log-subscriber and the api server.
+//
+// The stats worker in the log-subscriber writes the log lines and the api server reads them. Both use this single
+// definition so that the model never drifts from the migrations in this package.
+
+package schema
+
+import "time"
+
+// LogLine encapsulates the structure of postgres table. The table name is specified in the tableName field below.
+// To be precise its called "log_lines".
+//
+// The primary key here is a composite key between process_id, thread_id, timestamp and timestamp millis.
+// Note that timestamp is field in "timestampz" format. This is done to make sure that original timestamp is preserved
+// with milliseconds precision.
+// In addition to timestamp, there is an addition field called timestamp_seconds. This is because all the queries are at
+// seconds precision.
+// The timestamp_seconds is also interesting because the table is partitioned by day on it. Please refer to
+// partitions.go for more details. The partition key must be part of the primary key. Hence the timestamp_seconds field
+// is added.
+type LogLine struct {
+	tableName        struct{}          `pg:"log_lines"`
+	ProcessID        string            `json:"process_id" pg:"process_id,notnull,pk"`
+	ThreadID         string            `json:"thread_id" pg:"thread_id,notnull,pk"`
+	ThreadName       string            `json:"thread_name" pg:"thread_name"`
+	Timestamp        time.Time         `json:"timestamp" pg:"timestamp,notnull,pk"`
+	TimestampSeconds int64             `json:"timestamp_seconds" pg:"timestamp_seconds,notnull,pk"`
+	LogMessage       string            `json:"log_message" pg:"log_message"`
+	Attributes       map[string]string `json:"attributes" pg:"attributes,type:jsonb"`
+	TemplateID       int64             `json:"template_id" pg:"template_id"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
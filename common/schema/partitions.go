@@ -0,0 +1,281 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the maintenance of the daily partitions of the log_lines table.
+//
+// The log_lines table grows with every log line and only the recent lines are interesting. Deleting the old lines row
+// by row is slow and bloats the table. Instead the table is partitioned by day on timestamp_seconds (please refer to
+// the migration 0006_partition_log_lines) and a whole day is dropped at once when it falls out of the retention.
+//
+// The daily partitions are named log_lines_pYYYYMMDD and hold the range [start of the day, start of the next day) in
+// UTC. The lines of a day which has no partition land in the default partition log_lines_default.
+//
+// At a high-level the maintenance does the following.
+//
+// 1. Create the partitions of today and of the next few days, so that the new lines never land in the default
+//    partition.
+// 2. Create the partitions of the days found in the default partition and move their lines there. This happens for
+//    the lines older than the maintenance (for example the sample logs) and right after the migration.
+// 3. Drop the partitions which end before the retention.
+//
+// Every partition is created or dropped in its own transaction holding a postgres advisory lock, so that several
+// replicas of the log-subscriber can run the maintenance at the same time.
+
+package schema
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+)
+
+const (
+	// DefaultPartition is the name of the partition which holds the lines of the days without a partition.
+	DefaultPartition = "log_lines_default"
+
+	// partitionPrefix is the prefix of the name of a daily partition. The date follows in partitionDateLayout.
+	partitionPrefix = "log_lines_p"
+
+	// partitionDateLayout is the layout of the date in the name of a daily partition.
+	partitionDateLayout = "20060102"
+
+	// secondsPerDay is the width of a partition.
+	secondsPerDay = 86400
+
+	// partitionsLockID is the key of the postgres advisory lock held while creating or dropping a partition. It is an
+	// arbitrary constant which must be the same in all the services.
+	partitionsLockID = 7264917306
+)
+
+// partitionBound matches the bound of a daily partition as printed by pg_get_expr.
+var partitionBound = regexp.MustCompile(`FROM \('?(-?\d+)'?\) TO \('?(-?\d+)'?\)`)
+
+// Partition describes a partition of the log_lines table.
+type Partition struct {
+	// Name of the partition table.
+	Name string
+
+	// StartSeconds is the inclusive start of the range of the partition. It is zero for the default partition.
+	StartSeconds int64
+
+	// EndSeconds is the exclusive end of the range of the partition. It is zero for the default partition.
+	EndSeconds int64
+
+	// IsDefault is true for the default partition.
+	IsDefault bool
+
+	// EstimatedRows is the number of rows estimated by postgres. It is only as fresh as the last analyze of the
+	// partition.
+	EstimatedRows int64
+
+	// TotalBytes is the size of the partition including its indexes and toast.
+	TotalBytes int64
+}
+
+// partitionRow is a single row of the partitions query.
+type partitionRow struct {
+	Name          string `pg:"name"`
+	Bound         string `pg:"bound"`
+	EstimatedRows int64  `pg:"estimated_rows"`
+	TotalBytes    int64  `pg:"total_bytes"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// PartitionName returns the name of the daily partition which holds the given time.
+func PartitionName(t time.Time) string {
+	return partitionPrefix + t.UTC().Format(partitionDateLayout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// EnsurePartitions creates the partitions from the day of now to premakeDays days ahead, and the partitions of the
+// days found in the default partition. The names of the created partitions are returned.
+func EnsurePartitions(ctx context.Context, db *pg.DB, now time.Time, premakeDays int) ([]string, error) {
+	today := now.Unix() - now.Unix()%secondsPerDay
+	days := make(map[int64]bool)
+	for i := 0; i <= premakeDays; i++ {
+		days[today+int64(i)*secondsPerDay] = true
+	}
+
+	// The default partition should be small, so a full scan is fine.
+	var defaultDays []int64
+	_, err := db.QueryContext(ctx, &defaultDays, `
+		SELECT DISTINCT timestamp_seconds - timestamp_seconds % ? AS day
+		FROM ?`, secondsPerDay, pg.Ident(DefaultPartition))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the days in the default partition: %w", err)
+	}
+	for _, day := range defaultDays {
+		days[day] = true
+	}
+
+	var created []string
+	for day := range days {
+		name, ok, err := createPartition(ctx, db, day)
+		if err != nil {
+			return created, err
+		}
+		if ok {
+			created = append(created, name)
+		}
+	}
+
+	return created, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// DropExpiredPartitions drops the daily partitions which end before now minus the retention. The names of the dropped
+// partitions are returned.
+func DropExpiredPartitions(ctx context.Context, db *pg.DB, now time.Time, retention time.Duration) ([]string,
+	error) {
+	partitions, err := ListPartitions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := now.Add(-retention).Unix()
+	var dropped []string
+	for _, partition := range partitions {
+		if partition.IsDefault || partition.EndSeconds > cutoff {
+			continue
+		}
+
+		err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+			if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(?)", partitionsLockID); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS ?", pg.Ident(partition.Name))
+			return err
+		})
+		if err != nil {
+			return dropped, fmt.Errorf("failed to drop partition %s: %w", partition.Name, err)
+		}
+		dropped = append(dropped, partition.Name)
+	}
+
+	return dropped, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ListPartitions returns all the partitions of the log_lines table ordered by name. The default partition comes
+// last.
+func ListPartitions(ctx context.Context, db *pg.DB) ([]Partition, error) {
+	var rows []partitionRow
+	_, err := db.QueryContext(ctx, &rows, `
+		SELECT c.relname AS name,
+			pg_get_expr(c.relpartbound, c.oid) AS bound,
+			GREATEST(c.reltuples, 0)::BIGINT AS estimated_rows,
+			pg_total_relation_size(c.oid) AS total_bytes
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'log_lines'::regclass
+		ORDER BY c.relname = ?, c.relname`, DefaultPartition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	partitions := make([]Partition, 0, len(rows))
+	for _, row := range rows {
+		partition := Partition{
+			Name:          row.Name,
+			IsDefault:     row.Bound == "DEFAULT",
+			EstimatedRows: row.EstimatedRows,
+			TotalBytes:    row.TotalBytes,
+		}
+		if matches := partitionBound.FindStringSubmatch(row.Bound); matches != nil {
+			partition.StartSeconds, _ = strconv.ParseInt(matches[1], 10, 64)
+			partition.EndSeconds, _ = strconv.ParseInt(matches[2], 10, 64)
+		}
+		partitions = append(partitions, partition)
+	}
+
+	return partitions, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// CountPartitionRows returns the exact number of rows of a partition. This scans the whole partition.
+func CountPartitionRows(ctx context.Context, db *pg.DB, name string) (int64, error) {
+	var count int64
+	_, err := db.QueryOneContext(ctx, pg.Scan(&count), "SELECT count(*) FROM ?", pg.Ident(name))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count the rows of partition %s: %w", name, err)
+	}
+	return count, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// createPartition is a helper function to create the partition of the day starting at the given unix seconds. The
+// lines of the day are moved out of the default partition before the new partition is attached, otherwise postgres
+// refuses to attach it. The default partition is locked against the inserts until the partition is attached, so that
+// no line of the day lands in it after the move. The second return value is false if the partition already exists.
+func createPartition(ctx context.Context, db *pg.DB, start int64) (string, bool, error) {
+	name := PartitionName(time.Unix(start, 0))
+	end := start + secondsPerDay
+
+	created := false
+	err := db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(?)", partitionsLockID); err != nil {
+			return err
+		}
+
+		// Another replica may have created the partition while we waited for the lock.
+		var exists bool
+		_, err := tx.QueryOneContext(ctx, pg.Scan(&exists), "SELECT to_regclass(?) IS NOT NULL", name)
+		if err != nil || exists {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "CREATE TABLE ? (LIKE log_lines INCLUDING DEFAULTS INCLUDING CONSTRAINTS)",
+			pg.Ident(name))
+		if err != nil {
+			return err
+		}
+
+		// The stats worker keeps inserting while the partition is created. The lines of the day which it inserts after
+		// the move would land in the default partition and make the attach fail, so the inserts wait until the commit.
+		// The queries of the apis still read the default partition meanwhile.
+		_, err = tx.ExecContext(ctx, "LOCK TABLE ? IN SHARE ROW EXCLUSIVE MODE", pg.Ident(DefaultPartition))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			WITH moved AS (
+				DELETE FROM ?
+				WHERE timestamp_seconds >= ? AND timestamp_seconds < ?
+				RETURNING *
+			)
+			INSERT INTO ? SELECT * FROM moved`,
+			pg.Ident(DefaultPartition), start, end, pg.Ident(name))
+		if err != nil {
+			return err
+		}
+
+		// Attaching creates the indexes of log_lines on the partition.
+		_, err = tx.ExecContext(ctx, "ALTER TABLE log_lines ATTACH PARTITION ? FOR VALUES FROM (?) TO (?)",
+			pg.Ident(name), start, end)
+		if err != nil {
+			return err
+		}
+
+		created = true
+		return nil
+	})
+	if err != nil {
+		return name, false, fmt.Errorf("failed to create partition %s: %w", name, err)
+	}
+
+	return name, created, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
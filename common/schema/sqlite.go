@@ -0,0 +1,79 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the schema of the embedded SQLite backend.
+//
+// SQLite lets the log-subscriber and the api server run against a local database file, without postgres. It is meant
+// for a single node and for tests, not for production volumes. The stats are aggregated from the raw log lines at
+// query time, like in the ClickHouse backend, so there are no rollup tables.
+//
+// 1. log_lines: The raw log lines. The primary key is the primary key of the postgres table, so a line redelivered by
+//    kafka is skipped with "ON CONFLICT DO NOTHING". The timestamp is stored in unix milliseconds and the attributes
+//    as a json object.
+// 2. log_templates: The templates mined by the stats worker. The ids are assigned by SQLite.
+//
+// The tables are created with "IF NOT EXISTS". There are no versioned migrations for SQLite yet.
+
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	// Registers the pure go SQLite driver as "sqlite". It needs no cgo.
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBusyTimeout is the time in milliseconds a connection waits for the lock of the database file. The
+// log-subscriber and the api server share the file, so a query can wait for a write of the other process.
+const sqliteBusyTimeout = 5000
+
+// sqliteTables are the statements which create the tables and indexes of the SQLite backend.
+var sqliteTables = []string{
+	`CREATE TABLE IF NOT EXISTS log_lines (
+		process_id TEXT NOT NULL,
+		thread_id TEXT NOT NULL,
+		thread_name TEXT NOT NULL DEFAULT '',
+		timestamp INTEGER NOT NULL,
+		timestamp_seconds INTEGER NOT NULL,
+		log_message TEXT NOT NULL DEFAULT '',
+		attributes TEXT NOT NULL DEFAULT '{}',
+		template_id INTEGER NOT NULL,
+		byte_count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (process_id, thread_id, timestamp, timestamp_seconds)
+	)`,
+	`CREATE INDEX IF NOT EXISTS log_lines_timestamp_seconds_idx ON log_lines (timestamp_seconds)`,
+	`CREATE INDEX IF NOT EXISTS log_lines_template_id_idx ON log_lines (template_id, timestamp_seconds)`,
+
+	`CREATE TABLE IF NOT EXISTS log_templates (
+		template_id INTEGER PRIMARY KEY,
+		template TEXT NOT NULL,
+		token_count INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS log_templates_template_idx ON log_templates (template)`,
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// OpenSQLite opens the SQLite database file at the path. The file is created if it does not exist. The database is in
+// WAL mode, so the readers of the api server do not block the writes of the log-subscriber.
+func OpenSQLite(path string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)", path, sqliteBusyTimeout)
+	return sql.Open("sqlite", dsn)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// MigrateSQLite creates the tables of the SQLite backend if they do not exist.
+func MigrateSQLite(ctx context.Context, db *sql.DB) error {
+	for _, statement := range sqliteTables {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create the sqlite tables: %w", err)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,281 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the resolution, the rotation and the redaction of the secrets in the configuration.
+//
+// The value of a secret in defaults.yaml is a reference to the source of the secret instead of the secret itself, so
+// that no credentials are checked in. The following references are supported.
+//
+// 1. env:NAME: The environment variable NAME.
+// 2. file:/run/secrets/name: The content of the file, without the trailing newline. This is how docker and kubernetes
+//    mount their secrets.
+// 3. vault:path#field: The field of the secret at the path in the KV version 2 engine of Vault. Please refer to
+//    vault.go.
+//
+// Any other value is the secret itself. This is still accepted for local runs, but a warning is logged.
+//
+// The secrets are resolved again at an interval. When a secret changed, for example because the password of postgres
+// was rotated in Vault, the watchers of the secret are called with the new value. That way the services pick up new
+// credentials without a restart.
+//
+// The values of the secrets are never logged. Redact removes them from the text of the logs and RedactSettings from
+// the dumps of the configuration.
+
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Redacted replaces the value of a secret in the logs and in the dumps of the configuration.
+	Redacted = "[REDACTED]"
+
+	// The prefixes of the references to the sources of the secrets.
+	envPrefix   = "env:"
+	filePrefix  = "file:"
+	vaultPrefix = "vault:"
+
+	// minRedactedLength is the length below which a value is not redacted from the text of the logs. Replacing every
+	// occurrence of a one or two letter value would garble the logs without hiding anything.
+	minRedactedLength = 4
+)
+
+// Store holds the resolved values of the secrets of a service. It is safe for concurrent use.
+type Store struct {
+	// refs maps the configuration key of every secret to its reference.
+	refs map[string]string
+
+	// vault reads the "vault:" references. It is nil if vault is not configured.
+	vault *vaultClient
+
+	mu       sync.RWMutex
+	values   map[string]string
+	watchers map[string][]func(value string)
+
+	// redacted are all the values which were ever resolved, so that a rotated secret is still redacted.
+	redacted map[string]struct{}
+}
+
+// NewStore resolves the secrets of the references, which map the configuration key of every secret to its reference.
+// It fails if any of the secrets cannot be resolved.
+func NewStore(ctx context.Context, refs map[string]string, vault VaultConfig) (*Store, error) {
+	store := &Store{
+		refs:     refs,
+		values:   map[string]string{},
+		watchers: map[string][]func(string){},
+		redacted: map[string]struct{}{},
+	}
+
+	// The token of vault is a secret itself, but it cannot come from vault.
+	if vault.Addr != "" {
+		token, err := store.resolve(ctx, vault.Token)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the vault token: %w", err)
+		}
+		store.addRedacted(token)
+		store.vault = newVaultClient(vault, token)
+	}
+
+	for _, key := range sortedKeys(refs) {
+		ref := refs[key]
+		value, err := store.resolve(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the secret %s: %w", key, err)
+		}
+		if ref != "" && !IsReference(ref) {
+			glog.Warningf("The secret %s is set in the configuration, prefer an env:, file: or vault: reference", key)
+		}
+		store.values[key] = value
+		store.addRedacted(value)
+	}
+	return store, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Get returns the current value of the secret of the configuration key. It is empty if the key is not a secret.
+func (store *Store) Get(key string) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.values[key]
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Watch registers a function which is called with the new value whenever the secret of the configuration key changes.
+// The function is called from the go routine of Refresh.
+func (store *Store) Watch(key string, watcher func(value string)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.watchers[key] = append(store.watchers[key], watcher)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Refresh resolves all the secrets again and calls the watchers of the secrets which changed. A secret which cannot be
+// resolved keeps its current value.
+func (store *Store) Refresh(ctx context.Context) error {
+	var failed []string
+	for _, key := range sortedKeys(store.refs) {
+		value, err := store.resolve(ctx, store.refs[key])
+		if err != nil {
+			glog.Errorf("Failed to refresh the secret %s: %v", key, err)
+			failed = append(failed, key)
+			continue
+		}
+
+		store.mu.Lock()
+		changed := store.values[key] != value
+		store.values[key] = value
+		store.addRedacted(value)
+		watchers := store.watchers[key]
+		store.mu.Unlock()
+
+		if !changed {
+			continue
+		}
+		glog.Infof("The secret %s was rotated", key)
+		for _, watcher := range watchers {
+			watcher(value)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to refresh the secrets %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// RefreshPeriodically is run as a go routine. It refreshes the secrets at the interval until the context is cancelled.
+func (store *Store) RefreshPeriodically(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			store.Refresh(ctx)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Redact replaces the values of the secrets in the text with Redacted.
+func (store *Store) Redact(text string) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for value := range store.redacted {
+		text = strings.ReplaceAll(text, value, Redacted)
+	}
+	return text
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// IsReference checks if the value of a secret in the configuration is a reference to a source instead of the secret.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, envPrefix) || strings.HasPrefix(value, filePrefix) ||
+		strings.HasPrefix(value, vaultPrefix)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// RedactSettings replaces the secrets of the keys in the nested settings of the configuration, as returned by viper's
+// AllSettings, with Redacted. The references are kept, they tell where a secret comes from without revealing it.
+func RedactSettings(settings map[string]interface{}, keys []string) map[string]interface{} {
+	for _, key := range keys {
+		path := strings.Split(strings.ToLower(key), ".")
+
+		group := settings
+		for _, name := range path[:len(path)-1] {
+			nested, ok := group[name].(map[string]interface{})
+			if !ok {
+				group = nil
+				break
+			}
+			group = nested
+		}
+		if group == nil {
+			continue
+		}
+
+		name := path[len(path)-1]
+		if value, ok := group[name].(string); ok && value != "" && !IsReference(value) {
+			group[name] = Redacted
+		}
+	}
+	return settings
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// resolve is a helper function to read the secret of a reference from its source.
+func (store *Store) resolve(ctx context.Context, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, envPrefix):
+		name := strings.TrimPrefix(ref, envPrefix)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("the environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, filePrefix):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(ref, filePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case strings.HasPrefix(ref, vaultPrefix):
+		if store.vault == nil {
+			return "", fmt.Errorf("%s is a vault reference but vault is not configured", ref)
+		}
+		return store.vault.read(ctx, strings.TrimPrefix(ref, vaultPrefix))
+	default:
+		return ref, nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// addRedacted is a helper function to remember a value for the redaction. The caller holds the lock or owns the store.
+func (store *Store) addRedacted(value string) {
+	if len(value) >= minRedactedLength {
+		store.redacted[value] = struct{}{}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// sortedKeys is a helper function to return the keys of the map in ascending order, so that the secrets are always
+// resolved in the same order.
+func sortedKeys(refs map[string]string) []string {
+	keys := make([]string, 0, len(refs))
+	for key := range refs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,126 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains a minimal client of the KV version 2 secrets engine of Vault.
+//
+// Only reading the latest version of a secret is needed, which is a single http request, so the client is written
+// against the http api instead of pulling in the Vault sdk. Any server which implements this api works, for example
+// the Vault dev server of the docker-compose file.
+//
+// A reference "vault:olap#postgres_password" reads the field "postgres_password" of the secret at the path "olap":
+//
+// GET <addr>/v1/<mount>/data/olap
+// X-Vault-Token: <token>
+//
+// {"data": {"data": {"postgres_password": "..."}, "metadata": {...}}}
+
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultVaultTimeout bounds a read of a secret when the configuration has no timeout.
+const defaultVaultTimeout = 10 * time.Second
+
+// VaultConfig is the configuration of the vault client.
+type VaultConfig struct {
+	// Addr is the url of the server, for example http://vault:8200. Vault is not used if it is empty.
+	Addr string
+
+	// Token is the reference of the token. It is an env: or a file: reference, or the token itself.
+	Token string
+
+	// Mount is the path at which the KV version 2 engine is mounted, "secret" by default.
+	Mount string
+
+	// Timeout bounds a read of a secret.
+	Timeout time.Duration
+}
+
+// vaultClient reads the secrets from the KV version 2 engine of a vault server.
+type vaultClient struct {
+	addr   string
+	token  string
+	mount  string
+	client *http.Client
+}
+
+// vaultResponse is the body of the response of a read of a secret.
+type vaultResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+// newVaultClient returns a new instance of vaultClient.
+func newVaultClient(conf VaultConfig, token string) *vaultClient {
+	mount := strings.Trim(conf.Mount, "/")
+	if mount == "" {
+		mount = "secret"
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultVaultTimeout
+	}
+
+	return &vaultClient{
+		addr:   strings.TrimRight(conf.Addr, "/"),
+		token:  token,
+		mount:  mount,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// read returns the field of the secret of the reference "path#field".
+func (vault *vaultClient) read(ctx context.Context, ref string) (string, error) {
+	index := strings.LastIndex(ref, "#")
+	if index <= 0 || index == len(ref)-1 {
+		return "", fmt.Errorf("invalid vault reference %q, expected path#field", ref)
+	}
+	path, field := strings.Trim(ref[:index], "/"), ref[index+1:]
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s", vault.addr, vault.mount, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", vault.token)
+
+	resp, err := vault.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the vault secret %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the vault secret %s: %w", path, err)
+	}
+	// The body of an error has no secrets, only the error messages of vault.
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to read the vault secret %s: %s: %s", path, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+
+	var secret vaultResponse
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("invalid response for the vault secret %s: %w", path, err)
+	}
+	value, ok := secret.Data.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,219 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the ClickHouse implementation of the Writer.
+//
+// The writer only inserts the raw log lines and the templates. Please refer to clickhouse.go in the schema package for
+// the tables. The stats are aggregated at query time by the api server, so there are no rollups to maintain.
+//
+// ClickHouse prefers few large inserts over many small ones, and every small insert creates a part on disk. The stats
+// worker writes one line at a time, so the lines can be inserted with async_insert instead. The server buffers the
+// inserts and flushes them as a single part. The insert returns as soon as the line is buffered, which means a line
+// which the worker already acknowledged can be lost if ClickHouse crashes before the buffer is flushed
+// (async_insert_busy_timeout_ms, 200ms by default). The async inserts are disabled by default, since the stats worker
+// never drops a line otherwise. They must be enabled in the configuration.
+//
+// ClickHouse has no sequences. The id of a new template is derived from the hash of its text, so that the replicas of
+// the log-subscriber which mine the same template on their own insert the same row, which the ReplacingMergeTree
+// collapses.
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/golang/glog"
+
+	"common/schema"
+)
+
+// ClickHouseWriter implements the Writer interface on ClickHouse.
+type ClickHouseWriter struct {
+	conn driver.Conn
+
+	// asyncInsert is true if the lines are inserted with async_insert.
+	asyncInsert bool
+}
+
+// clickHouseTemplate is a single row of the log_templates table.
+type clickHouseTemplate struct {
+	TemplateID int64  `ch:"template_id"`
+	Template   string `ch:"template"`
+	TokenCount int32  `ch:"token_count"`
+}
+
+// NewClickHouseWriter returns a new instance of ClickHouseWriter.
+func NewClickHouseWriter(conn driver.Conn, asyncInsert bool) *ClickHouseWriter {
+	return &ClickHouseWriter{conn: conn, asyncInsert: asyncInsert}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Migrate creates the tables if they do not exist.
+func (writer *ClickHouseWriter) Migrate(ctx context.Context) error {
+	return schema.MigrateClickHouse(ctx, writer.conn)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadTemplates returns the latest version of all the templates ordered by id.
+func (writer *ClickHouseWriter) LoadTemplates(ctx context.Context) ([]Template, error) {
+	var persisted []clickHouseTemplate
+	err := writer.conn.Select(ctx, &persisted, `
+		SELECT template_id, template, token_count
+		FROM log_templates FINAL
+		ORDER BY template_id`)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]Template, 0, len(persisted))
+	for _, template := range persisted {
+		templates = append(templates, Template{
+			ID:         template.TemplateID,
+			Text:       template.Template,
+			TokenCount: int(template.TokenCount),
+		})
+	}
+	return templates, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// WriteLogLine inserts the template if it is new or changed, and then the log line. A redelivered log line has the
+// same sorting key as the original and is collapsed with it by the ReplacingMergeTree.
+func (writer *ClickHouseWriter) WriteLogLine(ctx context.Context, logLine *schema.LogLine, template Template,
+	numBytes int) (int64, error) {
+	if writer.asyncInsert {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+			"async_insert":          1,
+			"wait_for_async_insert": 0,
+		}))
+	}
+
+	templateID := template.ID
+	if templateID == 0 {
+		templateID = newTemplateID(template.Text)
+	}
+
+	// Every version of a template is a new row. The latest one wins.
+	if template.ID == 0 || template.Changed {
+		err := writer.conn.Exec(ctx, `
+			INSERT INTO log_templates (template_id, template, token_count, updated_at)
+			VALUES (?, ?, ?, now64(3))`,
+			templateID, template.Text, template.TokenCount)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert template: %w", err)
+		}
+	}
+	logLine.TemplateID = templateID
+
+	// The attributes are passed as two arrays, so that the names are quoted by the driver as well.
+	names := make([]string, 0, len(logLine.Attributes))
+	values := make([]string, 0, len(logLine.Attributes))
+	for name, value := range logLine.Attributes {
+		names = append(names, name)
+		values = append(values, value)
+	}
+
+	// The timestamp is passed in milliseconds, the driver would truncate a time.Time to seconds.
+	err := writer.conn.Exec(ctx, `
+		INSERT INTO log_lines (process_id, thread_id, thread_name, timestamp, timestamp_seconds, log_message,
+			attributes, template_id, byte_count)
+		VALUES (?, ?, ?, fromUnixTimestamp64Milli(?), ?, ?, CAST(([?], [?]), 'Map(String, String)'), ?, ?)`,
+		logLine.ProcessID, logLine.ThreadID, logLine.ThreadName, logLine.Timestamp.UnixMilli(),
+		logLine.TimestampSeconds, logLine.LogMessage, names, values, templateID, numBytes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert log line: %w", err)
+	}
+
+	return templateID, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Maintain drops the daily partitions which end before the retention. ClickHouse creates the partitions on insert, so
+// there is nothing to create ahead of time.
+func (writer *ClickHouseWriter) Maintain(ctx context.Context, now time.Time, policy RetentionPolicy) error {
+	if policy.Retention <= 0 {
+		return nil
+	}
+
+	// The partition id is the YYYYMMDD of the day.
+	var partitionIDs []string
+	rows, err := writer.conn.Query(ctx, `
+		SELECT DISTINCT partition_id
+		FROM system.parts
+		WHERE database = currentDatabase() AND table = 'log_lines' AND active`)
+	if err != nil {
+		return fmt.Errorf("failed to list the partitions: %w", err)
+	}
+	for rows.Next() {
+		var partitionID string
+		if err := rows.Scan(&partitionID); err != nil {
+			rows.Close()
+			return err
+		}
+		partitionIDs = append(partitionIDs, partitionID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-policy.Retention)
+	var dropped []string
+	for _, partitionID := range partitionIDs {
+		day, err := time.Parse("20060102", partitionID)
+		if err != nil || day.AddDate(0, 0, 1).After(cutoff) {
+			continue
+		}
+
+		if err := writer.conn.Exec(ctx, "ALTER TABLE log_lines DROP PARTITION ID ?", partitionID); err != nil {
+			return fmt.Errorf("failed to drop partition %s: %w", partitionID, err)
+		}
+		dropped = append(dropped, partitionID)
+	}
+
+	if len(dropped) > 0 {
+		glog.Infof("Dropped log_lines partitions: %v", dropped)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping checks if ClickHouse is reachable.
+func (writer *ClickHouseWriter) Ping(ctx context.Context) error {
+	return writer.conn.Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close closes the connections to ClickHouse.
+func (writer *ClickHouseWriter) Close() error {
+	return writer.conn.Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newTemplateID is a helper function to derive a positive id for a new template from the hash of its text.
+func newTemplateID(text string) int64 {
+	sum := sha256.Sum256([]byte(text))
+
+	// Clear the sign bit and make sure the id is never zero, which means a new template.
+	id := int64(binary.BigEndian.Uint64(sum[:8]) >> 1)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,373 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the postgres implementation of the Writer.
+//
+// Every api in the api server used to scan the raw log_lines table with a GROUP BY. That does not scale once the
+// table has a few hundred million rows. Instead the writer maintains the following rollups incrementally as the
+// messages arrive from kafka.
+//
+// 1. log_lines_per_second / log_lines_per_minute: number of lines and bytes per (bucket, process_id, thread_id).
+// 2. active_threads_per_second / active_threads_per_minute: number of distinct (process_id, thread_id) per bucket.
+// 3. thread_lifetimes: first and last seen timestamp per (process_id, thread_id).
+//
+// The thread_name of a (process_id, thread_id) is carried along in the rollups so that the apis can filter and group
+// by the thread name without touching the raw log_lines table. The rows written before the thread_name column existed
+// get the name of their thread when the thread is seen again.
+//
+// Every template is persisted in the log_templates table with the number of lines and the first and last seen
+// timestamps. Every log line refers to its template with the template_id column. The id is assigned by postgres when
+// the template is seen for the first time by any replica, the text of a template is unique.
+//
+// Idempotency:
+//
+// Kafka guarantees at-least-once delivery. So the same log line can be delivered more than once (for example after a
+// consumer group rebalance). The raw log line is inserted with "ON CONFLICT DO NOTHING" and the rollups and the
+// template counters are updated in the same transaction only if the raw log line was actually inserted. This makes
+// sure a redelivered message never double counts.
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/golang/glog"
+
+	"common/schema"
+)
+
+// rollupGranularity describes one granularity of the rollup tables.
+type rollupGranularity struct {
+	// linesTable is the table which holds lines and bytes per (bucket, process_id, thread_id).
+	linesTable string
+
+	// activeThreadsTable is the table which holds the number of active threads per bucket.
+	activeThreadsTable string
+
+	// bucketSeconds is the width of the bucket in seconds.
+	bucketSeconds int64
+}
+
+// rollupGranularities is the list of all the granularities maintained by the writer.
+var rollupGranularities = []rollupGranularity{
+	{linesTable: "log_lines_per_second", activeThreadsTable: "active_threads_per_second", bucketSeconds: 1},
+	{linesTable: "log_lines_per_minute", activeThreadsTable: "active_threads_per_minute", bucketSeconds: 60},
+}
+
+// logTemplate encapsulates the structure of the log_templates table.
+type logTemplate struct {
+	tableName        struct{}  `pg:"log_templates"`
+	TemplateID       int64     `pg:"template_id,pk"`
+	Template         string    `pg:"template,notnull"`
+	TokenCount       int       `pg:"token_count,notnull,use_zero"`
+	LineCount        int64     `pg:"line_count,notnull,use_zero"`
+	FirstSeen        time.Time `pg:"first_seen"`
+	LastSeen         time.Time `pg:"last_seen"`
+	FirstSeenSeconds int64     `pg:"first_seen_seconds"`
+	LastSeenSeconds  int64     `pg:"last_seen_seconds"`
+}
+
+// PostgresWriter implements the Writer interface on postgres.
+type PostgresWriter struct {
+	db *RotatingDB
+}
+
+// NewPostgresWriter returns a new instance of PostgresWriter. The caller owns the configuration of the db object, for
+// example its query hooks.
+func NewPostgresWriter(db *pg.DB) *PostgresWriter {
+	static := &RotatingDB{}
+	static.current.Store(db)
+	return &PostgresWriter{db: static}
+}
+
+// NewRotatingPostgresWriter returns a new instance of PostgresWriter which writes through the current go-pg object of
+// the db, so that the writes continue when the credentials are rotated.
+func NewRotatingPostgresWriter(db *RotatingDB) *PostgresWriter {
+	return &PostgresWriter{db: db}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Migrate applies the pending schema migrations. It is safe to call from several replicas at once, the migrations are
+// applied by exactly one of them.
+func (writer *PostgresWriter) Migrate(ctx context.Context) error {
+	migrator, err := schema.NewMigrator(writer.db.DB())
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Applied %d schema migrations", applied)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadTemplates returns all the persisted templates ordered by id.
+func (writer *PostgresWriter) LoadTemplates(ctx context.Context) ([]Template, error) {
+	var persisted []logTemplate
+	err := writer.db.DB().ModelContext(ctx, &persisted).
+		Column("template_id", "template", "token_count").
+		Order("template_id").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]Template, 0, len(persisted))
+	for _, template := range persisted {
+		templates = append(templates, Template{
+			ID:         template.TemplateID,
+			Text:       template.Template,
+			TokenCount: template.TokenCount,
+		})
+	}
+	return templates, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// WriteLogLine inserts the log line and updates the template and the rollups in a single transaction.
+func (writer *PostgresWriter) WriteLogLine(ctx context.Context, logLine *schema.LogLine, template Template,
+	numBytes int) (int64, error) {
+	err := writer.db.DB().RunInTransaction(ctx, func(tx *pg.Tx) error {
+		// Persist the template first, the log line refers to it.
+		templateID, err := persistTemplate(tx, template)
+		if err != nil {
+			return err
+		}
+		logLine.TemplateID = templateID
+
+		// A conflict means that this log line is a redelivery from kafka. The rollups must not be updated again.
+		res, err := tx.Model(logLine).OnConflict("DO NOTHING").Insert()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			glog.Infoln("Skipping duplicate log line for process", logLine.ProcessID, "thread", logLine.ThreadID)
+			return nil
+		}
+
+		if err := updateTemplateStats(tx, logLine); err != nil {
+			return err
+		}
+
+		return updateRollups(tx, logLine, numBytes)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return logLine.TemplateID, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Maintain creates the daily partitions of log_lines ahead of time and drops the expired ones. The partitions are
+// created before the expired ones are dropped, so that the old lines in the default partition are dropped as well.
+// Please refer to partitions.go in the schema package for more details.
+func (writer *PostgresWriter) Maintain(ctx context.Context, now time.Time, policy RetentionPolicy) error {
+	created, err := schema.EnsurePartitions(ctx, writer.db.DB(), now, policy.PremakeDays)
+	if len(created) > 0 {
+		glog.Infof("Created log_lines partitions: %v", created)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A retention of zero keeps the partitions forever.
+	if policy.Retention <= 0 {
+		return nil
+	}
+
+	dropped, err := schema.DropExpiredPartitions(ctx, writer.db.DB(), now, policy.Retention)
+	if len(dropped) > 0 {
+		glog.Infof("Dropped log_lines partitions: %v", dropped)
+	}
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping checks if postgres is reachable.
+func (writer *PostgresWriter) Ping(ctx context.Context) error {
+	return writer.db.DB().Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close closes the db object.
+func (writer *PostgresWriter) Close() error {
+	return writer.db.Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// persistTemplate is a helper function to insert the template if it is new or update its text if it changed. The id
+// of the template is returned.
+//
+// The replicas of the log-subscriber mine the templates on their own, so the template may already be persisted by
+// another replica under another id. The text of a template is unique, the id of the persisted template with the same
+// text is returned in that case.
+func persistTemplate(tx *pg.Tx, template Template) (int64, error) {
+	if template.ID != 0 && !template.Changed {
+		return template.ID, nil
+	}
+
+	if template.Changed && template.ID != 0 {
+		// Two replicas may rename different templates to the same text. The lock on the text serializes them, so the
+		// second one sees the renamed template and leaves its own as is.
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", template.Text); err != nil {
+			return 0, err
+		}
+		_, err := tx.Exec(`
+			UPDATE log_templates
+			SET template = ?0
+			WHERE template_id = ?1
+			  AND NOT EXISTS (SELECT 1 FROM log_templates WHERE md5(template) = md5(?0))`,
+			template.Text, template.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Insert the template or look it up by its text. The no-op update makes the existing row return its id.
+	var templateID int64
+	_, err := tx.QueryOne(pg.Scan(&templateID), `
+		INSERT INTO log_templates (template, token_count)
+		VALUES (?, ?)
+		ON CONFLICT ((md5(template))) DO UPDATE
+		SET template = EXCLUDED.template
+		RETURNING template_id`,
+		template.Text, template.TokenCount)
+	return templateID, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// updateTemplateStats is a helper function to count the log line against its template. This must be called in the
+// same transaction in which the raw log line is inserted, so that a redelivered message is not counted twice.
+func updateTemplateStats(tx *pg.Tx, logLine *schema.LogLine) error {
+	_, err := tx.Exec(`
+		UPDATE log_templates
+		SET line_count = line_count + 1,
+			first_seen = LEAST(first_seen, ?0),
+			last_seen = GREATEST(last_seen, ?0),
+			first_seen_seconds = LEAST(first_seen_seconds, ?1),
+			last_seen_seconds = GREATEST(last_seen_seconds, ?1)
+		WHERE template_id = ?2`,
+		logLine.Timestamp, logLine.TimestampSeconds, logLine.TemplateID)
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// updateRollups is a helper function to update all the rollup tables for a single log line. This must be called in
+// the same transaction in which the raw log line is inserted.
+func updateRollups(tx *pg.Tx, logLine *schema.LogLine, numBytes int) error {
+	if err := backfillThreadName(tx, logLine.ProcessID, logLine.ThreadID, logLine.ThreadName); err != nil {
+		return err
+	}
+
+	for _, granularity := range rollupGranularities {
+		bucket := logLine.TimestampSeconds - logLine.TimestampSeconds%granularity.bucketSeconds
+
+		// Upsert the lines for the bucket. The xmax system column is zero only for the freshly inserted rows. This
+		// tells us if this is the first line of the thread in this bucket.
+		var inserted bool
+		_, err := tx.QueryOne(pg.Scan(&inserted), `
+			INSERT INTO ? AS r (bucket_seconds, process_id, thread_id, thread_name, line_count, byte_count)
+			VALUES (?, ?, ?, ?, 1, ?)
+			ON CONFLICT (bucket_seconds, process_id, thread_id) DO UPDATE
+			SET thread_name = EXCLUDED.thread_name,
+				line_count = r.line_count + 1,
+				byte_count = r.byte_count + EXCLUDED.byte_count
+			RETURNING (xmax = 0) AS inserted`,
+			pg.Ident(granularity.linesTable), bucket, logLine.ProcessID, logLine.ThreadID, logLine.ThreadName,
+			numBytes)
+		if err != nil {
+			return err
+		}
+
+		if !inserted {
+			continue
+		}
+
+		// If we reach here, the thread is seen for the first time in this bucket.
+		_, err = tx.Exec(`
+			INSERT INTO ? AS a (bucket_seconds, active_threads)
+			VALUES (?, 1)
+			ON CONFLICT (bucket_seconds) DO UPDATE
+			SET active_threads = a.active_threads + 1`,
+			pg.Ident(granularity.activeThreadsTable), bucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	return upsertThreadLifetime(tx, logLine.ProcessID, logLine.ThreadID, logLine.ThreadName, logLine.Timestamp)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// backfillThreadName is a helper function to record the name of a thread which was seen before the thread_name column
+// existed, and to copy the name to the existing rows of the thread in log_lines and the rollups. It only touches those
+// rows when the name of the thread is recorded for the first time, so it costs a single lookup for the other lines.
+func backfillThreadName(tx *pg.Tx, processID string, threadID string, threadName string) error {
+	if threadName == "" {
+		return nil
+	}
+
+	result, err := tx.Exec(`
+		UPDATE thread_lifetimes
+		SET thread_name = ?
+		WHERE process_id = ? AND thread_id = ? AND thread_name IS NULL`,
+		threadName, processID, threadID)
+	if err != nil || result.RowsAffected() == 0 {
+		return err
+	}
+
+	for _, table := range []string{"log_lines", "log_lines_per_second", "log_lines_per_minute"} {
+		_, err := tx.Exec(`
+			UPDATE ?
+			SET thread_name = ?
+			WHERE process_id = ? AND thread_id = ? AND thread_name IS NULL`,
+			pg.Ident(table), threadName, processID, threadID)
+		if err != nil {
+			return err
+		}
+	}
+	glog.Infof("Backfilled the thread name %s of %s:%s", threadName, processID, threadID)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// upsertThreadLifetime is a helper function to extend the first and last seen timestamps of a thread. LEAST and
+// GREATEST make this safe for out of order delivery.
+func upsertThreadLifetime(tx *pg.Tx, processID string, threadID string, threadName string,
+	timestamp time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO thread_lifetimes AS t
+			(process_id, thread_id, thread_name, first_seen, last_seen, first_seen_seconds, last_seen_seconds,
+			 line_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT (process_id, thread_id) DO UPDATE
+		SET thread_name = EXCLUDED.thread_name,
+			first_seen = LEAST(t.first_seen, EXCLUDED.first_seen),
+			last_seen = GREATEST(t.last_seen, EXCLUDED.last_seen),
+			first_seen_seconds = LEAST(t.first_seen_seconds, EXCLUDED.first_seen_seconds),
+			last_seen_seconds = GREATEST(t.last_seen_seconds, EXCLUDED.last_seen_seconds),
+			line_count = t.line_count + 1`,
+		processID, threadID, threadName, timestamp, timestamp, timestamp.Unix(), timestamp.Unix())
+	return err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
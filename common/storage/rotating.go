@@ -0,0 +1,228 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains a go-pg object and a ClickHouse connection pool whose credentials can be rotated while they are
+// in use.
+//
+// go-pg reads the password from its options whenever it opens a connection, and the options cannot be changed once
+// the object is created. So when the password of postgres is rotated, a new go-pg object is connected with the new
+// password and replaces the current one. The old object is closed after a grace period, so that the queries which
+// already started on it can finish. The ClickHouse connection pool is replaced the same way.
+//
+// The callers must get the current object for every unit of work instead of keeping it. The ClickHouse pool does this
+// itself, it implements the connection interface of the driver by delegating every call to the current pool.
+
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/go-pg/pg/v10"
+	"github.com/golang/glog"
+)
+
+// rotationGracePeriod is the time after which the go-pg object of the old credentials is closed.
+const rotationGracePeriod = time.Minute
+
+// RotatingDB holds the current go-pg object of a postgres server. It is safe for concurrent use.
+type RotatingDB struct {
+	// current holds the *pg.DB of the current credentials.
+	current atomic.Value
+
+	// hooks are added to every go-pg object.
+	hooks []pg.QueryHook
+}
+
+// NewRotatingDB connects to postgres with the options and adds the query hooks.
+func NewRotatingDB(options *pg.Options, hooks ...pg.QueryHook) *RotatingDB {
+	rotating := &RotatingDB{hooks: hooks}
+	rotating.current.Store(rotating.connect(options))
+	return rotating
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// DB returns the go-pg object of the current credentials.
+func (rotating *RotatingDB) DB() *pg.DB {
+	return rotating.current.Load().(*pg.DB)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Rotate connects with the new password and replaces the current go-pg object. The connections of the old object
+// are closed after the grace period.
+func (rotating *RotatingDB) Rotate(password string) {
+	options := *rotating.DB().Options()
+	options.Password = password
+
+	old := rotating.DB()
+	rotating.current.Store(rotating.connect(&options))
+	glog.Infof("Reconnecting to postgres %s with the rotated credentials", options.Addr)
+
+	time.AfterFunc(rotationGracePeriod, func() {
+		if err := old.Close(); err != nil {
+			glog.Warningf("Failed to close the connections of the old credentials: %v", err)
+		}
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close closes the go-pg object of the current credentials.
+func (rotating *RotatingDB) Close() error {
+	return rotating.DB().Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// connect is a helper function to create a go-pg object with the query hooks.
+func (rotating *RotatingDB) connect(options *pg.Options) *pg.DB {
+	db := pg.Connect(options)
+	for _, hook := range rotating.hooks {
+		db.AddQueryHook(hook)
+	}
+	return db
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// RotatingClickHouse holds the current connection pool of a ClickHouse server. It implements driver.Conn and is safe
+// for concurrent use.
+type RotatingClickHouse struct {
+	// current holds the driver.Conn of the current credentials.
+	current atomic.Value
+
+	// options are the options of the current pool. They are only changed by Rotate, which is called by the secret
+	// store one at a time.
+	options clickhouse.Options
+}
+
+// NewRotatingClickHouse opens a connection pool to ClickHouse with the options. The connections are established
+// lazily.
+func NewRotatingClickHouse(options *clickhouse.Options) (*RotatingClickHouse, error) {
+	conn, err := clickhouse.Open(options)
+	if err != nil {
+		return nil, err
+	}
+	rotating := &RotatingClickHouse{options: *options}
+	rotating.current.Store(conn)
+	return rotating, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Conn returns the connection pool of the current credentials.
+func (rotating *RotatingClickHouse) Conn() driver.Conn {
+	return rotating.current.Load().(driver.Conn)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Rotate opens a connection pool with the new password and replaces the current one. The old pool is closed after
+// the grace period. The current pool is kept if the new one cannot be opened.
+func (rotating *RotatingClickHouse) Rotate(password string) {
+	options := rotating.options
+	options.Auth.Password = password
+
+	conn, err := clickhouse.Open(&options)
+	if err != nil {
+		glog.Errorf("Failed to reconnect to ClickHouse with the rotated credentials: %v", err)
+		return
+	}
+	rotating.options = options
+
+	old := rotating.Conn()
+	rotating.current.Store(conn)
+	glog.Infof("Reconnecting to ClickHouse %v with the rotated credentials", options.Addr)
+
+	time.AfterFunc(rotationGracePeriod, func() {
+		if err := old.Close(); err != nil {
+			glog.Warningf("Failed to close the connections of the old credentials: %v", err)
+		}
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Contributors implements driver.Conn.
+func (rotating *RotatingClickHouse) Contributors() []string {
+	return rotating.Conn().Contributors()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ServerVersion implements driver.Conn.
+func (rotating *RotatingClickHouse) ServerVersion() (*driver.ServerVersion, error) {
+	return rotating.Conn().ServerVersion()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Select implements driver.Conn.
+func (rotating *RotatingClickHouse) Select(ctx context.Context, dest interface{}, query string,
+	args ...interface{}) error {
+	return rotating.Conn().Select(ctx, dest, query, args...)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Query implements driver.Conn.
+func (rotating *RotatingClickHouse) Query(ctx context.Context, query string, args ...interface{}) (driver.Rows, error) {
+	return rotating.Conn().Query(ctx, query, args...)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// QueryRow implements driver.Conn.
+func (rotating *RotatingClickHouse) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	return rotating.Conn().QueryRow(ctx, query, args...)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// PrepareBatch implements driver.Conn.
+func (rotating *RotatingClickHouse) PrepareBatch(ctx context.Context, query string) (driver.Batch, error) {
+	return rotating.Conn().PrepareBatch(ctx, query)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Exec implements driver.Conn.
+func (rotating *RotatingClickHouse) Exec(ctx context.Context, query string, args ...interface{}) error {
+	return rotating.Conn().Exec(ctx, query, args...)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// AsyncInsert implements driver.Conn.
+func (rotating *RotatingClickHouse) AsyncInsert(ctx context.Context, query string, wait bool) error {
+	return rotating.Conn().AsyncInsert(ctx, query, wait)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements driver.Conn.
+func (rotating *RotatingClickHouse) Ping(ctx context.Context) error {
+	return rotating.Conn().Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Stats implements driver.Conn.
+func (rotating *RotatingClickHouse) Stats() driver.Stats {
+	return rotating.Conn().Stats()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements driver.Conn. It closes the connection pool of the current credentials.
+func (rotating *RotatingClickHouse) Close() error {
+	return rotating.Conn().Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,186 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the SQLite implementation of the Writer.
+//
+// The writer only inserts the raw log lines and the templates. Please refer to sqlite.go in the schema package for
+// the tables. The stats are aggregated at query time by the api server, so there are no rollups to maintain.
+//
+// A redelivered log line conflicts with the primary key of the original and is skipped, so it is never counted twice.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"common/schema"
+)
+
+// SQLiteWriter implements the Writer interface on an embedded SQLite database.
+type SQLiteWriter struct {
+	db *sql.DB
+}
+
+// NewSQLiteWriter returns a new instance of SQLiteWriter.
+func NewSQLiteWriter(db *sql.DB) *SQLiteWriter {
+	return &SQLiteWriter{db: db}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Migrate creates the tables if they do not exist.
+func (writer *SQLiteWriter) Migrate(ctx context.Context) error {
+	return schema.MigrateSQLite(ctx, writer.db)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadTemplates returns all the persisted templates ordered by id.
+func (writer *SQLiteWriter) LoadTemplates(ctx context.Context) ([]Template, error) {
+	rows, err := writer.db.QueryContext(ctx, `
+		SELECT template_id, template, token_count
+		FROM log_templates
+		ORDER BY template_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []Template
+	for rows.Next() {
+		var template Template
+		if err := rows.Scan(&template.ID, &template.Text, &template.TokenCount); err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// WriteLogLine inserts the template if it is new or updates it if it changed, and then the log line, in a single
+// transaction. A template is looked up by its text first, like the postgres writer does.
+func (writer *SQLiteWriter) WriteLogLine(ctx context.Context, logLine *schema.LogLine, template Template,
+	numBytes int) (int64, error) {
+	attributes := []byte("{}")
+	if len(logLine.Attributes) > 0 {
+		encoded, err := json.Marshal(logLine.Attributes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode attributes: %w", err)
+		}
+		attributes = encoded
+	}
+
+	tx, err := writer.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	templateID, err := persistSQLiteTemplate(ctx, tx, template)
+	if err != nil {
+		return 0, err
+	}
+	logLine.TemplateID = templateID
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO log_lines (process_id, thread_id, thread_name, timestamp, timestamp_seconds, log_message,
+			attributes, template_id, byte_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`,
+		logLine.ProcessID, logLine.ThreadID, logLine.ThreadName, logLine.Timestamp.UnixMilli(),
+		logLine.TimestampSeconds, logLine.LogMessage, string(attributes), templateID, numBytes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert log line: %w", err)
+	}
+	if inserted, err := res.RowsAffected(); err == nil && inserted == 0 {
+		glog.Infoln("Skipping duplicate log line for process", logLine.ProcessID, "thread", logLine.ThreadID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return templateID, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Maintain deletes the log lines of the days which end before the retention, the same days whose partitions are
+// dropped by the other backends. SQLite has no partitions, so there is nothing to create ahead of time.
+func (writer *SQLiteWriter) Maintain(ctx context.Context, now time.Time, policy RetentionPolicy) error {
+	if policy.Retention <= 0 {
+		return nil
+	}
+
+	cutoff := now.Add(-policy.Retention).Unix()
+	cutoff -= cutoff % 86400
+
+	res, err := writer.db.ExecContext(ctx, "DELETE FROM log_lines WHERE timestamp_seconds < ?", cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to delete the expired log lines: %w", err)
+	}
+	if deleted, err := res.RowsAffected(); err == nil && deleted > 0 {
+		glog.Infof("Deleted %d log lines before %d", deleted, cutoff)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping checks if the database file can be opened.
+func (writer *SQLiteWriter) Ping(ctx context.Context) error {
+	return writer.db.PingContext(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close closes the database.
+func (writer *SQLiteWriter) Close() error {
+	return writer.db.Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// persistSQLiteTemplate is a helper function to insert the template if it is new or update its text if it changed.
+// The id of the template with the same text is returned if there is one already.
+func persistSQLiteTemplate(ctx context.Context, tx *sql.Tx, template Template) (int64, error) {
+	if template.ID != 0 && !template.Changed {
+		return template.ID, nil
+	}
+
+	var templateID int64
+	err := tx.QueryRowContext(ctx, "SELECT template_id FROM log_templates WHERE template = ?", template.Text).
+		Scan(&templateID)
+	if err == nil {
+		return templateID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to look up template: %w", err)
+	}
+
+	if template.ID != 0 {
+		_, err := tx.ExecContext(ctx, "UPDATE log_templates SET template = ? WHERE template_id = ?",
+			template.Text, template.ID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update template: %w", err)
+		}
+		return template.ID, nil
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO log_templates (template, token_count) VALUES (?, ?)",
+		template.Text, template.TokenCount)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert template: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
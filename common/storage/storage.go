@@ -0,0 +1,88 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the storage interface behind the writes of the stats worker in the log-subscriber.
+//
+// The stats worker used to write to postgres directly. Postgres is a stand-in for a real OLAP database, so the writes
+// now go through the Writer interface and the backend is selected in the configuration. The following backends are
+// implemented.
+//
+// 1. postgres: The raw log lines, the rollup tables and the template counters. Please refer to postgres.go.
+// 2. clickhouse: The raw log lines in a MergeTree table. Please refer to clickhouse.go.
+// 3. sqlite: The raw log lines in an embedded database file, for a single node and for tests. Please refer to
+//    sqlite.go.
+//
+// The reads of the api server go through the StatsServicer interface of the api server, which has an implementation
+// per backend.
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"common/schema"
+)
+
+const (
+	// BackendPostgres is the name of the postgres backend in the configuration.
+	BackendPostgres = "postgres"
+
+	// BackendClickHouse is the name of the ClickHouse backend in the configuration.
+	BackendClickHouse = "clickhouse"
+
+	// BackendSQLite is the name of the embedded SQLite backend in the configuration.
+	BackendSQLite = "sqlite"
+)
+
+// Template is a log template as seen by the storage.
+type Template struct {
+	// ID is the id of the persisted template. It is zero if the template is new.
+	ID int64
+
+	// Text of the template.
+	Text string
+
+	// TokenCount is the number of tokens of the template.
+	TokenCount int
+
+	// Changed is true if the text of a persisted template changed and must be written again.
+	Changed bool
+}
+
+// RetentionPolicy describes which data the maintenance keeps.
+type RetentionPolicy struct {
+	// PremakeDays is the number of days ahead of today for which the partitions are created.
+	PremakeDays int
+
+	// Retention is the age after which the data is dropped. Zero keeps the data forever.
+	Retention time.Duration
+}
+
+// Writer persists the log lines processed by the stats worker.
+type Writer interface {
+	// Migrate creates or upgrades the schema of the backend.
+	Migrate(ctx context.Context) error
+
+	// LoadTemplates returns all the persisted templates ordered by id. They seed the template miner on startup.
+	LoadTemplates(ctx context.Context) ([]Template, error)
+
+	// WriteLogLine persists the log line and its template. The id of the template is returned, which is assigned by
+	// the backend if the template is new. If a template with the same text is persisted already, for example by
+	// another replica, its id is returned instead. numBytes is the size of the raw message counted by the byte stats. A
+	// redelivered log line must not be counted twice.
+	WriteLogLine(ctx context.Context, logLine *schema.LogLine, template Template, numBytes int) (int64, error)
+
+	// Maintain runs the maintenance of the backend once. That is creating the partitions ahead of time and dropping
+	// the data past the retention.
+	Maintain(ctx context.Context, now time.Time, policy RetentionPolicy) error
+
+	// Ping checks if the backend is reachable. It is used by the readiness check.
+	Ping(ctx context.Context) error
+
+	// Close releases the connections to the backend.
+	Close() error
+}
+
+//----------------------------------------------------------------------------------------------------------------------
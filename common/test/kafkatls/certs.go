@@ -0,0 +1,117 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the certificates of the kafka security test.
+//
+// A throwaway certificate authority signs the certificate of the broker, for localhost, and the certificate of the
+// client. The keys are PKCS#8 pem blocks, which both the broker and librdkafka read.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+// certificate is a signed certificate and its key, pem encoded.
+type certificate struct {
+	cert []byte
+	key  []byte
+
+	template *x509.Certificate
+	signer   *ecdsa.PrivateKey
+}
+
+// certificates are the certificates of the test.
+type certificates struct {
+	ca     *certificate
+	broker *certificate
+	client *certificate
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newCertificates creates the certificate authority and the certificates of the broker and of the client.
+func newCertificates() (*certificates, error) {
+	ca, err := newCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "kafkatls test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	broker, err := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "logprocessor"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificates{ca: ca, broker: broker, client: client}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newCertificate creates a key and a certificate of the template, signed by the parent. The certificate is self signed
+// without a parent.
+func newCertificate(template *x509.Certificate, parent *certificate) (*certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+
+	signerTemplate, signer := template, key
+	if parent != nil {
+		signerTemplate, signer = parent.template, parent.signer
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerTemplate, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificate{
+		cert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:      pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		template: template,
+		signer:   key,
+	}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,381 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file for the security test of the kafka clients.
+//
+// The production cluster rejects plain text connections. This test checks that the clients created by kafkautil
+// connect to a broker over TLS and authenticate with SASL, the way the log-processor and the log-subscriber do.
+//
+// It performs the following steps:
+// 1. Create a throwaway certificate authority and the certificates of the broker and of the client.
+// 2. Start a kafka broker in a local docker container with two listeners. The ssl listener requires a client
+//    certificate, the sasl_ssl listener authenticates with SASL/PLAIN and SASL/SCRAM-SHA-512.
+// 3. For every case, build the configuration of the kafka block, create the topic, produce a message and consume it
+//    back through kafkautil. The passwords are read through the secret store from file: references.
+// 4. Check that the misconfigured clients, like a plain text client or a wrong password, are rejected.
+// 5. Remove the container.
+//
+// For example,
+//
+//     cd common
+//     go run ./test/kafkatls
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/kafkautil"
+	"common/secrets"
+)
+
+const (
+	// containerName is the name of the docker container of the broker.
+	containerName = "kafkatls-broker"
+
+	// clusterID is the id of the KRaft cluster of the broker.
+	clusterID = "kafkatls-test-cluster-0"
+
+	// The credentials of the SASL user.
+	username = "olap"
+	password = "olap-secret"
+
+	// topic is the topic of the test. Every case publishes a single message.
+	topic = "kafkatls-messages"
+
+	// startupTimeout is the maximum time to wait for the broker to accept connections.
+	startupTimeout = 2 * time.Minute
+
+	// rejectTimeout is the time after which a misconfigured client which did not connect counts as rejected.
+	rejectTimeout = 15 * time.Second
+)
+
+// securityCase is a configuration of the kafka block and whether the broker must accept it.
+type securityCase struct {
+	name     string
+	settings map[string]interface{}
+	accepted bool
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+func main() {
+	image := flag.String("image", "apache/kafka:3.7.0", "docker image of the kafka broker")
+	sslAddr := flag.String("ssl-addr", "localhost:19094", "host:port of the listener with client certificates")
+	saslAddr := flag.String("sasl-addr", "localhost:19095", "host:port of the listener with SASL authentication")
+	flag.Parse()
+
+	// Step 1: Create the certificates and the password files in a scratch directory.
+	scratchDir, err := os.MkdirTemp("", "kafkatls")
+	if err != nil {
+		log.Fatal("Failed to create the scratch directory:", err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	certs, err := newCertificates()
+	if err != nil {
+		log.Fatal("Failed to create the certificates:", err)
+	}
+	files := map[string][]byte{
+		"ca.pem":            certs.ca.cert,
+		"client.pem":        certs.client.cert,
+		"client.key":        certs.client.key,
+		"password":          []byte(password),
+		"wrong_password":    []byte("not-" + password),
+		"server.properties": []byte(brokerProperties(certs, *sslAddr, *saslAddr)),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(scratchDir, name), content, 0644); err != nil {
+			log.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(scratchDir, name) }
+
+	// Step 2: Start the broker and create the SCRAM credentials of the user.
+	startBroker(*image, scratchDir, *sslAddr, *saslAddr)
+	defer removeContainer()
+
+	cases := []securityCase{
+		{"ssl with a client certificate", map[string]interface{}{
+			configutil.KBootstrapServers:      *sslAddr,
+			configutil.KKafkaSecurityProtocol: kafkautil.ProtocolSSL,
+			configutil.KKafkaTLSCAFile:        path("ca.pem"),
+			configutil.KKafkaTLSCertFile:      path("client.pem"),
+			configutil.KKafkaTLSKeyFile:       path("client.key"),
+		}, true},
+		{"sasl_ssl with PLAIN", saslSettings(*saslAddr, "PLAIN", path("ca.pem"), path("password")), true},
+		{"sasl_ssl with SCRAM-SHA-512", saslSettings(*saslAddr, "SCRAM-SHA-512", path("ca.pem"), path("password")),
+			true},
+		{"plaintext", map[string]interface{}{
+			configutil.KBootstrapServers:      *sslAddr,
+			configutil.KKafkaSecurityProtocol: kafkautil.ProtocolPlaintext,
+		}, false},
+		{"ssl without a client certificate", map[string]interface{}{
+			configutil.KBootstrapServers:      *sslAddr,
+			configutil.KKafkaSecurityProtocol: kafkautil.ProtocolSSL,
+			configutil.KKafkaTLSCAFile:        path("ca.pem"),
+		}, false},
+		{"ssl with an unknown certificate authority", map[string]interface{}{
+			configutil.KBootstrapServers:      *sslAddr,
+			configutil.KKafkaSecurityProtocol: kafkautil.ProtocolSSL,
+			configutil.KKafkaTLSCertFile:      path("client.pem"),
+			configutil.KKafkaTLSKeyFile:       path("client.key"),
+		}, false},
+		{"sasl_ssl with a wrong password",
+			saslSettings(*saslAddr, "SCRAM-SHA-512", path("ca.pem"), path("wrong_password")), false},
+	}
+
+	// Step 3 and 4: Check every case.
+	if err := waitForBroker(newConfig(cases[0].settings)); err != nil {
+		removeContainer()
+		log.Fatal("The broker did not start:", err)
+	}
+
+	failed := 0
+	for _, securityCase := range cases {
+		err := checkCase(newConfig(securityCase.settings))
+		switch {
+		case securityCase.accepted && err != nil:
+			fmt.Printf("FAIL %s: %v\n", securityCase.name, err)
+			failed++
+		case !securityCase.accepted && err == nil:
+			fmt.Printf("FAIL %s: the broker accepted the client\n", securityCase.name)
+			failed++
+		default:
+			fmt.Printf("PASS %s\n", securityCase.name)
+		}
+	}
+
+	if failed > 0 {
+		removeContainer()
+		os.RemoveAll(scratchDir)
+		log.Fatalf("%d of %d security cases failed", failed, len(cases))
+	}
+	fmt.Println("The kafka clients connect securely.")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// saslSettings returns the settings of a client which authenticates with the mechanism over TLS. The password is read
+// from the file.
+func saslSettings(addr string, mechanism string, caFile string, passwordFile string) map[string]interface{} {
+	return map[string]interface{}{
+		configutil.KBootstrapServers:      addr,
+		configutil.KKafkaSecurityProtocol: kafkautil.ProtocolSASLSSL,
+		configutil.KKafkaTLSCAFile:        caFile,
+		configutil.KKafkaSASLMechanism:    mechanism,
+		configutil.KKafkaSASLUsername:     username,
+		configutil.KKafkaSASLPassword:     "file:" + passwordFile,
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newConfig returns the configuration of a case. It is validated against the schema of the kafka block like the
+// configuration of a service.
+func newConfig(settings map[string]interface{}) *viper.Viper {
+	conf := viper.New()
+	conf.Set(configutil.KTopic, topic)
+	for key, value := range settings {
+		conf.Set(key, value)
+	}
+	if err := configutil.KafkaSchema.Validate(conf); err != nil {
+		log.Fatal(err)
+	}
+	return conf
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// waitForBroker waits until the broker accepts the client of the configuration.
+func waitForBroker(conf *viper.Viper) error {
+	deadline := time.Now().Add(startupTimeout)
+	for {
+		err := kafkautil.MaybeCreateTopic(conf, newSecretStore(conf))
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkCase creates the clients of the configuration, checks the topic and round trips a message through the broker.
+func checkCase(conf *viper.Viper) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rejectTimeout)
+	defer cancel()
+
+	secretStore := newSecretStore(conf)
+	producer, err := kafkautil.NewProducer(conf, secretStore)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	if err := kafkautil.HealthCheck(producer, topic)(ctx); err != nil {
+		return err
+	}
+
+	// Produce a message which is unique to the case and consume it back.
+	value := fmt.Sprintf("%s-%d", conf.GetString(configutil.KKafkaSecurityProtocol), time.Now().UnixNano())
+	deliveries := make(chan kafka.Event, 1)
+	topicName := topic
+	err = producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topicName, Partition: kafka.PartitionAny},
+		Value:          []byte(value),
+	}, deliveries)
+	if err != nil {
+		return err
+	}
+	select {
+	case event := <-deliveries:
+		if message := event.(*kafka.Message); message.TopicPartition.Error != nil {
+			return message.TopicPartition.Error
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("the message was not delivered: %w", ctx.Err())
+	}
+
+	consumer, err := kafkautil.NewConsumer(conf, secretStore, fmt.Sprintf("kafkatls-%d", time.Now().UnixNano()))
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	if err := consumer.Subscribe(topic, nil); err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		message, err := consumer.ReadMessage(time.Second)
+		if err != nil {
+			if kafkaErr, ok := err.(kafka.Error); ok && kafkaErr.Code() == kafka.ErrTimedOut {
+				continue
+			}
+			return err
+		}
+		if string(message.Value) == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("the message was not consumed: %w", ctx.Err())
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newSecretStore resolves the passwords of the configuration like the services do.
+func newSecretStore(conf *viper.Viper) *secrets.Store {
+	store, err := configutil.NewSecretStore(context.Background(), conf, kafkautil.SecretRefs(conf))
+	if err != nil {
+		log.Fatal("Failed to resolve the secrets:", err)
+	}
+	return store
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// brokerProperties returns the configuration of a single node KRaft broker. The internal listener is only used inside
+// the container to create the SCRAM credentials.
+func brokerProperties(certs *certificates, sslAddr string, saslAddr string) string {
+	properties := []string{
+		"process.roles=broker,controller",
+		"node.id=1",
+		"controller.quorum.voters=1@localhost:9093",
+		"controller.listener.names=CONTROLLER",
+		"inter.broker.listener.name=INTERNAL",
+		"listeners=INTERNAL://:9092,CONTROLLER://:9093,SSL://:9094,SASL_SSL://:9095",
+		fmt.Sprintf("advertised.listeners=INTERNAL://localhost:9092,SSL://%s,SASL_SSL://%s", sslAddr, saslAddr),
+		"listener.security.protocol.map=INTERNAL:PLAINTEXT,CONTROLLER:PLAINTEXT,SSL:SSL,SASL_SSL:SASL_SSL",
+		"log.dirs=/tmp/kraft-logs",
+		"offsets.topic.replication.factor=1",
+		"transaction.state.log.replication.factor=1",
+		"transaction.state.log.min.isr=1",
+		"ssl.keystore.type=PEM",
+		"ssl.keystore.certificate.chain=" + inlinePEM(certs.broker.cert),
+		"ssl.keystore.key=" + inlinePEM(certs.broker.key),
+		"ssl.truststore.type=PEM",
+		"ssl.truststore.certificates=" + inlinePEM(certs.ca.cert),
+		"listener.name.ssl.ssl.client.auth=required",
+		"sasl.enabled.mechanisms=PLAIN,SCRAM-SHA-512",
+		fmt.Sprintf("listener.name.sasl_ssl.plain.sasl.jaas.config="+
+			"org.apache.kafka.common.security.plain.PlainLoginModule required user_%s=\"%s\";", username, password),
+		"listener.name.sasl_ssl.scram-sha-512.sasl.jaas.config=" +
+			"org.apache.kafka.common.security.scram.ScramLoginModule required;",
+	}
+	return strings.Join(properties, "\n") + "\n"
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// inlinePEM is a helper function to write a pem block as the value of a property. The lines are continued with a
+// backslash, the broker ignores the whitespace in the base64 content.
+func inlinePEM(block []byte) string {
+	return strings.Join(strings.Split(strings.TrimSpace(string(block)), "\n"), " \\\n  ")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// startBroker starts the broker in a docker container. The storage is formatted by hand, so that the broker only
+// depends on the properties of the test and not on the entrypoint of the image.
+func startBroker(image string, scratchDir string, sslAddr string, saslAddr string) {
+	removeContainer()
+
+	command := fmt.Sprintf("/opt/kafka/bin/kafka-storage.sh format -t %s -c /mnt/kafkatls/server.properties && "+
+		"exec /opt/kafka/bin/kafka-server-start.sh /mnt/kafkatls/server.properties", clusterID)
+	args := []string{"run", "-d", "--rm", "--name", containerName,
+		"-p", portOf(sslAddr) + ":9094", "-p", portOf(saslAddr) + ":9095",
+		"-v", scratchDir + ":/mnt/kafkatls:ro", "--entrypoint", "sh", image, "-c", command}
+	if output, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		log.Fatalf("Failed to start the %s container: %v\n%s", containerName, err, output)
+	}
+
+	// The SCRAM credentials are stored in the cluster, so they are created once the broker is up.
+	deadline := time.Now().Add(startupTimeout)
+	for {
+		output, err := exec.Command("docker", "exec", containerName, "/opt/kafka/bin/kafka-configs.sh",
+			"--bootstrap-server", "localhost:9092", "--alter", "--entity-type", "users", "--entity-name", username,
+			"--add-config", fmt.Sprintf("SCRAM-SHA-512=[password=%s]", password)).CombinedOutput()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			removeContainer()
+			log.Fatalf("Failed to create the SCRAM credentials: %v\n%s", err, output)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// removeContainer removes the docker container of the broker if it exists.
+func removeContainer() {
+	exec.Command("docker", "rm", "-f", containerName).Run()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// portOf is a helper function to return the port of a host:port address.
+func portOf(addr string) string {
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			return addr[i+1:]
+		}
+	}
+	return addr
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,733 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file for the contract test of the message queue transports.
+//
+// The workers of the log-subscriber rely on the guarantees of messageq/messageq.go, whichever transport carries the
+// messages. This test checks every transport against the same cases.
+//
+// It performs the following steps:
+// 1. Start kafka, NATS with JetStream and redis in local docker containers. The memory transport needs no container.
+// 2. Start two subscribers of the same consumer group, a subscriber of a second group, a subscriber of a third group
+//    and a subscriber of a fourth group which pauses for a while, and publish the messages of a number of keys,
+//    every key numbered in order. The first key is a thread of log lines, keyed like the log-processor keys them.
+// 3. Check that every key is received in order, that the messages are spread over both the subscribers of the first
+//    group, that the second group receives all the messages and that the lag of the subscribers drops to zero. The
+//    paused subscriber must receive nothing while paused, and all the messages in order once resumed.
+// 4. Close the subscriber of the third group halfway and check that a new subscriber of the group receives the rest.
+// 5. Remove the containers.
+//
+// For example,
+//
+//     cd common
+//     go run ./test/messageq
+//
+// The containers can be skipped with -docker=false to run against servers started by hand. The transports are selected
+// with -transports. The memory transport alone needs neither docker nor a server,
+//
+//     go run ./test/messageq -transports memory
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/messageq"
+	"common/secrets"
+)
+
+const (
+	// transportMemory is the name of the in-memory transport in this test. It is not selectable in the configuration.
+	transportMemory = "memory"
+
+	// partitions is the number of partitions of the topic on every transport.
+	partitions = 4
+
+	// startupTimeout is the maximum time to wait for a container to accept connections.
+	startupTimeout = 2 * time.Minute
+
+	// receiveTimeout is the poll timeout of the subscribers, like the one of the workers.
+	receiveTimeout = time.Second
+
+	// pauseDuration is the time for which the subscriber of the paused group pauses, longer than the rebalance
+	// interval of the nats and redis transports.
+	pauseDuration = 3 * time.Second
+
+	// threadLineFormat is the format of the log lines of the thread of the first key, with the timestamp of the line.
+	threadLineFormat = "8003:123145320058880::Thread-2 %s - line %d"
+
+	// timestampLayout is the layout of the timestamps of the log lines.
+	timestampLayout = "2006-01-02 15:04:05,000"
+)
+
+// container is the docker container of a transport.
+type container struct {
+	name  string
+	image string
+	port  string
+	args  []string
+
+	// command are the arguments of the server after the image.
+	command []string
+}
+
+// containers are the docker containers of the transports. The advertised listener of kafka is set when the container
+// is started.
+var containers = map[string]container{
+	messageq.TransportKafka: {
+		name: "messageq-kafka", image: "apache/kafka:3.7.0", port: "9092",
+		args: []string{"-e", "KAFKA_NODE_ID=1", "-e", "KAFKA_PROCESS_ROLES=broker,controller",
+			"-e", "KAFKA_LISTENERS=PLAINTEXT://:9092,CONTROLLER://:9093",
+			"-e", "KAFKA_CONTROLLER_LISTENER_NAMES=CONTROLLER",
+			"-e", "KAFKA_LISTENER_SECURITY_PROTOCOL_MAP=CONTROLLER:PLAINTEXT,PLAINTEXT:PLAINTEXT",
+			"-e", "KAFKA_CONTROLLER_QUORUM_VOTERS=1@localhost:9093",
+			"-e", "KAFKA_OFFSETS_TOPIC_REPLICATION_FACTOR=1", "-e", "KAFKA_GROUP_INITIAL_REBALANCE_DELAY_MS=0"},
+	},
+	messageq.TransportNATS: {
+		name: "messageq-nats", image: "nats:2.10", port: "4222", command: []string{"-js"},
+	},
+	messageq.TransportRedis: {
+		name: "messageq-redis", image: "redis:7", port: "6379",
+	},
+}
+
+// transport creates the clients of a transport under test.
+type transport struct {
+	name          string
+	newPublisher  func() (messageq.Publisher, error)
+	newSubscriber func(group string) (messageq.Subscriber, error)
+}
+
+// receipt is a message received by a subscriber.
+type receipt struct {
+	subscriber string
+	key        string
+	seq        int
+}
+
+// consumer receives the messages of a subscriber in the background until it is stopped.
+type consumer struct {
+	name       string
+	subscriber messageq.Subscriber
+	stop       chan struct{}
+	stopped    chan struct{}
+
+	// limit is the number of messages after which the consumer stops by itself, zero receives until it is stopped.
+	limit int
+
+	// pauseAt is the number of messages after which the consumer pauses its subscriber for pauseDuration, zero never
+	// pauses. pauseErr is the first violation of the pause, guarded by the mutex.
+	pauseAt  int
+	pauseErr error
+
+	// receipts are shared by the consumers of a group, in the order in which they were received.
+	mutex    *sync.Mutex
+	receipts *[]receipt
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+func main() {
+	transportNames := flag.String("transports", "memory,kafka,nats,redis", "comma separated transports to check")
+	useDocker := flag.Bool("docker", true, "start kafka, nats and redis in local docker containers")
+	kafkaAddr := flag.String("kafka-addr", "localhost:19092", "host:port of the kafka broker")
+	natsURL := flag.String("nats-url", "nats://localhost:14222", "url of the nats server")
+	redisAddr := flag.String("redis-addr", "localhost:16379", "host:port of the redis server")
+	keys := flag.Int("keys", 20, "number of keys of the messages")
+	messages := flag.Int("messages", 100, "number of messages of every key")
+	warmup := flag.Duration("warmup", 10*time.Second, "time for the subscribers of a group to share the partitions")
+	timeout := flag.Duration("timeout", 2*time.Minute, "maximum time to wait for the messages of a case")
+	flag.Parse()
+
+	// A fresh topic per run, the servers started by hand may keep the topics of the previous runs.
+	topic := fmt.Sprintf("messageq-contract-%d", time.Now().Unix())
+	conf := viper.New()
+	conf.Set(configutil.KTopic, topic)
+	conf.Set(configutil.KBootstrapServers, *kafkaAddr)
+	conf.Set(configutil.KNATSURL, *natsURL)
+	conf.Set(configutil.KNATSPartitions, partitions)
+	conf.Set(configutil.KRedisAddr, *redisAddr)
+	conf.Set(configutil.KRedisPartitions, partitions)
+	addrs := map[string]string{
+		messageq.TransportKafka: *kafkaAddr,
+		messageq.TransportNATS:  strings.TrimPrefix(*natsURL, "nats://"),
+		messageq.TransportRedis: *redisAddr,
+	}
+
+	failed := 0
+	names := strings.Split(*transportNames, ",")
+	for _, name := range names {
+		// Step 1: Start the container of the transport.
+		if container, ok := containers[name]; ok && *useDocker {
+			startContainer(container, addrs[name])
+		}
+
+		transport, err := newTransport(name, conf, topic)
+		if err == nil {
+			err = checkTransport(transport, topic, *keys, *messages, *warmup, *timeout)
+		}
+
+		// Step 5: Remove the container.
+		if container, ok := containers[name]; ok && *useDocker {
+			removeContainer(container.name)
+		}
+		if err != nil {
+			log.Printf("The %s transport broke the contract: %v", name, err)
+			failed++
+			continue
+		}
+		log.Printf("The %s transport fulfils the contract", name)
+	}
+
+	if failed > 0 {
+		log.Fatalf("%d of %d transports broke the message queue contract", failed, len(names))
+	}
+	fmt.Println("All the transports fulfil the message queue contract.")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newTransport is a helper function to return the clients of a transport. The memory transport shares a broker, the
+// others are configured like the services. The kafka topic is created with the partitions of the test.
+func newTransport(name string, conf *viper.Viper, topic string) (*transport, error) {
+	if name == transportMemory {
+		broker := messageq.NewMemoryBroker(partitions)
+		return &transport{
+			name:         name,
+			newPublisher: func() (messageq.Publisher, error) { return broker.NewPublisher(), nil },
+			newSubscriber: func(group string) (messageq.Subscriber, error) {
+				return broker.NewSubscriber(group), nil
+			},
+		}, nil
+	}
+
+	conf.Set(configutil.KTransport, name)
+	if err := configutil.Merge(messageq.Schema, configutil.KafkaSchema).Validate(conf); err != nil {
+		return nil, err
+	}
+	secretStore, err := configutil.NewSecretStore(context.Background(), conf, messageq.SecretRefs(conf))
+	if err != nil {
+		return nil, err
+	}
+
+	// The servers take a while to accept connections after the container is started.
+	if err := waitFor(startupTimeout, func() error { return ping(name, conf, secretStore, topic) }); err != nil {
+		return nil, fmt.Errorf("the server is not ready: %w", err)
+	}
+
+	return &transport{
+		name: name,
+		newPublisher: func() (messageq.Publisher, error) {
+			return messageq.NewPublisher(conf, secretStore)
+		},
+		newSubscriber: func(group string) (messageq.Subscriber, error) {
+			return messageq.NewSubscriber(conf, secretStore, group)
+		},
+	}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ping is a helper function to check if the server of the transport is ready. The kafka topic is created on the way.
+func ping(name string, conf *viper.Viper, secretStore *secrets.Store, topic string) error {
+	if name == messageq.TransportKafka {
+		if err := createKafkaTopic(conf.GetString(configutil.KBootstrapServers), topic); err != nil {
+			return err
+		}
+	}
+
+	publisher, err := messageq.NewPublisher(conf, secretStore)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return publisher.Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// createKafkaTopic is a helper function to create the topic with the partitions of the test.
+func createKafkaTopic(bootstrapServers string, topic string) error {
+	adminClient, err := kafka.NewAdminClient(&kafka.ConfigMap{"bootstrap.servers": bootstrapServers})
+	if err != nil {
+		return err
+	}
+	defer adminClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, err := adminClient.CreateTopics(ctx, []kafka.TopicSpecification{{
+		Topic:             topic,
+		NumPartitions:     partitions,
+		ReplicationFactor: 1,
+	}})
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError && result.Error.Code() != kafka.ErrTopicAlreadyExists {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkTransport is a helper function to run the cases of the contract against a transport.
+func checkTransport(transport *transport, topic string, keys int, messages int, warmup time.Duration,
+	timeout time.Duration) error {
+	total := keys * messages
+
+	// Step 2: Start the subscribers and publish the messages once the subscribers of the group share the partitions.
+	ordered, err := startConsumers(transport, topic, "ordered", 0, "first", "second")
+	if err != nil {
+		return err
+	}
+	defer stopConsumers(ordered)
+	all, err := startConsumers(transport, topic, "all", 0, "only")
+	if err != nil {
+		return err
+	}
+	defer stopConsumers(all)
+
+	// The group of the handover joins before the messages are published, the memory transport drops the messages
+	// which every group consumed. Its first subscriber stops halfway.
+	handover, err := startConsumers(transport, topic, "handover", total/2, "first")
+	if err != nil {
+		return err
+	}
+	paused, err := startConsumers(transport, topic, "paused", 0, "only")
+	if err != nil {
+		return err
+	}
+	defer stopConsumers(paused)
+	paused[0].pauseAt = total / 4
+	time.Sleep(warmup)
+
+	if err := publish(transport, topic, keys, messages); err != nil {
+		return err
+	}
+
+	// Step 3: Check the ordering, the spread and the lag.
+	if err := waitFor(timeout, func() error { return expectCount(ordered, total) }); err != nil {
+		return fmt.Errorf("ordered group: %w", err)
+	}
+	if err := waitFor(timeout, func() error { return expectCount(all, total) }); err != nil {
+		return fmt.Errorf("all group: %w", err)
+	}
+	if err := expectOrder(ordered, keys, messages); err != nil {
+		return fmt.Errorf("ordered group: %w", err)
+	}
+	if err := expectOrder(all, keys, messages); err != nil {
+		return fmt.Errorf("all group: %w", err)
+	}
+	if err := expectSpread(ordered); err != nil {
+		return fmt.Errorf("ordered group: %w", err)
+	}
+	if err := waitFor(timeout, func() error { return expectCount(paused, total) }); err != nil {
+		return fmt.Errorf("paused group: %w", err)
+	}
+	if err := expectOrder(paused, keys, messages); err != nil {
+		return fmt.Errorf("paused group: %w", err)
+	}
+	if err := expectPaused(paused[0]); err != nil {
+		return fmt.Errorf("paused group: %w", err)
+	}
+	for _, c := range append(append(ordered, all...), paused...) {
+		if err := waitFor(timeout, func() error { return expectNoLag(c) }); err != nil {
+			return fmt.Errorf("subscriber %s: %w", c.name, err)
+		}
+	}
+
+	// Step 4: Hand over the group to a new subscriber halfway.
+	return checkHandover(transport, topic, handover, total, timeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkHandover is a helper function to check that the messages which the first subscriber of a group did not receive
+// before it was closed are received by the next one. The messages may be received twice around the handover.
+func checkHandover(transport *transport, topic string, first []*consumer, total int, timeout time.Duration) error {
+	err := waitFor(timeout, func() error {
+		select {
+		case <-first[0].stopped:
+			return nil
+		default:
+			return fmt.Errorf("received %d of %d messages", count(first), total/2)
+		}
+	})
+	stopConsumers(first)
+	if err != nil {
+		return fmt.Errorf("handover group: %w", err)
+	}
+
+	second, err := startConsumers(transport, topic, "handover", 0, "second")
+	if err != nil {
+		return err
+	}
+	defer stopConsumers(second)
+
+	return waitFor(timeout, func() error {
+		seen := map[receipt]bool{}
+		for _, c := range append(first, second...) {
+			c.mutex.Lock()
+			for _, r := range *c.receipts {
+				seen[receipt{key: r.key, seq: r.seq}] = true
+			}
+			c.mutex.Unlock()
+		}
+		if len(seen) != total {
+			return fmt.Errorf("handover group: received %d of %d distinct messages", len(seen), total)
+		}
+		return nil
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// startConsumers is a helper function to start a consumer per name in the consumer group, which stop by themselves
+// after the limit. The consumers of the group share their receipts.
+func startConsumers(transport *transport, topic string, group string, limit int, names ...string) ([]*consumer,
+	error) {
+	mutex := &sync.Mutex{}
+	receipts := &[]receipt{}
+
+	var consumers []*consumer
+	for _, name := range names {
+		subscriber, err := transport.newSubscriber(group)
+		if err == nil {
+			err = subscriber.Subscribe(topic)
+		}
+		if err != nil {
+			stopConsumers(consumers)
+			return nil, fmt.Errorf("failed to subscribe %s to the group %s: %w", name, group, err)
+		}
+
+		c := &consumer{
+			name:       group + "/" + name,
+			subscriber: subscriber,
+			stop:       make(chan struct{}),
+			stopped:    make(chan struct{}),
+			limit:      limit,
+			mutex:      mutex,
+			receipts:   receipts,
+		}
+		go c.run()
+		consumers = append(consumers, c)
+	}
+	return consumers, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// stopConsumers is a helper function to stop the consumers and to close their subscribers.
+func stopConsumers(consumers []*consumer) {
+	for _, c := range consumers {
+		select {
+		case <-c.stopped:
+		default:
+			close(c.stop)
+			<-c.stopped
+		}
+		c.subscriber.Close()
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// run receives the messages of the subscriber until the consumer is stopped, like the loop of the workers.
+func (c *consumer) run() {
+	defer close(c.stopped)
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		message, err := c.subscriber.Receive(receiveTimeout)
+		if errors.Is(err, messageq.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Subscriber %s failed to receive: %v", c.name, err)
+			time.Sleep(receiveTimeout)
+			continue
+		}
+
+		seq, err := strconv.Atoi(string(message.Value))
+		if err != nil {
+			log.Printf("Subscriber %s received an unexpected message %q", c.name, message.Value)
+			continue
+		}
+		c.mutex.Lock()
+		*c.receipts = append(*c.receipts, receipt{subscriber: c.name, key: string(message.Key), seq: seq})
+		done := c.limit > 0 && len(*c.receipts) >= c.limit
+		pause := c.pauseAt > 0 && len(*c.receipts) == c.pauseAt
+		c.mutex.Unlock()
+		if done {
+			return
+		}
+		if pause {
+			c.pause()
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// pause is a helper function to pause the subscriber for pauseDuration while receiving, like the stats worker while
+// the storage is down, and to resume it. A message received while paused is a violation.
+func (c *consumer) pause() {
+	violation := c.subscriber.Pause()
+	for deadline := time.Now().Add(pauseDuration); violation == nil && time.Now().Before(deadline); {
+		message, err := c.subscriber.Receive(receiveTimeout)
+		if message != nil {
+			violation = fmt.Errorf("received %s %s while paused", message.Key, message.Value)
+		} else if !errors.Is(err, messageq.ErrTimeout) {
+			violation = fmt.Errorf("failed to receive while paused: %v", err)
+		}
+	}
+	if err := c.subscriber.Resume(); violation == nil {
+		violation = err
+	}
+
+	c.mutex.Lock()
+	c.pauseErr = violation
+	c.mutex.Unlock()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// publish is a helper function to publish the messages of the keys, interleaved, and to wait for their delivery. The
+// first key is the key of the log-processor for the lines of a thread, every line has a later timestamp.
+func publish(transport *transport, topic string, keys int, messages int) error {
+	publisher, err := transport.newPublisher()
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	failed := make(chan error, 1)
+	go func() {
+		for delivery := range publisher.Deliveries() {
+			if delivery.Err != nil {
+				select {
+				case failed <- delivery.Err:
+				default:
+				}
+			}
+		}
+	}()
+
+	start := time.Date(2020, 8, 9, 18, 59, 25, 0, time.UTC)
+	for seq := 0; seq < messages; seq++ {
+		for key := 0; key < keys; key++ {
+			messageKey := "key-" + strconv.Itoa(key)
+			if key == 0 {
+				timestamp := start.Add(time.Duration(seq) * 7 * time.Millisecond).Format(timestampLayout)
+				messageKey = messageq.LogLineKey(fmt.Sprintf(threadLineFormat, timestamp, seq))
+			}
+			message := &messageq.Message{
+				Topic:   topic,
+				Key:     []byte(messageKey),
+				Value:   []byte(strconv.Itoa(seq)),
+				Headers: map[string]string{"seq": strconv.Itoa(seq)},
+			}
+			for err := publisher.Publish(message); err != nil; err = publisher.Publish(message) {
+				if err != messageq.ErrQueueFull {
+					return err
+				}
+				publisher.Flush(receiveTimeout)
+			}
+		}
+	}
+
+	if remaining := publisher.Flush(startupTimeout); remaining > 0 {
+		return fmt.Errorf("%d messages were not delivered", remaining)
+	}
+	select {
+	case err := <-failed:
+		return fmt.Errorf("failed to deliver a message: %w", err)
+	default:
+		return nil
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// count is a helper function to return the number of messages received by the consumers of a group.
+func count(consumers []*consumer) int {
+	consumers[0].mutex.Lock()
+	defer consumers[0].mutex.Unlock()
+	return len(*consumers[0].receipts)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expectCount is a helper function to check the number of messages received by the consumers of a group.
+func expectCount(consumers []*consumer, total int) error {
+	if received := count(consumers); received != total {
+		return fmt.Errorf("received %d of %d messages", received, total)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expectOrder is a helper function to check that the consumers of a group received every message of every key once,
+// in order.
+func expectOrder(consumers []*consumer, keys int, messages int) error {
+	consumers[0].mutex.Lock()
+	defer consumers[0].mutex.Unlock()
+
+	next := map[string]int{}
+	for _, r := range *consumers[0].receipts {
+		if r.seq != next[r.key] {
+			return fmt.Errorf("%s received message %d of %s, expected %d", r.subscriber, r.seq, r.key, next[r.key])
+		}
+		next[r.key]++
+	}
+	if len(next) != keys {
+		return fmt.Errorf("received %d of %d keys", len(next), keys)
+	}
+	for key, seq := range next {
+		if seq != messages {
+			return fmt.Errorf("received %d of %d messages of %s", seq, messages, key)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expectSpread is a helper function to check that every consumer of a group received messages and that every key was
+// received by a single consumer.
+func expectSpread(consumers []*consumer) error {
+	consumers[0].mutex.Lock()
+	defer consumers[0].mutex.Unlock()
+
+	owners := map[string]string{}
+	perSubscriber := map[string]int{}
+	for _, r := range *consumers[0].receipts {
+		if owner, ok := owners[r.key]; ok && owner != r.subscriber {
+			return fmt.Errorf("%s was received by %s and %s", r.key, owner, r.subscriber)
+		}
+		owners[r.key] = r.subscriber
+		perSubscriber[r.subscriber]++
+	}
+
+	for _, c := range consumers {
+		if perSubscriber[c.name] == 0 {
+			return fmt.Errorf("%s received no messages, the partitions are not spread: %v", c.name,
+				sortedCounts(perSubscriber))
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expectNoLag is a helper function to check that the subscriber of a consumer has no lag.
+func expectNoLag(c *consumer) error {
+	lags, err := c.subscriber.Lag()
+	if err != nil {
+		return err
+	}
+	for _, lag := range lags {
+		if lag.Lag != 0 {
+			return fmt.Errorf("the lag of partition %d is %d", lag.Partition, lag.Lag)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expectPaused is a helper function to check that the consumer paused without receiving a message.
+func expectPaused(c *consumer) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pauseErr
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// sortedCounts is a helper function to format the counts in the order of their names.
+func sortedCounts(counts map[string]int) string {
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, counts[name]))
+	}
+	return strings.Join(parts, " ")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// waitFor is a helper function to retry the check until it succeeds or the timeout expires. It returns the last error.
+func waitFor(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// startContainer starts the docker container of a transport and publishes the port of the server on the port of its
+// address.
+func startContainer(container container, addr string) {
+	removeContainer(container.name)
+
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	args := []string{"run", "-d", "--rm", "--name", container.name, "-p", port + ":" + container.port}
+	args = append(args, container.args...)
+	if container.name == containers[messageq.TransportKafka].name {
+		// The clients connect to the broker on the published port.
+		args = append(args, "-e", "KAFKA_ADVERTISED_LISTENERS=PLAINTEXT://localhost:"+port)
+	}
+	args = append(args, container.image)
+	args = append(args, container.command...)
+	if output, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		log.Fatalf("Failed to start the %s container: %v\n%s", container.name, err, output)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// removeContainer removes a docker container if it exists.
+func removeContainer(name string) {
+	exec.Command("docker", "rm", "-f", name).Run()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
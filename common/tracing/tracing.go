@@ -0,0 +1,85 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the OpenTelemetry tracing shared by the services.
+//
+// A single log record can be followed from the file to the database with the following spans.
+//
+// 1. logprocessor: "process batch" per batch of files, "process file" per file and "publish" per record. The trace
+//    context of the "publish" span is injected into the headers of the message.
+// 2. logsubscriber: the file worker and the stats worker extract the trace context from the message headers and
+//    continue the trace. The stats worker traces the postgres queries.
+// 3. apiserver: every http request is traced down to the postgres queries.
+//
+// The spans are exported with OTLP over grpc to a local OpenTelemetry collector. When the tracing is disabled the
+// spans are not recorded, but the trace context is still propagated. Every service declares its own tracer in its
+// tracing package.
+
+package tracing
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+
+	"common/configutil"
+	"common/messageq"
+)
+
+// Init installs the global tracer provider and the trace context propagator. The spans are exported with the name of
+// the service. The returned function flushes the pending spans and must be called before the process exits.
+func Init(conf *viper.Viper, serviceName string) (func(context.Context) error, error) {
+	// The trace context is propagated even if the spans of this service are not exported.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !conf.GetBool(configutil.KTracingEnabled) {
+		glog.Infoln("Tracing is disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// The exporter connects lazily, so the collector does not need to be up when the service starts.
+	endpoint := conf.GetString(configutil.KTracingEndpoint)
+	exporter, err := otlptracegrpc.New(context.Background(),
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(conf.GetFloat64(configutil.KTracingSampleRatio)))),
+	)
+	otel.SetTracerProvider(provider)
+
+	glog.Infoln("Exporting traces to", endpoint)
+	return provider.Shutdown, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// InjectHeaders writes the trace context of the context into the headers of the message.
+func InjectHeaders(ctx context.Context, message *messageq.Message) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(message.Headers))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// ExtractHeaders returns the context with the trace context read from the headers of the message.
+func ExtractHeaders(ctx context.Context, message *messageq.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(message.Headers))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,57 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the log-processor as a library.
+//
+// The service is wired by cmd/main.go with a kafka producer. The packages of the service are internal, so Run is the
+// entry point for the processes which run the log-processor on another transport, for example the standalone command
+// which runs all the services in one process on the in-memory transport of messageq in the common module.
+
+package app
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	commonmessageq "common/messageq"
+
+	"logprocessor/internal/config"
+	"logprocessor/internal/messageq"
+	"logprocessor/internal/processor"
+)
+
+// flushTimeout is the interval at which the progress of the delivery of the last messages is logged.
+const flushTimeout = 10 * time.Second
+
+// Run processes all the files of the logs directory of the configuration and publishes the lines with the publisher.
+// It returns when every line is delivered. The reloaded batch size is applied while the files are processed.
+func Run(conf *viper.Viper, publisher commonmessageq.Publisher, reloader *configutil.Reloader) {
+	// Drain the delivery reports of the publisher.
+	go messageq.HandleDeliveryReports(publisher)
+
+	proc := processor.NewLogProcessor(conf, publisher)
+	reloader.OnReload(proc.Reload)
+
+	proc.ProcessLogs()
+
+	// The lines are sent in batches in the background. Wait until all of them are delivered.
+	for remaining := publisher.Flush(flushTimeout); remaining > 0; remaining = publisher.Flush(flushTimeout) {
+		glog.Infof("Waiting for the delivery of %d messages", remaining)
+	}
+
+	glog.Infoln("Completed processing all the files in the input logs directory")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadConfiguration loads the configuration file of the log-processor with the overrides of the environment variables.
+// The returned Reloader reloads the same file. Please refer to config.LoadFile.
+func LoadConfiguration(file string) (*viper.Viper, *configutil.Reloader, error) {
+	return config.LoadFile(file)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,223 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file of the benchmark command of the log-processor.
+//
+// The benchmark measures the throughput of the log-processor from the files to the broker, in lines and megabytes per
+// second, for different settings of the producer. It is meant to size the log-processor and to pick the producer
+// settings for large log directories.
+//
+// Every run processes all the files of the logs directory with the same code as the service and waits until the broker
+// acknowledged every line. The runs are the combinations of the comma separated values of the flags. A flag which is
+// not given keeps the setting of the configuration. For example,
+//
+//     cd logprocessor
+//     go run ./cmd/benchmark -set kafka.bootstrap_servers=localhost:9092 -set kafka.topic=benchmark \
+//         -set log_processor.logs_directory=../data/input -linger-ms 0,20,100 -compression none,lz4,zstd
+//
+// The lines are published to the topic of the configuration, so use a topic which no log-subscriber consumes.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/kafkautil"
+	"common/logging"
+	"common/messageq"
+	"common/secrets"
+
+	"logprocessor/internal/config"
+	"logprocessor/internal/processor"
+)
+
+// flushTimeout is the interval at which the flush of the producer is retried.
+const flushTimeout = time.Second
+
+var (
+	lingerMs    = flag.String("linger-ms", "", "comma separated values of kafka.producer.linger_ms")
+	batchSize   = flag.String("batch-size", "", "comma separated values of kafka.producer.batch_size")
+	compression = flag.String("compression", "", "comma separated values of kafka.producer.compression")
+	idempotence = flag.String("idempotence", "", "comma separated values of kafka.producer.enable_idempotence")
+	runs        = flag.Int("runs", 1, "number of runs of every combination of the settings")
+)
+
+// result is the outcome of a single run.
+type result struct {
+	settings map[string]string
+	lines    int64
+	bytes    int64
+	failures int64
+	duration time.Duration
+}
+
+func init() {
+	logging.Init()
+}
+
+func main() {
+	defer glog.Flush()
+
+	conf := config.LoadConfiguration()
+	secretStore, err := configutil.NewSecretStore(context.Background(), conf, kafkautil.SecretRefs(conf))
+	if err != nil {
+		glog.Fatalf("Failed to resolve the secrets: %v", err)
+	}
+
+	// All the settings are validated before the first run.
+	combinations := combine([]setting{
+		{configutil.KProducerLingerMs, splitList(*lingerMs)},
+		{configutil.KProducerBatchSize, splitList(*batchSize)},
+		{configutil.KProducerCompression, splitList(*compression)},
+		{configutil.KProducerIdempotence, splitList(*idempotence)},
+	})
+	for _, settings := range combinations {
+		apply(conf, settings)
+		if err := config.Schema.Validate(conf); err != nil {
+			glog.Exitf("Invalid benchmark settings %v: %v", settings, err)
+		}
+	}
+
+	if err := kafkautil.MaybeCreateTopic(conf, secretStore); err != nil {
+		glog.Fatalf("Failed to create Kafka topic: %v", err)
+	}
+
+	var results []result
+	for _, settings := range combinations {
+		for i := 0; i < *runs; i++ {
+			res, err := run(conf, secretStore, settings)
+			if err != nil {
+				glog.Fatalf("Benchmark run %v failed: %v", settings, err)
+			}
+			results = append(results, res)
+		}
+	}
+
+	printResults(results)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setting is a key of the configuration and the values to benchmark.
+type setting struct {
+	key    string
+	values []string
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// combine returns all the combinations of the values of the settings. The settings without values are left out.
+func combine(settings []setting) []map[string]string {
+	combinations := []map[string]string{{}}
+	for _, s := range settings {
+		if len(s.values) == 0 {
+			continue
+		}
+
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, value := range s.values {
+				extended := map[string]string{s.key: value}
+				for key, v := range combination {
+					extended[key] = v
+				}
+				next = append(next, extended)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// run processes the logs directory once with the settings and waits until every line is delivered.
+func run(conf *viper.Viper, secretStore *secrets.Store, settings map[string]string) (result, error) {
+	apply(conf, settings)
+	publisher, err := messageq.NewKafkaPublisher(conf, secretStore)
+	if err != nil {
+		return result{}, err
+	}
+
+	// Count the delivery reports. The publisher closes the deliveries channel when it is closed.
+	res := result{settings: map[string]string{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for delivery := range publisher.Deliveries() {
+			if delivery.Err != nil {
+				res.failures++
+				continue
+			}
+			res.lines++
+			res.bytes += int64(len(delivery.Message.Value))
+		}
+	}()
+
+	start := time.Now()
+	processor.NewLogProcessor(conf, publisher).ProcessLogs()
+	for remaining := publisher.Flush(flushTimeout); remaining > 0; remaining = publisher.Flush(flushTimeout) {
+		glog.Infof("Waiting for the delivery of %d messages", remaining)
+	}
+	res.duration = time.Since(start)
+
+	publisher.Close()
+	<-done
+
+	for _, key := range []string{configutil.KProducerLingerMs, configutil.KProducerBatchSize,
+		configutil.KProducerCompression, configutil.KProducerIdempotence} {
+		res.settings[key] = conf.GetString(key)
+	}
+	return res, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// apply is a helper function to set the settings of a run on the configuration.
+func apply(conf *viper.Viper, settings map[string]string) {
+	for key, value := range settings {
+		conf.Set(key, value)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// printResults prints a table of the results.
+func printResults(results []result) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "linger_ms\tbatch_size\tcompression\tidempotence\tlines\tfailures\tseconds\tlines/s\tMB/s\t")
+	for _, res := range results {
+		seconds := res.duration.Seconds()
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\t%d\t%.2f\t%.0f\t%.2f\t\n",
+			res.settings[configutil.KProducerLingerMs], res.settings[configutil.KProducerBatchSize],
+			res.settings[configutil.KProducerCompression], res.settings[configutil.KProducerIdempotence],
+			res.lines, res.failures, seconds, float64(res.lines)/seconds, float64(res.bytes)/seconds/1e6)
+	}
+	writer.Flush()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// splitList is a helper function to split a comma separated flag.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+//----------------------------------------------------------------------------------------------------------------------
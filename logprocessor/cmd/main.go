@@ -33,14 +33,15 @@
 // 6. We can assume buffered channel as a thread safe in memory FIFO queue. The size of this buffered channel is usually
 //    larger than total number of files that are processed in a given batch.
 //
-// 7. For each batch of files establish a go-routine(consumer thread) to listen to buffered channel (FIFO) queue.
+// 7. Establish a single go-routine(consumer thread) for all the batches to listen to buffered channel (FIFO) queue.
 //    Dequeue from the buffered channel and write the message to kafka. Most kafka clients do in-memory buffering
 //    any way. No need to additional buffering.
 //
 // 8. Till now we have the following.
 //         a) Producer :- go routines which are reading the files in "max_files_per_batch" batch and writing one line
 //                         at a time and writing to buffered channel (Thread safe FIFO queue).
-//         b) Consumer :- one go routine per batch which listens to the buffered channel and writes them to kafka.
+//         b) Consumer :- one go routine which listens to the buffered channel and writes them to kafka, so that the
+//                         lines of a thread are written in the order in which they were read.
 //
 // Kafka partitioning strategy:
 //
@@ -61,21 +62,28 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/golang/glog"
 
+	"common/configutil"
+	"common/health"
+	"common/kafkautil"
+	"common/logging"
+	commonmessageq "common/messageq"
+	commontracing "common/tracing"
+
+	"logprocessor/app"
 	"logprocessor/internal/config"
 	"logprocessor/internal/messageq"
-	"logprocessor/internal/processor"
+	"logprocessor/internal/tracing"
 )
 
 func init() {
-	flag.Parse()
-	flag.Set("logtostderr", "true")
+	logging.Init()
 }
 
 func main() {
@@ -90,28 +98,64 @@ func main() {
 	// Step (2): Load the configuration.
 	conf := config.LoadConfiguration()
 
+	// Resolve the credentials of the message queue from their sources. Please refer to secrets/secrets.go in the common
+	// module.
+	secretStore, err := configutil.NewSecretStore(context.Background(), conf, commonmessageq.SecretRefs(conf))
+	if err != nil {
+		glog.Fatalf("Failed to resolve the secrets: %v", err)
+	}
+	go secretStore.RefreshPeriodically(context.Background(), conf.GetDuration(configutil.KSecretsRefreshInterval))
+
+	// Install the tracer provider. The pending spans are flushed when the process exits.
+	shutdownTracing, err := commontracing.Init(conf, tracing.ServiceName)
+	if err != nil {
+		glog.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Start the http server for the operational endpoints like /metrics. The health checks are registered below as
+	// the dependencies are created.
+	checker := health.NewChecker()
+	go health.StartServer(conf, checker)
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Step (3): Create the kafka topic if it does not exist. Also create the kafka producer.
+	// Step (3): Create the kafka topic if it does not exist. Also create the publisher of the message queue.
 
-	// Create the kafka topic if it does not exist.
-	if err := messageq.MaybeCreateKafkaTopic(conf); err != nil {
-		glog.Fatalf("Failed to create Kafka topic:", err)
+	// Create the kafka topic if it does not exist. The nats and redis publishers create their streams themselves.
+	transport := conf.GetString(configutil.KTransport)
+	if transport == commonmessageq.TransportKafka {
+		if err := kafkautil.MaybeCreateTopic(conf, secretStore); err != nil {
+			glog.Fatalf("Failed to create Kafka topic: %v", err)
+		}
 	}
 
-	// Create Kafka producer configuration
-	// Create the Kafka producer
-	producer, err := messageq.CreateKafkaProducer(conf)
+	// Create the publisher on the transport of the configuration.
+	publisher, err := commonmessageq.NewPublisher(conf, secretStore)
 	if err != nil {
-		glog.Fatalf("Failed to create Kafka producer:", err)
+		glog.Fatalf("Failed to create the %s publisher: %v", transport, err)
 	}
-	defer producer.Close()
+
+	// Spool the lines to disk while the message queue is not available. Please refer to messageq/spool.go.
+	if directory := conf.GetString(config.KSpoolDirectory); directory != "" {
+		spoolPublisher, err := messageq.NewSpoolPublisher(publisher, directory, conf.GetInt64(config.KSpoolMaxBytes),
+			conf.GetDuration(config.KSpoolCheckInterval))
+		if err != nil {
+			glog.Fatalf("Failed to open the spool: %v", err)
+		}
+		publisher = spoolPublisher
+	}
+	defer publisher.Close()
+
+	// The service is ready only when the message queue is reachable and the topic exists.
+	checker.AddReadinessCheck(transport, publisher.Ping)
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Step (4): Create the processor object to process the logs.
-	proc := processor.NewLogProcessor(conf, producer)
-	proc.ProcessLogs()
+	// Step (4): Process the logs. The changes of the batch size and the log levels are applied while the files are
+	// processed. Please refer to app/app.go.
+	reloader := config.NewReloader(conf)
+	go reloader.Run(context.Background())
 
-	glog.Infoln("Completed processing all the files in the input logs directory")
+	app.Run(conf, publisher, reloader)
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// Step (5):
@@ -9,11 +9,13 @@
 // needing to recompile the code. We do not use helm in this excercise. But this pattern is extensible.
 //
 // The file contains a method called LoadConfiguration() which will load all the configuration represented in the
-// defaults.yaml and creates a golang object for that. This will be passed into all the other functions/classes in this
+// defaults.yaml, overridden by the environment variables and the command line flags, validates it against the Schema
+// and creates a golang object for that. This will be passed into all the other functions/classes in this
 // microservice and this object will be a single place where all the configuration is all maintained.
 //
-// The file also creates constants like "KTopic" which represents the key in defaults.yaml which represents the kafka
-// topic name.
+// The file also creates constants like "KLogsDirectory" which represents the key in defaults.yaml which represents the
+// directory of the input logs. The keys of the blocks shared by the services, like "KTopic" for the kafka topic name,
+// are declared in configutil/keys.go in the common module.
 //
 // Any other package in this microservice, to refer to this configuration, it will simply do the following.
 //
@@ -28,9 +30,14 @@
 package config
 
 import (
-	"fmt"
+	"flag"
+	"time"
 
 	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/logging"
+	commonmessageq "common/messageq"
 )
 
 const (
@@ -52,45 +59,87 @@ const (
 	// KMaxParallelLines s a nested key under the group key KGroupKeyLogWorker to obtain the max parallel lines.
 	KMaxParallelLines = KGroupKeyLogProcessor + ".max_parallel_lines"
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Kafka related configuration.
-
-	// KGroupKafka is group key for kafka block in defaults.yaml. This is the parent key. All the nested
-	// children in this group can be referenced with this group key. For example defaults.yaml has something like this.
-	// kafka:
-	//  topic: "processor-messages"
-	// To access the topic key it can be accessed as
-	KGroupKafka = "kafka"
-
-	// KBootstrapServers is a nested key under the group key KGroupKafka to obtain the kafka boostrap servers.
-	KBootstrapServers = KGroupKafka + ".bootstrap_servers"
-
-	// KTopic is a nested key under the group key KTopic to obtain the kafka topic name.
-	KTopic = KGroupKafka + ".topic"
-
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// KSpoolDirectory is a nested key under the group key KGroupKeyLogProcessor to obtain the directory of the local
+	// spool, which keeps the lines while the message queue is not available. The spool is disabled when it is empty.
+	// log_processor:
+	//  spool:
+	//   directory: "/app/data/spool"
+	//   max_bytes: 1073741824
+	//   check_interval: 5s
+	KSpoolDirectory = KGroupKeyLogProcessor + ".spool.directory"
+
+	// KSpoolMaxBytes is a nested key under the group key KGroupKeyLogProcessor to obtain the maximum size of the
+	// segment files of the spool. The file readers wait for the spool to drain when it is full.
+	KSpoolMaxBytes = KGroupKeyLogProcessor + ".spool.max_bytes"
+
+	// KSpoolCheckInterval is a nested key under the group key KGroupKeyLogProcessor to obtain the interval at which
+	// the message queue is pinged, to spool the lines when it is not available and to drain the spool once it is.
+	KSpoolCheckInterval = KGroupKeyLogProcessor + ".spool.check_interval"
 )
 
-// LoadConfiguration is a helper function to load the configuration present in defaults.yaml. This will be loaded
-// to a config object which then can be passed around(injected) to all the structs/classes to read the global
-// configuration.
+// envPrefix is the prefix of the environment variables which override the configuration, for example
+// LOGPROCESSOR_KAFKA_TOPIC.
+const envPrefix = "LOGPROCESSOR"
+
+// Schema describes the keys of the configuration. The configuration is validated against it on startup and on every
+// reload. Only the Mutable keys are applied by a reload. Please refer to configutil/schema.go in the common module.
+var Schema = configutil.Merge(configutil.Schema{
+	configutil.String(KLogsDirectory).Required(),
+	configutil.Int(KMaxFilesPerBatch).Required().AtLeast(1).Mutable(),
+	configutil.Int(KMaxParallelLines).Required().AtLeast(1).Mutable(),
+	configutil.String(KSpoolDirectory),
+	configutil.Int(KSpoolMaxBytes).AtLeast(1),
+	configutil.Duration(KSpoolCheckInterval).DurationAtLeast(100 * time.Millisecond),
+}, commonmessageq.Schema, configutil.KafkaSchema, configutil.KafkaProducerSchema, configutil.HttpServerSchema,
+	configutil.SecretsSchema, configutil.LoggingSchema, configutil.TracingSchema)
+
+// flags are the command line flags of the configuration. Please refer to configutil/load.go in the common module.
+var flags = configutil.RegisterFlags(flag.CommandLine)
+
+// LoadConfiguration is a helper function to load the configuration present in defaults.yaml, with the overrides of the
+// environment variables and of the -set flags. This will be loaded to a config object which then can be passed
+// around(injected) to all the structs/classes to read the global configuration.
+//
+// The service exits with all the problems of the configuration if it does not match the Schema. With -print-config
+// the effective configuration is printed, with the secrets masked, and the service exits.
 func LoadConfiguration() *viper.Viper {
+	conf := configutil.MustLoad(Schema, envPrefix, flags)
+	logging.Apply(conf)
 
-	// Create a new Viper instance.
-	config := viper.New()
+	// At this point all the configuration present in defaults.yaml will be loaded into the config object.
+	return conf
+}
 
-	// Initialize Viper config
-	config.SetConfigName("defaults")
-	config.SetConfigType("yaml")
-	config.AddConfigPath(".")
+//----------------------------------------------------------------------------------------------------------------------
 
-	// Read the configuration file.
-	if err := config.ReadInConfig(); err != nil {
-		panic(fmt.Sprintf("failed to read config file: %v", err))
+// NewReloader returns the Reloader of the configuration loaded by LoadConfiguration. The log levels are applied on
+// every reload, the other mutable keys by the watchers registered by their owners. Please refer to
+// configutil/reload.go in the common module.
+func NewReloader(conf *viper.Viper) *configutil.Reloader {
+	return newReloader(conf, flags)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadFile loads the configuration file with the overrides of the environment variables, but not of the command line
+// flags. It is used when the log-processor runs in another process, for example the standalone command, which has
+// flags of its own. The returned Reloader reloads the same file.
+func LoadFile(file string) (*viper.Viper, *configutil.Reloader, error) {
+	fileFlags := &configutil.Flags{File: file}
+	conf, err := configutil.Load(Schema, envPrefix, fileFlags)
+	if err != nil {
+		return nil, nil, err
 	}
+	return conf, newReloader(conf, fileFlags), nil
+}
 
-	// At this point all the configuration present in defaults.yaml will be loaded into the config object.
-	return config
+//----------------------------------------------------------------------------------------------------------------------
+
+// newReloader is a helper function to create the Reloader of the configuration loaded with the flags.
+func newReloader(conf *viper.Viper, flags *configutil.Flags) *configutil.Reloader {
+	reloader := configutil.NewReloader(conf, Schema, envPrefix, flags)
+	reloader.OnReload(logging.Apply)
+	return reloader
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -3,6 +3,9 @@
 // Author: Suresh Bysani
 //
 // This file contains message queue related utils.
+//
+// The lines are published with the Publisher of messageq in the common module, which is created in main. Please refer
+// to messageq/messageq.go in the common module.
 
 package messageq
 
@@ -10,77 +13,54 @@ import (
 	"context"
 	"log"
 	"strings"
+	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/golang/glog"
-	"github.com/spf13/viper"
-
-	"logprocessor/internal/config"
-)
-
-// MaybeCreateKafkaTopic is a helper function to create a topic in message cluster. The topic
-// will be created only if the topic does not exist.
-func MaybeCreateKafkaTopic(conf *viper.Viper) error {
-
-	// Read the broker config from the configuration.
-	brokers := conf.GetString(config.KBootstrapServers)
-	topic := conf.GetString(config.KTopic)
-
-	adminClient, err := kafka.NewAdminClient(&kafka.ConfigMap{"bootstrap.servers": brokers})
-	if err != nil {
-		return err
-	}
-	defer adminClient.Close()
-
-	// Check if the topic already exists.
-	exists, err := topicExists(topic, adminClient)
-	if err != nil {
-		glog.Errorln(err.Error())
-		return err
-	}
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 
-	// If we reach here, the topic does not exist. Create one.
-	if !exists {
-		err = createKafkaTopic(topic, adminClient)
-		if err != nil {
-			glog.Errorln(err.Error())
-			return err
-		}
+	commonmessageq "common/messageq"
+	commontracing "common/tracing"
 
-		glog.Infoln("Kafka topic", topic, "created successfully")
-	} else {
-		glog.Infoln("Kafka topic", topic, "already exists")
-	}
-
-	return nil
-}
+	"logprocessor/internal/metrics"
+	"logprocessor/internal/tracing"
+)
 
-//---------------------------------------------------------------------------------------------------------------------
+const (
+	// queueFullBackoff is the time to wait for the local queue of the publisher to drain when it is full.
+	queueFullBackoff = 10 * time.Millisecond
 
-// CreateKafkaProducer creates and returns a new Kafka producer instance.
-func CreateKafkaProducer(conf *viper.Viper) (*kafka.Producer, error) {
+	// spoolFullWarning is the time after which a line waiting for the local queue of the publisher is logged. It only
+	// happens when the spool is full or disabled.
+	spoolFullWarning = 10 * time.Second
+)
 
-	brokers := conf.GetString(config.KBootstrapServers)
-	producerConfig := &kafka.ConfigMap{"bootstrap.servers": brokers}
-	producer, err := kafka.NewProducer(producerConfig)
-	if err != nil {
-		glog.Errorln(err.Error())
-		return nil, err
-	}
-	return producer, nil
+// LogRecord is a single log line read from a file. Ctx carries the span of the file which the line is read from, so
+// that the trace continues across the channel.
+type LogRecord struct {
+	Ctx  context.Context
+	Line string
 }
 
-//----------------------------------------------------------------------------------------------------------------------
-
-// PublishToKafka is a helper function which is run as a go routine per batch of files being processed. The function
-// takes the following parameters.
+// Publish is a helper function which publishes the lines of a batch of files. It is called by a single go routine for
+// one batch after the other, so that the lines of a thread are published in the order in which they were read. The
+// function takes the following parameters.
 //
 // logLines : a buffered channel which is populated various go routines that is processing the files in a given batch.
-func PublishToKafka(logLines chan string, producer *kafka.Producer, topic string) {
+// transport : the message_queue.transport of the configuration, the messaging system of the publish spans.
+//
+// The function returns when the channel is closed. The lines are logged only at the verbosity 2, the logging of every
+// line used to cost more than the produce call itself. It is enabled for this file alone with the setting
+// logging.vmodule: kafka_utils=2, or for the whole service with logging.verbosity: 2, without a restart.
+func Publish(logLines chan LogRecord, publisher commonmessageq.Publisher, topic string, transport string) {
 
 	// Please note that we are iterating over a buffered channel here. This is a blocking call. The go routine will
 	// infinitely block until the next message is available in the buffered channel.
-	for logLine := range logLines {
+	for record := range logLines {
+		logLine := record.Line
+
 		// Parse the log line and extract the required fields
 		parts := strings.Split(logLine, " - ")
 		if len(parts) < 2 {
@@ -88,62 +68,87 @@ func PublishToKafka(logLines chan string, producer *kafka.Producer, topic string
 			continue
 		}
 
-		messageKey := parts[0]
+		// The key is the thread of the line, so that the lines of a thread are delivered in order.
+		messageKey := commonmessageq.LogLineKey(parts[0])
 		messageValue := logLine
 
-		// Publish the log message to Kafka.
-		err := producer.Produce(&kafka.Message{
-			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-			Key:            []byte(messageKey),
-			Value:          []byte(messageValue),
-		}, nil)
+		// The publish span ends when the delivery report of the message arrives.
+		ctx, span := tracing.Tracer.Start(record.Ctx, "publish", trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String(transport),
+				semconv.MessagingDestinationKindTopic,
+				semconv.MessagingDestinationKey.String(topic)))
+
+		message := &commonmessageq.Message{
+			Topic:   topic,
+			Key:     []byte(messageKey),
+			Value:   []byte(messageValue),
+			Headers: make(map[string]string),
+			Opaque:  span,
+		}
+
+		// The consumers continue the trace from the headers of the message.
+		commontracing.InjectHeaders(ctx, message)
+
+		// Publish the log message. The kafka producer sends the messages in batches in the background. When its local
+		// queue is full, the batches in flight must be delivered first. With the spool, the queue is only full when
+		// the spool is full, and the lines wait until the message queue is available again.
+		err := publisher.Publish(message)
+		for waited := time.Duration(0); err == commonmessageq.ErrQueueFull; waited += queueFullBackoff {
+			if waited == spoolFullWarning {
+				glog.Warningf("The local queue of the publisher is full since %v, waiting to publish", waited)
+			}
+			time.Sleep(queueFullBackoff)
+			err = publisher.Publish(message)
+		}
 
 		if err != nil {
 			log.Printf("Failed to produce message: %s", err.Error())
+			metrics.ProducerErrors.WithLabelValues(topic, metrics.ErrorProduce).Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to produce message")
+			span.End()
 		}
 
-		glog.Infoln("The message key: ", messageKey)
-		glog.Infoln("The message value: ", messageValue)
-	}
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-// topicExists is a helper function to check if the topic exists in the given kafka broker.
-func topicExists(topic string, adminClient *kafka.AdminClient) (bool, error) {
-	topics, err := adminClient.GetMetadata(&topic, false, 5000)
-	if err != nil {
-		return false, err
-	}
+		// Update the depth of the in-memory queues.
+		metrics.QueueDepth.WithLabelValues(metrics.QueueLines).Set(float64(len(logLines)))
+		metrics.QueueDepth.WithLabelValues(metrics.QueueProducer).Set(float64(publisher.Len()))
 
-	// Iterate over all the topics that are present and check if the topic exists.
-	for _, t := range topics.Topics {
-		if t.Topic == topic {
-			return true, nil
+		if glog.V(2) {
+			glog.Infof("Published the message with the key %s: %s", messageKey, messageValue)
 		}
 	}
-
-	// If we reach here the topic does not exist.
-	return false, nil
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
-// createKafkaTopic is a helper function to create the kafka topic.
-func createKafkaTopic(topic string, adminClient *kafka.AdminClient) error {
-	topicConfig := &kafka.TopicSpecification{
-		Topic:             topic,
-		NumPartitions:     1,
-		ReplicationFactor: 1,
-	}
+// HandleDeliveryReports is a helper function which is run as a go routine for the lifetime of the publisher. The
+// publisher is asynchronous and reports the outcome of every message on the deliveries channel. The channel must be
+// drained, otherwise the publisher eventually blocks.
+func HandleDeliveryReports(publisher commonmessageq.Publisher) {
+	for delivery := range publisher.Deliveries() {
+		message := delivery.Message
+
+		// The publish span of the message is carried in the opaque field.
+		span, ok := message.Opaque.(trace.Span)
+		if !ok {
+			span = trace.SpanFromContext(context.Background())
+		}
 
-	topics := []kafka.TopicSpecification{*topicConfig}
-	_, err := adminClient.CreateTopics(context.Background(), topics)
-	if err != nil {
-		return err
+		if delivery.Err != nil {
+			glog.Errorf("Failed to deliver message: %v", delivery.Err)
+			metrics.ProducerErrors.WithLabelValues(message.Topic, metrics.ErrorDelivery).Inc()
+			span.RecordError(delivery.Err)
+			span.SetStatus(codes.Error, "failed to deliver message")
+			span.End()
+			continue
+		}
+		metrics.RecordsPublished.WithLabelValues(message.Topic).Inc()
+		span.SetAttributes(
+			semconv.MessagingKafkaPartitionKey.Int(int(message.Partition)),
+			attribute.Int64("messaging.kafka.offset", message.Offset))
+		span.End()
 	}
-
-	return nil
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,784 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the local spool of the log-processor, which keeps the lines on disk while the message queue is
+// not available.
+//
+// The SpoolPublisher wraps the publisher of the message queue which is created in main.
+//
+// 1. The lines are published directly while the message queue is available. A line whose delivery fails is appended
+//    to the spool instead of being dropped, and the message queue is considered unavailable until it answers a ping
+//    again. A line is spooled as well when the local queue of the publisher is full, so a burst does not block the
+//    file readers.
+// 2. Once a line is spooled, the next lines are spooled as well until the spool is drained. So the lines of a thread
+//    are published in the order they were read, except for the lines which were in flight when the message queue
+//    became unavailable. They are spooled when their delivery fails, after the lines spooled in the meantime.
+// 3. The message queue is pinged every check_interval. Once it answers, the spool is drained in order in batches. A
+//    batch is removed from the spool when all its lines are delivered, and published again otherwise. The delivery
+//    is at least once, like the delivery of the lines which are not spooled.
+// 4. The spool is a directory of segment files, which survives a restart. The lines spooled by the previous run are
+//    drained first. Publish returns ErrQueueFull once the segment files reach max_bytes, so the file readers wait
+//    until the spool is drained.
+//
+// A line is appended to its segment file with a single write call, so it survives a crash of the process but not a
+// crash of the node.
+
+package messageq
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	commonmessageq "common/messageq"
+
+	"logprocessor/internal/metrics"
+)
+
+const (
+	// spoolSegmentBytes is the size after which the spool starts a new segment file. A segment file is removed once
+	// all its lines are delivered.
+	spoolSegmentBytes = 64 << 20
+
+	// spoolBatchSize is the number of lines which are drained from the spool at a time.
+	spoolBatchSize = 1000
+
+	// spoolHeaderBytes is the size of the header of a line in a segment file, the length and the checksum of the line.
+	spoolHeaderBytes = 8
+
+	// spoolSuffix is the suffix of the segment files. They are named after their sequence number, so that sorting
+	// them by name sorts them in order.
+	spoolSuffix = ".spool"
+)
+
+// errSpoolCorrupted is returned when a line of a segment file does not match its checksum.
+var errSpoolCorrupted = errors.New("the line does not match its checksum")
+
+// SpoolPublisher implements the Publisher interface of messageq in the common module. It publishes with the wrapped
+// publisher and spools the lines to disk while the message queue is not available.
+type SpoolPublisher struct {
+	publisher commonmessageq.Publisher
+
+	// Guards the spool and the availability of the message queue.
+	mutex     sync.Mutex
+	spool     *spool
+	available bool
+
+	deliveries chan commonmessageq.Delivery
+
+	// pending is the number of directly published lines whose delivery is not handled yet. It is accessed atomically.
+	pending int64
+
+	// done is closed by Close. stopped and handled are closed when the drain loop and the delivery handler returned.
+	done      chan struct{}
+	stopped   chan struct{}
+	handled   chan struct{}
+	closeOnce sync.Once
+}
+
+// spoolBatch is a batch of lines drained from the spool, which is removed from the spool once all its lines are
+// delivered.
+type spoolBatch struct {
+	records   []*spoolRecord
+	opaques   []interface{}
+	positions []spoolPosition
+
+	// offset is the position in the first segment file after the batch.
+	offset int64
+
+	// corrupted is set when the rest of the first segment file cannot be read. It is dropped with the batch.
+	corrupted bool
+
+	// pending is the number of lines whose delivery is not reported yet, done is closed when it reaches zero. failed
+	// is set when a delivery failed. They are accessed atomically.
+	pending int64
+	failed  int32
+	done    chan struct{}
+}
+
+// spoolOpaque is the opaque value of a drained line. It carries the opaque value of the line when it was spooled.
+type spoolOpaque struct {
+	batch  *spoolBatch
+	opaque interface{}
+}
+
+// NewSpoolPublisher returns a new instance of SpoolPublisher, which spools to the directory up to maxBytes and pings
+// the message queue at the check interval. The lines left in the directory by the previous run are drained first.
+func NewSpoolPublisher(publisher commonmessageq.Publisher, directory string, maxBytes int64,
+	checkInterval time.Duration) (*SpoolPublisher, error) {
+	spool, err := openSpool(directory, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if spool.records > 0 {
+		glog.Infof("Recovered %d lines from the spool in %s", spool.records, directory)
+	}
+
+	spoolPublisher := &SpoolPublisher{
+		publisher:  publisher,
+		spool:      spool,
+		available:  true,
+		deliveries: make(chan commonmessageq.Delivery),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		handled:    make(chan struct{}),
+	}
+	go spoolPublisher.handleDeliveries()
+	go spoolPublisher.run(checkInterval)
+	return spoolPublisher, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Publish implements Publisher. It returns ErrQueueFull only when the spool is full.
+func (publisher *SpoolPublisher) Publish(message *commonmessageq.Message) error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	select {
+	case <-publisher.done:
+		return errors.New("the publisher is closed")
+	default:
+	}
+
+	// The lines are published directly only when no line is waiting in the spool, to keep them in order.
+	if publisher.available && publisher.spool.records == 0 {
+		atomic.AddInt64(&publisher.pending, 1)
+		err := publisher.publisher.Publish(message)
+		if err == nil {
+			return nil
+		}
+		atomic.AddInt64(&publisher.pending, -1)
+
+		// The publish call fails right away only for an invalid line. An unavailable message queue fails the delivery.
+		if err != commonmessageq.ErrQueueFull {
+			return err
+		}
+	}
+
+	if err := publisher.spool.append(message); err != nil {
+		return err
+	}
+	metrics.RecordsSpooled.WithLabelValues(message.Topic).Inc()
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Deliveries implements Publisher. The delivery of a spooled line is reported once it is drained.
+func (publisher *SpoolPublisher) Deliveries() <-chan commonmessageq.Delivery {
+	return publisher.deliveries
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Flush implements Publisher. It waits for the spool to be drained as well.
+func (publisher *SpoolPublisher) Flush(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for publisher.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(queueFullBackoff)
+	}
+	return publisher.Len()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Len implements Publisher. The lines waiting in the spool are counted as well.
+func (publisher *SpoolPublisher) Len() int {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	return int(atomic.LoadInt64(&publisher.pending)) + publisher.spool.records
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Publisher. The service is not ready while the message queue is not available, even though the
+// lines are spooled.
+func (publisher *SpoolPublisher) Ping(ctx context.Context) error {
+	return publisher.publisher.Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Publisher. The wrapped publisher is closed as well. The lines of the spool are kept for the next
+// run.
+func (publisher *SpoolPublisher) Close() {
+	publisher.closeOnce.Do(func() {
+		close(publisher.done)
+		<-publisher.stopped
+
+		publisher.publisher.Close()
+		<-publisher.handled
+
+		publisher.mutex.Lock()
+		defer publisher.mutex.Unlock()
+		publisher.spool.close()
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setUnavailable is a helper function to spool the next lines until the message queue answers a ping. The caller
+// must hold the mutex.
+func (publisher *SpoolPublisher) setUnavailable(err error) {
+	if publisher.available {
+		glog.Warningf("The message queue is not available, spooling the lines to %s: %v",
+			publisher.spool.directory, err)
+	}
+	publisher.available = false
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// run is a helper function which is run as a go routine for the lifetime of the publisher. It pings the message queue
+// at the check interval and drains the spool while the message queue is available.
+func (publisher *SpoolPublisher) run(checkInterval time.Duration) {
+	defer close(publisher.stopped)
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		publisher.mutex.Lock()
+		drain := publisher.available && publisher.spool.records > 0
+		publisher.updateMetrics()
+		publisher.mutex.Unlock()
+
+		// Drain the next batch right away, unless the previous one was not delivered.
+		if drain && publisher.drain() {
+			continue
+		}
+
+		select {
+		case <-publisher.done:
+			return
+		case <-ticker.C:
+		}
+		publisher.check(checkInterval)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// check is a helper function to ping the message queue and to update its availability.
+func (publisher *SpoolPublisher) check(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := publisher.publisher.Ping(ctx)
+
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	if err != nil {
+		publisher.setUnavailable(err)
+		return
+	}
+	if !publisher.available {
+		glog.Infof("The message queue is available again, draining %d lines from the spool",
+			publisher.spool.records)
+	}
+	publisher.available = true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// drain is a helper function to publish the next batch of lines of the spool, and to remove them from the spool once
+// they are delivered. It returns false when the batch was not delivered.
+func (publisher *SpoolPublisher) drain() bool {
+	publisher.mutex.Lock()
+	batch, err := publisher.spool.read(spoolBatchSize)
+	publisher.mutex.Unlock()
+	if err != nil {
+		glog.Errorf("Failed to read the spool: %v", err)
+		return false
+	}
+
+	batch.pending = int64(len(batch.records))
+	batch.done = make(chan struct{})
+	if batch.pending == 0 {
+		close(batch.done)
+	}
+
+	for i, record := range batch.records {
+		message := &commonmessageq.Message{
+			Topic:   record.Topic,
+			Key:     record.Key,
+			Value:   record.Value,
+			Headers: record.Headers,
+			Opaque:  &spoolOpaque{batch: batch, opaque: batch.opaques[i]},
+		}
+
+		err := publisher.publisher.Publish(message)
+		for err == commonmessageq.ErrQueueFull {
+			select {
+			case <-publisher.done:
+				return false
+			case <-time.After(queueFullBackoff):
+			}
+			err = publisher.publisher.Publish(message)
+		}
+
+		// The lines which are not published are reported as failed, so that the batch is drained again.
+		if err != nil {
+			publisher.mutex.Lock()
+			publisher.setUnavailable(err)
+			publisher.mutex.Unlock()
+			for range batch.records[i:] {
+				batch.deliver(err)
+			}
+			break
+		}
+	}
+
+	select {
+	case <-batch.done:
+	case <-publisher.done:
+		return false
+	}
+	if atomic.LoadInt32(&batch.failed) != 0 {
+		return false
+	}
+
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	if err := publisher.spool.commit(batch); err != nil {
+		glog.Errorf("Failed to remove the drained lines from the spool: %v", err)
+		return false
+	}
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// handleDeliveries is a helper function which is run as a go routine for the lifetime of the wrapped publisher. The
+// lines whose delivery failed are spooled, the other deliveries are reported on the deliveries channel. The delivery
+// of a drained line is reported with the opaque value of the line when it was spooled.
+func (publisher *SpoolPublisher) handleDeliveries() {
+	defer close(publisher.handled)
+	defer close(publisher.deliveries)
+
+	for delivery := range publisher.publisher.Deliveries() {
+		message := delivery.Message
+
+		if drained, ok := message.Opaque.(*spoolOpaque); ok {
+			if delivery.Err != nil {
+				publisher.mutex.Lock()
+				publisher.setUnavailable(delivery.Err)
+				publisher.mutex.Unlock()
+				drained.batch.deliver(delivery.Err)
+				continue
+			}
+			message.Opaque = drained.opaque
+			publisher.deliveries <- delivery
+			drained.batch.deliver(nil)
+			continue
+		}
+
+		if delivery.Err != nil {
+			publisher.mutex.Lock()
+			publisher.setUnavailable(delivery.Err)
+			err := publisher.spool.append(message)
+			publisher.mutex.Unlock()
+			if err == nil {
+				metrics.RecordsSpooled.WithLabelValues(message.Topic).Inc()
+				atomic.AddInt64(&publisher.pending, -1)
+				continue
+			}
+			glog.Errorf("Failed to spool the undelivered line: %v", err)
+		}
+		publisher.deliveries <- delivery
+		atomic.AddInt64(&publisher.pending, -1)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// updateMetrics is a helper function to export the size and the age of the spool. The caller must hold the mutex.
+func (publisher *SpoolPublisher) updateMetrics() {
+	spool := publisher.spool
+	metrics.SpoolRecords.Set(float64(spool.records))
+	metrics.SpoolBytes.Set(float64(spool.size))
+
+	age := 0.0
+	if spool.records > 0 && !spool.oldest.IsZero() {
+		age = time.Since(spool.oldest).Seconds()
+	}
+	metrics.SpoolAge.Set(age)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// deliver is a helper function to report the delivery of a line of the batch.
+func (batch *spoolBatch) deliver(err error) {
+	if err != nil {
+		atomic.StoreInt32(&batch.failed, 1)
+	}
+	if atomic.AddInt64(&batch.pending, -1) == 0 {
+		close(batch.done)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// spool is the directory of segment files of a SpoolPublisher. The lines are appended to the last segment file and
+// drained from the first one. It is guarded by the mutex of the SpoolPublisher.
+type spool struct {
+	directory string
+	maxBytes  int64
+
+	// segments are the segment files in order. The last one is written to when writer is set.
+	segments []*spoolSegment
+	writer   *os.File
+
+	// offset is the position in the first segment file of the next line to drain.
+	offset int64
+
+	// size is the size of the segment files and records is the number of lines which are not drained yet.
+	size    int64
+	records int
+
+	// oldest is the time at which the next line to drain was spooled.
+	oldest time.Time
+
+	// sequence is the sequence number of the next segment file.
+	sequence uint64
+
+	// opaques are the opaque values of the lines spooled by this run, by their position.
+	opaques map[spoolPosition]interface{}
+}
+
+// spoolSegment is a segment file of the spool.
+type spoolSegment struct {
+	sequence uint64
+	path     string
+	size     int64
+
+	// records is the number of lines of the segment file which are not drained yet.
+	records int
+}
+
+// spoolPosition is the position of a line in the spool.
+type spoolPosition struct {
+	sequence uint64
+	offset   int64
+}
+
+// spoolRecord is a line in a segment file.
+type spoolRecord struct {
+	Time    time.Time         `json:"time"`
+	Topic   string            `json:"topic"`
+	Key     []byte            `json:"key"`
+	Value   []byte            `json:"value"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// openSpool is a helper function to open the spool in the directory, which is created if it does not exist. The lines
+// of the existing segment files are recovered. A segment file which ends with a partially written line, because the
+// process crashed while writing it, is truncated to its last complete line.
+func openSpool(directory string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the spool directory: %w", err)
+	}
+
+	spool := &spool{directory: directory, maxBytes: maxBytes, opaques: make(map[spoolPosition]interface{})}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segment := &spoolSegment{sequence: sequence, path: filepath.Join(directory, name)}
+		if err := segment.recover(); err != nil {
+			return nil, err
+		}
+		if segment.records == 0 {
+			os.Remove(segment.path)
+			continue
+		}
+		spool.segments = append(spool.segments, segment)
+		spool.size += segment.size
+		spool.records += segment.records
+	}
+	sort.Slice(spool.segments, func(i, j int) bool { return spool.segments[i].sequence < spool.segments[j].sequence })
+
+	if len(spool.segments) > 0 {
+		spool.sequence = spool.segments[len(spool.segments)-1].sequence + 1
+	}
+	spool.oldest = spool.peekTime()
+	return spool, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// append is a helper function to append the message to the last segment file. It returns ErrQueueFull when the spool
+// is full.
+func (spool *spool) append(message *commonmessageq.Message) error {
+	if spool.opaques == nil {
+		return errors.New("the spool is closed")
+	}
+
+	record := &spoolRecord{
+		Time:    time.Now(),
+		Topic:   message.Topic,
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: message.Headers,
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	size := int64(spoolHeaderBytes + len(payload))
+	if spool.size+size > spool.maxBytes {
+		return commonmessageq.ErrQueueFull
+	}
+
+	if spool.writer == nil || spool.segments[len(spool.segments)-1].size+size > spoolSegmentBytes {
+		if err := spool.rotate(); err != nil {
+			return err
+		}
+	}
+	segment := spool.segments[len(spool.segments)-1]
+
+	// The line is written with a single write call. A failed write is truncated, so that the next lines are not
+	// appended after a partial line.
+	buffer := make([]byte, size)
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buffer[4:8], crc32.ChecksumIEEE(payload))
+	copy(buffer[spoolHeaderBytes:], payload)
+	if _, err := spool.writer.Write(buffer); err != nil {
+		spool.writer.Truncate(segment.size)
+		return fmt.Errorf("failed to write to the spool: %w", err)
+	}
+
+	if message.Opaque != nil {
+		spool.opaques[spoolPosition{sequence: segment.sequence, offset: segment.size}] = message.Opaque
+	}
+	if spool.records == 0 {
+		spool.oldest = record.Time
+	}
+	segment.size += size
+	segment.records++
+	spool.size += size
+	spool.records++
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// rotate is a helper function to close the segment file which is written to and to start a new one.
+func (spool *spool) rotate() error {
+	if spool.writer != nil {
+		spool.writer.Close()
+		spool.writer = nil
+	}
+
+	path := filepath.Join(spool.directory, fmt.Sprintf("%020d%s", spool.sequence, spoolSuffix))
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create the spool segment: %w", err)
+	}
+
+	spool.writer = writer
+	spool.segments = append(spool.segments, &spoolSegment{sequence: spool.sequence, path: path})
+	spool.sequence++
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// read is a helper function to read up to count lines from the first segment file, from the position of the next line
+// to drain. The lines stay in the spool until the batch is committed.
+func (spool *spool) read(count int) (*spoolBatch, error) {
+	batch := &spoolBatch{offset: spool.offset}
+	if len(spool.segments) == 0 {
+		return batch, nil
+	}
+	segment := spool.segments[0]
+
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(spool.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(io.LimitReader(file, segment.size-spool.offset))
+	for len(batch.records) < count && batch.offset < segment.size {
+		record, size, err := readRecord(reader)
+		if err != nil {
+			glog.Errorf("Dropping the rest of the spool segment %s from %d: %v", segment.path, batch.offset, err)
+			batch.corrupted = true
+			break
+		}
+
+		position := spoolPosition{sequence: segment.sequence, offset: batch.offset}
+		batch.records = append(batch.records, record)
+		batch.opaques = append(batch.opaques, spool.opaques[position])
+		batch.positions = append(batch.positions, position)
+		batch.offset += size
+	}
+	return batch, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// commit is a helper function to remove the lines of the batch from the spool. The first segment file is removed once
+// all its lines are drained.
+func (spool *spool) commit(batch *spoolBatch) error {
+	segment := spool.segments[0]
+	for _, position := range batch.positions {
+		delete(spool.opaques, position)
+	}
+
+	drained := len(batch.records)
+	if batch.corrupted {
+		drained = segment.records
+		batch.offset = segment.size
+	}
+	segment.records -= drained
+	spool.records -= drained
+	spool.offset = batch.offset
+
+	if segment.records == 0 {
+		if len(spool.segments) == 1 && spool.writer != nil {
+			spool.writer.Close()
+			spool.writer = nil
+		}
+		if err := os.Remove(segment.path); err != nil {
+			return err
+		}
+		spool.segments = spool.segments[1:]
+		spool.size -= segment.size
+		spool.offset = 0
+	}
+
+	spool.oldest = spool.peekTime()
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// peekTime is a helper function to return the time at which the next line to drain was spooled. It returns the zero
+// time when the spool is empty or the line cannot be read.
+func (spool *spool) peekTime() time.Time {
+	if spool.records == 0 {
+		return time.Time{}
+	}
+
+	batch, err := spool.read(1)
+	if err != nil || len(batch.records) == 0 {
+		return time.Time{}
+	}
+	return batch.records[0].Time
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// close is a helper function to close the segment file which is written to. The spool cannot be appended to anymore.
+func (spool *spool) close() {
+	if spool.writer != nil {
+		spool.writer.Close()
+		spool.writer = nil
+	}
+	spool.opaques = nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// recover is a helper function to count the lines of the segment file, and to truncate it after its last complete
+// line.
+func (segment *spoolSegment) recover() error {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		_, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			glog.Warningf("Truncating the spool segment %s at %d of %d bytes: %v", segment.path, segment.size,
+				info.Size(), err)
+			break
+		}
+		segment.size += size
+		segment.records++
+	}
+
+	if segment.size < info.Size() {
+		return os.Truncate(segment.path, segment.size)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// readRecord is a helper function to read the next line of a segment file and its size in the file. It returns io.EOF
+// at the end of the file.
+func readRecord(reader *bufio.Reader) (*spoolRecord, int64, error) {
+	header := make([]byte, spoolHeaderBytes)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > spoolSegmentBytes {
+		return nil, 0, errSpoolCorrupted
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolCorrupted
+	}
+
+	record := &spoolRecord{}
+	if err := json.Unmarshal(payload, record); err != nil {
+		return nil, 0, err
+	}
+	return record, int64(spoolHeaderBytes) + int64(length), nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,101 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the prometheus metrics exported by the log-processor.
+//
+// All the metrics are prefixed with the service name. The labels are consistent across the three services. For example
+// the kafka topic is always labelled as "topic" and the input file is labelled as "file".
+//
+// The metrics are served on the /metrics endpoint of the http server in the web package.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// namespace is the prefix of all the metrics exported by the log-processor.
+	namespace = "logprocessor"
+
+	// QueueLines is the label value of the buffered channel between the file readers and the kafka publisher.
+	QueueLines = "lines"
+
+	// QueueProducer is the label value of the local queue of the kafka producer.
+	QueueProducer = "producer"
+
+	// ErrorProduce is the label value of the errors returned by the produce call.
+	ErrorProduce = "produce"
+
+	// ErrorDelivery is the label value of the errors reported by the delivery reports.
+	ErrorDelivery = "delivery"
+)
+
+var (
+	// LinesRead is the number of log lines read per input file.
+	LinesRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lines_read_total",
+		Help:      "Number of lines read from the input log files.",
+	}, []string{"file"})
+
+	// BytesRead is the number of bytes read per input file.
+	BytesRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_read_total",
+		Help:      "Number of bytes read from the input log files.",
+	}, []string{"file"})
+
+	// RecordsPublished is the number of records successfully delivered to kafka.
+	RecordsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_published_total",
+		Help:      "Number of records delivered to kafka.",
+	}, []string{"topic"})
+
+	// ProducerErrors is the number of records which could not be published to kafka.
+	ProducerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "producer_errors_total",
+		Help:      "Number of records which could not be published to kafka.",
+	}, []string{"topic", "stage"})
+
+	// QueueDepth is the number of records waiting in the in-memory queues.
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of records waiting in the in-memory queues.",
+	}, []string{"queue"})
+
+	// SpoolRecords is the number of records waiting in the local spool for the message queue to be available.
+	SpoolRecords = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_records",
+		Help:      "Number of records waiting in the local spool.",
+	})
+
+	// SpoolBytes is the size of the segment files of the local spool.
+	SpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_bytes",
+		Help:      "Size of the segment files of the local spool in bytes.",
+	})
+
+	// SpoolAge is the age of the oldest record waiting in the local spool.
+	SpoolAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_age_seconds",
+		Help:      "Age of the oldest record waiting in the local spool in seconds, zero when the spool is empty.",
+	})
+
+	// RecordsSpooled is the number of records which were written to the local spool instead of being published.
+	RecordsSpooled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_spooled_total",
+		Help:      "Number of records written to the local spool instead of being published.",
+	}, []string{"topic"})
+)
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -8,18 +8,27 @@ package processor
 
 import (
 	"bufio"
+	"context"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sync"
+	"sync/atomic"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"common/configutil"
+	commonmessageq "common/messageq"
 
 	"logprocessor/internal/config"
 	"logprocessor/internal/messageq"
+	"logprocessor/internal/metrics"
+	"logprocessor/internal/tracing"
 )
 
 // Mutex to synchronize access to the logLine variable
@@ -29,21 +38,41 @@ type LogProcessor struct {
 	// The configuration object.
 	conf *viper.Viper
 
-	// The kafka producer for the log processor.
-	producer *kafka.Producer
+	// The publisher of the log lines, the kafka producer of the log processor unless it runs in one process with the
+	// other services.
+	publisher commonmessageq.Publisher
+
+	// maxFilesPerBatch is the number of files processed in parallel. It can be changed while the files are processed,
+	// the next batch picks it up. It is accessed atomically.
+	maxFilesPerBatch int32
+
+	// maxParallelLines is the number of lines read ahead of the publisher. Like maxFilesPerBatch, the next batch picks
+	// up a change. It is accessed atomically.
+	maxParallelLines int32
 }
 
 // NewLogProcessor creates a new instance of the LogProcessor.
-func NewLogProcessor(conf *viper.Viper, producer *kafka.Producer) *LogProcessor {
+func NewLogProcessor(conf *viper.Viper, publisher commonmessageq.Publisher) *LogProcessor {
 	return &LogProcessor{
-		conf:     conf,
-		producer: producer,
+		conf:             conf,
+		publisher:        publisher,
+		maxFilesPerBatch: int32(conf.GetInt(config.KMaxFilesPerBatch)),
+		maxParallelLines: int32(conf.GetInt(config.KMaxParallelLines)),
 	}
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-// ProcessLogs is a the struct method to process the logs.
+// Reload applies the reloaded batch size and parallelism. It is registered with the configuration reloader.
+func (processor *LogProcessor) Reload(conf *viper.Viper) {
+	atomic.StoreInt32(&processor.maxFilesPerBatch, int32(conf.GetInt(config.KMaxFilesPerBatch)))
+	atomic.StoreInt32(&processor.maxParallelLines, int32(conf.GetInt(config.KMaxParallelLines)))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ProcessLogs is a the struct method to process the logs. It returns when all the lines are handed to the publisher,
+// the caller flushes the publisher to wait for their delivery.
 func (processor *LogProcessor) ProcessLogs() {
 	// Get the input logs directory from config.
 	inputLogsDir := processor.conf.GetString(config.KLogsDirectory)
@@ -52,7 +81,7 @@ func (processor *LogProcessor) ProcessLogs() {
 	// Get a list of files in the data directory.
 	filePaths, err := filepath.Glob(inputLogsDir + "/*")
 	if err != nil {
-		glog.Fatalf("Failed to get list of log files: ", err)
+		glog.Fatalf("Failed to get list of log files: %v", err)
 	}
 
 	glog.Infoln("Printing all the log files in the directory...")
@@ -60,55 +89,85 @@ func (processor *LogProcessor) ProcessLogs() {
 		glog.Infoln(fileName)
 	}
 
-	maxParallelLines := 100
-	maxFilesPerBatch := 10
-	logLines := make(chan string, maxParallelLines)
 	var wg sync.WaitGroup
 
-	topic := processor.conf.GetString(config.KTopic)
+	topic := processor.conf.GetString(configutil.KTopic)
+	transport := processor.conf.GetString(configutil.KTransport)
+
+	// A single go routine publishes the lines of all the batches, one batch after the other. The lines of a thread are
+	// published in the order in which they were read, which the message queue keeps for the messages with the same
+	// key. Every batch has its own channel, since the capacity of a channel cannot change.
+	batches := make(chan chan messageq.LogRecord, 1)
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for logLines := range batches {
+			messageq.Publish(logLines, processor.publisher, topic, transport)
+		}
+	}()
 
-	// Process log files in batches
-	for i := 0; i < len(filePaths); i += maxFilesPerBatch {
+	// Process log files in batches. The batch size is read for every batch, so that a reloaded size is applied.
+	for i, end := 0, 0; i < len(filePaths); i = end {
 		glog.Infoln("Processing file with index: ", filePaths[i])
 		// Determine the end index of the current batch
-		end := i + maxFilesPerBatch
+		end = i + int(atomic.LoadInt32(&processor.maxFilesPerBatch))
 		if end > len(filePaths) {
 			end = len(filePaths)
 		}
 
+		// The parallelism is read for every batch as well, it is the capacity of the channel of the batch.
+		logLines := make(chan messageq.LogRecord, int(atomic.LoadInt32(&processor.maxParallelLines)))
+		batches <- logLines
+
+		// Every batch is the root of a trace. The records of the batch continue the trace up to the database.
+		ctx, span := tracing.Tracer.Start(context.Background(), "process batch",
+			trace.WithAttributes(attribute.Int("logprocessor.batch.files", end-i)))
+
 		// Process log files in the current batch
 		for _, filePath := range filePaths[i:end] {
 			wg.Add(1)
 			glog.Infoln("Starting a go routine for a file: ", filePath)
-			go processor.ProcessLogFile(filePath, logLines, &wg)
+			go processor.ProcessLogFile(ctx, filePath, logLines, &wg)
 		}
 
-		// Start goroutine to publish log lines to Kafka
-		go messageq.PublishToKafka(logLines, processor.producer, topic)
-
-		// Wait for the current batch to finish processing
+		// Wait for the current batch to finish processing. The publisher moves on to the next batch once it handed
+		// the rest of the lines of this batch to the publisher.
 		wg.Wait()
+		close(logLines)
+		span.End()
 	}
 
-	// Close the logLines channel to signal the end of processing
-	close(logLines)
+	// Close the batches channel to signal the end of processing, and wait until every line is handed to the publisher.
+	close(batches)
+	<-published
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
 // ProcessLogFile is a helper function to process the data from a given file path.
-func (processor *LogProcessor) ProcessLogFile(filePath string, logLines chan string, wg *sync.WaitGroup) {
+func (processor *LogProcessor) ProcessLogFile(ctx context.Context, filePath string, logLines chan messageq.LogRecord,
+	wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	ctx, span := tracing.Tracer.Start(ctx, "process file",
+		trace.WithAttributes(attribute.String("logprocessor.file", filePath)))
+	defer span.End()
+
 	file, err := os.Open(filePath)
 	if err != nil {
 		log.Printf("Failed to open file: %s - %s", filePath, err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to open file")
 		return
 	}
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
 
+	// The per file metrics are labelled with the file name.
+	linesRead := metrics.LinesRead.WithLabelValues(filepath.Base(filePath))
+	bytesRead := metrics.BytesRead.WithLabelValues(filepath.Base(filePath))
+
 	// Regex pattern to match the log line format
 	pattern := `(\d+:\d+::[\w-]+ \d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) - (.*)`
 	regex := regexp.MustCompile(pattern)
@@ -118,6 +177,8 @@ func (processor *LogProcessor) ProcessLogFile(filePath string, logLines chan str
 
 	for scanner.Scan() {
 		line := scanner.Text()
+		linesRead.Inc()
+		bytesRead.Add(float64(len(line) + 1))
 
 		// Check if the line matches the log line format
 		match := regex.FindStringSubmatch(line)
@@ -126,7 +187,7 @@ func (processor *LogProcessor) ProcessLogFile(filePath string, logLines chan str
 			logLineMutex.Lock()
 			if logLine != "" {
 				// If there is a previous log line, send it to the logLines channel
-				logLines <- logLine
+				logLines <- messageq.LogRecord{Ctx: ctx, Line: logLine}
 			}
 			// Set the current log line to the matched line
 			logLine = line
@@ -140,13 +201,15 @@ func (processor *LogProcessor) ProcessLogFile(filePath string, logLines chan str
 	}
 
 	if err := scanner.Err(); err != nil {
-		glog.Infoln("Error reading file: %s - %s", filePath, err.Error())
+		glog.Infof("Error reading file: %s - %s", filePath, err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to read file")
 	}
 
 	// Send the last log line to the logLines channel
 	logLineMutex.Lock()
 	if logLine != "" {
-		logLines <- logLine
+		logLines <- messageq.LogRecord{Ctx: ctx, Line: logLine}
 	}
 	logLineMutex.Unlock()
 }
@@ -0,0 +1,22 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the OpenTelemetry tracer of the log-processor.
+//
+// The tracer provider is installed by Init of the tracing package in the common module, with ServiceName as the name
+// of the service in the exported spans. Please refer to tracing/tracing.go in the common module.
+
+package tracing
+
+import (
+	"go.opentelemetry.io/otel"
+)
+
+// ServiceName is the name of the service in the exported spans.
+const ServiceName = "logprocessor"
+
+// Tracer is the tracer of the log-processor. It picks up the tracer provider installed by Init.
+var Tracer = otel.Tracer(ServiceName)
+
+//----------------------------------------------------------------------------------------------------------------------
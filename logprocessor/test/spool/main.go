@@ -0,0 +1,478 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file for the test of the local spool of the log-processor.
+//
+// The spool keeps the lines on disk while the message queue is not available. This test checks that no line is lost
+// through an outage, a restart of the process and a full spool. The message queue is the in-memory transport of
+// messageq in the common module behind a publisher which can be taken down: while it is down, its ping fails and the
+// delivery of every line fails, like the kafka producer when the brokers are not reachable.
+//
+// It performs the following steps:
+// 1. Publish lines through an outage and check that every line is received.
+// 2. Spool lines while the message queue is down, close the publisher and check that a new publisher on the same
+//    directory delivers all of them in order. The last segment file ends with a partially written line, like after a
+//    crash, which is dropped.
+// 3. Fill a small spool while the message queue is down and check that Publish reports the full queue until the spool
+//    is drained.
+//
+// For example,
+//
+//     cd logprocessor
+//     go run ./test/spool
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	commonmessageq "common/messageq"
+
+	"logprocessor/internal/messageq"
+)
+
+const (
+	// topic is the topic of the test.
+	topic = "spool-messages"
+
+	// checkInterval is the interval at which the spool pings the message queue. A short one keeps the test fast.
+	checkInterval = 50 * time.Millisecond
+
+	// maxBytes is the size of the spool of the first two steps.
+	maxBytes = 64 << 20
+)
+
+var (
+	keys     = flag.Int("keys", 20, "number of keys, like the threads of the log files")
+	messages = flag.Int("messages", 500, "number of messages per key")
+	timeout  = flag.Duration("timeout", time.Minute, "maximum time to wait for the delivery of the messages")
+
+	// errDown is the error of the deliveries while the message queue is down.
+	errDown = errors.New("the message queue is down")
+)
+
+// flakyPublisher is a publisher of the in-memory transport which can be taken down.
+type flakyPublisher struct {
+	publisher *commonmessageq.MemoryPublisher
+	down      int32
+
+	// failures are the lines published while the message queue is down, whose delivery fails.
+	failures   chan *commonmessageq.Message
+	deliveries chan commonmessageq.Delivery
+	pending    int64
+}
+
+// receipt is a line received by the subscriber.
+type receipt struct {
+	key      string
+	sequence int
+}
+
+func main() {
+	flag.Parse()
+
+	directory, err := os.MkdirTemp("", "spool-test")
+	if err != nil {
+		log.Fatalf("Failed to create the spool directory: %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	steps := []struct {
+		name string
+		run  func(directory string) error
+	}{
+		{"outage", checkOutage},
+		{"restart", checkRestart},
+		{"full", checkFull},
+	}
+	for _, step := range steps {
+		if err := step.run(filepath.Join(directory, step.name)); err != nil {
+			log.Fatalf("The %s step failed: %v", step.name, err)
+		}
+		log.Printf("The %s step passed", step.name)
+	}
+	fmt.Println("The spool kept all the lines.")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkOutage is a helper function to publish the lines while the message queue goes down and up again, and to check
+// that every line is received.
+func checkOutage(directory string) error {
+	broker := commonmessageq.NewMemoryBroker(4)
+	subscriber, err := subscribe(broker)
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+
+	flaky := newFlakyPublisher(broker)
+	publisher, err := messageq.NewSpoolPublisher(flaky, directory, maxBytes, checkInterval)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+	go drainDeliveries(publisher)
+
+	total := *keys * *messages
+	for i := 0; i < total; i++ {
+		switch i {
+		case total / 3:
+			flaky.setDown(true)
+		case 2 * total / 3:
+			flaky.setDown(false)
+		}
+		if err := publish(publisher, i); err != nil {
+			return err
+		}
+		if i%100 == 0 {
+			time.Sleep(checkInterval / 10)
+		}
+	}
+
+	if remaining := publisher.Flush(*timeout); remaining > 0 {
+		return fmt.Errorf("%d lines are not delivered", remaining)
+	}
+	receipts, err := receive(subscriber, total)
+	if err != nil {
+		return err
+	}
+	if err := expectAll(receipts, total, false); err != nil {
+		return err
+	}
+	return expectEmpty(directory)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkRestart is a helper function to spool the lines while the message queue is down, and to check that they are
+// delivered in order by the publisher of the next run.
+func checkRestart(directory string) error {
+	broker := commonmessageq.NewMemoryBroker(4)
+	subscriber, err := subscribe(broker)
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+
+	flaky := newFlakyPublisher(broker)
+	flaky.setDown(true)
+	publisher, err := messageq.NewSpoolPublisher(flaky, directory, maxBytes, checkInterval)
+	if err != nil {
+		return err
+	}
+	go drainDeliveries(publisher)
+
+	// Wait for the spool to notice the outage, so that every line is spooled in order.
+	time.Sleep(5 * checkInterval)
+	total := *keys * *messages
+	for i := 0; i < total; i++ {
+		if err := publish(publisher, i); err != nil {
+			return err
+		}
+	}
+	if remaining := publisher.Len(); remaining != total {
+		return fmt.Errorf("%d lines are spooled, expected %d", remaining, total)
+	}
+	publisher.Close()
+
+	// A crash while writing a line leaves a partial line at the end of the last segment file.
+	segments, err := filepath.Glob(filepath.Join(directory, "*.spool"))
+	if err != nil || len(segments) == 0 {
+		return fmt.Errorf("no segment file in the spool: %v", err)
+	}
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	file.Write([]byte{0, 0, 1, 0, 42})
+	file.Close()
+
+	// The next run drains the spool once the message queue is up.
+	publisher, err = messageq.NewSpoolPublisher(newFlakyPublisher(broker), directory, maxBytes, checkInterval)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+	go drainDeliveries(publisher)
+
+	if remaining := publisher.Flush(*timeout); remaining > 0 {
+		return fmt.Errorf("%d lines are not delivered", remaining)
+	}
+	receipts, err := receive(subscriber, total)
+	if err != nil {
+		return err
+	}
+	if err := expectAll(receipts, total, true); err != nil {
+		return err
+	}
+	return expectEmpty(directory)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkFull is a helper function to check that a full spool makes Publish report the full queue until it is drained.
+func checkFull(directory string) error {
+	broker := commonmessageq.NewMemoryBroker(4)
+	subscriber, err := subscribe(broker)
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+
+	flaky := newFlakyPublisher(broker)
+	flaky.setDown(true)
+	publisher, err := messageq.NewSpoolPublisher(flaky, directory, 16<<10, checkInterval)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+	go drainDeliveries(publisher)
+	time.Sleep(5 * checkInterval)
+
+	spooled := 0
+	for ; ; spooled++ {
+		err := publish(publisher, spooled)
+		if err == commonmessageq.ErrQueueFull {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if spooled > 1000 {
+			return errors.New("the spool is never full")
+		}
+	}
+
+	flaky.setDown(false)
+	if remaining := publisher.Flush(*timeout); remaining > 0 {
+		return fmt.Errorf("%d lines are not delivered", remaining)
+	}
+	if err := publish(publisher, spooled); err != nil {
+		return fmt.Errorf("failed to publish after the spool was drained: %w", err)
+	}
+	if remaining := publisher.Flush(*timeout); remaining > 0 {
+		return fmt.Errorf("%d lines are not delivered", remaining)
+	}
+
+	receipts, err := receive(subscriber, spooled+1)
+	if err != nil {
+		return err
+	}
+	return expectAll(receipts, spooled+1, true)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// newFlakyPublisher is a helper function to return a new publisher of the broker, which is up.
+func newFlakyPublisher(broker *commonmessageq.MemoryBroker) *flakyPublisher {
+	publisher := &flakyPublisher{
+		publisher:  broker.NewPublisher(),
+		failures:   make(chan *commonmessageq.Message, 1000000),
+		deliveries: make(chan commonmessageq.Delivery),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for delivery := range publisher.publisher.Deliveries() {
+			publisher.deliveries <- delivery
+			atomic.AddInt64(&publisher.pending, -1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for message := range publisher.failures {
+			publisher.deliveries <- commonmessageq.Delivery{Message: message, Err: errDown}
+			atomic.AddInt64(&publisher.pending, -1)
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(publisher.deliveries)
+	}()
+	return publisher
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setDown takes the message queue down or up.
+func (publisher *flakyPublisher) setDown(down bool) {
+	value := int32(0)
+	if down {
+		value = 1
+	}
+	atomic.StoreInt32(&publisher.down, value)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Publish implements Publisher. The delivery of the line fails while the message queue is down.
+func (publisher *flakyPublisher) Publish(message *commonmessageq.Message) error {
+	atomic.AddInt64(&publisher.pending, 1)
+	if atomic.LoadInt32(&publisher.down) != 0 {
+		publisher.failures <- message
+		return nil
+	}
+	if err := publisher.publisher.Publish(message); err != nil {
+		atomic.AddInt64(&publisher.pending, -1)
+		return err
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Deliveries implements Publisher.
+func (publisher *flakyPublisher) Deliveries() <-chan commonmessageq.Delivery {
+	return publisher.deliveries
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Flush implements Publisher.
+func (publisher *flakyPublisher) Flush(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for publisher.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return publisher.Len()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Len implements Publisher.
+func (publisher *flakyPublisher) Len() int {
+	return int(atomic.LoadInt64(&publisher.pending))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping implements Publisher. It fails while the message queue is down.
+func (publisher *flakyPublisher) Ping(ctx context.Context) error {
+	if atomic.LoadInt32(&publisher.down) != 0 {
+		return errDown
+	}
+	return publisher.publisher.Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Close implements Publisher.
+func (publisher *flakyPublisher) Close() {
+	publisher.publisher.Close()
+	close(publisher.failures)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// subscribe is a helper function to return a subscriber of the topic. It subscribes before the lines are published,
+// so that the broker keeps them.
+func subscribe(broker *commonmessageq.MemoryBroker) (commonmessageq.Subscriber, error) {
+	subscriber := broker.NewSubscriber("spool-test")
+	if err := subscriber.Subscribe(topic); err != nil {
+		return nil, err
+	}
+	return subscriber, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// publish is a helper function to publish the line of the index. The lines are spread over the keys, and numbered in
+// order per key.
+func publish(publisher commonmessageq.Publisher, index int) error {
+	key := fmt.Sprintf("key-%d", index%*keys)
+	return publisher.Publish(&commonmessageq.Message{
+		Topic:   topic,
+		Key:     []byte(key),
+		Value:   []byte(fmt.Sprintf("%s - %d", key, index / *keys)),
+		Headers: map[string]string{},
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// drainDeliveries is a helper function to drain the deliveries of the publisher, like the log-processor does. Every
+// reported delivery must be successful since the spool retries the failed ones.
+func drainDeliveries(publisher commonmessageq.Publisher) {
+	for delivery := range publisher.Deliveries() {
+		if delivery.Err != nil {
+			log.Fatalf("The delivery of a line failed: %v", delivery.Err)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// receive is a helper function to receive the lines until the count of distinct lines is reached, or no line arrives
+// within a second.
+func receive(subscriber commonmessageq.Subscriber, count int) ([]receipt, error) {
+	var receipts []receipt
+	distinct := map[receipt]bool{}
+	for len(distinct) < count {
+		message, err := subscriber.Receive(time.Second)
+		if err == commonmessageq.ErrTimeout {
+			return nil, fmt.Errorf("received %d of %d lines", len(distinct), count)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var line receipt
+		if _, err := fmt.Sscanf(string(message.Value), "%s - %d", &line.key, &line.sequence); err != nil {
+			return nil, fmt.Errorf("unexpected line %q", message.Value)
+		}
+		receipts = append(receipts, line)
+		distinct[line] = true
+	}
+	return receipts, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expectAll is a helper function to check that all the lines are received. With ordered, the lines of every key must
+// be received exactly once and in order.
+func expectAll(receipts []receipt, count int, ordered bool) error {
+	distinct := map[receipt]bool{}
+	next := map[string]int{}
+	for _, line := range receipts {
+		distinct[line] = true
+		if ordered {
+			if line.sequence != next[line.key] {
+				return fmt.Errorf("received %s %d, expected %d", line.key, line.sequence, next[line.key])
+			}
+			next[line.key]++
+		}
+	}
+	if len(distinct) != count {
+		return fmt.Errorf("received %d distinct lines, expected %d", len(distinct), count)
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expectEmpty is a helper function to check that the drained spool has no segment file left.
+func expectEmpty(directory string) error {
+	segments, err := filepath.Glob(filepath.Join(directory, "*.spool"))
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		return fmt.Errorf("the drained spool still has %d segment files", len(segments))
+	}
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,120 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the log-subscriber as a library.
+//
+// The service is wired by cmd/main.go with kafka consumers. The packages of the service are internal, so Start is the
+// entry point for the processes which run the log-subscriber on another transport, for example the standalone command
+// which runs all the services in one process on the in-memory transport of messageq in the common module.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/health"
+	"common/messageq"
+	commonmetrics "common/metrics"
+	"common/secrets"
+
+	"logworker/internal/config"
+	"logworker/internal/metrics"
+	"logworker/internal/workers"
+)
+
+// Start starts the file worker on the file subscriber and the stats worker on the stats subscriber. The workers run
+// until the context is cancelled. Their health checks are registered with the checker and the reloaded extraction
+// rules are applied by the stats worker.
+func Start(ctx context.Context, conf *viper.Viper, secretStore *secrets.Store, fileSubscriber,
+	statsSubscriber messageq.Subscriber, checker *health.Checker, reloader *configutil.Reloader) error {
+	// Clean up any old sanitized log files directory.
+	if err := mayBeDeleteOldSanitizedDir(conf); err != nil {
+		return err
+	}
+
+	// The service is ready only when the sanitized logs can be written.
+	checker.AddReadinessCheck("sanitized_logs_directory",
+		health.WritableDirCheck(conf.GetString(config.KSanitizedLogsDirectory)))
+
+	// Export the consumer lag of both the subscribers.
+	go commonmetrics.MonitorConsumerLag(ctx, metrics.ConsumerLag, metrics.WorkerFile, fileSubscriber)
+	go commonmetrics.MonitorConsumerLag(ctx, metrics.ConsumerLag, metrics.WorkerStats, statsSubscriber)
+
+	// Create file worker.
+	fileWorker := workers.NewFileWorker(conf, fileSubscriber)
+	go func() {
+		err := fileWorker.Start(ctx)
+		if err != nil {
+			glog.Fatalf("File worker error: %v", err)
+		}
+	}()
+
+	// Create stats worker.
+	statsWorker, err := workers.NewStatsWorker(conf, statsSubscriber, secretStore)
+	if err != nil {
+		return fmt.Errorf("failed to create stats worker: %w", err)
+	}
+	checker.AddReadinessCheck("storage", statsWorker.Ping)
+	checker.AddReadinessCheck("storage_circuit_breaker", statsWorker.CheckCircuitBreaker)
+	go func() {
+		err := statsWorker.Start(ctx)
+		if err != nil {
+			glog.Fatalf("Stats worker error: %v", err)
+		}
+	}()
+
+	// A worker which stops beating its heartbeat is stuck.
+	heartbeatTimeout := time.Duration(conf.GetInt(config.KHeartbeatTimeoutSeconds)) * time.Second
+	checker.AddLivenessCheck("file_worker", fileWorker.Heartbeat().Check(heartbeatTimeout))
+	checker.AddLivenessCheck("stats_worker", statsWorker.Heartbeat().Check(heartbeatTimeout))
+
+	// Apply the changes of the extraction rules without a restart.
+	reloader.OnReload(statsWorker.Reload)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// LoadConfiguration loads the configuration file of the log-subscriber with the overrides of the environment variables.
+// The returned Reloader reloads the same file. Please refer to config.LoadFile.
+func LoadConfiguration(file string) (*viper.Viper, *configutil.Reloader, error) {
+	return config.LoadFile(file)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// mayBeDeleteOldSanitizedDir is a helper function to delete the old sanitized directory if exists.
+func mayBeDeleteOldSanitizedDir(conf *viper.Viper) error {
+	// Retrieve the directory path from sanitized log directory. This can contain output from previous runs.
+	dirPath := conf.GetString(config.KSanitizedLogsDirectory)
+
+	// Check if the directory exists.
+	_, err := os.Stat(dirPath)
+	if os.IsNotExist(err) {
+		// Directory does not exist, no action needed.
+		glog.Infoln("The sanitized directory does not exist")
+		return nil
+	}
+
+	// Delete the directory and its contents.
+	err = os.RemoveAll(dirPath)
+	if err != nil {
+		// Handle the error if deletion fails
+		msg := fmt.Sprintf("Failed to delete directory: %v\n", err)
+		return fmt.Errorf(msg)
+	}
+
+	// Directory successfully deleted.
+	glog.Infoln("Directory deleted:", dirPath)
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -16,23 +16,25 @@ package main
 
 import (
 	"context"
-	"flag"
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/golang/glog"
-	"github.com/spf13/viper"
 
+	"common/configutil"
+	"common/dbutil"
+	"common/health"
+	"common/logging"
+	"common/messageq"
+	commontracing "common/tracing"
+	"logworker/app"
 	"logworker/internal/config"
-	"logworker/internal/messageq"
-	"logworker/internal/workers"
+	"logworker/internal/tracing"
 )
 
 func init() {
-	flag.Parse()
-	flag.Set("logtostderr", "true")
+	logging.Init()
 }
 
 func main() {
@@ -46,46 +48,62 @@ func main() {
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// Step (2): Load the configuration.
 	conf := config.LoadConfiguration()
+	glog.Infof("Loaded configuration: %v", config.RedactedSettings(conf))
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Step (3): Clean up any old sanitized log files directory.
-	if err := mayBeDeleteOldSanitizedDir(conf); err != nil {
-		glog.Fatalf(err.Error())
+	// Resolve the credentials from their sources. Please refer to secrets/secrets.go in the common module.
+	secretStore, err := configutil.NewSecretStore(context.Background(), conf, dbutil.SecretRefs(conf),
+		messageq.SecretRefs(conf))
+	if err != nil {
+		glog.Fatalf("Failed to resolve the secrets: %v", err)
 	}
 
+	// Install the tracer provider. The pending spans are flushed when the process exits.
+	shutdownTracing, err := commontracing.Init(conf, tracing.ServiceName)
+	if err != nil {
+		glog.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Start the http server for the operational endpoints like /metrics. The health checks are registered below as
+	// the dependencies are created.
+	checker := health.NewChecker()
+	go health.StartServer(conf, checker)
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Step (4): Create all the kafka consumers.
-	// Create Kafka consumer for file worker
-	fileConsumer := messageq.CreateKafkaConsumer(conf, "file-consumer-group-id")
-	defer fileConsumer.Close()
+	// Step (3): Create all the subscribers on the transport of the configuration.
+	// Create the subscriber for file worker
+	fileSubscriber, err := messageq.NewSubscriber(conf, secretStore, "file-consumer-group-id")
+	if err != nil {
+		glog.Fatalf("Failed to create the file consumer: %v", err)
+	}
+	defer fileSubscriber.Close()
+
+	// Create the subscriber for stats worker
+	statsSubscriber, err := messageq.NewSubscriber(conf, secretStore, "stats-consumer-group-id")
+	if err != nil {
+		glog.Fatalf("Failed to create the stats consumer: %v", err)
+	}
+	defer statsSubscriber.Close()
 
-	// Create Kafka consumer for stats worker
-	statsConsumer := messageq.CreateKafkaConsumer(conf, "stats-consumer-group-id")
-	defer statsConsumer.Close()
+	// The service is ready only when the message queue is reachable.
+	checker.AddReadinessCheck(conf.GetString(configutil.KTransport), statsSubscriber.Ping)
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Step (4): Create all the workers which process log statements from kafka.
+	// Step (4): Create all the workers which process log statements from the message queue. Please refer to app/app.go.
 
 	// Create context for graceful shutdown.
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Create file worker.
-	fileWorker := workers.NewFileWorker(conf, fileConsumer)
-	go func() {
-		err := fileWorker.Start(ctx)
-		if err != nil {
-			glog.Fatalf("File worker error: %v", err)
-		}
-	}()
-
-	// Create stats worker.
-	statsWorker := workers.NewStatsWorker(conf, statsConsumer)
-	go func() {
-		err := statsWorker.Start(ctx)
-		if err != nil {
-			glog.Fatalf("Stats worker error: %v", err)
-		}
-	}()
+	// Pick up the rotated credentials without a restart.
+	go secretStore.RefreshPeriodically(ctx, conf.GetDuration(configutil.KSecretsRefreshInterval))
+
+	// Apply the changes of the log levels and the extraction rules without a restart.
+	reloader := config.NewReloader(conf)
+	go reloader.Run(ctx)
+
+	if err := app.Start(ctx, conf, secretStore, fileSubscriber, statsSubscriber, checker, reloader); err != nil {
+		glog.Fatalf(err.Error())
+	}
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -100,31 +118,3 @@ func main() {
 }
 
 //----------------------------------------------------------------------------------------------------------------------
-
-// mayBeDeleteOldSanitizedDir is a helper function to delete the old sanitized directory if exists.
-func mayBeDeleteOldSanitizedDir(conf *viper.Viper) error {
-	// Retrieve the directory path from sanitized log directory. This can contain output from previous runs.
-	dirPath := conf.GetString(config.KSanitizedLogsDirectory)
-
-	// Check if the directory exists.
-	_, err := os.Stat(dirPath)
-	if os.IsNotExist(err) {
-		// Directory does not exist, no action needed.
-		glog.Infoln("The sanitized directory does not exist")
-		return nil
-	}
-
-	// Delete the directory and its contents.
-	err = os.RemoveAll(dirPath)
-	if err != nil {
-		// Handle the error if deletion fails
-		msg := fmt.Sprintf("Failed to delete directory: %v\n", err)
-		return fmt.Errorf(msg)
-	}
-
-	// Directory successfully deleted.
-	glog.Infoln("Directory deleted:", dirPath)
-	return nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
@@ -9,11 +9,13 @@
 // needing to recompile the code. We do not use helm in this excercise. But this pattern is extensible.
 //
 // The file contains a method called LoadConfiguration() which will load all the configuration represented in the
-// defaults.yaml and creates a golang object for that. This will be passed into all the other functions/classes in this
+// defaults.yaml, overridden by the environment variables and the command line flags, validates it against the Schema
+// and creates a golang object for that. This will be passed into all the other functions/classes in this
 // microservice and this object will be a single place where all the configuration is all maintained.
 //
-// The file also creates constants like "KTopic" which represents the key in defaults.yaml which represents the kafka
-// topic name.
+// The file also creates constants like "KLogsDirectory" which represents the key in defaults.yaml which represents the
+// directory of the logs. The keys of the blocks shared by the services, like "KTopic" for the kafka topic name, are
+// declared in configutil/keys.go in the common module.
 //
 // Any other package in this microservice, to refer to this configuration, it will simply do the following.
 //
@@ -28,9 +30,14 @@
 package config
 
 import (
-	"fmt"
+	"flag"
 
 	"github.com/spf13/viper"
+
+	"common/configutil"
+	"common/dbutil"
+	"common/logging"
+	"common/messageq"
 )
 
 const (
@@ -48,74 +55,155 @@ const (
 	// sanitized files are written.
 	KSanitizedLogsDirectory = KGroupKeyLogWorker + ".sanitized_logs_directory"
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Kafka related configuration.
-
-	// KGroupKafka is group key for kafka block in defaults.yaml. This is the parent key. All the nested
-	// children in this group can be referenced with this group key. For example defaults.yaml has something like this.
-	// kafka:
-	//  topic: "processor-messages"
-	// To access the topic key it can be accessed as
-	KGroupKafka = "kafka"
-
-	// KBootstrapServers is a nested key under the group key KGroupKafka to obtain the kafka boostrap servers.
-	KBootstrapServers = KGroupKafka + ".bootstrap_servers"
-
-	// KTopic is a nested key under the group key KTopic to obtain the kafka topic name.
-	KTopic = KGroupKafka + ".topic"
+	// KExtractionRules is a nested key under the group KGroupKeyLogWorker to obtain the list of field extraction rules
+	// applied by the stats worker. Each rule has a name and a pattern.
+	KExtractionRules = KGroupKeyLogWorker + ".extraction_rules"
+
+	// KGroupTemplateMining is a nested group under the group KGroupKeyLogWorker for the log template miner. For
+	// example defaults.yaml has something like this.
+	// logsubscriber:
+	//   template_mining:
+	//     depth: 4
+	KGroupTemplateMining = KGroupKeyLogWorker + ".template_mining"
+
+	// KTemplateDepth is a nested key under the group KGroupTemplateMining to obtain the depth of the prefix tree.
+	KTemplateDepth = KGroupTemplateMining + ".depth"
+
+	// KTemplateSimilarityThreshold is a nested key under the group KGroupTemplateMining to obtain the minimum
+	// similarity for a message to belong to an existing template.
+	KTemplateSimilarityThreshold = KGroupTemplateMining + ".similarity_threshold"
+
+	// KTemplateMaxChildren is a nested key under the group KGroupTemplateMining to obtain the maximum number of
+	// children per node of the prefix tree.
+	KTemplateMaxChildren = KGroupTemplateMining + ".max_children"
+
+	// KGroupPartitions is a nested group under the group KGroupKeyLogWorker for the maintenance of the daily
+	// partitions of the log_lines table. For example defaults.yaml has something like this.
+	// logsubscriber:
+	//   partitions:
+	//     premake_days: 3
+	//     retention_days: 0
+	//     maintenance_interval: 1h
+	KGroupPartitions = KGroupKeyLogWorker + ".partitions"
+
+	// KPartitionsPremakeDays is a nested key under the group KGroupPartitions to obtain the number of days ahead of
+	// today for which the partitions are created.
+	KPartitionsPremakeDays = KGroupPartitions + ".premake_days"
+
+	// KPartitionsRetentionDays is a nested key under the group KGroupPartitions to obtain the number of days after
+	// which a partition is dropped. Zero keeps the partitions forever.
+	KPartitionsRetentionDays = KGroupPartitions + ".retention_days"
+
+	// KPartitionsMaintenanceInterval is a nested key under the group KGroupPartitions to obtain the interval between
+	// two runs of the partition maintenance.
+	KPartitionsMaintenanceInterval = KGroupPartitions + ".maintenance_interval"
+
+	// KGroupCircuitBreaker is a nested group under the group KGroupKeyLogWorker for the circuit breaker which pauses
+	// the stats worker while the storage is down. For example defaults.yaml has something like this.
+	// logsubscriber:
+	//   circuit_breaker:
+	//     initial_backoff: 1s
+	//     max_backoff: 1m
+	KGroupCircuitBreaker = KGroupKeyLogWorker + ".circuit_breaker"
+
+	// KCircuitBreakerInitialBackoff is a nested key under the group KGroupCircuitBreaker to obtain the time before the
+	// first retry of a failed write. The time doubles after every failed retry.
+	KCircuitBreakerInitialBackoff = KGroupCircuitBreaker + ".initial_backoff"
+
+	// KCircuitBreakerMaxBackoff is a nested key under the group KGroupCircuitBreaker to obtain the maximum time between
+	// two retries.
+	KCircuitBreakerMaxBackoff = KGroupCircuitBreaker + ".max_backoff"
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Database related configuration
+	// The keys of the blocks shared by the services are declared in configutil/keys.go in the common module. The
+	// keys below are nested in those blocks but only used by the log-subscriber.
 
-	// KGroupDatabase is group key for db block in defaults.yaml. This is the parent key. All the nested
-	// children in this group can be referenced with this group key. For example defaults.yaml has something like this.
-	// db:
-	//   host: postgres
-	//   port: 5432
-	//   username: suresh
-	//   password: suresh
-	//   database: olap
-	KGroupDatabase = "db"
-
-	// KHost is a nested key under the group key KGroupDatabase to obtain the hostname for the postgres database.
-	KHost = KGroupDatabase + ".host"
-
-	// KPort is a nested key under the group key KGroupDatabase to obtain the portname for the postgres database.
-	KPort = KGroupDatabase + ".port"
-
-	// KUsername is a nested key under the group key KGroupDatabase to obtain the username to connect to the postgres
-	// database.
-	KUsername = KGroupDatabase + ".username"
-
-	// KPassword is a nested key under the group key KGroupDatabase to obtain the password to connect to the postgres
-	// database.
-	KPassword = KGroupDatabase + ".password"
-
-	// KDatabaseName is a nested key under the group key KGroupDatabase to obtain the database name to connect to the postgres
-	// database.
-	KDatabaseName = KGroupDatabase + ".database"
+	// KHeartbeatTimeoutSeconds is a nested key under the group key KGroupHttpServer to obtain the time after which a
+	// worker without a heartbeat is considered stuck by the liveness check.
+	KHeartbeatTimeoutSeconds = configutil.KGroupHttpServer + ".heartbeat_timeout_seconds"
+
+	// KClickHouseAsyncInsert is a nested key under the group key KGroupClickHouse to insert the log lines with
+	// async_insert. Please refer to storage/clickhouse.go in the common module for the trade-off.
+	KClickHouseAsyncInsert = configutil.KGroupClickHouse + ".async_insert"
 )
 
-// LoadConfiguration is a helper function to load the configuration present in defaults.yaml. This will be loaded
-// to a config object which then can be passed around(injected) to all the structs/classes to read the global
-// configuration.
+// envPrefix is the prefix of the environment variables which override the configuration, for example
+// LOGSUBSCRIBER_DB_HOST.
+const envPrefix = "LOGSUBSCRIBER"
+
+// Schema describes the keys of the configuration. The configuration is validated against it on startup and on every
+// reload. Only the Mutable keys are applied by a reload. Please refer to configutil/schema.go in the common module.
+var Schema = configutil.Merge(configutil.Schema{
+	configutil.String(KLogsDirectory).Required(),
+	configutil.String(KSanitizedLogsDirectory).Required(),
+	configutil.List(KExtractionRules).Mutable(),
+	configutil.Int(KTemplateDepth).AtLeast(1),
+	configutil.Float(KTemplateSimilarityThreshold).Between(0, 1),
+	configutil.Int(KTemplateMaxChildren).AtLeast(1),
+	configutil.Int(KPartitionsPremakeDays).AtLeast(0),
+	configutil.Int(KPartitionsRetentionDays).AtLeast(0),
+	configutil.Duration(KPartitionsMaintenanceInterval).DurationAtLeast(0),
+	configutil.Duration(KCircuitBreakerInitialBackoff).DurationAtLeast(0),
+	configutil.Duration(KCircuitBreakerMaxBackoff).DurationAtLeast(0),
+	configutil.Int(KHeartbeatTimeoutSeconds).Required().AtLeast(1),
+	configutil.Bool(KClickHouseAsyncInsert),
+}, messageq.Schema, configutil.KafkaSchema, configutil.HttpServerSchema, dbutil.DatabaseSchema, dbutil.StorageSchema,
+	configutil.SecretsSchema, configutil.LoggingSchema, configutil.TracingSchema)
+
+// flags are the command line flags of the configuration. Please refer to configutil/load.go in the common module.
+var flags = configutil.RegisterFlags(flag.CommandLine)
+
+// LoadConfiguration is a helper function to load the configuration present in defaults.yaml, with the overrides of the
+// environment variables and of the -set flags. This will be loaded to a config object which then can be passed
+// around(injected) to all the structs/classes to read the global configuration.
+//
+// The service exits with all the problems of the configuration if it does not match the Schema. With -print-config
+// the effective configuration is printed, with the secrets masked, and the service exits.
 func LoadConfiguration() *viper.Viper {
+	conf := configutil.MustLoad(Schema, envPrefix, flags)
+	logging.Apply(conf)
+
+	// At this point all the configuration present in defaults.yaml will be loaded into the config object.
+	return conf
+}
 
-	// Create a new Viper instance.
-	config := viper.New()
+//----------------------------------------------------------------------------------------------------------------------
+
+// NewReloader returns the Reloader of the configuration loaded by LoadConfiguration. The log levels are applied on
+// every reload, the other mutable keys by the watchers registered by their owners. Please refer to
+// configutil/reload.go in the common module.
+func NewReloader(conf *viper.Viper) *configutil.Reloader {
+	return newReloader(conf, flags)
+}
 
-	// Initialize Viper config
-	config.SetConfigName("defaults")
-	config.SetConfigType("yaml")
-	config.AddConfigPath(".")
+//----------------------------------------------------------------------------------------------------------------------
 
-	// Read the configuration file.
-	if err := config.ReadInConfig(); err != nil {
-		panic(fmt.Sprintf("failed to read config file: %v", err))
+// LoadFile loads the configuration file with the overrides of the environment variables, but not of the command line
+// flags. It is used when the log-subscriber runs in another process, for example the standalone command, which has
+// flags of its own. The returned Reloader reloads the same file.
+func LoadFile(file string) (*viper.Viper, *configutil.Reloader, error) {
+	fileFlags := &configutil.Flags{File: file}
+	conf, err := configutil.Load(Schema, envPrefix, fileFlags)
+	if err != nil {
+		return nil, nil, err
 	}
+	return conf, newReloader(conf, fileFlags), nil
+}
 
-	// At this point all the configuration present in defaults.yaml will be loaded into the config object.
-	return config
+//----------------------------------------------------------------------------------------------------------------------
+
+// newReloader is a helper function to create the Reloader of the configuration loaded with the flags.
+func newReloader(conf *viper.Viper, flags *configutil.Flags) *configutil.Reloader {
+	reloader := configutil.NewReloader(conf, Schema, envPrefix, flags)
+	reloader.OnReload(logging.Apply)
+	return reloader
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// RedactedSettings returns all the settings of the configuration with the secrets redacted, for logging.
+func RedactedSettings(conf *viper.Viper) map[string]interface{} {
+	return configutil.Redacted(conf, Schema)
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -4,53 +4,94 @@
 //
 // This file contains db related struct methods, constructors and utils.
 //
-// GO-PG is an ORM tool to interact with postgres SQL. It can be thought of as hibernate equivalent.
+// The connections to the storage backends are set up by dbutil in the common module. The stats worker writes through
+// the storage.Writer of the backend selected in the configuration. Please refer to storage/storage.go in the common
+// module for more details.
 
 package db
 
 import (
+	"context"
 	"fmt"
+	"time"
 
-	"github.com/go-pg/pg/v10"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
 
+	"common/configutil"
+	"common/dbutil"
+	"common/secrets"
+	"common/storage"
+
 	"logworker/internal/config"
+	"logworker/internal/metrics"
 )
 
-type Config struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	Database string
+// NewWriter returns the storage.Writer of the backend selected in the configuration. The credentials are obtained from
+// the secret store.
+func NewWriter(conf *viper.Viper, secretStore *secrets.Store) (storage.Writer, error) {
+	backend := conf.GetString(configutil.KStorageBackend)
+	glog.Infoln("Using storage backend", backend)
+
+	switch backend {
+	case storage.BackendPostgres, "":
+		db, err := dbutil.NewPostgres(conf, secretStore)
+		if err != nil {
+			return nil, err
+		}
+		metrics.DBPools.Add("primary", db)
+		return storage.NewRotatingPostgresWriter(db), nil
+	case storage.BackendClickHouse:
+		conn, err := dbutil.NewClickHouse(conf, secretStore)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewClickHouseWriter(conn, conf.GetBool(config.KClickHouseAsyncInsert)), nil
+	case storage.BackendSQLite:
+		db, err := dbutil.NewSQLite(conf)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewSQLiteWriter(db), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage backend: %s", backend)
+	}
 }
 
-// NewDB returns a new instance of go pg DB object. Using this object the postgres queries can be made.
-// Please note that this will also connect to the postgres db.
-func NewDB(conf *viper.Viper) *pg.DB {
-	host := conf.GetString(config.KHost)
-	port := conf.GetInt(config.KPort)
-	username := conf.GetString(config.KUsername)
-	password := conf.GetString(config.KPassword)
-	dbname := conf.GetString(config.KDatabaseName)
-
-	// Printing this information to make sure the config is correctly loaded into the config object.
-	// TODO(SURESH BYSANI): Move this V2 logging to reduce the logging.
-	glog.Infoln("the host", host)
-	glog.Infoln("the port", port)
-	glog.Infoln("the username", username)
-	glog.Infoln("the password", password)
-	glog.Infoln("the dbname", dbname)
-
-	db := pg.Connect(&pg.Options{
-		User:     username,
-		Password: password,
-		Addr:     fmt.Sprintf("%s:%d", host, port),
-		Database: dbname,
-	})
-
-	return db
+//----------------------------------------------------------------------------------------------------------------------
+
+// MaintainPartitions is a helper function which is run as a go routine. It runs the maintenance of the storage right
+// away and then at the configured interval until the context is cancelled. That is creating the daily partitions of
+// log_lines ahead of time and dropping the ones past the retention.
+func MaintainPartitions(ctx context.Context, conf *viper.Viper, writer storage.Writer) {
+	interval := conf.GetDuration(config.KPartitionsMaintenanceInterval)
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	// A retention of zero keeps the partitions forever.
+	policy := storage.RetentionPolicy{
+		PremakeDays: conf.GetInt(config.KPartitionsPremakeDays),
+		Retention:   time.Duration(conf.GetInt(config.KPartitionsRetentionDays)) * 24 * time.Hour,
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writer.Maintain(ctx, time.Now(), policy); err != nil {
+			glog.Errorf("Failed to maintain the log_lines partitions: %v", err)
+			metrics.PartitionMaintenanceRuns.WithLabelValues(metrics.ResultError).Inc()
+		} else {
+			metrics.PartitionMaintenanceRuns.WithLabelValues(metrics.ResultSuccess).Inc()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 //----------------------------------------------------------------------------------------------------------------------
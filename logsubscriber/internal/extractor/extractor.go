@@ -0,0 +1,153 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the field extractor used by the stats worker.
+//
+// The log messages contain useful fields which are otherwise stored as opaque text. For example the message
+// "Starting new HTTPS connection (1): en.wikipedia.org" contains the scheme and the host of an outbound connection.
+//
+// The extraction rules are defined in the defaults.yaml under logsubscriber.extraction_rules. Each rule has a name
+// and a pattern. The pattern is a go regular expression with named groups. Grok style references are also supported
+// and are expanded to the built-in patterns below. For example,
+//
+// extraction_rules:
+//   - name: outbound_connection
+//     pattern: 'Starting new\s+%{WORD:scheme}\s+connection\s+\(%{INT}\):\s+%{HOSTNAME:host}'
+//
+// Every rule is applied to every log message. The named groups of all the matching rules are merged into a single
+// map of attributes. If two rules extract the same field, the rule defined first wins.
+
+package extractor
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/golang/glog"
+	"github.com/spf13/viper"
+
+	"logworker/internal/config"
+)
+
+// grokPatterns is the list of built-in patterns which can be referenced as %{NAME} or %{NAME:field} in a rule.
+var grokPatterns = map[string]string{
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"INT":          `[+-]?\d+`,
+	"NUMBER":       `[+-]?(?:\d+(?:\.\d*)?|\.\d+)`,
+	"HOSTNAME":     `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPV4":         `(?:\d{1,3}\.){3}\d{1,3}`,
+	"IP":           `(?:\d{1,3}\.){3}\d{1,3}|[0-9A-Fa-f:]+:[0-9A-Fa-f:.]+`,
+	"URI":          `[A-Za-z][A-Za-z0-9+.-]*://\S+`,
+	"QUOTEDSTRING": `"(?:[^"\\]|\\.)*"`,
+}
+
+// grokReference matches a %{NAME} or %{NAME:field} reference in a pattern.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+// Rule is a single extraction rule as defined in the defaults.yaml.
+type Rule struct {
+	// Name of the rule. This is only used for logging.
+	Name string `mapstructure:"name"`
+
+	// Pattern is a regular expression with named groups. Grok references are expanded before compiling.
+	Pattern string `mapstructure:"pattern"`
+}
+
+// compiledRule is a rule with its compiled regular expression.
+type compiledRule struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+// Extractor applies the configured extraction rules to the log messages.
+type Extractor struct {
+	rules []compiledRule
+}
+
+// NewExtractor creates a new instance of the Extractor from the extraction rules in the configuration. An error is
+// returned if any of the rules is invalid.
+func NewExtractor(conf *viper.Viper) (*Extractor, error) {
+	var rules []Rule
+	if err := conf.UnmarshalKey(config.KExtractionRules, &rules); err != nil {
+		return nil, fmt.Errorf("failed to read extraction rules: %v", err)
+	}
+
+	return NewExtractorFromRules(rules)
+}
+
+// NewExtractorFromRules creates a new instance of the Extractor from the given rules.
+func NewExtractorFromRules(rules []Rule) (*Extractor, error) {
+	extractor := &Extractor{}
+	for _, rule := range rules {
+		pattern, err := expandGrok(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extraction rule %s: %v", rule.Name, err)
+		}
+
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extraction rule %s: %v", rule.Name, err)
+		}
+
+		extractor.rules = append(extractor.rules, compiledRule{name: rule.Name, regex: regex})
+		glog.Infoln("Loaded extraction rule", rule.Name, "with pattern", pattern)
+	}
+
+	return extractor, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Extract applies all the rules to the message and returns the extracted attributes. nil is returned if no rule
+// matched.
+func (extractor *Extractor) Extract(message string) map[string]string {
+	var attributes map[string]string
+
+	for _, rule := range extractor.rules {
+		match := rule.regex.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+
+		for i, field := range rule.regex.SubexpNames() {
+			if field == "" || match[i] == "" {
+				continue
+			}
+			if attributes == nil {
+				attributes = make(map[string]string)
+			}
+			if _, ok := attributes[field]; !ok {
+				attributes[field] = match[i]
+			}
+		}
+	}
+
+	return attributes
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// expandGrok is a helper function to replace the grok references in the pattern with the built-in patterns.
+func expandGrok(pattern string) (string, error) {
+	var err error
+	expanded := grokReference.ReplaceAllStringFunc(pattern, func(reference string) string {
+		parts := grokReference.FindStringSubmatch(reference)
+		builtin, ok := grokPatterns[parts[1]]
+		if !ok {
+			err = fmt.Errorf("unknown grok pattern %s", parts[1])
+			return reference
+		}
+		if parts[2] == "" {
+			return "(?:" + builtin + ")"
+		}
+		return "(?P<" + parts[2] + ">" + builtin + ")"
+	})
+
+	return expanded, err
+}
+
+//----------------------------------------------------------------------------------------------------------------------
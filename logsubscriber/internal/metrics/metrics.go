@@ -0,0 +1,110 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the prometheus metrics exported by the log-subscriber.
+//
+// All the metrics are prefixed with the service name. The labels are consistent across the three services. For example
+// the kafka topic is always labelled as "topic" and the worker is labelled as "worker".
+//
+// The metrics are served on the /metrics endpoint of the http server in the web package.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	commonmetrics "common/metrics"
+)
+
+const (
+	// namespace is the prefix of all the metrics exported by the log-subscriber.
+	namespace = "logsubscriber"
+
+	// WorkerFile is the label value of the file worker.
+	WorkerFile = "file"
+
+	// WorkerStats is the label value of the stats worker.
+	WorkerStats = "stats"
+
+	// ResultSuccess is the label value of a successful operation.
+	ResultSuccess = "success"
+
+	// ResultError is the label value of a failed operation.
+	ResultError = "error"
+
+	// BreakerStorage is the label value of the circuit breaker of the storage of the stats worker.
+	BreakerStorage = "storage"
+)
+
+var (
+	// MessagesConsumed is the number of messages consumed from kafka per worker.
+	MessagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Number of messages consumed from kafka.",
+	}, []string{"worker", "topic"})
+
+	// ProcessingDuration is the time taken by a worker to process a single message.
+	ProcessingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "processing_duration_seconds",
+		Help:      "Time taken to process a single message.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"worker"})
+
+	// DBInsertDuration is the time taken by the transaction which inserts a log line and updates the rollups.
+	DBInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_insert_duration_seconds",
+		Help:      "Time taken to insert a single log line into postgres.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"worker", "result"})
+
+	// FileWrites is the number of log lines written to the sanitized files.
+	FileWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "file_writes_total",
+		Help:      "Number of log lines written to the sanitized files.",
+	}, []string{"result"})
+
+	// ConsumerLag is the number of messages between the position of the consumer and the end of the partition. It is
+	// refreshed by metrics.MonitorConsumerLag in the common module.
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag",
+		Help:      "Number of messages the consumer is behind the end of the partition.",
+	}, []string{"worker", "topic", "partition"})
+
+	// PartitionMaintenanceRuns is the number of runs of the maintenance of the log_lines partitions.
+	PartitionMaintenanceRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "partition_maintenance_runs_total",
+		Help:      "Number of runs of the maintenance of the log_lines partitions.",
+	}, []string{"result"})
+
+	// CircuitBreakerState is 1 for the current state of a circuit breaker, closed, open or half_open, and 0 for the
+	// other states.
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "Current state of the circuit breaker, 1 for the current state.",
+	}, []string{"breaker", "state"})
+
+	// CircuitBreakerRetries is the number of retries of a circuit breaker which is not closed.
+	CircuitBreakerRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_retries_total",
+		Help:      "Number of retries while the circuit breaker is not closed.",
+	}, []string{"breaker", "result"})
+
+	// DBPools exports the statistics of the postgres connection pool.
+	DBPools = commonmetrics.NewPoolCollector(namespace)
+)
+
+func init() {
+	prometheus.MustRegister(DBPools)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
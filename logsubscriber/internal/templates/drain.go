@@ -0,0 +1,297 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains an online log template miner based on the Drain algorithm.
+//
+// Reference: "Drain: An Online Log Parsing Approach with Fixed Depth Tree" (He et al., ICWS 2017).
+//
+// The logs are dominated by a few message shapes with variable parts. For example,
+//
+//     Starting new HTTPS connection (1): en.wikipedia.org
+//     Starting new HTTPS connection (2): www.google.com
+//
+// belong to the template "Starting new HTTPS connection <*> <*>".
+//
+// At a high-level the miner does the following for every message.
+//
+// 1. Split the message into tokens on white space.
+// 2. Walk a fixed depth prefix tree. The first level of the tree is the number of tokens. The next "depth - 2" levels
+//    are the leading tokens of the message. Tokens with digits are very likely variables, so they are routed to the
+//    wildcard "<*>" child. The number of children of a node is bounded by max_children, after which the wildcard
+//    child is used.
+// 3. The leaf of the tree holds a small list of templates. The template with the highest similarity to the message is
+//    picked. If the similarity is above the similarity threshold the message belongs to the template and the tokens
+//    which differ are replaced with "<*>". Otherwise a new template is created.
+//
+// The miner is purely in memory. The stats worker persists the templates in postgres and seeds the miner with the
+// persisted templates on startup so that the template ids are stable across restarts. Match does not change the miner,
+// the new or merged template is committed only once it is persisted, so that a failed write leaves the miner as is.
+
+package templates
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/spf13/viper"
+
+	"logworker/internal/config"
+)
+
+// Wildcard is the token which represents the variable part of a template.
+const Wildcard = "<*>"
+
+const (
+	// defaultDepth is the depth of the prefix tree when it is not configured.
+	defaultDepth = 4
+
+	// defaultSimilarityThreshold is the similarity threshold when it is not configured.
+	defaultSimilarityThreshold = 0.4
+
+	// defaultMaxChildren is the maximum number of children per node when it is not configured.
+	defaultMaxChildren = 100
+)
+
+// Template is a single cluster of messages.
+type Template struct {
+	// ID is the id of the template in postgres. It is zero until the template is persisted.
+	ID int64
+
+	// Tokens of the template. The variable parts are represented by Wildcard.
+	Tokens []string
+
+	// leaf is the leaf of the prefix tree of the matched message, and base the template of the miner which the message
+	// is merged into, nil for a new template. They are set on the templates returned by Match, for Commit.
+	leaf *node
+	base *Template
+}
+
+// String returns the template text.
+func (template *Template) String() string {
+	return strings.Join(template.Tokens, " ")
+}
+
+// node is a node of the prefix tree.
+type node struct {
+	children  map[string]*node
+	templates []*Template
+}
+
+// Miner clusters the messages into templates.
+type Miner struct {
+	// Guards all the fields below.
+	mutex sync.Mutex
+
+	// The root of the prefix tree. The children of the root are keyed by the number of tokens.
+	root *node
+
+	// depth is the depth of the prefix tree including the root and the leaf.
+	depth int
+
+	// similarityThreshold is the minimum similarity for a message to belong to a template.
+	similarityThreshold float64
+
+	// maxChildren is the maximum number of children of a node.
+	maxChildren int
+}
+
+// NewMiner creates a new instance of the Miner from the template mining configuration.
+func NewMiner(conf *viper.Viper) *Miner {
+	miner := &Miner{
+		root:                &node{children: make(map[string]*node)},
+		depth:               defaultDepth,
+		similarityThreshold: defaultSimilarityThreshold,
+		maxChildren:         defaultMaxChildren,
+	}
+
+	if conf.IsSet(config.KTemplateDepth) {
+		miner.depth = conf.GetInt(config.KTemplateDepth)
+	}
+	if conf.IsSet(config.KTemplateSimilarityThreshold) {
+		miner.similarityThreshold = conf.GetFloat64(config.KTemplateSimilarityThreshold)
+	}
+	if conf.IsSet(config.KTemplateMaxChildren) {
+		miner.maxChildren = conf.GetInt(config.KTemplateMaxChildren)
+	}
+
+	// The tree needs at least the root, the token count level and the leaf.
+	if miner.depth < 3 {
+		miner.depth = 3
+	}
+
+	return miner
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Add adds an already known template to the miner. This is used to seed the miner with the persisted templates.
+func (miner *Miner) Add(id int64, template string) {
+	miner.mutex.Lock()
+	defer miner.mutex.Unlock()
+
+	tokens := strings.Fields(template)
+	leaf := miner.leaf(tokens)
+	leaf.templates = append(leaf.templates, &Template{ID: id, Tokens: tokens})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Match finds the template of the message. A new template is returned if the message does not belong to any of the
+// existing templates. The returned template is a copy and the miner is not changed until the template is committed
+// with Commit. The second return value is true if the template is new or its text changed because of this message.
+func (miner *Miner) Match(message string) (Template, bool) {
+	miner.mutex.Lock()
+	defer miner.mutex.Unlock()
+
+	tokens := strings.Fields(message)
+	leaf := miner.leaf(tokens)
+
+	// Find the most similar template in the leaf.
+	var best *Template
+	bestSimilarity, bestWildcards := -1.0, -1
+	for _, template := range leaf.templates {
+		similarity, wildcards := similarity(template.Tokens, tokens)
+		if similarity > bestSimilarity || (similarity == bestSimilarity && wildcards > bestWildcards) {
+			best, bestSimilarity, bestWildcards = template, similarity, wildcards
+		}
+	}
+
+	// If we reach here with no template or a dissimilar one, this is a new template.
+	if best == nil || bestSimilarity < miner.similarityThreshold {
+		return Template{Tokens: tokens, leaf: leaf}, true
+	}
+
+	// Merge the message into a copy of the template. The tokens which differ become wildcards.
+	merged := best.copy()
+	merged.leaf, merged.base = leaf, best
+	changed := false
+	for i, token := range tokens {
+		if merged.Tokens[i] != Wildcard && merged.Tokens[i] != token {
+			merged.Tokens[i] = Wildcard
+			changed = true
+		}
+	}
+
+	return merged, changed
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Commit applies a template returned by Match to the miner once it is persisted with the id. The id may differ from
+// the id of the template, if another replica persisted the same template first.
+func (miner *Miner) Commit(template Template, id int64) {
+	miner.mutex.Lock()
+	defer miner.mutex.Unlock()
+
+	committed := template.copy()
+	if template.base != nil {
+		template.base.ID, template.base.Tokens = id, committed.Tokens
+		return
+	}
+
+	// A new template is only added once, even if it was matched again before it was committed.
+	for _, candidate := range template.leaf.templates {
+		if candidate.String() == committed.String() {
+			candidate.ID = id
+			return
+		}
+	}
+	committed.ID = id
+	template.leaf.templates = append(template.leaf.templates, &committed)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// leaf is a helper function to walk the prefix tree for the tokens and return the leaf. The missing nodes are created
+// on the way. Must be called with the mutex held.
+func (miner *Miner) leaf(tokens []string) *node {
+	current := miner.child(miner.root, tokenCountKey(len(tokens)))
+
+	for i := 0; i < miner.depth-2 && i < len(tokens); i++ {
+		key := tokens[i]
+		if hasDigit(key) {
+			key = Wildcard
+		}
+		current = miner.child(current, key)
+	}
+
+	return current
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// child is a helper function to return the child of the node for the key. The child is created if it does not exist.
+// Once the node has max children, the new keys are routed to the wildcard child.
+func (miner *Miner) child(parent *node, key string) *node {
+	if child, ok := parent.children[key]; ok {
+		return child
+	}
+
+	if len(parent.children) >= miner.maxChildren {
+		key = Wildcard
+		if child, ok := parent.children[key]; ok {
+			return child
+		}
+	}
+
+	child := &node{children: make(map[string]*node)}
+	parent.children[key] = child
+	return child
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// copy is a helper function to copy the template so that the caller does not share the tokens with the miner.
+func (template *Template) copy() Template {
+	tokens := make([]string, len(template.Tokens))
+	copy(tokens, template.Tokens)
+	return Template{ID: template.ID, Tokens: tokens}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// similarity is a helper function to compute the fraction of the tokens of the message which are equal to the tokens
+// of the template. The wildcards of the template do not count as equal. The number of wildcards in the template is
+// also returned to break the ties. The template and the message always have the same number of tokens.
+func similarity(template []string, tokens []string) (float64, int) {
+	if len(tokens) == 0 {
+		return 1.0, 0
+	}
+
+	equal, wildcards := 0, 0
+	for i, token := range template {
+		if token == Wildcard {
+			wildcards++
+			continue
+		}
+		if token == tokens[i] {
+			equal++
+		}
+	}
+
+	return float64(equal) / float64(len(tokens)), wildcards
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// tokenCountKey is a helper function to build the key of the first level of the prefix tree.
+func tokenCountKey(count int) string {
+	return "#" + strconv.Itoa(count)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// hasDigit is a helper function to check if the token contains a digit.
+func hasDigit(token string) bool {
+	for _, r := range token {
+		if unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,47 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the OpenTelemetry tracer of the log-subscriber.
+//
+// The tracer provider is installed by Init of the tracing package in the common module, with ServiceName as the name
+// of the service in the exported spans. Please refer to tracing/tracing.go in the common module.
+
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"common/messageq"
+	commontracing "common/tracing"
+)
+
+// ServiceName is the name of the service in the exported spans.
+const ServiceName = "logsubscriber"
+
+// Tracer is the tracer of the log-subscriber. It picks up the tracer provider installed by Init.
+var Tracer = otel.Tracer(ServiceName)
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// StartConsumerSpan continues the trace from the headers of the message and starts the span in which a worker
+// processes the message. The transport is the message_queue.transport of the configuration. The caller must end the
+// span.
+func StartConsumerSpan(ctx context.Context, name string, message *messageq.Message, transport string) (context.Context,
+	trace.Span) {
+	ctx = commontracing.ExtractHeaders(ctx, message)
+
+	return Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(transport),
+			semconv.MessagingDestinationKindTopic,
+			semconv.MessagingDestinationKey.String(message.Topic),
+			semconv.MessagingOperationProcess,
+			semconv.MessagingKafkaPartitionKey.Int(int(message.Partition))))
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,145 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the circuit breaker of the stats worker.
+//
+// The breaker is closed while the storage accepts the writes. A failed write opens it, the stats worker pauses the
+// subscriber and waits for the backoff, then the breaker is half open while the write is retried. A failed retry opens
+// it again with the double backoff, up to the maximum backoff, and a successful retry closes it. The state is exported
+// as a metric and fails the readiness check while the breaker is not closed.
+
+package workers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"logworker/internal/config"
+	"logworker/internal/metrics"
+)
+
+const (
+	// stateClosed is the state of the breaker while the operations succeed.
+	stateClosed = "closed"
+
+	// stateOpen is the state of the breaker while it waits for the backoff after a failure.
+	stateOpen = "open"
+
+	// stateHalfOpen is the state of the breaker while an operation is retried after the backoff.
+	stateHalfOpen = "half_open"
+)
+
+// circuitBreaker tracks the state of a dependency of a worker. It is safe for concurrent use, the state is read by the
+// readiness check.
+type circuitBreaker struct {
+	name           string
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mutex   sync.Mutex
+	state   string
+	backoff time.Duration
+	err     error
+}
+
+// newCircuitBreaker returns a new closed instance of circuitBreaker with the backoffs of the configuration.
+func newCircuitBreaker(conf *viper.Viper, name string) *circuitBreaker {
+	initialBackoff := conf.GetDuration(config.KCircuitBreakerInitialBackoff)
+	if initialBackoff <= 0 {
+		initialBackoff = time.Second
+	}
+	maxBackoff := conf.GetDuration(config.KCircuitBreakerMaxBackoff)
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+	if maxBackoff < initialBackoff {
+		maxBackoff = initialBackoff
+	}
+
+	breaker := &circuitBreaker{name: name, initialBackoff: initialBackoff, maxBackoff: maxBackoff}
+	breaker.setState(stateClosed)
+	return breaker
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Fail opens the breaker after a failed operation and returns the time to wait before the retry. The time starts at the
+// initial backoff and doubles with every failed retry.
+func (breaker *circuitBreaker) Fail(err error) time.Duration {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case stateClosed:
+		breaker.backoff = breaker.initialBackoff
+	case stateHalfOpen:
+		metrics.CircuitBreakerRetries.WithLabelValues(breaker.name, metrics.ResultError).Inc()
+		breaker.backoff *= 2
+		if breaker.backoff > breaker.maxBackoff {
+			breaker.backoff = breaker.maxBackoff
+		}
+	}
+	breaker.err = err
+	breaker.setState(stateOpen)
+	return breaker.backoff
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Retry moves the open breaker to half open once the backoff is over, before the operation is retried.
+func (breaker *circuitBreaker) Retry() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.setState(stateHalfOpen)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Succeed closes the breaker after a successful operation. It returns true if the breaker was not closed, that is if
+// the dependency recovered.
+func (breaker *circuitBreaker) Succeed() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.state == stateClosed {
+		return false
+	}
+	metrics.CircuitBreakerRetries.WithLabelValues(breaker.name, metrics.ResultSuccess).Inc()
+	breaker.err = nil
+	breaker.setState(stateClosed)
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Check fails while the breaker is not closed. It is used by the readiness check.
+func (breaker *circuitBreaker) Check(ctx context.Context) error {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.state == stateClosed {
+		return nil
+	}
+	return fmt.Errorf("the circuit breaker is %s: %v", breaker.state, breaker.err)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// setState is a helper function to change the state of the breaker and its metric. The mutex must be held.
+func (breaker *circuitBreaker) setState(state string) {
+	breaker.state = state
+	for _, s := range []string{stateClosed, stateOpen, stateHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		metrics.CircuitBreakerState.WithLabelValues(breaker.name, s).Set(value)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -14,8 +14,9 @@
 // 1. Create a folder called "sanitized" directory. This is where all the sanitized data is going to be written.
 // 2. Establish a infinite loop which acts as consumer. Read one message at a time from the kafka queue (From a given
 //    partition).
-// 3. The strategy here is to write to one file per (process-id:thread-id). Keep the file descriptors open in the
-//    memory for efficient catching.
+// 3. The strategy here is to write to one file per (process-id, thread-id), named <process-id>-<thread-id>.log. The
+//    fields are parsed from the log line like the stats worker does. Keep the file descriptors open in the memory for
+//    efficient catching.
 
 package workers
 
@@ -24,33 +25,51 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strings"
+	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/codes"
+
+	"common/configutil"
+	"common/health"
+	"common/messageq"
 
 	"logworker/internal/config"
+	"logworker/internal/metrics"
+	"logworker/internal/tracing"
 )
 
 type FileWorker struct {
 	// The configuration object.
 	conf *viper.Viper
 
-	// The kafka consumer established for the file worker.
-	consumer *kafka.Consumer
+	// The subscriber established for the file worker, a kafka consumer unless it runs in one process with the other
+	// services.
+	subscriber messageq.Subscriber
+
+	// The heartbeat of the consume loop.
+	heartbeat *health.Heartbeat
 }
 
 // NewFileWorker creates a new instance of the FileWorker.
-func NewFileWorker(conf *viper.Viper, consumer *kafka.Consumer) *FileWorker {
+func NewFileWorker(conf *viper.Viper, subscriber messageq.Subscriber) *FileWorker {
 	return &FileWorker{
-		conf:     conf,
-		consumer: consumer,
+		conf:       conf,
+		subscriber: subscriber,
+		heartbeat:  &health.Heartbeat{},
 	}
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
+// Heartbeat returns the heartbeat of the FileWorker.
+func (worker *FileWorker) Heartbeat() *health.Heartbeat {
+	return worker.heartbeat
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
 // Start starts the FileWorker and begins consuming messages from Kafka.
 func (worker *FileWorker) Start(ctx context.Context) error {
 
@@ -62,11 +81,12 @@ func (worker *FileWorker) Start(ctx context.Context) error {
 	}
 
 	// Get the kafka topic name from the configuration object.
-	topic := worker.conf.GetString(config.KTopic)
+	topic := worker.conf.GetString(configutil.KTopic)
+	transport := worker.conf.GetString(configutil.KTransport)
 
 	// Subscribe to the log processor topic. Please note that this is just establishing the subscription. The messages
 	// must be still read. It is read in an infinite for select below
-	err := worker.consumer.SubscribeTopics([]string{topic}, nil)
+	err := worker.subscriber.Subscribe(topic)
 	if err != nil {
 		log.Fatalf("failed to subscribe to Kafka topic: %v", err)
 	}
@@ -74,7 +94,7 @@ func (worker *FileWorker) Start(ctx context.Context) error {
 	// If we are here the consumer is successfully established.
 	glog.Infoln("The consumer established for file worker and  topic: ", topic)
 
-	// Map to store the log files per process. This can be thought of as in-memory cache for all the opened file
+	// Map to store the log files per thread. This can be thought of as in-memory cache for all the opened file
 	// descriptors.
 	logFiles := make(map[string]*os.File)
 
@@ -86,47 +106,64 @@ func (worker *FileWorker) Start(ctx context.Context) error {
 			worker.closeLogFiles(logFiles)
 			return nil
 		default:
-			// This infinitely blocks until next message is available for the consumer group to consume.
-			msg, err := worker.consumer.ReadMessage(-1)
+			// This blocks until next message is available for the consumer group to consume or the poll times out.
+			// The worker is alive either way.
+			msg, err := worker.subscriber.Receive(pollTimeout)
+			worker.heartbeat.Beat()
 			if err != nil {
-				glog.Error("error while consuming message: ", err)
+				if !isTimeout(err) {
+					glog.Error("error while consuming message: ", err)
+				}
 				continue
 			}
+			metrics.MessagesConsumed.WithLabelValues(metrics.WorkerFile, topic).Inc()
+			start := time.Now()
+
+			// Continue the trace of the log-processor.
+			_, span := tracing.StartConsumerSpan(ctx, "file worker process", msg, transport)
 
-			// Extract process ID and thread ID from Kafka key
-			key := string(msg.Key)
-			parts := strings.Split(key, "-")
-			if len(parts) < 2 {
-				glog.Error("Invalid key format:", key)
+			// Extract the process ID and the thread ID from the log line.
+			logMessage := string(msg.Value)
+			fields, ok := parseLogLine(logMessage)
+			if !ok {
+				glog.Error("Invalid log line: ", logMessage)
+				span.SetStatus(codes.Error, "invalid log line")
+				span.End()
 				continue
 			}
-			processID := parts[0]
-			//threadID := parts[1]
+			thread := fields.processID + "-" + fields.threadID
 
 			// Check if the file descriptor is available in cache.
-			logFile, ok := logFiles[processID]
+			logFile, ok := logFiles[thread]
 			if !ok {
 				// If we reach here, the file descriptor is not available and hence we are creating it.
-				fileName := fmt.Sprintf("%s/%s.log", sanitizedDir, processID)
+				fileName := fmt.Sprintf("%s/%s.log", sanitizedDir, thread)
 				logFile, err = os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 				if err != nil {
-					glog.Errorf("failed to create log file for process %s: %v",
-						processID, err)
+					glog.Errorf("failed to create log file for thread %s: %v", thread, err)
+					metrics.FileWrites.WithLabelValues(metrics.ResultError).Inc()
+					span.RecordError(err)
+					span.SetStatus(codes.Error, "failed to create log file")
+					span.End()
 					continue
 				}
 
 				// Cache the file descriptor.
-				logFiles[processID] = logFile
+				logFiles[thread] = logFile
 			}
 
-			// Sanitize the log message.
-			logMessage := string(msg.Value)
-
-			// Write the log message to the process's log file.
+			// Write the log message to the thread's log file.
 			_, err = logFile.WriteString(logMessage + "\n")
 			if err != nil {
-				glog.Errorf("failed to write log message for process %s: %v", processID, err)
+				glog.Errorf("failed to write log message for thread %s: %v", thread, err)
+				metrics.FileWrites.WithLabelValues(metrics.ResultError).Inc()
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "failed to write log message")
+			} else {
+				metrics.FileWrites.WithLabelValues(metrics.ResultSuccess).Inc()
 			}
+			metrics.ProcessingDuration.WithLabelValues(metrics.WorkerFile).Observe(time.Since(start).Seconds())
+			span.End()
 		}
 	}
 }
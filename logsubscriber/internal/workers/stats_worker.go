@@ -15,77 +15,154 @@
 // 1. Establish a infinite loop which acts as consumer. Read one message at a time from the kafka queue (From a given
 //    partition).
 // 2. Process each line.
-//          a) Extract process_id, thread_id, timestamp, log message from the log.
-//          b) Write them to postgres database.
+//          a) Extract process_id, thread_id, thread_name, timestamp, log message from the log.
+//          b) Write them to the storage backend selected in the configuration. Please refer to storage/storage.go in
+//             the common module for more details.
+//          c) Extract the structured attributes from the log message using the configured extraction rules.
+//          d) Find the template of the log message. Please refer to templates/drain.go for more details.
+//          e) The postgres backend updates the rollup tables in the same transaction.
+// 3. Maintain the daily partitions of the log_lines table in the background.
+//
+// A line which cannot be written because the storage is down is not dropped. The circuit breaker opens, the consumption
+// is paused and the write is retried with an exponential backoff until the storage recovers, after which the
+// consumption resumes. Please refer to circuit_breaker.go.
 
 package workers
 
 import (
 	"context"
+	"fmt"
 	"log"
-	"regexp"
-	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/go-pg/pg/v10"
 	"github.com/golang/glog"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/codes"
+
+	"common/configutil"
+	"common/health"
+	"common/messageq"
+	"common/schema"
+	"common/secrets"
+	"common/storage"
 
-	"logworker/internal/config"
 	"logworker/internal/db"
+	"logworker/internal/extractor"
+	"logworker/internal/metrics"
+	"logworker/internal/templates"
+	"logworker/internal/tracing"
 )
 
-// LogLine encapsulates the structure of postgres table. The table name is specified in the tableName field below.
-// To be precise its called "log_lines".
-//
-// The primary key here is a composite key between process_id, thread_id, timestamp and timestamp millis.
-// Note that timestamp is field in "timestampz" format. This is done to make sure that original timestamp is preserved
-// with milliseconds precision.
-// In addition to timestamp, there is an addition field called timestamp_seconds. This is because all the queries are at
-// seconds precision.
-// The timestamp_seconds is also interesting because it will allow us to partition the table based on the seconds.
-// To create a partition the filed must be part of unique key or primary key. Hence the timestamp_seconds field is
-// added.
-type LogLine struct {
-	tableName        struct{}  `pg:"log_lines"`
-	ProcessID        string    `pg:"process_id,notnull,pk"`
-	ThreadID         string    `pg:"thread_id,notnull,pk"`
-	Timestamp        time.Time `pg:"timestamp,notnull,pk"`
-	TimestampSeconds int64     `pg:"timestamp_seconds,notnull,pk"`
-	LogMessage       string    `pg:"log_message"`
-}
+// storagePingTimeout is the timeout of the ping which tells a rejected line from a storage which is down.
+const storagePingTimeout = 5 * time.Second
 
 // StatsWorker implements the worker interface.
 type StatsWorker struct {
-	conf     *viper.Viper
-	consumer *kafka.Consumer
-	db       *pg.DB
+	conf       *viper.Viper
+	subscriber messageq.Subscriber
+	store      storage.Writer
+	extractor  atomic.Value // *extractor.Extractor, replaced when the extraction rules are reloaded.
+	miner      *templates.Miner
+	heartbeat  *health.Heartbeat
+	breaker    *circuitBreaker
 }
 
-// NewStatsWorker returns new instance of StatsWorker.
-func NewStatsWorker(conf *viper.Viper, consumer *kafka.Consumer) *StatsWorker {
+// NewStatsWorker returns new instance of StatsWorker. The storage writer is created right away so that the readiness
+// check can ping the storage before the worker starts. The credentials of the storage are obtained from the secret store.
+func NewStatsWorker(conf *viper.Viper, subscriber messageq.Subscriber,
+	secretStore *secrets.Store) (*StatsWorker, error) {
+	store, err := db.NewWriter(conf, secretStore)
+	if err != nil {
+		return nil, err
+	}
+
 	return &StatsWorker{
-		conf:     conf,
-		consumer: consumer,
+		conf:       conf,
+		subscriber: subscriber,
+		store:      store,
+		heartbeat:  &health.Heartbeat{},
+		breaker:    newCircuitBreaker(conf, metrics.BreakerStorage),
+	}, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Heartbeat returns the heartbeat of the StatsWorker.
+func (worker *StatsWorker) Heartbeat() *health.Heartbeat {
+	return worker.heartbeat
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Reload applies the reloaded extraction rules to the next log lines. It is registered with the configuration reloader.
+// Invalid rules are rejected and the current rules are kept.
+func (worker *StatsWorker) Reload(conf *viper.Viper) {
+	rules, err := extractor.NewExtractor(conf)
+	if err != nil {
+		glog.Errorf("Rejected the reloaded extraction rules, keeping the current ones: %v", err)
+		return
 	}
+	worker.extractor.Store(rules)
+	glog.Infoln("Applied the reloaded extraction rules")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// Ping checks if the storage is reachable. It is used by the readiness check.
+func (worker *StatsWorker) Ping(ctx context.Context) error {
+	return worker.store.Ping(ctx)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// CheckCircuitBreaker fails while the writes to the storage fail and the consumption is paused. It is used by the
+// readiness check.
+func (worker *StatsWorker) CheckCircuitBreaker(ctx context.Context) error {
+	return worker.breaker.Check(ctx)
 }
 
 //----------------------------------------------------------------------------------------------------------------------
 
 func (worker *StatsWorker) Start(ctx context.Context) error {
 	// Get the kafka topic name from the configuration object.
-	topic := worker.conf.GetString(config.KTopic)
+	topic := worker.conf.GetString(configutil.KTopic)
+	transport := worker.conf.GetString(configutil.KTransport)
 
 	// Subscribe to the log processor topic. Please note that this is just establishing the subscription. The messages
 	// must be still read. It is read in an infinite for select below
-	err := worker.consumer.SubscribeTopics([]string{topic}, nil)
+	err := worker.subscriber.Subscribe(topic)
 	if err != nil {
 		log.Fatalf("failed to subscribe to Kafka topic: %v", err)
 	}
 
-	// Create a new db object.
-	worker.db = db.NewDB(worker.conf)
+	// Compile the field extraction rules.
+	rules, err := extractor.NewExtractor(worker.conf)
+	if err != nil {
+		return err
+	}
+	worker.extractor.Store(rules)
+
+	// Apply the pending schema migrations before touching the tables.
+	if worker.conf.GetBool(configutil.KMigrateOnStartup) {
+		if err := worker.store.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Keep the daily partitions of log_lines ahead of the incoming lines and drop the expired ones.
+	go db.MaintainPartitions(ctx, worker.conf, worker.store)
+
+	// Seed the log template miner with the persisted templates so that the template ids are stable across restarts.
+	worker.miner = templates.NewMiner(worker.conf)
+	persisted, err := worker.store.LoadTemplates(ctx)
+	if err != nil {
+		return err
+	}
+	for _, template := range persisted {
+		worker.miner.Add(template.ID, template.Text)
+	}
+	glog.Infoln("Loaded", len(persisted), "log templates")
 
 	glog.Infof("Stats consumer established for topic: %s", topic)
 
@@ -94,19 +171,30 @@ func (worker *StatsWorker) Start(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		default:
-			// This infinitely blocks until next message is available for the consumer group to consume.
-			msg, err := worker.consumer.ReadMessage(-1)
+			// This blocks until next message is available for the consumer group to consume or the poll times out.
+			// The worker is alive either way.
+			msg, err := worker.subscriber.Receive(pollTimeout)
+			worker.heartbeat.Beat()
 			if err != nil {
-				glog.Errorf("error while consuming message: %v", err)
+				if !isTimeout(err) {
+					glog.Errorf("error while consuming message: %v", err)
+				}
 				continue
 			}
+			metrics.MessagesConsumed.WithLabelValues(metrics.WorkerStats, topic).Inc()
 
-			// Process the log line that we just obtained from kafka.
-			err = worker.processLogLine(string(msg.Value))
+			// Process the log line that we just obtained from kafka. The postgres queries are traced as children of the
+			// span which continues the trace of the log-processor.
+			start := time.Now()
+			msgCtx, span := tracing.StartConsumerSpan(ctx, "stats worker process", msg, transport)
+			err = worker.processLogLine(msgCtx, string(msg.Value))
+			metrics.ProcessingDuration.WithLabelValues(metrics.WorkerStats).Observe(time.Since(start).Seconds())
 			if err != nil {
 				glog.Errorf("error processing log line: %v", err)
-				continue
+				span.RecordError(err)
+				span.SetStatus(codes.Error, "failed to process log line")
 			}
+			span.End()
 		}
 	}
 }
@@ -114,24 +202,21 @@ func (worker *StatsWorker) Start(ctx context.Context) error {
 //----------------------------------------------------------------------------------------------------------------------
 
 // processLogLine is a helper function to process a single line. This involves obtaining some stats and writing the
-// stats to the postgres database.
-func (worker *StatsWorker) processLogLine(logLine string) error {
+// stats to the postgres database. While the storage is down the write is retried, the function returns an error only
+// when the context is cancelled in the meantime.
+func (worker *StatsWorker) processLogLine(ctx context.Context, logLine string) error {
 
-	// Define the regular expression pattern.
-	pattern := `(\d+):(\d+)::([\w-]+) (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) - (.*(?:\n.*)*)`
-
-	// Compile the regular expression pattern.
-	regex := regexp.MustCompile(pattern)
-
-	// Find submatches within the log line
-	matches := regex.FindStringSubmatch(logLine)
-
-	// Extract the captured groups.
-	processID := matches[1]
-	threadID := matches[2]
-	threadName := matches[3]
-	loggedTime := matches[4]
-	logMessage := strings.TrimSpace(matches[5])
+	// Extract the fields of the log line.
+	fields, ok := parseLogLine(logLine)
+	if !ok {
+		glog.Errorln("Invalid log line: ", logLine)
+		return nil
+	}
+	processID := fields.processID
+	threadID := fields.threadID
+	threadName := fields.threadName
+	loggedTime := fields.loggedTime
+	logMessage := fields.logMessage
 
 	// Print the extracted information.
 	glog.Infoln("Process ID: ", processID)
@@ -149,22 +234,107 @@ func (worker *StatsWorker) processLogLine(logLine string) error {
 	}
 
 	// Create a new LogLine object.
-	logLineObj := &LogLine{
+	logLineObj := &schema.LogLine{
 		ProcessID:        processID,
 		ThreadID:         threadID,
+		ThreadName:       threadName,
 		Timestamp:        timestamp.UTC(),
 		TimestampSeconds: timestamp.Unix(),
 		LogMessage:       logMessage,
+		Attributes:       worker.extractor.Load().(*extractor.Extractor).Extract(logMessage),
 	}
 
-	// Insert the log line into the database.
-	_, err = worker.db.Model(logLineObj).Insert()
-	if err != nil {
-		log.Printf("failed to insert log line: %v", err)
-		return nil
+	// Find the template of the log message.
+	template, changed := worker.miner.Match(logMessage)
+
+	// Persist the log line together with its template. Only the write is retried while the storage is down, the
+	// template is matched once.
+	storageTemplate := storage.Template{
+		ID:         template.ID,
+		Text:       template.String(),
+		TokenCount: len(template.Tokens),
+		Changed:    changed,
 	}
+	for {
+		insertStart := time.Now()
+		templateID, err := worker.store.WriteLogLine(ctx, logLineObj, storageTemplate, len(logLine))
+		if err == nil {
+			metrics.DBInsertDuration.WithLabelValues(metrics.WorkerStats, metrics.ResultSuccess).
+				Observe(time.Since(insertStart).Seconds())
 
+			// The new or merged template is persisted, apply it to the miner.
+			worker.miner.Commit(template, templateID)
+			worker.mayBeResume()
+			return nil
+		}
+		metrics.DBInsertDuration.WithLabelValues(metrics.WorkerStats, metrics.ResultError).
+			Observe(time.Since(insertStart).Seconds())
+
+		// The line itself is rejected if the storage is healthy. It is dropped, otherwise it would be retried forever.
+		pingCtx, cancel := context.WithTimeout(ctx, storagePingTimeout)
+		pingErr := worker.store.Ping(pingCtx)
+		cancel()
+		if pingErr == nil {
+			log.Printf("failed to insert log line: %v", err)
+			worker.mayBeResume()
+			return nil
+		}
+
+		if err := worker.pauseForBackoff(ctx, err); err != nil {
+			return err
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// pauseForBackoff is a helper function to open the circuit breaker after a failed write and to wait for its backoff
+// before the write is retried. The consumption is paused when the breaker opens. The subscriber is still polled while
+// waiting, to stay in the consumer group, and the heartbeat is beaten since the worker is not stuck. A paused subscriber
+// hands out no message, the held line stays the last received one. It returns an error only when the context is
+// cancelled, the held line is consumed again after a restart.
+func (worker *StatsWorker) pauseForBackoff(ctx context.Context, writeErr error) error {
+	if worker.breaker.Check(ctx) == nil {
+		glog.Errorf("Failed to insert the log line, pausing the consumption until the storage recovers: %v", writeErr)
+		if err := worker.subscriber.Pause(); err != nil {
+			glog.Errorf("Failed to pause the consumption: %v", err)
+		}
+	}
+	backoff := worker.breaker.Fail(writeErr)
+	glog.Warningf("Retrying to insert the log line in %v: %v", backoff, writeErr)
+
+	for deadline := time.Now().Add(backoff); time.Now().Before(deadline); {
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to insert log line: %w", writeErr)
+		}
+		timeout := time.Until(deadline)
+		if timeout > pollTimeout {
+			timeout = pollTimeout
+		}
+		_, err := worker.subscriber.Receive(timeout)
+		worker.heartbeat.Beat()
+		if err != nil && !isTimeout(err) {
+			glog.Errorf("error while consuming message: %v", err)
+		}
+	}
+
+	worker.breaker.Retry()
 	return nil
 }
 
 //----------------------------------------------------------------------------------------------------------------------
+
+// mayBeResume is a helper function to close the circuit breaker after a successful write and to resume the consumption
+// if it was paused.
+func (worker *StatsWorker) mayBeResume() {
+	if !worker.breaker.Succeed() {
+		return
+	}
+	if err := worker.subscriber.Resume(); err != nil {
+		glog.Errorf("Failed to resume the consumption: %v", err)
+		return
+	}
+	glog.Infoln("The storage recovered, resumed the consumption")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -16,8 +16,32 @@ package workers
 
 import (
 	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"common/health"
+	"common/messageq"
 )
 
+// pollTimeout is the maximum time a worker blocks on the subscriber for the next message. The workers beat their
+// heartbeat after every poll, so this must be well below the heartbeat timeout of the liveness check.
+const pollTimeout = time.Second
+
+// logLinePattern matches a log line published by the log-processor, for example
+// 8003:123145320058880::Thread-2 2020-08-09 18:59:25,204 - **START**
+var logLinePattern = regexp.MustCompile(
+	`(\d+):(\d+)::([\w-]+) (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) - (.*(?:\n.*)*)`)
+
+// logLineFields are the fields of a log line extracted by parseLogLine.
+type logLineFields struct {
+	processID  string
+	threadID   string
+	threadName string
+	loggedTime string
+	logMessage string
+}
+
 // Worker defines the interface for a worker.
 type Worker interface {
 	// Start the worker.
@@ -25,4 +49,35 @@ type Worker interface {
 
 	// Stop the worker.
 	Stop() error
+
+	// Heartbeat returns the heartbeat of the worker. It is used by the liveness check.
+	Heartbeat() *health.Heartbeat
 }
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// parseLogLine is a helper function to extract the fields of a log line. It returns false if the line does not match
+// logLinePattern.
+func parseLogLine(logLine string) (*logLineFields, bool) {
+	matches := logLinePattern.FindStringSubmatch(logLine)
+	if len(matches) != 6 {
+		return nil, false
+	}
+	return &logLineFields{
+		processID:  matches[1],
+		threadID:   matches[2],
+		threadName: matches[3],
+		loggedTime: matches[4],
+		logMessage: strings.TrimSpace(matches[5]),
+	}, true
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// isTimeout is a helper function to check if the error returned by the subscriber is a poll timeout. The timeout only
+// means that no message is available yet.
+func isTimeout(err error) bool {
+	return err == messageq.ErrTimeout
+}
+
+//----------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,129 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains main file for the standalone command.
+//
+// The standalone command runs the log-processor, the log-subscriber and the api server in one process, for local
+// development and tests without brokers and databases. The services are connected by the in-memory broker of messageq
+// in the common module instead of kafka and the stats are stored in sqlite.
+//
+//     cd standalone
+//     go run ./cmd
+//     curl localhost:8080/basicStats
+//
+// Every service reads its own configuration file, logprocessor.yaml, logsubscriber.yaml and apiserver.yaml of this
+// directory by default. The environment variables of the services override them as usual, for example
+// LOGPROCESSOR_LOG_PROCESSOR_LOGS_DIRECTORY. The operational endpoints of the log-subscriber, like /metrics, are
+// served on its http_server port, the api server serves its own. The messages are lost when the process exits.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/golang/glog"
+
+	"common/configutil"
+	"common/dbutil"
+	"common/health"
+	"common/logging"
+	"common/messageq"
+
+	apiserver "apiserver/app"
+	logprocessor "logprocessor/app"
+	logsubscriber "logworker/app"
+)
+
+var (
+	logProcessorConfig  = flag.String("logprocessor-config", "logprocessor.yaml", "configuration of the log-processor")
+	logSubscriberConfig = flag.String("logsubscriber-config", "logsubscriber.yaml",
+		"configuration of the log-subscriber")
+	apiServerConfig = flag.String("apiserver-config", "apiserver.yaml", "configuration of the api server")
+	partitions      = flag.Int("partitions", 4, "number of partitions of the topics of the in-memory broker")
+)
+
+func init() {
+	logging.Init()
+}
+
+func main() {
+	defer glog.Flush()
+
+	glog.Infoln("Starting the services in one process")
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Step (1): Load the configuration of every service.
+	processorConf, processorReloader, err := logprocessor.LoadConfiguration(*logProcessorConfig)
+	if err != nil {
+		glog.Exitf("Invalid configuration of the log-processor: %v", err)
+	}
+	subscriberConf, subscriberReloader, err := logsubscriber.LoadConfiguration(*logSubscriberConfig)
+	if err != nil {
+		glog.Exitf("Invalid configuration of the log-subscriber: %v", err)
+	}
+	apiServerConf, apiServerReloader, err := apiserver.LoadConfiguration(*apiServerConfig)
+	if err != nil {
+		glog.Exitf("Invalid configuration of the api server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The log-processor has no secrets without kafka.
+	subscriberSecrets, err := configutil.NewSecretStore(ctx, subscriberConf, dbutil.SecretRefs(subscriberConf))
+	if err != nil {
+		glog.Fatalf("Failed to resolve the secrets of the log-subscriber: %v", err)
+	}
+	apiServerSecrets, err := configutil.NewSecretStore(ctx, apiServerConf, dbutil.SecretRefs(apiServerConf))
+	if err != nil {
+		glog.Fatalf("Failed to resolve the secrets of the api server: %v", err)
+	}
+
+	go processorReloader.Run(ctx)
+	go subscriberReloader.Run(ctx)
+	go apiServerReloader.Run(ctx)
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Step (2): Start the log-subscriber and the api server. The consumer groups are the ones of the log-subscriber
+	// service.
+	broker := messageq.NewMemoryBroker(*partitions)
+
+	checker := health.NewChecker()
+	go health.StartServer(subscriberConf, checker)
+
+	fileSubscriber := broker.NewSubscriber("file-consumer-group-id")
+	defer fileSubscriber.Close()
+	statsSubscriber := broker.NewSubscriber("stats-consumer-group-id")
+	defer statsSubscriber.Close()
+
+	if err := logsubscriber.Start(ctx, subscriberConf, subscriberSecrets, fileSubscriber, statsSubscriber, checker,
+		subscriberReloader); err != nil {
+		glog.Fatalf("Failed to start the log-subscriber: %v", err)
+	}
+
+	go func() {
+		if err := apiserver.Run(apiServerConf, apiServerSecrets, apiServerReloader); err != nil {
+			glog.Fatalf("Failed to start the api server: %v", err)
+		}
+	}()
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Step (3): Process the logs.
+	publisher := broker.NewPublisher()
+	defer publisher.Close()
+
+	logprocessor.Run(processorConf, publisher, processorReloader)
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Step (4): Keep serving the apis until the process is stopped.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+}
+
+//----------------------------------------------------------------------------------------------------------------------
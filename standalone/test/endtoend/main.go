@@ -0,0 +1,276 @@
+// Copyright 2023
+//
+// Author: Suresh Bysani
+//
+// This file contains the main file for the end-to-end test of the standalone command.
+//
+// The end-to-end test in the test directory of the repository needs docker, kafka and postgres. This test runs the
+// same pipeline in one process on the in-memory broker and sqlite, so it runs anywhere go runs.
+//
+// It performs the following steps:
+// 1. Build the standalone command and start it with its sanitized logs and sqlite database in a scratch directory.
+// 2. Count the log records and the (process-id, thread-id) pairs of the input files, the way the log-processor splits
+//    them.
+// 3. Wait until both the workers of the log-subscriber consumed every record, as reported by their metrics.
+// 4. Check that the file worker wrote one sanitized file per (process-id, thread-id) with the records in the order of
+//    their timestamps, and that the api server answers from the lines of the stats worker.
+// 5. Stop the standalone command.
+//
+// For example,
+//
+//     cd standalone
+//     go run ./test/endtoend
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// The ports of the standalone command, away from the ports of the services started by hand.
+	metricsPort   = 19090
+	apiServerPort = 18080
+)
+
+// recordPattern matches the first line of a log record, like the log-processor does. The process id, the thread id and
+// the timestamp are captured.
+var recordPattern = regexp.MustCompile(`^(\d+):(\d+)::[\w-]+ (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) - `)
+
+// consumedPattern matches the counter of the messages consumed by a worker in the metrics of the log-subscriber.
+var consumedPattern = regexp.MustCompile(`^logsubscriber_messages_consumed_total\{.*worker="(\w+)".*\} (\d+)$`)
+
+func main() {
+	inputDir := flag.String("input", "../data/input", "directory of the input log files")
+	timeout := flag.Duration("timeout", 2*time.Minute, "maximum time to wait for the records to be consumed")
+	flag.Parse()
+
+	scratchDir, err := os.MkdirTemp("", "endtoend")
+	if err != nil {
+		log.Fatal("Failed to create the scratch directory:", err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	// Step 1: Build and start the standalone command.
+	binary := filepath.Join(scratchDir, "standalone")
+	build := exec.Command("go", "build", "-o", binary, "./cmd")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		log.Fatal("Failed to build the standalone command:", err)
+	}
+
+	logFile, err := os.Create(filepath.Join(scratchDir, "standalone.log"))
+	if err != nil {
+		log.Fatal("Failed to create the log file:", err)
+	}
+	defer logFile.Close()
+
+	sanitizedDir := filepath.Join(scratchDir, "sanitized")
+	sqlitePath := filepath.Join(scratchDir, "olap.sqlite")
+	standalone := exec.Command(binary, "-logtostderr")
+	standalone.Stdout, standalone.Stderr = logFile, logFile
+	standalone.Env = append(os.Environ(),
+		"LOGPROCESSOR_LOG_PROCESSOR_LOGS_DIRECTORY="+*inputDir,
+		"LOGSUBSCRIBER_LOGSUBSCRIBER_SANITIZED_LOGS_DIRECTORY="+sanitizedDir,
+		"LOGSUBSCRIBER_SQLITE_PATH="+sqlitePath,
+		"LOGSUBSCRIBER_HTTP_SERVER_PORT="+strconv.Itoa(metricsPort),
+		"APISERVER_SQLITE_PATH="+sqlitePath,
+		"APISERVER_APISERVER_PORT="+strconv.Itoa(apiServerPort))
+	if err := standalone.Start(); err != nil {
+		log.Fatal("Failed to start the standalone command:", err)
+	}
+	stop := func() {
+		standalone.Process.Kill()
+		standalone.Wait()
+	}
+
+	// Step 2: Count the records of the input files.
+	records, threads, err := countRecords(*inputDir)
+	if err != nil {
+		stop()
+		log.Fatal("Failed to read the input files:", err)
+	}
+	log.Printf("The input files have %d records of %d threads", records, len(threads))
+
+	// Step 3: Wait for the workers.
+	if err := waitForConsumers(records, *timeout); err != nil {
+		stop()
+		log.Fatalf("%v, please refer to %s", err, logFile.Name())
+	}
+
+	// Step 4: Check the output of the workers.
+	failed := false
+	sanitized, err := os.ReadDir(sanitizedDir)
+	if err != nil {
+		log.Println("Failed to read the sanitized directory:", err)
+		failed = true
+	} else if len(sanitized) != len(threads) {
+		log.Printf("Expected %d sanitized files, found %d", len(threads), len(sanitized))
+		failed = true
+	}
+	for thread := range threads {
+		if err := checkOrder(filepath.Join(sanitizedDir, thread+".log")); err != nil {
+			log.Printf("Invalid sanitized file of the thread %s: %v", thread, err)
+			failed = true
+		}
+	}
+
+	var concurrency struct {
+		ConcurrentThreads int `json:"concurrent_threads"`
+	}
+	if err := getJSON(fmt.Sprintf("http://localhost:%d/maxConcurrentThreads", apiServerPort), &concurrency); err != nil {
+		log.Println("Failed to call the api server:", err)
+		failed = true
+	} else if concurrency.ConcurrentThreads == 0 {
+		log.Println("The api server found no concurrent threads")
+		failed = true
+	}
+
+	// Step 5: Stop the standalone command.
+	stop()
+	if failed {
+		log.Fatalf("The standalone pipeline failed, please refer to %s", logFile.Name())
+	}
+	fmt.Println("The standalone pipeline processed all the records.")
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// countRecords is a helper function to count the records and to collect the distinct (process-id, thread-id) pairs of
+// the input files, as <process-id>-<thread-id> like the file worker names the sanitized files.
+func countRecords(inputDir string) (int, map[string]bool, error) {
+	files, err := filepath.Glob(inputDir + "/*")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	records := 0
+	threads := make(map[string]bool)
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			match := recordPattern.FindStringSubmatch(scanner.Text())
+			if match == nil {
+				continue
+			}
+			records++
+			threads[match[1]+"-"+match[2]] = true
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, nil, err
+		}
+	}
+	return records, threads, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// checkOrder is a helper function to check that the records of a sanitized file are in the order of their timestamps.
+// The lines of a thread are published with the same key, so they must be written in the order in which they were read.
+func checkOrder(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	previous := ""
+	line := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+		match := recordPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		if match[3] < previous {
+			return fmt.Errorf("the record at the line %d is logged at %s, before the previous record at %s", line,
+				match[3], previous)
+		}
+		previous = match[3]
+	}
+	return scanner.Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// waitForConsumers is a helper function to wait until both the workers consumed the records or the timeout expires.
+func waitForConsumers(records int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	consumed := map[string]int{}
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		var err error
+		consumed, err = consumedMessages()
+		if err != nil {
+			// The http server is not up yet.
+			continue
+		}
+		if consumed["file"] == records && consumed["stats"] == records {
+			return nil
+		}
+	}
+	return fmt.Errorf("the workers consumed %v of %d records within %v", consumed, records, timeout)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// consumedMessages is a helper function to read the number of messages consumed by every worker from the metrics.
+func consumedMessages() (map[string]int, error) {
+	response, err := http.Get(fmt.Sprintf("http://localhost:%d/metrics", metricsPort))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	consumed := map[string]int{}
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if match := consumedPattern.FindStringSubmatch(scanner.Text()); match != nil {
+			count, err := strconv.Atoi(match[2])
+			if err != nil {
+				return nil, err
+			}
+			consumed[match[1]] += count
+		}
+	}
+	return consumed, scanner.Err()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+// getJSON is a helper function to call an api and decode the json response.
+func getJSON(url string, out interface{}) error {
+	response, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("%s returned %s: %s", url, response.Status, body)
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
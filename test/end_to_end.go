@@ -10,7 +10,8 @@
 // 2. Clean up if any previous installation of the setup is running. We do this by checking any containers running with
 //    eightfold-assignment prefix.
 // 3. Wait all the containers from previous installation are successfuly killed.
-// 4. Starts the log sanitization system using Docker Compose.
+// 4. Starts the log sanitization system using Docker Compose. The password of postgres is generated if it does not
+//    exist yet, like the README asks to do by hand.
 // 5. Waits for the system to initialize.
 // 6. Check for the existence of sanitized directory and make sure required number of files are created.
 // 7. CheckPostgresData executes a psql command to check if there is non-zero data in the log_lines table.
@@ -22,6 +23,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -30,10 +33,15 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+// postgresPasswordFile is the docker secret with the password of postgres, which docker-compose.yml mounts into postgres,
+// the logsubscriber and the apiserver. It is not checked in.
+const postgresPasswordFile = "../secrets/postgres_password"
+
 func main() {
 	// Step 1: Check if Docker and Docker Compose are installed
 	checkDockerInstallation()
@@ -143,6 +151,8 @@ func waitForContainersToStop() {
 
 // startLogSanitizationSystem to start the project again.
 func startLogSanitizationSystem() {
+	createPostgresPassword()
+
 	cmd := exec.Command("docker-compose", "up", "--build", "-d")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -157,6 +167,30 @@ func startLogSanitizationSystem() {
 
 //----------------------------------------------------------------------------------------------------------------------
 
+// createPostgresPassword generates a random password of postgres if the secret file does not exist, so that the test
+// runs on a clean checkout. An existing password is kept, the postgres data directory was initialized with it. The file
+// must be readable by the users of the containers, which the bind mount of docker-compose does not change.
+func createPostgresPassword() {
+	if _, err := os.Stat(postgresPasswordFile); err == nil {
+		return
+	}
+
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		log.Fatal("Failed to generate the postgres password:", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(postgresPasswordFile), 0755); err != nil {
+		log.Fatal("Failed to create the secrets directory:", err)
+	}
+	if err := os.WriteFile(postgresPasswordFile, []byte(hex.EncodeToString(password)+"\n"), 0644); err != nil {
+		log.Fatal("Failed to write the postgres password:", err)
+	}
+
+	fmt.Println("Generated the postgres password in", postgresPasswordFile)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
 // checkSanitizedDirectory checks if the "../data/sanitized" directory is created and contains 250 files.
 func checkSanitizedDirectory() {
 	dirPath := "../data/sanitized"